@@ -4,7 +4,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"os"
@@ -13,14 +15,18 @@ import (
 	"sdr/labo1/src/dto"
 	"sdr/labo1/src/network"
 	"sdr/labo1/src/network/client_server"
+	"sdr/labo1/src/network/consistency"
 	"sdr/labo1/src/types"
 	"sdr/labo1/src/utils"
 	"sdr/labo1/src/utils/colors"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
+const refreshInterval = 10 * time.Second // Minimum delay between two updates of the state of the servers after a command
+
 // authenticate prompts the user for his credentials
 func authenticate() types.Credentials {
 	return types.Credentials{
@@ -39,14 +45,11 @@ func clientProcess(configuration config.ClientConfiguration) {
 		server = configuration.Servers[rand.Intn(len(configuration.Servers))]
 	}
 
-	protocol := connect("tcp", server)
+	// The client changes of server when the connection is lost
+	client := &session{configuration: configuration, address: server, protocol: connect("tcp", server)}
+	client.refresh()
 	core.OnSigTerm(func() {
-		disconnect(protocol)
-	})
-	protocol.OnClose(func() {
-		fmt.Println()
-		utils.PrintError("Connection closed by server")
-		os.Exit(1)
+		disconnect(client.protocol)
 	})
 	utils.PrintHelp()
 	for {
@@ -56,7 +59,7 @@ func clientProcess(configuration config.ClientConfiguration) {
 		case "h":
 			utils.PrintHelp()
 		case "create":
-			json, err := protocol.SendRequest("create", func(auth client_server.AuthId) any {
+			json, err := client.send("create", func(auth client_server.AuthId) any {
 				event := dto.EventCreate{
 					Name: utils.StringPrompt("Enter event name:"),
 				}
@@ -90,7 +93,7 @@ func clientProcess(configuration config.ClientConfiguration) {
 				}
 			}
 		case "close":
-			json, err := protocol.SendRequest("close", func(auth client_server.AuthId) any {
+			json, err := client.send("close", func(auth client_server.AuthId) any {
 				return dto.EventClose{
 					EventId: utils.IntPrompt("Enter event id:"),
 				}
@@ -106,7 +109,7 @@ func clientProcess(configuration config.ClientConfiguration) {
 				}
 			}
 		case "register":
-			json, err := protocol.SendRequest("register", func(auth client_server.AuthId) any {
+			json, err := client.send("register", func(auth client_server.AuthId) any {
 				return dto.EventRegister{
 					EventId: utils.IntPrompt("Enter event id:"),
 					JobId:   utils.IntPrompt("Enter job id:"),
@@ -127,10 +130,11 @@ func clientProcess(configuration config.ClientConfiguration) {
 			if len(args) > 0 {
 				eventId, _ = strconv.Atoi(args[0])
 			}
-			json, err := protocol.SendRequest("show", func(auth client_server.AuthId) any {
+			json, err := client.send("show", func(auth client_server.AuthId) any {
 				return dto.EventShow{
-					EventId: eventId,
-					Resume:  flags["resume"],
+					EventId:      eventId,
+					Resume:       flags["resume"],
+					Linearizable: flags["linearizable"],
 				}
 			})
 			if err != nil {
@@ -158,8 +162,69 @@ func clientProcess(configuration config.ClientConfiguration) {
 					displayEvents(events)
 				}
 			}
+		case "snapshot":
+			json, err := client.send("snapshot", func(auth client_server.AuthId) any {
+				return nil
+			})
+			if err != nil {
+				utils.PrintError(err.Error())
+			} else {
+				result, responseError := network.ParseResponse[*dto.SnapshotResult](json)
+				if responseError != nil {
+					utils.PrintError(responseError.Error())
+				} else {
+					utils.PrintSuccess(fmt.Sprintf("Snapshot %s written to %s, servers %v", result.Id, result.Path, result.Servers))
+					if len(result.Missing) > 0 {
+						utils.PrintError(fmt.Sprintf("Servers missing from the snapshot: %v", result.Missing))
+					}
+				}
+			}
+		case "consistency":
+			json, err := client.send("consistency", func(auth client_server.AuthId) any {
+				return nil
+			})
+			if err != nil {
+				utils.PrintError(err.Error())
+			} else {
+				status, responseError := network.ParseResponse[*consistency.Status](json)
+				if responseError != nil {
+					utils.PrintError(responseError.Error())
+				} else {
+					displayConsistency(status)
+				}
+			}
+		case "members":
+			client.refresh()
+			displayServers(client.servers)
+		case "join", "leave":
+			json, err := client.send(cmd, func(auth client_server.AuthId) any {
+				if cmd == "join" {
+					return dto.ServerJoin{
+						Client: utils.StringPrompt("Enter client address of the new server:"),
+						Server: utils.StringPrompt("Enter server address of the new server:"),
+					}
+				}
+				return dto.ServerLeave{
+					ServerId: utils.IntPrompt("Enter server id:"),
+				}
+			})
+			if err != nil {
+				utils.PrintError(err.Error())
+			} else {
+				membership, responseError := network.ParseResponse[*dto.Membership](json)
+				if responseError != nil {
+					utils.PrintError(responseError.Error())
+				} else {
+					if cmd == "join" {
+						utils.PrintSuccess(fmt.Sprintf("Server %d added, start it with --id %d", membership.ServerId, membership.ServerId))
+					} else {
+						utils.PrintSuccess(fmt.Sprintf("Server %d removed", membership.ServerId))
+					}
+					displayMembership(membership)
+				}
+			}
 		case "quit":
-			disconnect(protocol)
+			disconnect(client.protocol)
 			return
 		default:
 			utils.PrintError(fmt.Sprintf("Unknown command \"%s\"", cmd))
@@ -167,6 +232,79 @@ func clientProcess(configuration config.ClientConfiguration) {
 	}
 }
 
+// session is the connection of the client to a server
+//   - servers: the last state of the servers given by the failure detector, used to choose the next server
+//   - refreshed: the time of the last update of the servers
+type session struct {
+	configuration config.ClientConfiguration
+	address       string
+	protocol      *client_server.ClientProtocol
+	servers       []dto.ServerState
+	refreshed     time.Time
+}
+
+// send sends a request to the server, the client connects to another server if the connection is lost.
+// The state of the servers is updated after a command once refreshInterval has elapsed since the last update.
+func (s *session) send(endpointId string, data func(auth client_server.AuthId) any) (string, error) {
+	json, err := s.protocol.SendRequest(endpointId, data)
+	var opError *net.OpError
+	if errors.Is(err, io.EOF) || errors.As(err, &opError) {
+		utils.PrintError(fmt.Sprintf("Connection to %s lost", s.address))
+		s.failover()
+		return json, fmt.Errorf("the command was not executed, retry it")
+	}
+	if err == nil && time.Since(s.refreshed) > refreshInterval {
+		s.refresh()
+	}
+	return json, err
+}
+
+// refresh gets the state of the servers from the failure detector of the server
+func (s *session) refresh() {
+	json, err := s.protocol.SendRequest("members", func(auth client_server.AuthId) any {
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if servers, responseError := network.ParseResponse[[]dto.ServerState](json); responseError == nil {
+		s.servers = servers
+		s.refreshed = time.Now()
+	}
+}
+
+// failover connects to another server, the alive servers first, then the suspected ones and the configured ones
+func (s *session) failover() {
+	var candidates []string
+	for _, state := range []string{"alive", "suspect"} {
+		for _, server := range s.servers {
+			if server.State == state {
+				candidates = append(candidates, server.Client)
+			}
+		}
+	}
+	candidates = append(candidates, s.configuration.Servers...)
+
+	tried := map[string]bool{s.address: true}
+	for _, address := range candidates {
+		if tried[address] {
+			continue
+		}
+		tried[address] = true
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err != nil {
+			continue
+		}
+		s.address = address
+		s.protocol = client_server.CreateClientProtocol(conn, authenticate)
+		utils.PrintSuccess(fmt.Sprintf("Connected to %s", address))
+		s.refresh()
+		return
+	}
+	utils.PrintError("No server reachable")
+	os.Exit(1)
+}
+
 // connect makes client connects to server
 func connect(protocol string, address string) *client_server.ClientProtocol {
 	fmt.Print(colors.Yellow + fmt.Sprintf("Connecting to %s://%s", protocol, address) + colors.Reset)
@@ -204,6 +342,53 @@ func disconnect(conn *client_server.ClientProtocol) {
 	conn.Close()
 }
 
+// Display the consistency of a server with the other servers as table format
+func displayConsistency(status *consistency.Status) {
+	headers := []string{"Server", "Versions", "Hash", "Same versions", "Consistent"}
+	rows := []string{fmt.Sprintf("%d (local)\t%s\t%s\t-\t-", status.Server, status.State.Versions, status.State.Hash)}
+	var servers []int
+	for serverId := range status.Peers {
+		servers = append(servers, serverId)
+	}
+	sort.Ints(servers)
+	for _, serverId := range servers {
+		state := status.Peers[serverId]
+		sameVersions := state.Versions == status.State.Versions
+		consistent := !sameVersions || state.Hash == status.State.Hash
+		rows = append(rows, fmt.Sprintf("%d\t%s\t%s\t%t\t%t", serverId, state.Versions, state.Hash, sameVersions, consistent))
+	}
+	utils.PrintTable(headers, rows)
+
+	if status.Consistent {
+		utils.PrintSuccess("No divergence detected")
+	}
+	for _, alert := range status.Alerts {
+		utils.PrintError(fmt.Sprintf("Server %d diverged at %s: versions %s, local hash %s, remote hash %s",
+			alert.Server, alert.Time.Format("15:04:05"), alert.Versions, alert.Local, alert.Remote))
+	}
+}
+
+// Display the state of the servers given by the failure detector as table format
+func displayServers(servers []dto.ServerState) {
+	headers := []string{"Server", "Client address", "State"}
+	var rows []string
+	for _, server := range servers {
+		rows = append(rows, fmt.Sprintf("%d\t%s\t%s", server.Id, server.Client, server.State))
+	}
+	utils.PrintTable(headers, rows)
+}
+
+// Display the servers of the cluster as table format
+func displayMembership(membership *dto.Membership) {
+	headers := []string{"Server", "Client address", "Server address", "Removed"}
+	var rows []string
+	for _, member := range membership.Servers {
+		rows = append(rows, fmt.Sprintf("%d\t%s\t%s\t%t", member.Id, member.Client, member.Server, member.Removed))
+	}
+	utils.PrintTable(headers, rows)
+	fmt.Printf("Membership version: %d\n", membership.Version)
+}
+
 // Display events as table format
 func displayEvents(events []dto.Event) {
 	headers := []string{"Number", "Name", "Organizer name", "open"}
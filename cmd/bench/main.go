@@ -0,0 +1,88 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// The bench simulates volunteers and organizers sending requests to the servers of the client configuration. It
+// reports the throughput, the latency of each endpoint and the messages sent between the servers by request.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sdr/labo1/src/bench"
+	"sdr/labo1/src/config"
+	"sdr/labo1/src/core"
+	"sdr/labo1/src/utils"
+	"sort"
+	"time"
+)
+
+func main() {
+	clientPath := flag.String("config", "client.json", "configuration of the client, the simulated clients are spread over its servers")
+	serverPath := flag.String("users", "server.json", "configuration of the servers, the simulated clients log in as its users")
+	volunteers := flag.Int("volunteers", 8, "number of simulated volunteers")
+	organizers := flag.Int("organizers", 2, "number of simulated organizers")
+	duration := flag.Duration("duration", 10*time.Second, "duration of the bench")
+	linearizable := flag.Bool("linearizable", false, "send linearizable reads instead of reading the local copy of the servers")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed of the random requests")
+	flag.Parse()
+	utils.SetEnabled(false)
+
+	clientConfiguration := core.ReadConfig(*clientPath, &config.ClientConfiguration{})
+	serverConfiguration := core.ReadConfig(*serverPath, &config.ServerConfiguration{})
+	b := bench.CreateBench(bench.Config{
+		Volunteers:   *volunteers,
+		Organizers:   *organizers,
+		Duration:     *duration,
+		Linearizable: *linearizable,
+		Seed:         *seed,
+	}, clientConfiguration.Servers, serverConfiguration.Users, func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	})
+
+	backend := serverConfiguration.Backend
+	if backend == "" || backend == config.MutualExclusionBackend {
+		backend = fmt.Sprintf("%s (%s)", config.MutualExclusionBackend, serverConfiguration.MutualExclusion)
+	}
+	fmt.Printf("%d volunteers and %d organizers on %d servers for %v, backend %s, seed %d\n", *volunteers, *organizers,
+		len(clientConfiguration.Servers), *duration, backend, *seed)
+	report, err := b.Run()
+	if err != nil {
+		utils.LogError(true, "bench", err.Error())
+		os.Exit(1)
+	}
+	if report.Lost > 0 {
+		utils.PrintError(fmt.Sprintf("%d clients lost their connection", report.Lost))
+	}
+
+	fmt.Printf("%d requests in %v, %.1f requests/s\n", report.Requests(), report.Elapsed.Round(time.Millisecond), report.Throughput())
+	var rows []string
+	for _, endpoint := range report.Endpoints {
+		rows = append(rows, fmt.Sprintf("%s\t%d\t%d\t%.1f\t%v\t%v", endpoint.Name, endpoint.Requests, endpoint.Errors,
+			float64(endpoint.Requests)/report.Elapsed.Seconds(), endpoint.Percentile(0.5).Round(time.Microsecond),
+			endpoint.Percentile(0.99).Round(time.Microsecond)))
+	}
+	utils.PrintTable([]string{"Endpoint", "Requests", "Errors", "Requests/s", "p50", "p99"}, rows)
+
+	// The messages of the background protocols (failure detector, anti-entropy) are counted too
+	channels := make([]string, 0, len(report.Messages))
+	for channel := range report.Messages {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	rows = nil
+	for _, channel := range channels {
+		rows = append(rows, fmt.Sprintf("%s\t%d\t%s\t%s", channel, report.Messages[channel],
+			perOperation(report.Messages[channel], report.Requests()), perOperation(report.Messages[channel], report.Writes())))
+	}
+	utils.PrintTable([]string{"Channel", "Messages", "By request", "By write"}, rows)
+}
+
+// perOperation formats the number of messages by operation
+func perOperation(messages int64, operations int) string {
+	if operations == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f", float64(messages)/float64(operations))
+}
@@ -0,0 +1,47 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// The chaos proxy forwards the connections between the servers with a proxy address in the configuration and injects
+// the faults of a scenario: delays, reordered or dropped lines and partitions.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sdr/labo1/src/chaos"
+	"sdr/labo1/src/config"
+	"sdr/labo1/src/core"
+	"sdr/labo1/src/network"
+	"sdr/labo1/src/utils"
+)
+
+func main() {
+	configPath := flag.String("config", "server.json", "configuration of the servers")
+	scenarioPath := flag.String("scenario", "chaos.json", "scenario of the faults")
+	verbose := flag.Bool("verbose", false, "log every dropped or reordered line")
+	flag.Parse()
+	utils.SetEnabled(*verbose)
+
+	configuration := core.ReadConfig(*configPath, &config.ServerConfiguration{})
+	scenario, err := chaos.ReadScenario(*scenarioPath)
+	if err != nil {
+		utils.LogError(true, "chaos", "invalid scenario", *scenarioPath+":", err.Error())
+		os.Exit(1)
+	}
+
+	proxy := chaos.CreateProxy(configuration.Servers, scenario, network.TCPTransport{})
+	if err = proxy.Start(); err != nil {
+		utils.LogError(true, "chaos", "cannot start the proxy:", err.Error())
+		os.Exit(1)
+	}
+
+	var input string
+	for {
+		fmt.Scanln(&input)
+		if input == "quit" {
+			proxy.Stop()
+			break
+		}
+	}
+}
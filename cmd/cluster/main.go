@@ -0,0 +1,135 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// The cluster launcher starts every server of the configuration as a child process and prints their logs, prefixed by
+// the id of the server. The servers are controlled with commands read on the standard input.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sdr/labo1/src/cluster"
+	"sdr/labo1/src/config"
+	"sdr/labo1/src/core"
+	"sdr/labo1/src/utils"
+	"strconv"
+	"strings"
+)
+
+const usage = "commands: start <id>, stop <id>, kill <id>, restart <id>, status, quit"
+
+func main() {
+	configPath := flag.String("config", "server.json", "configuration of the servers")
+	binary := flag.String("binary", "", "executable of the server, built from server.go if empty")
+	flag.Parse()
+
+	configuration := core.ReadConfig(*configPath, &config.ServerConfiguration{})
+	var ids []int
+	for id, server := range configuration.Servers {
+		if !server.Removed {
+			ids = append(ids, id)
+		}
+	}
+
+	// The directory of the server built is removed before exiting, os.Exit does not run the deferred calls
+	directory := ""
+	exit := func(code int) {
+		if directory != "" {
+			_ = os.RemoveAll(directory)
+		}
+		os.Exit(code)
+	}
+	if *binary == "" {
+		var err error
+		directory, err = os.MkdirTemp("", "cluster")
+		if err != nil {
+			utils.LogError(true, "cluster", "cannot build the server:", err.Error())
+			os.Exit(1)
+		}
+		*binary = filepath.Join(directory, "server")
+		if runtime.GOOS == "windows" {
+			*binary += ".exe"
+		}
+		build := exec.Command("go", "build", "-o", *binary, "server.go")
+		build.Stdout, build.Stderr = os.Stdout, os.Stderr
+		if err = build.Run(); err != nil {
+			utils.LogError(true, "cluster", "cannot build the server:", err.Error())
+			exit(1)
+		}
+	}
+
+	c := cluster.CreateCluster(ids, func(id int) *exec.Cmd {
+		return exec.Command(*binary, "--id", strconv.Itoa(id), "--config", *configPath)
+	}, os.Stdout)
+	core.OnSigTerm(func() {
+		c.StopAll()
+		exit(1)
+	})
+	if err := c.StartAll(); err != nil {
+		utils.LogError(true, "cluster", err.Error())
+		c.StopAll()
+		exit(1)
+	}
+	fmt.Println(usage)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" {
+			break
+		}
+		if err := run(c, configuration, fields); err != nil {
+			utils.PrintError(err.Error())
+		}
+	}
+	c.StopAll()
+	exit(0)
+}
+
+// run runs a command on the servers
+func run(c *cluster.Cluster, configuration *config.ServerConfiguration, fields []string) error {
+	if fields[0] == "status" {
+		running := make(map[int]bool)
+		for _, id := range c.Running() {
+			running[id] = true
+		}
+		var rows []string
+		for _, id := range c.GetIds() {
+			state := "stopped"
+			if running[id] {
+				state = "running"
+			}
+			rows = append(rows, fmt.Sprintf("%d\t%s\t%s", id, configuration.Servers[id].Client, state))
+		}
+		utils.PrintTable([]string{"Id", "Client", "State"}, rows)
+		return nil
+	}
+
+	if len(fields) != 2 {
+		return fmt.Errorf(usage)
+	}
+	id, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return fmt.Errorf("invalid server id %q", fields[1])
+	}
+	switch fields[0] {
+	case "start":
+		return c.Start(id)
+	case "stop":
+		return c.Stop(id)
+	case "kill":
+		return c.Kill(id)
+	case "restart":
+		return c.Restart(id)
+	default:
+		return fmt.Errorf(usage)
+	}
+}
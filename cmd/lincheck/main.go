@@ -0,0 +1,158 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// The linearizability checker sends random requests from concurrent clients to the servers of the configuration,
+// records their history and checks that it is linearizable. A violation is printed as a minimal counterexample.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sdr/labo1/src/config"
+	"sdr/labo1/src/core"
+	"sdr/labo1/src/dto"
+	"sdr/labo1/src/linearizability"
+	"sdr/labo1/src/network"
+	"sdr/labo1/src/network/client_server"
+	"sdr/labo1/src/types"
+	"sdr/labo1/src/utils"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func main() {
+	configPath := flag.String("config", "server.json", "configuration of the servers, the clients log in as its users")
+	clients := flag.Int("clients", 4, "number of concurrent clients, spread over the servers")
+	operations := flag.Int("operations", 25, "number of requests sent by each client")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed of the random requests")
+	local := flag.Bool("local", false, "read the local copy of the servers instead of the linearizable reads")
+	output := flag.String("output", "", "file the history is written to")
+	input := flag.String("input", "", "file of a history to check again, no request is sent")
+	flag.Parse()
+	utils.SetEnabled(false)
+
+	if *input != "" {
+		recorded, err := linearizability.ReadHistory(*input)
+		if err != nil {
+			utils.LogError(true, "lincheck", "invalid history", *input+":", err.Error())
+			os.Exit(1)
+		}
+		check(recorded)
+		return
+	}
+
+	configuration := core.ReadConfig(*configPath, &config.ServerConfiguration{})
+	var servers []string
+	for _, server := range configuration.Servers {
+		if !server.Removed {
+			servers = append(servers, server.Client)
+		}
+	}
+	if len(servers) == 0 || len(configuration.Users) == 0 {
+		utils.LogError(true, "lincheck", "the configuration needs servers and users")
+		os.Exit(1)
+	}
+
+	protocols := make([]*client_server.ClientProtocol, *clients)
+	for i := range protocols {
+		conn, err := net.Dial("tcp", servers[i%len(servers)])
+		if err != nil {
+			utils.LogError(true, "lincheck", "cannot connect to", servers[i%len(servers)]+":", err.Error())
+			os.Exit(1)
+		}
+		user := configuration.Users[i%len(configuration.Users)]
+		protocols[i] = client_server.CreateClientProtocol(conn, func() types.Credentials {
+			return types.Credentials{Username: user.Username, Password: user.Password}
+		})
+		defer protocols[i].Close()
+	}
+
+	json, err := protocols[0].SendRequest("show", func(auth client_server.AuthId) any {
+		return dto.EventShow{EventId: -1, Linearizable: true}
+	})
+	initial, responseError := network.ParseResponse[[]dto.Event](json)
+	if err != nil || responseError != nil {
+		utils.LogError(true, "lincheck", "cannot read the events before the requests")
+		os.Exit(1)
+	}
+
+	fmt.Printf("%d clients on %d servers, %d requests each, seed %d\n", *clients, len(servers), *operations, *seed)
+	recorder := linearizability.CreateRecorder()
+	var lastId atomic.Int64
+	for _, event := range initial {
+		if int64(event.Id) > lastId.Load() {
+			lastId.Store(int64(event.Id))
+		}
+	}
+	var wg sync.WaitGroup
+	for i, protocol := range protocols {
+		wg.Add(1)
+		go func(clientId int, protocol *client_server.ClientProtocol) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(*seed + int64(clientId)))
+			for n := 0; n < *operations; n++ {
+				op := sendRandom(recorder, clientId, protocol, random, int(lastId.Load()), !*local)
+				if op.Pending && op.Error == "" {
+					utils.LogError(true, "lincheck", "client", clientId, "lost its connection")
+					return
+				}
+				if op.Type == dto.CreateCommand && op.Success {
+					created := int64(op.Events[0].Id)
+					for id := lastId.Load(); id < created && !lastId.CompareAndSwap(id, created); id = lastId.Load() {
+					}
+				}
+			}
+		}(i, protocol)
+	}
+	wg.Wait()
+
+	recorded := linearizability.History{Initial: initial, Operations: recorder.Operations()}
+	if *output != "" {
+		if err = recorded.Write(*output); err != nil {
+			utils.LogError(true, "lincheck", "cannot write the history:", err.Error())
+		}
+	}
+	check(recorded)
+}
+
+// check checks a history and prints the counterexample if it is not linearizable
+func check(recorded linearizability.History) {
+	start := time.Now()
+	result := linearizability.Check(recorded.Initial, recorded.Operations)
+	fmt.Printf("%d requests checked in %v\n", result.Operations, time.Since(start).Round(time.Millisecond))
+	if result.Linearizable {
+		utils.PrintSuccess("The history is linearizable")
+		return
+	}
+	utils.PrintError(fmt.Sprintf("The history is not linearizable, minimal counterexample (%d requests):", len(result.Counterexample)))
+	var rows []string
+	for _, op := range result.Counterexample {
+		rows = append(rows, fmt.Sprintf("%v\t%v\t%s", op.Invoke.Round(time.Microsecond), op.Return.Round(time.Microsecond), op))
+	}
+	utils.PrintTable([]string{"Invoke", "Return", "Request"}, rows)
+	os.Exit(2)
+}
+
+// sendRandom sends a random request, most of them on the existing events
+func sendRandom(recorder *linearizability.Recorder, clientId int, protocol *client_server.ClientProtocol, random *rand.Rand,
+	lastId int, linearizable bool) linearizability.Operation {
+	eventId := 1 + random.Intn(lastId+1) // The event after the last one may not exist
+	switch choice := random.Intn(100); {
+	case choice < 10 || lastId == 0:
+		create := dto.EventCreate{Name: fmt.Sprintf("Event %d-%d", clientId, random.Intn(1000))}
+		for i, jobs := 0, 1+random.Intn(2); i < jobs; i++ {
+			create.Jobs = append(create.Jobs, dto.Job{Name: fmt.Sprintf("Job %d", i+1), Capacity: 1 + random.Intn(2)})
+		}
+		return recorder.Create(clientId, protocol, create)
+	case choice < 15:
+		return recorder.Close(clientId, protocol, eventId)
+	case choice < 65:
+		return recorder.Register(clientId, protocol, eventId, 1+random.Intn(2))
+	default:
+		return recorder.Show(clientId, protocol, eventId, linearizable)
+	}
+}
@@ -12,30 +12,41 @@ import (
 	"sdr/labo1/src/utils"
 )
 
+const configPath = "server.json"
+
 func main() {
 	utils.PrintServerWelcome()
 
-	config := core.ReadConfig("server.json", &config.ServerConfiguration{})
 	flagId := flag.Int("id", 0, "# of the server")
+	flagConfig := flag.String("config", configPath, "configuration of the servers")
 	flag.Parse()
+	config := core.ReadConfig(*flagConfig, &config.ServerConfiguration{})
 	config.Id = *flagId
-	if config.Id < 0 || config.Id >= len(config.Servers) {
+	config.Path = *flagConfig
+	if config.Id < 0 || config.Id >= len(config.Servers) || config.Servers[config.Id].Removed {
 		panic("Invalid server number")
 	}
 
-	go server.Start(config)
+	stopped := make(chan bool)
+	go func() {
+		server.Start(config)
+		close(stopped) // Stopped by quit, or removed from the cluster
+	}()
 
 	/*core.OnSigTerm(func() {
 		fmt.Println("Stopping server...")
 		server.Stop()
 	})*/
 
-	var input string
-	for {
-		fmt.Scanln(&input)
-		if input == "quit" {
-			server.Stop()
-			break
+	go func() {
+		var input string
+		for {
+			fmt.Scanln(&input)
+			if input == "quit" {
+				server.Stop()
+				break
+			}
 		}
-	}
+	}()
+	<-stopped
 }
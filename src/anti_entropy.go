@@ -0,0 +1,139 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package server
+
+import (
+	"math/rand"
+	"sdr/labo1/src/dto"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"time"
+)
+
+const (
+	antiEntropyChannel  = "anti-entropy"
+	antiEntropyInterval = 2 * time.Second // Delay between two comparisons with a random server
+)
+
+type antiEntropyType int
+
+const (
+	antiEntropyDigest antiEntropyType = 0 // Versions of the events of the sender
+	antiEntropyEvents antiEntropyType = 1 // Events newer than the versions of the digest
+)
+
+// antiEntropyMessage
+//   - Versions: the version of each event of the sender, by event id
+//   - Events: the state of the events missing or outdated on the receiver
+type antiEntropyMessage struct {
+	Type     antiEntropyType `json:"type"`
+	Sender   int             `json:"sender"`
+	Versions map[int]int     `json:"versions,omitempty"`
+	Events   []dto.Operation `json:"events,omitempty"`
+}
+
+// antiEntropy
+// periodically compares the versions of the events with a random server and pulls the missing or newer events.
+// The replicas converge even if an operation was lost while the connection to a server was down.
+type antiEntropy struct {
+	protocol server_server.Protocol[antiEntropyMessage]
+	appData  *Data
+}
+
+// startAntiEntropy starts the comparisons of the events with the other servers
+func startAntiEntropy(mux *server_server.Mux, appData *Data) {
+	a := &antiEntropy{
+		protocol: server_server.OpenChannel[antiEntropyMessage](mux, antiEntropyChannel),
+		appData:  appData,
+	}
+	go a.start()
+}
+
+// versions gets the version of each event
+func (a *antiEntropy) versions() map[int]int {
+	a.appData.mutex.RLock()
+	defer a.appData.mutex.RUnlock()
+	versions := make(map[int]int, len(a.appData.events))
+	for _, event := range a.appData.events {
+		versions[event.Id] = event.Version
+	}
+	return versions
+}
+
+func (a *antiEntropy) sendDigest(serverId int) {
+	_ = a.protocol.SendTo(serverId, antiEntropyMessage{Type: antiEntropyDigest, Sender: a.protocol.GetServerId(), Versions: a.versions()})
+}
+
+// round sends the versions of the events to a random connected server, it answers with the events newer than them
+func (a *antiEntropy) round() {
+	var peers []int
+	for i := 0; i < a.protocol.GetNumberOfServers(); i++ {
+		if i != a.protocol.GetServerId() && a.protocol.IsConnected(i) {
+			peers = append(peers, i)
+		}
+	}
+	if len(peers) > 0 {
+		a.sendDigest(peers[rand.Intn(len(peers))])
+	}
+}
+
+// handleDigest sends the events newer than the versions of the sender, and asks for the events it has in a newer version
+func (a *antiEntropy) handleDigest(message antiEntropyMessage) {
+	a.appData.mutex.RLock()
+	var events []dto.Operation
+	outdated := false
+	for _, operation := range stateOperations(a.appData) {
+		if version, ok := message.Versions[operation.EventId]; !ok || version < operation.Sequence {
+			events = append(events, operation)
+		}
+	}
+	for eventId, version := range message.Versions {
+		if ev := findEvent(a.appData, eventId); ev == nil || ev.Version < version {
+			outdated = true
+		}
+	}
+	a.appData.mutex.RUnlock()
+
+	if len(events) > 0 {
+		_ = a.protocol.SendTo(message.Sender, antiEntropyMessage{Type: antiEntropyEvents, Sender: a.protocol.GetServerId(), Events: events})
+	}
+	if outdated {
+		a.sendDigest(message.Sender)
+	}
+}
+
+// handleEvents applies the events received, only the events newer than the local ones are replaced
+func (a *antiEntropy) handleEvents(message antiEntropyMessage) {
+	a.appData.mutex.Lock()
+	defer a.appData.mutex.Unlock()
+	var repaired []int
+	for _, operation := range message.Events {
+		if ev := findEvent(a.appData, operation.EventId); ev == nil || ev.Version < operation.Sequence {
+			repaired = append(repaired, operation.EventId)
+		}
+	}
+	applyOperations(a.appData, message.Events)
+	if len(repaired) > 0 {
+		utils.LogWarning(false, "anti-entropy", "events", repaired, "repaired from server", message.Sender)
+	}
+}
+
+func (a *antiEntropy) start() {
+	ticker := time.NewTicker(antiEntropyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case message := <-a.protocol.GetMessageChan():
+			switch message.Type {
+			case antiEntropyDigest:
+				a.handleDigest(message)
+			case antiEntropyEvents:
+				a.handleEvents(message)
+			}
+		case <-a.protocol.GetPeerChan():
+		case <-ticker.C:
+			a.round()
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package bench
+// This package simulates volunteers and organizers sending requests to the servers at the same time. It measures the
+// latency of each endpoint and counts the messages sent between the servers during the run, to compare the backends
+// and the mutual exclusion algorithms.
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sdr/labo1/src/config"
+	"sdr/labo1/src/dto"
+	"sdr/labo1/src/network"
+	"sdr/labo1/src/network/client_server"
+	"sdr/labo1/src/types"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config of a run
+//   - Volunteers: clients registering to the events and reading them
+//   - Organizers: clients creating events, reading and closing them
+//   - Duration: time during which the clients send requests, each client waits for a response before its next request
+//   - Linearizable: the reads are linearizable instead of reading the local copy of the server
+type Config struct {
+	Volunteers   int
+	Organizers   int
+	Duration     time.Duration
+	Linearizable bool
+	Seed         int64
+}
+
+// Endpoint is the measures of the requests sent to an endpoint
+//   - Errors: the requests answered with an error, like a full job, they are measured like the others
+type Endpoint struct {
+	Name      string
+	Requests  int
+	Errors    int
+	latencies []time.Duration
+}
+
+// Percentile gets the latency under which a fraction of the requests were answered (nearest rank)
+func (e *Endpoint) Percentile(fraction float64) time.Duration {
+	if len(e.latencies) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(fraction*float64(len(e.latencies)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return e.latencies[rank]
+}
+
+// Report is the result of a run
+//   - Endpoints: the measures of each endpoint called, sorted by name
+//   - Messages: the messages sent between the servers during the run by channel, summed over the servers
+//   - Lost: the clients that lost their connection before the end
+type Report struct {
+	Elapsed   time.Duration
+	Endpoints []*Endpoint
+	Messages  map[string]int64
+	Lost      int
+}
+
+// Requests gets the number of requests answered
+func (r Report) Requests() int {
+	requests := 0
+	for _, endpoint := range r.Endpoints {
+		requests += endpoint.Requests
+	}
+	return requests
+}
+
+// Writes gets the number of requests modifying the events, answered with an error or not
+func (r Report) Writes() int {
+	writes := 0
+	for _, endpoint := range r.Endpoints {
+		if endpoint.Name != string(dto.ShowCommand) {
+			writes += endpoint.Requests
+		}
+	}
+	return writes
+}
+
+// Throughput gets the number of requests answered by second
+func (r Report) Throughput() float64 {
+	return float64(r.Requests()) / r.Elapsed.Seconds()
+}
+
+// Bench sends the requests of the simulated clients, the mutex protects the measures
+//   - lastId: the id of the last event created, the volunteers register to the events up to it
+type Bench struct {
+	config    Config
+	servers   []string
+	users     []config.UserWithPassword
+	dial      func(addr string) (net.Conn, error)
+	endpoints map[string]*Endpoint
+	lastId    atomic.Int64
+	mutex     sync.Mutex
+}
+
+// CreateBench Constructor, the clients are spread over the client addresses of the servers and log in as the users
+// in turn. The dial function connects to a server, like net.Dial over TCP.
+func CreateBench(configuration Config, servers []string, users []config.UserWithPassword, dial func(addr string) (net.Conn, error)) *Bench {
+	return &Bench{
+		config:    configuration,
+		servers:   servers,
+		users:     users,
+		dial:      dial,
+		endpoints: make(map[string]*Endpoint),
+	}
+}
+
+// Run connects the clients, sends their requests until the end of the duration and gets the report
+func (b *Bench) Run() (Report, error) {
+	if len(b.servers) == 0 || len(b.users) == 0 {
+		return Report{}, fmt.Errorf("the bench needs servers and users")
+	}
+	before, err := b.messages()
+	if err != nil {
+		return Report{}, err
+	}
+
+	clients := make([]*client_server.ClientProtocol, b.config.Organizers+b.config.Volunteers)
+	for i := range clients {
+		user := b.users[i%len(b.users)]
+		clients[i], err = b.connect(b.servers[i%len(b.servers)], types.Credentials{Username: user.Username, Password: user.Password})
+		if err != nil {
+			return Report{}, err
+		}
+		defer clients[i].Close()
+	}
+	if len(clients) > 0 {
+		response, err := clients[0].SendRequest(string(dto.ShowCommand), func(auth client_server.AuthId) any {
+			return dto.EventShow{EventId: -1}
+		})
+		events, responseError := network.ParseResponse[[]dto.Event](response)
+		if err != nil || responseError != nil {
+			return Report{}, fmt.Errorf("cannot read the events before the requests")
+		}
+		for _, event := range events {
+			if int64(event.Id) > b.lastId.Load() {
+				b.lastId.Store(int64(event.Id))
+			}
+		}
+	}
+
+	var lost atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(b.config.Duration)
+	for i, client := range clients {
+		wg.Add(1)
+		go func(clientId int, client *client_server.ClientProtocol) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(b.config.Seed + int64(clientId)))
+			step := b.volunteer
+			if clientId < b.config.Organizers {
+				step = b.organizer()
+			}
+			for time.Now().Before(deadline) {
+				if !step(client, random) {
+					lost.Add(1)
+					return
+				}
+			}
+		}(i, client)
+	}
+	wg.Wait()
+	report := Report{Elapsed: time.Since(start), Lost: int(lost.Load())}
+
+	after, err := b.messages()
+	if err != nil {
+		return report, err
+	}
+	report.Messages = make(map[string]int64)
+	for channel, sent := range after {
+		if sent > before[channel] {
+			report.Messages[channel] = sent - before[channel]
+		}
+	}
+	for _, endpoint := range b.endpoints {
+		sort.Slice(endpoint.latencies, func(i, j int) bool { return endpoint.latencies[i] < endpoint.latencies[j] })
+		report.Endpoints = append(report.Endpoints, endpoint)
+	}
+	sort.Slice(report.Endpoints, func(i, j int) bool { return report.Endpoints[i].Name < report.Endpoints[j].Name })
+	return report, nil
+}
+
+// connect connects a client to a server
+func (b *Bench) connect(addr string, credentials types.Credentials) (*client_server.ClientProtocol, error) {
+	conn, err := b.dial(addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %s", addr, err.Error())
+	}
+	return client_server.CreateClientProtocol(conn, func() types.Credentials {
+		return credentials
+	}), nil
+}
+
+// messages gets the messages sent by the servers since their start, by channel
+func (b *Bench) messages() (map[string]int64, error) {
+	messages := make(map[string]int64)
+	for _, addr := range b.servers {
+		client, err := b.connect(addr, types.Credentials{})
+		if err != nil {
+			return nil, err
+		}
+		response, err := client.SendRequest("stats", func(auth client_server.AuthId) any {
+			return nil
+		})
+		_ = client.Close()
+		stats, responseError := network.ParseResponse[dto.ServerStats](response)
+		if err != nil || responseError != nil {
+			return nil, fmt.Errorf("cannot get the messages sent by %s", addr)
+		}
+		for channel, sent := range stats.Messages {
+			messages[channel] += sent
+		}
+	}
+	return messages, nil
+}
+
+// send sends a request and measures its latency, it returns false if the connection is lost
+func (b *Bench) send(client *client_server.ClientProtocol, command dto.CommandType, request any) (response string, ok bool) {
+	start := time.Now()
+	response, err := client.SendRequest(string(command), func(auth client_server.AuthId) any {
+		return request
+	})
+	latency := time.Since(start)
+	if err != nil {
+		return "", false
+	}
+	var result network.Response[json.RawMessage]
+	failed := json.Unmarshal([]byte(response), &result) != nil || !result.Success
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	endpoint, found := b.endpoints[string(command)]
+	if !found {
+		endpoint = &Endpoint{Name: string(command)}
+		b.endpoints[string(command)] = endpoint
+	}
+	endpoint.Requests++
+	if failed {
+		endpoint.Errors++
+	}
+	endpoint.latencies = append(endpoint.latencies, latency)
+	return response, true
+}
+
+// volunteer sends a request of a volunteer: it registers to a job of an event or reads the events
+func (b *Bench) volunteer(client *client_server.ClientProtocol, random *rand.Rand) bool {
+	lastId := int(b.lastId.Load())
+	show := dto.EventShow{EventId: -1, Linearizable: b.config.Linearizable}
+	switch choice := random.Intn(100); {
+	case lastId == 0 || choice < 10:
+	case choice < 40:
+		_, ok := b.send(client, dto.RegisterCommand, dto.EventRegister{EventId: 1 + random.Intn(lastId), JobId: 1 + random.Intn(2)})
+		return ok
+	default:
+		show.EventId = 1 + random.Intn(lastId)
+	}
+	_, ok := b.send(client, dto.ShowCommand, show)
+	return ok
+}
+
+// organizer gets the requests of an organizer: it creates events, reads them and closes them. It only closes its
+// own events, the oldest first.
+func (b *Bench) organizer() func(client *client_server.ClientProtocol, random *rand.Rand) bool {
+	var open []int
+	return func(client *client_server.ClientProtocol, random *rand.Rand) bool {
+		switch choice := random.Intn(100); {
+		case len(open) == 0 || choice < 30:
+			create := dto.EventCreate{Name: fmt.Sprintf("Bench %d", random.Intn(1000))}
+			for i := 0; i < 2; i++ {
+				create.Jobs = append(create.Jobs, dto.Job{Name: fmt.Sprintf("Job %d", i+1), Capacity: 1 + b.config.Volunteers/2})
+			}
+			response, ok := b.send(client, dto.CreateCommand, create)
+			if event, err := network.ParseResponse[dto.Event](response); ok && err == nil {
+				open = append(open, event.Id)
+				for id := b.lastId.Load(); id < int64(event.Id) && !b.lastId.CompareAndSwap(id, int64(event.Id)); id = b.lastId.Load() {
+				}
+			}
+			return ok
+		case choice < 45:
+			_, ok := b.send(client, dto.CloseCommand, dto.EventClose{EventId: open[0]})
+			open = open[1:]
+			return ok
+		default:
+			_, ok := b.send(client, dto.ShowCommand, dto.EventShow{EventId: open[random.Intn(len(open))], Linearizable: b.config.Linearizable})
+			return ok
+		}
+	}
+}
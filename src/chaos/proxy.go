@@ -0,0 +1,319 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package chaos
+// This package implements a proxy injecting faults in the connections between the servers. A server with a proxy
+// address in the configuration is dialed through the proxy by the other servers: the proxy accepts the connection,
+// dials the server and forwards the lines of both directions following the steps of a scenario. The dialing server is
+// known from the handshake, the first line it sends.
+package chaos
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sdr/labo1/src/config"
+	"sdr/labo1/src/network"
+	"sdr/labo1/src/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MaxHold    = 200 * time.Millisecond // Maximum delay a reordered line waits for the next lines
+	QueueSize  = 1024                   // Number of lines waiting for their delay in each direction
+	heartbeat  = "\n"
+	unknownId  = -1
+	logsPrefix = "chaos"
+)
+
+// link is a connection forwarded by the proxy
+//   - source: the server that dialed the connection, unknown until its handshake is read
+//   - cut: lines have been dropped by a partition, the connection is closed when the partition ends
+type link struct {
+	source   int
+	target   int
+	accepted net.Conn
+	dialed   net.Conn
+	cut      bool
+	once     sync.Once
+}
+
+func (l *link) close() {
+	l.once.Do(func() {
+		_ = l.accepted.Close()
+		_ = l.dialed.Close()
+	})
+}
+
+// stats counts the lines forwarded during a step
+type stats struct {
+	forwarded   int
+	dropped     int
+	partitioned int
+	reordered   int
+}
+
+// Proxy
+// forwards the connections to the servers with a proxy address. The mutex protects the step, the links, the
+// statistics and the random generator.
+type Proxy struct {
+	servers   []config.ServerUrl
+	scenario  Scenario
+	transport network.Transport
+	listeners []net.Listener
+	step      int // Index of the current step, -1 before the first one
+	links     map[*link]bool
+	stats     stats
+	random    *rand.Rand
+	done      chan bool
+	mutex     sync.Mutex
+}
+
+// CreateProxy Constructor, the connections are accepted and dialed with the transport
+func CreateProxy(servers []config.ServerUrl, scenario Scenario, transport network.Transport) *Proxy {
+	return &Proxy{
+		servers:   servers,
+		scenario:  scenario,
+		transport: transport,
+		step:      -1,
+		links:     make(map[*link]bool),
+		random:    rand.New(rand.NewSource(scenario.Seed)),
+		done:      make(chan bool),
+	}
+}
+
+// Start listens on the proxy address of every server and starts the scenario
+func (p *Proxy) Start() error {
+	for id, server := range p.servers {
+		if server.Proxy == "" || server.Removed {
+			continue
+		}
+		listener, err := p.transport.Listen(server.Proxy)
+		if err != nil {
+			p.Stop()
+			return err
+		}
+		p.listeners = append(p.listeners, listener)
+		utils.LogSuccess(true, logsPrefix, "server", id, "proxied on", server.Proxy, "to", server.Server)
+		go p.accept(listener, id)
+	}
+	if len(p.listeners) == 0 {
+		return errors.New("no server has a proxy address in the configuration")
+	}
+	go p.run()
+	return nil
+}
+
+// Stop closes the listeners and the connections
+func (p *Proxy) Stop() {
+	select {
+	case <-p.done:
+		return
+	default:
+		close(p.done)
+	}
+	for _, listener := range p.listeners {
+		_ = listener.Close()
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for l := range p.links {
+		l.close()
+	}
+	p.logStats()
+}
+
+// run applies the steps of the scenario at their time
+func (p *Proxy) run() {
+	start := time.Now()
+	for i, step := range p.scenario.Steps {
+		select {
+		case <-time.After(time.Until(start.Add(time.Duration(step.At)))):
+			p.apply(i)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// apply starts a step. The connections cut by the previous partition are closed if their servers are connected again.
+func (p *Proxy) apply(index int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.logStats()
+	p.step = index
+	p.stats = stats{}
+	step := p.scenario.Steps[index]
+	utils.LogWarning(true, logsPrefix, fmt.Sprintf("step %d at %v:", index, time.Duration(step.At)), step.String())
+
+	for l := range p.links {
+		if l.cut && !step.partitioned(l.source, l.target) {
+			utils.LogInfo(true, logsPrefix, "connection", l.source, "->", l.target, "healed, closed to connect again")
+			l.close()
+		}
+	}
+}
+
+// logStats logs the statistics of the current step, the mutex must be held
+func (p *Proxy) logStats() {
+	if p.step == -1 {
+		return
+	}
+	utils.LogInfo(true, logsPrefix, fmt.Sprintf("step %d:", p.step), "forwarded", p.stats.forwarded, "dropped", p.stats.dropped,
+		"partitioned", p.stats.partitioned, "reordered", p.stats.reordered)
+}
+
+// accept accepts the connections to a server, each one is forwarded to a new connection to the server
+func (p *Proxy) accept(listener net.Listener, target int) {
+	for {
+		accepted, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			dialed, err := p.transport.Dial(p.servers[target].Server)
+			if err != nil {
+				utils.LogWarning(false, logsPrefix, "server", target, "unreachable:", err.Error())
+				_ = accepted.Close()
+				return
+			}
+			l := &link{source: unknownId, target: target, accepted: accepted, dialed: dialed}
+			p.mutex.Lock()
+			p.links[l] = true
+			p.mutex.Unlock()
+			go p.forward(l, accepted, dialed, true)
+			p.forward(l, dialed, accepted, false)
+			p.mutex.Lock()
+			delete(p.links, l)
+			p.mutex.Unlock()
+		}()
+	}
+}
+
+// item is a line waiting for its delay
+type item struct {
+	line string
+	due  time.Time
+}
+
+// forward forwards the lines of a direction of a link until one of its connections is closed.
+// A reordered line is held until the next lines are forwarded, or until MaxHold.
+func (p *Proxy) forward(l *link, src net.Conn, dst net.Conn, outgoing bool) {
+	lines := make(chan string)
+	queue := make(chan item, QueueSize)
+	defer func() {
+		l.close()
+		close(queue)
+		for range lines { // Unblocks the reader until it sees the closed connection
+		}
+	}()
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(src)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+	go p.write(l, dst, queue)
+
+	var held *item
+	remaining := 0
+	var release <-chan time.Time
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				if held != nil {
+					queue <- *held
+				}
+				return
+			}
+			next, reorder, distance := p.decide(l, line, outgoing, held != nil)
+			if next == nil {
+				continue
+			}
+			switch {
+			case held != nil:
+				queue <- *next
+				if remaining--; remaining == 0 {
+					queue <- *held
+					held, release = nil, nil
+				}
+			case reorder:
+				held, remaining, release = next, distance, time.After(MaxHold)
+			default:
+				queue <- *next
+			}
+		case <-release:
+			queue <- *held
+			held, release = nil, nil
+		}
+	}
+}
+
+// decide applies the current step to a line, it returns nil if the line is dropped.
+// The heartbeats are only dropped by the partitions, they are never reordered, nor the lines following a held line.
+func (p *Proxy) decide(l *link, line string, outgoing bool, holding bool) (next *item, reorder bool, distance int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if outgoing && l.source == unknownId {
+		var handshake struct {
+			ServerId *int `json:"serverId"`
+		}
+		if json.Unmarshal([]byte(line), &handshake) == nil && handshake.ServerId != nil {
+			l.source = *handshake.ServerId
+		}
+	}
+	from, to := l.source, l.target
+	if !outgoing {
+		from, to = to, from
+	}
+	if p.step == -1 {
+		p.stats.forwarded++
+		return &item{line: line, due: time.Now()}, false, 0
+	}
+
+	step := p.scenario.Steps[p.step]
+	isHeartbeat := line == heartbeat
+	switch {
+	case step.partitioned(from, to):
+		l.cut = true
+		p.stats.partitioned++
+		return nil, false, 0
+	case !isHeartbeat && p.random.Float64() < step.Drop:
+		p.stats.dropped++
+		utils.LogInfo(false, logsPrefix, "dropped", from, "->", to, strings.TrimSpace(line))
+		return nil, false, 0
+	}
+	delay := time.Duration(step.Delay)
+	if step.Jitter > 0 {
+		delay += time.Duration(p.random.Int63n(int64(step.Jitter)))
+	}
+	p.stats.forwarded++
+	if !isHeartbeat && !holding && p.random.Float64() < step.Reorder {
+		p.stats.reordered++
+		distance = 1 + p.random.Intn(step.Distance)
+		utils.LogInfo(false, logsPrefix, "reordered", from, "->", to, "after", distance, "lines", strings.TrimSpace(line))
+		return &item{line: line, due: time.Now().Add(delay)}, true, distance
+	}
+	return &item{line: line, due: time.Now().Add(delay)}, false, 0
+}
+
+// write writes the lines of a direction once their delay has elapsed, in the order they are queued
+func (p *Proxy) write(l *link, dst net.Conn, queue chan item) {
+	for next := range queue {
+		time.Sleep(time.Until(next.due))
+		if _, err := dst.Write([]byte(next.line)); err != nil {
+			l.close()
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package chaos
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Duration is a duration written as a string in the scenario file, e.g. "1.5s" or "200ms"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid duration %s, expected a string like \"200ms\"", string(data))
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Step defines the faults injected from its time until the next step, the lines are forwarded unchanged before the
+// first step
+//   - At: the time of the step since the start of the proxy
+//   - Delay, Jitter: each line is delayed by Delay plus a random duration up to Jitter, the lines are kept in order
+//   - Drop: the probability to drop a line
+//   - Reorder, Distance: the probability to deliver a line after the next ones, at most Distance lines (1 by default)
+//   - Partition: the groups of servers, the lines between two groups are dropped. A server in no group is alone.
+//     The connections between the groups are closed when the partition ends, the servers connect again.
+type Step struct {
+	Name      string   `json:"name"`
+	At        Duration `json:"at"`
+	Delay     Duration `json:"delay"`
+	Jitter    Duration `json:"jitter"`
+	Drop      float64  `json:"drop"`
+	Reorder   float64  `json:"reorder"`
+	Distance  int      `json:"distance"`
+	Partition [][]int  `json:"partition"`
+}
+
+// Scenario
+//   - Seed: initializes the random generator deciding the faults
+//   - Steps: the steps, sorted by time once read
+type Scenario struct {
+	Seed  int64  `json:"seed"`
+	Steps []Step `json:"steps"`
+}
+
+// ReadScenario reads and checks a scenario file
+func ReadScenario(path string) (Scenario, error) {
+	var scenario Scenario
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return scenario, err
+	}
+	if err = json.Unmarshal(content, &scenario); err != nil {
+		return scenario, err
+	}
+	sort.SliceStable(scenario.Steps, func(i, j int) bool { return scenario.Steps[i].At < scenario.Steps[j].At })
+	for i, step := range scenario.Steps {
+		if step.Drop < 0 || step.Drop > 1 || step.Reorder < 0 || step.Reorder > 1 {
+			return scenario, fmt.Errorf("step %d: the probabilities must be between 0 and 1", i)
+		}
+		if step.Delay < 0 || step.Jitter < 0 || step.Distance < 0 {
+			return scenario, fmt.Errorf("step %d: the delays and the distance cannot be negative", i)
+		}
+		if step.Distance == 0 {
+			scenario.Steps[i].Distance = 1
+		}
+		seen := make(map[int]bool)
+		for _, group := range step.Partition {
+			for _, id := range group {
+				if seen[id] {
+					return scenario, fmt.Errorf("step %d: server %d is in several groups", i, id)
+				}
+				seen[id] = true
+			}
+		}
+	}
+	return scenario, nil
+}
+
+// group gets the group of a server in the partition of the step, a server in no group is alone
+func (step Step) group(serverId int) int {
+	for i, group := range step.Partition {
+		for _, id := range group {
+			if id == serverId {
+				return i
+			}
+		}
+	}
+	return -1 - serverId
+}
+
+// partitioned checks if the lines between two servers are dropped, the servers are unknown (-1) until the handshake
+func (step Step) partitioned(a int, b int) bool {
+	return len(step.Partition) > 0 && a != -1 && b != -1 && step.group(a) != step.group(b)
+}
+
+func (step Step) String() string {
+	name := step.Name
+	if name == "" {
+		name = "step"
+	}
+	return fmt.Sprintf("%s (delay %v, jitter %v, drop %.2f, reorder %.2f/%d, partition %v)", name,
+		time.Duration(step.Delay), time.Duration(step.Jitter), step.Drop, step.Reorder, step.Distance, step.Partition)
+}
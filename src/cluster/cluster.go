@@ -0,0 +1,235 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package cluster
+// This package launches the servers of a configuration as child processes. The logs of the servers are written to a
+// single output, each line prefixed by the id of its server. A server can be killed, stopped or restarted alone.
+package cluster
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"sdr/labo1/src/utils/colors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const StopTimeout = 5 * time.Second // Time given to a server to quit before it is killed
+
+// prefixColors are the colors of the prefixes of the logs, by server id
+var prefixColors = []string{colors.Cyan, colors.Purple, colors.Yellow, colors.Green, colors.Blue, colors.Red}
+
+// process is a running server
+//   - stdin: the input of the server, "quit" stops it
+//   - done: closed once the server exited and its logs are written
+type process struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  chan struct{}
+}
+
+// Cluster
+// is the servers launched as child processes, the mutex protects the running processes and the output
+//   - command: gets the command starting a server, a new command is needed at each start
+type Cluster struct {
+	ids       []int
+	command   func(id int) *exec.Cmd
+	output    io.Writer
+	processes map[int]*process
+	mutex     sync.Mutex
+	writing   sync.Mutex
+}
+
+// CreateCluster Constructor, the logs of the servers are written to the output
+func CreateCluster(ids []int, command func(id int) *exec.Cmd, output io.Writer) *Cluster {
+	return &Cluster{
+		ids:       append([]int{}, ids...),
+		command:   command,
+		output:    output,
+		processes: make(map[int]*process),
+	}
+}
+
+// StartAll starts every server not running
+func (c *Cluster) StartAll() error {
+	for _, id := range c.ids {
+		if c.IsRunning(id) {
+			continue
+		}
+		if err := c.Start(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start starts a server
+func (c *Cluster) Start(id int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.known(id) {
+		return fmt.Errorf("unknown server %d", id)
+	}
+	if _, ok := c.processes[id]; ok {
+		return fmt.Errorf("server %d is already running", id)
+	}
+
+	cmd := c.command(id)
+	setProcessGroup(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("cannot start server %d: %s", id, err.Error())
+	}
+	p := &process{cmd: cmd, stdin: stdin, done: make(chan struct{})}
+	c.processes[id] = p
+	c.log(id, fmt.Sprintf("started (pid %d)", cmd.Process.Pid))
+
+	go func() {
+		var wg sync.WaitGroup
+		for _, pipe := range []io.Reader{stdout, stderr} {
+			wg.Add(1)
+			go func(pipe io.Reader) {
+				defer wg.Done()
+				scanner := bufio.NewScanner(pipe)
+				for scanner.Scan() {
+					c.log(id, scanner.Text())
+				}
+			}(pipe)
+		}
+		wg.Wait() // The pipes must be read before waiting for the exit
+		err := cmd.Wait()
+
+		c.mutex.Lock()
+		delete(c.processes, id)
+		c.mutex.Unlock()
+		if err != nil {
+			c.log(id, "exited: "+err.Error())
+		} else {
+			c.log(id, "exited")
+		}
+		close(p.done)
+	}()
+	return nil
+}
+
+// Kill kills a server without letting it quit, like a crash
+func (c *Cluster) Kill(id int) error {
+	p, err := c.running(id)
+	if err != nil {
+		return err
+	}
+	_ = p.cmd.Process.Kill()
+	<-p.done
+	return nil
+}
+
+// Stop asks a server to quit, it is killed if it is still running after the timeout
+func (c *Cluster) Stop(id int) error {
+	p, err := c.running(id)
+	if err != nil {
+		return err
+	}
+	_, _ = io.WriteString(p.stdin, "quit\n")
+	select {
+	case <-p.done:
+	case <-time.After(StopTimeout):
+		c.log(id, "not stopped after", StopTimeout, "killing it")
+		_ = p.cmd.Process.Kill()
+		<-p.done
+	}
+	return nil
+}
+
+// Restart stops a server if it is running and starts it again
+func (c *Cluster) Restart(id int) error {
+	if c.IsRunning(id) {
+		if err := c.Stop(id); err != nil {
+			return err
+		}
+	}
+	return c.Start(id)
+}
+
+// StopAll stops every running server at the same time
+func (c *Cluster) StopAll() {
+	var wg sync.WaitGroup
+	for _, id := range c.Running() {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			_ = c.Stop(id)
+		}(id)
+	}
+	wg.Wait()
+}
+
+// IsRunning checks if a server is running
+func (c *Cluster) IsRunning(id int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.processes[id]
+	return ok
+}
+
+// Running gets the ids of the running servers, sorted
+func (c *Cluster) Running() []int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ids := make([]int, 0, len(c.processes))
+	for id := range c.processes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// GetIds gets the ids of the servers of the cluster
+func (c *Cluster) GetIds() []int {
+	return append([]int{}, c.ids...)
+}
+
+// running gets the process of a running server
+func (c *Cluster) running(id int) (*process, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.known(id) {
+		return nil, fmt.Errorf("unknown server %d", id)
+	}
+	p, ok := c.processes[id]
+	if !ok {
+		return nil, fmt.Errorf("server %d is not running", id)
+	}
+	return p, nil
+}
+
+// known checks if a server is in the cluster
+func (c *Cluster) known(id int) bool {
+	for _, known := range c.ids {
+		if known == id {
+			return true
+		}
+	}
+	return false
+}
+
+// log writes a line of a server to the output, the lines of the servers are never mixed
+func (c *Cluster) log(id int, data ...any) {
+	color := prefixColors[id%len(prefixColors)]
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	_, _ = fmt.Fprintln(c.output, append([]any{fmt.Sprintf("%s[server %d]%s", color, id, colors.Reset)}, data...)...)
+}
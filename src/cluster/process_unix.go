@@ -0,0 +1,17 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+//go:build !windows
+
+package cluster
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts a server in its own process group: a Ctrl-C in the terminal is only received by the
+// launcher, which stops the servers itself
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
@@ -4,30 +4,116 @@
 package config
 
 import (
+	"fmt"
+	"math"
 	"sdr/labo1/src/dto"
+	"sdr/labo1/src/network"
 	"sdr/labo1/src/types"
+	"sort"
 )
 
 // UserWithPassword contains the user credentials for authentication
+// - Admin: the user can change the servers of the cluster
 type UserWithPassword struct {
 	Id       int    `json:"id"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Admin    bool   `json:"admin,omitempty"`
 }
 
+// ServerUrl contains the addresses of a server
+// - Parent: the parent of the server in the spanning tree used by Raymond's algorithm, nil for the root
+// - Quorum: the voting set of the server used by Maekawa's algorithm, computed from a grid if empty
+// - Removed: the server left the cluster, its id is not reused
+// - Proxy: the address of the chaos proxy forwarding to the server, the other servers dial it instead of the server
 type ServerUrl struct {
-	Client string `json:"client"`
-	Server string `json:"server"`
+	Client  string `json:"client"`
+	Server  string `json:"server"`
+	Parent  *int   `json:"parent,omitempty"`
+	Quorum  []int  `json:"quorum,omitempty"`
+	Removed bool   `json:"removed,omitempty"`
+	Proxy   string `json:"proxy,omitempty"`
 }
 
+// GetDialAddress gets the address dialed by the other servers, the proxy if the server is behind one
+func (url ServerUrl) GetDialAddress() string {
+	if url.Proxy != "" {
+		return url.Proxy
+	}
+	return url.Server
+}
+
+// Mutual exclusion algorithms that can be selected in the configuration
+const (
+	Lamport        = "lamport"
+	RicartAgrawala = "ricart-agrawala"
+	SuzukiKasami   = "suzuki-kasami"
+	Raymond        = "raymond"
+	Centralized    = "centralized"
+	Maekawa        = "maekawa"
+)
+
+// Backends that can be selected in the configuration to replicate the events
+const (
+	MutualExclusionBackend = "mutual-exclusion"
+	RaftBackend            = "raft"
+	TotalOrderBackend      = "total-order"
+)
+
+// Leader election algorithms that can be selected in the configuration
+const (
+	Bully        = "bully"
+	ChangRoberts = "chang-roberts"
+)
+
+// Failure detectors that can be selected in the configuration
+const (
+	HeartbeatDetector = "heartbeat"
+	SwimDetector      = "swim"
+)
+
 // ServerConfiguration contains the information
+//   - Coordinator: the server granting the critical section with the centralized mutual exclusion, the elected one if nil
+//   - CausalOrder: the messages replicating the events are delivered in causal order
+//   - FailureDetector: detects the crashes given to the algorithms, the silent servers or the servers declared dead by SWIM
+//   - MembershipVersion: number of changes of the servers since the first configuration
+//   - RaftDirectory: the directory of the files keeping the term, the vote and the log of each server with the Raft
+//     backend, "raft" if empty
+//   - Path: the file the configuration was read from, the changes of the servers are written to it
+//   - Transport: creates the connections of the server, TCP if nil
 type ServerConfiguration struct {
-	Id            int                `json:"-"`
-	Servers       []ServerUrl        `json:"servers"`
-	Users         []UserWithPassword `json:"users"`
-	Events        []dto.Event        `json:"events"`
-	Debug         bool               `json:"debug"`
-	ShowInfosLogs bool               `json:"showInfosLogs"`
+	Id                int                `json:"-"`
+	Servers           []ServerUrl        `json:"servers"`
+	Users             []UserWithPassword `json:"users"`
+	Events            []dto.Event        `json:"events"`
+	Debug             bool               `json:"debug"`
+	ShowInfosLogs     bool               `json:"showInfosLogs"`
+	MutualExclusion   string             `json:"mutualExclusion"`
+	Backend           string             `json:"backend"`
+	Election          string             `json:"election"`
+	Coordinator       *int               `json:"coordinator,omitempty"`
+	CausalOrder       bool               `json:"causalOrder"`
+	FailureDetector   string             `json:"failureDetector,omitempty"`
+	MembershipVersion int                `json:"membershipVersion,omitempty"`
+	RaftDirectory     string             `json:"raftDirectory,omitempty"`
+	Path              string             `json:"-"`
+	Transport         network.Transport  `json:"-"`
+}
+
+// GetTransport gets the transport creating the connections of the server
+func (config ServerConfiguration) GetTransport() network.Transport {
+	if config.Transport == nil {
+		return network.TCPTransport{}
+	}
+	return config.Transport
+}
+
+// GetRaftDirectory gets the directory of the files of the Raft backend
+func (config ServerConfiguration) GetRaftDirectory() string {
+	if config.RaftDirectory == "" {
+		return "raft"
+	}
+	return config.RaftDirectory
 }
 
 // GetCurrentUrls gets the current server urls
@@ -35,16 +121,109 @@ func (config ServerConfiguration) GetCurrentUrls() ServerUrl {
 	return config.Servers[config.Id]
 }
 
+// GetOtherServers gets the addresses of the other servers, empty for the servers that left the cluster.
+// A server behind a proxy is dialed through it.
 func (config ServerConfiguration) GetOtherServers() []string {
 	var urls []string
 	for id, server := range config.Servers {
-		if id != config.Id {
-			urls = append(urls, server.Server)
+		switch {
+		case id == config.Id:
+			continue
+		case server.Removed:
+			urls = append(urls, "")
+		default:
+			urls = append(urls, server.GetDialAddress())
 		}
 	}
 	return urls
 }
 
+// GetParents gets the parent of each server in the spanning tree, -1 for the root.
+// Servers without configured parent are placed as in a binary heap ( the parent of i is (i-1)/2 )
+func (config ServerConfiguration) GetParents() ([]int, error) {
+	parents := make([]int, len(config.Servers))
+	for id, server := range config.Servers {
+		switch {
+		case server.Parent != nil:
+			parents[id] = *server.Parent
+		case id == 0:
+			parents[id] = -1
+		default:
+			parents[id] = (id - 1) / 2
+		}
+		if parents[id] < -1 || parents[id] >= len(config.Servers) || parents[id] == id {
+			return nil, fmt.Errorf("invalid parent %d for server %d", parents[id], id)
+		}
+	}
+
+	// Every server must reach the same root without cycle
+	root := -1
+	for id := range parents {
+		current := id
+		for steps := 0; parents[current] != -1; steps++ {
+			if steps == len(parents) {
+				return nil, fmt.Errorf("cycle in the spanning tree at server %d", id)
+			}
+			current = parents[current]
+		}
+		if root != -1 && root != current {
+			return nil, fmt.Errorf("the spanning tree has more than one root (%d and %d)", root, current)
+		}
+		root = current
+	}
+	return parents, nil
+}
+
+// GetQuorums gets the voting set of each server, any two voting sets must intersect.
+// Servers without configured voting set get the row and the column of their cell in a grid of ceil(√N) columns,
+// the cells after the last server are filled with the first servers again so every row meets every column.
+func (config ServerConfiguration) GetQuorums() ([][]int, error) {
+	n := len(config.Servers)
+	size := int(math.Ceil(math.Sqrt(float64(n))))
+	quorums := make([][]int, n)
+	for id, server := range config.Servers {
+		if len(server.Quorum) > 0 {
+			quorums[id] = append([]int{}, server.Quorum...)
+		} else {
+			row, column := id/size, id%size
+			members := make(map[int]bool)
+			for i := 0; i < size; i++ {
+				members[(row*size+i)%n] = true
+				members[(i*size+column)%n] = true
+			}
+			for member := range members {
+				quorums[id] = append(quorums[id], member)
+			}
+		}
+		sort.Ints(quorums[id])
+		for _, member := range quorums[id] {
+			if member < 0 || member >= n {
+				return nil, fmt.Errorf("invalid server %d in the voting set of server %d", member, id)
+			}
+		}
+	}
+
+	for i := range quorums {
+		for j := i + 1; j < n; j++ {
+			if !intersect(quorums[i], quorums[j]) {
+				return nil, fmt.Errorf("the voting sets of servers %d and %d do not intersect", i, j)
+			}
+		}
+	}
+	return quorums, nil
+}
+
+func intersect(a []int, b []int) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // GetData Get the users and events from a ServerConfiguration
 func (config ServerConfiguration) GetData() (users map[int]*types.User, events []*types.Event) {
 	users = make(map[int]*types.User)
@@ -53,6 +232,7 @@ func (config ServerConfiguration) GetData() (users map[int]*types.User, events [
 			Id:       user.Id,
 			Username: user.Username,
 			Password: user.Password,
+			Admin:    user.Admin,
 		}
 	}
 
@@ -64,6 +244,7 @@ func (config ServerConfiguration) GetData() (users map[int]*types.User, events [
 			OrganizerId:  event.Organizer.Id,
 			Jobs:         make(map[int]*types.Job),
 			Participants: make(map[int]int),
+			Version:      event.Version,
 		}
 		for _, job := range event.Jobs {
 			e.Jobs[job.Id] = &types.Job{
@@ -0,0 +1,78 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sdr/labo1/src/network"
+	"sdr/labo1/src/network/client_server"
+	"sdr/labo1/src/network/consistency"
+	"sdr/labo1/src/network/server_server"
+	"sort"
+	"strings"
+)
+
+const consistencyChannel = "consistency"
+
+// createChecker starts the consistency check of the events, the servers exchange a hash of their events after each change
+func createChecker(mux *server_server.Mux, appData *Data) *consistency.Checker {
+	checker := consistency.CreateChecker(server_server.OpenChannel[consistency.Message](mux, consistencyChannel))
+	go checker.Start()
+	appData.mutex.Lock()
+	defer appData.mutex.Unlock()
+	appData.checker = checker
+	appData.changed()
+	return checker
+}
+
+// changed sends the new state of the events to the consistency check, the data mutex must be held
+func (appData *Data) changed() {
+	if appData.checker != nil {
+		appData.checker.Update(consistencyState(appData))
+	}
+}
+
+// consistencyState hashes the events and their versions, the data mutex must be held.
+// The jobs and the participants are sorted, the hash does not depend on the order of the maps.
+func consistencyState(appData *Data) consistency.State {
+	versions := make([]string, 0, len(appData.events))
+	events := make([]any, 0, len(appData.events))
+	for _, event := range appData.events {
+		versions = append(versions, fmt.Sprintf("%d:%d", event.Id, event.Version))
+		jobs := make([]string, 0, len(event.Jobs))
+		for _, job := range event.Jobs {
+			jobs = append(jobs, fmt.Sprintf("%d:%s:%d:%d", job.Id, job.Name, job.Capacity, job.Count))
+		}
+		participants := make([]string, 0, len(event.Participants))
+		for userId, jobId := range event.Participants {
+			participants = append(participants, fmt.Sprintf("%d:%d", userId, jobId))
+		}
+		sort.Strings(jobs)
+		sort.Strings(participants)
+		events = append(events, []any{event.Id, event.Name, event.Open, event.OrganizerId, event.Version, jobs, participants})
+	}
+	content, _ := json.Marshal(events)
+	return consistency.State{
+		Versions: hash([]byte(strings.Join(versions, ","))),
+		Hash:     hash(content),
+	}
+}
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// consistencyEndpoint defines an endpoint that displays the consistency of the server with the other servers
+func consistencyEndpoint(checker *consistency.Checker) client_server.ServerEndpoint {
+	return client_server.ServerEndpoint{
+		NeedsAuth: false,
+		HandlerFunc: func(request request) network.Response[any] {
+			return network.CreateResponse(true, checker.GetStatus())
+		},
+	}
+}
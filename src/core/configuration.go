@@ -27,3 +27,25 @@ func ReadConfig[T any](path string, config T) T {
 	}
 	return config
 }
+
+// UpdateConfig replaces the given keys of a JSON configuration file, the other keys are kept
+func UpdateConfig(path string, values map[string]any) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(content, &fields); err != nil {
+		return err
+	}
+	for key, value := range values {
+		if fields[key], err = json.Marshal(value); err != nil {
+			return err
+		}
+	}
+	content, err = json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(content, '\n'), 0644)
+}
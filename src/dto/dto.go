@@ -22,6 +22,7 @@ type Event struct {
 	Jobs         []types.Job   `json:"jobs"`
 	Organizer    types.User    `json:"organizer"`
 	Participants []Participant `json:"participants"`
+	Version      int           `json:"version"`
 }
 
 // ToRow gets a representation of an event to a table-printable format
@@ -59,7 +60,109 @@ type EventCreate struct {
 }
 
 // EventShow defines required data for a show request
+//   - Linearizable: the events are read in order with the writes of the cluster instead of the local copy
 type EventShow struct {
-	EventId int  `json:"eventId"`
-	Resume  bool `json:"resume"`
+	EventId      int  `json:"eventId"`
+	Resume       bool `json:"resume"`
+	Linearizable bool `json:"linearizable"`
+}
+
+// OperationType defines the type of modification of an event
+type OperationType string
+
+const (
+	EventCreated        OperationType = "created"
+	EventClosed         OperationType = "closed"
+	RegistrationChanged OperationType = "registered"
+	EventState          OperationType = "state" // Full state of an event, sent when the operations may have been missed
+)
+
+// Operation is a modification of an event replicated to the other servers
+//   - Sequence: the version of the event once the operation is applied, the operations of an event are applied in order
+//   - Event: the event created, or the full state of the event
+//   - UserId, JobId: the registration changed
+type Operation struct {
+	Type     OperationType `json:"type"`
+	EventId  int           `json:"eventId"`
+	Sequence int           `json:"sequence"`
+	Event    *Event        `json:"event,omitempty"`
+	UserId   int           `json:"userId,omitempty"`
+	JobId    int           `json:"jobId,omitempty"`
+}
+
+// CommandType defines the type of modification asked by a client
+type CommandType string
+
+const (
+	CreateCommand   CommandType = "create"
+	CloseCommand    CommandType = "close"
+	RegisterCommand CommandType = "register"
+	ShowCommand     CommandType = "show" // Linearizable read, ordered with the modifications without modifying the events
+)
+
+// Command is a modification of the events asked by a client, executed by every server in the same order in raft mode
+type Command struct {
+	Type    CommandType  `json:"type"`
+	UserId  int          `json:"userId"`
+	EventId int          `json:"eventId,omitempty"`
+	JobId   int          `json:"jobId,omitempty"`
+	Create  *EventCreate `json:"create,omitempty"`
+}
+
+// SnapshotState is the state of a server recorded in a global snapshot
+//   - Pending: the replicated operations received before a previous operation of their event, not applied yet
+type SnapshotState struct {
+	Events  []Event     `json:"events"`
+	Pending []Operation `json:"pending,omitempty"`
+}
+
+// SnapshotResult is the summary of a global snapshot written by the server
+type SnapshotResult struct {
+	Id      string `json:"id"`
+	Path    string `json:"path"`
+	Servers []int  `json:"servers"`
+	Missing []int  `json:"missing"`
+}
+
+// ServerJoin asks to add a server to the cluster, it gets the next id
+type ServerJoin struct {
+	Client string `json:"client"`
+	Server string `json:"server"`
+}
+
+// ServerLeave asks to remove a server from the cluster
+type ServerLeave struct {
+	ServerId int `json:"serverId"`
+}
+
+// Member is a server of the cluster, the servers that left it keep their id
+type Member struct {
+	Id      int    `json:"id"`
+	Client  string `json:"client"`
+	Server  string `json:"server"`
+	Removed bool   `json:"removed"`
+}
+
+// Membership is the servers of the cluster after a join or a leave
+//   - ServerId: the server added or removed
+//   - Version: number of changes of the servers since the first configuration
+type Membership struct {
+	ServerId int      `json:"serverId"`
+	Version  int      `json:"version"`
+	Servers  []Member `json:"servers"`
+}
+
+// ServerState is the state of a server in the view of the failure detector, given to the clients to choose a server
+//   - State: "alive", "suspect" or "dead"
+type ServerState struct {
+	Id     int    `json:"id"`
+	Client string `json:"client"`
+	State  string `json:"state"`
+}
+
+// ServerStats is the number of messages sent by a server to the other servers since its start
+//   - Messages: the messages sent on each channel between the servers, like "mutual-exclusion" or "raft"
+type ServerStats struct {
+	Id       int              `json:"id"`
+	Messages map[string]int64 `json:"messages"`
 }
@@ -0,0 +1,30 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package server
+
+import (
+	"os"
+	"sdr/labo1/src/config"
+	"sdr/labo1/src/network/election"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+)
+
+const electionChannel = "election"
+
+// createElection creates the leader election algorithm defined in the configuration
+func createElection(serverConfiguration *config.ServerConfiguration, mux *server_server.Mux) election.Election {
+	p := server_server.OpenChannel[election.Message](mux, electionChannel)
+	switch serverConfiguration.Election {
+	case "", config.Bully:
+		b := election.InitBully(p)
+		return &b
+	case config.ChangRoberts:
+		cr := election.InitChangRoberts(p)
+		return &cr
+	}
+	utils.LogError(true, "Unknown election algorithm:", serverConfiguration.Election)
+	os.Exit(1)
+	return nil
+}
@@ -0,0 +1,290 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package linearizability
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"math"
+	"sdr/labo1/src/dto"
+	"sdr/labo1/src/types"
+	"sort"
+	"time"
+)
+
+// Result of the check of a history
+//   - Counterexample: if the history is not linearizable, a minimal set of requests whose responses cannot be given
+//     by any sequential execution, sorted by invocation. Each request of the set is needed: without it, the others
+//     are linearizable.
+type Result struct {
+	Linearizable   bool
+	Operations     int
+	Counterexample []Operation
+}
+
+// Check checks that a history is linearizable from the events known before the first request.
+// A history is linearizable if the history of each event is linearizable (locality), the events are therefore checked
+// one by one, after the creations which give the ids of the events. The search tries the requests in an order
+// respecting their real time order: a request can take effect once every request returned before its invocation has
+// taken effect. The states already explored are not visited again.
+func Check(initial []dto.Event, history []Operation) Result {
+	result := Result{Operations: len(history), Linearizable: true}
+	for _, p := range partition(initial, history) {
+		optional := make([]bool, len(p.history))
+		for i, op := range p.history {
+			optional[i] = op.Pending
+		}
+		if !linearizable(p.initial, p.history, optional) {
+			result.Linearizable = false
+			result.Counterexample = minimize(p.initial, p.history, optional)
+			return result
+		}
+	}
+	return result
+}
+
+// part is the history of an event, or of the creations of events, with the model before its first request
+type part struct {
+	initial model
+	history []Operation
+}
+
+// partition splits a history in the creations of the events and in the history of each event.
+// The history of an event has the requests on the event and its creation: the creation gets the id of the event and
+// the requests before it do not find the event. A creation without response may have created any event.
+// A show of every event is seen by each event as the show of this event only.
+func partition(initial []dto.Event, history []Operation) []part {
+	var creations part
+	known := make(map[int]*types.Event)
+	ids := make(map[int]bool)
+	for _, event := range initial {
+		known[event.Id] = toModel(event)
+		ids[event.Id] = true
+		if event.Id > creations.initial.lastId {
+			creations.initial.lastId = event.Id
+		}
+	}
+	created := make(map[int]bool)
+	for _, op := range history {
+		if op.EventId != -1 {
+			ids[op.EventId] = true
+		}
+		for _, event := range op.Events {
+			ids[event.Id] = true
+		}
+		if op.Type == dto.CreateCommand {
+			creations.history = append(creations.history, op)
+			if op.Success {
+				created[op.Events[0].Id] = true
+			}
+		}
+	}
+	sorted := make([]int, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Ints(sorted)
+
+	parts := []part{creations}
+	for _, id := range sorted {
+		p := part{initial: model{lastId: id - 1}}
+		if event, ok := known[id]; ok {
+			p.initial = model{lastId: id, events: []*types.Event{event}}
+		}
+		for _, op := range history {
+			switch {
+			case op.Type == dto.CreateCommand:
+				if op.Success && op.Events[0].Id == id || op.Pending && !created[id] && known[id] == nil {
+					p.history = append(p.history, op)
+				}
+			case op.Type == dto.ShowCommand && op.EventId == -1:
+				projected := op
+				projected.Events = nil
+				for _, event := range op.Events {
+					if event.Id == id {
+						projected.Events = append(projected.Events, event)
+					}
+				}
+				p.history = append(p.history, projected)
+			case op.EventId == id:
+				p.history = append(p.history, op)
+			}
+		}
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+// minimize finds a minimal counterexample by making the requests optional, by blocks then one by one.
+// An optional request may take effect or not, and its response is ignored: if the history is still not linearizable,
+// the request is not needed in the counterexample. A linearization of the history is still a linearization once a
+// request is optional, the counterexample is therefore a real violation.
+func minimize(initial model, history []Operation, optional []bool) []Operation {
+	var mandatory []int
+	for i := range history {
+		if !optional[i] {
+			mandatory = append(mandatory, i)
+		}
+	}
+	for size := len(mandatory) / 2; size >= 1; size /= 2 {
+		for start := 0; start < len(mandatory); {
+			end := start + size
+			if end > len(mandatory) {
+				end = len(mandatory)
+			}
+			for _, i := range mandatory[start:end] {
+				optional[i] = true
+			}
+			if linearizable(initial, history, optional) {
+				for _, i := range mandatory[start:end] {
+					optional[i] = false
+				}
+				start = end
+				continue
+			}
+			mandatory = append(mandatory[:start], mandatory[end:]...)
+		}
+	}
+
+	counterexample := make([]Operation, 0, len(mandatory))
+	for _, i := range mandatory {
+		counterexample = append(counterexample, history[i])
+	}
+	return counterexample
+}
+
+// search explores the linearizations of a history
+//   - resolved: the requests that took effect or that are skipped, only the optional requests can be skipped
+//   - failed: the hashes of the states (resolved requests and model) from which no linearization exists
+//   - digests: the hashes of each event, the events of a model are never modified
+type search struct {
+	history  []Operation
+	optional []bool
+	resolved []byte
+	failed   map[[2]uint64]bool
+	digests  map[*types.Event][2]uint64
+	seeds    [2]maphash.Seed
+	buffer   []byte
+}
+
+// linearizable checks if a history is linearizable, the optional requests may take effect or not
+func linearizable(initial model, history []Operation, optional []bool) bool {
+	s := &search{
+		history:  history,
+		optional: optional,
+		resolved: make([]byte, (len(history)+7)/8),
+		failed:   make(map[[2]uint64]bool),
+		digests:  make(map[*types.Event][2]uint64),
+	}
+	for i := range s.seeds {
+		s.seeds[i] = maphash.MakeSeed()
+	}
+	remaining := 0
+	for i := range history {
+		if !optional[i] {
+			remaining++
+		}
+	}
+	return s.explore(initial, 0, remaining)
+}
+
+func (s *search) isResolved(i int) bool {
+	return s.resolved[i/8]&(1<<(i%8)) != 0
+}
+
+func (s *search) setResolved(i int, resolved bool) {
+	if resolved {
+		s.resolved[i/8] |= 1 << (i % 8)
+	} else {
+		s.resolved[i/8] &^= 1 << (i % 8)
+	}
+}
+
+// state gets the hash of the resolved requests and of the model, two hashes make a collision unlikely
+func (s *search) state(m model) (state [2]uint64) {
+	for i := range s.seeds {
+		s.buffer = append(s.buffer[:0], s.resolved...)
+		s.buffer = binary.LittleEndian.AppendUint64(s.buffer, uint64(m.lastId))
+		for _, event := range m.events {
+			s.buffer = binary.LittleEndian.AppendUint64(s.buffer, s.digest(event)[i])
+		}
+		state[i] = maphash.Bytes(s.seeds[i], s.buffer)
+	}
+	return
+}
+
+// digest gets the hashes of an event
+func (s *search) digest(event *types.Event) [2]uint64 {
+	digest, ok := s.digests[event]
+	if !ok {
+		k := key(event)
+		for i := range s.seeds {
+			digest[i] = maphash.String(s.seeds[i], k)
+		}
+		s.digests[event] = digest
+	}
+	return digest
+}
+
+// explore tries each request that can take effect next, the history is sorted by invocation and the requests before
+// first are resolved
+func (s *search) explore(m model, first int, remaining int) bool {
+	if remaining == 0 {
+		return true
+	}
+	for s.isResolved(first) {
+		first++
+	}
+	// A request can take effect next if no mandatory request waiting returned before its invocation
+	deadline := time.Duration(math.MaxInt64)
+	for i := first; i < len(s.history) && s.history[i].Invoke <= deadline; i++ {
+		if !s.isResolved(i) && !s.optional[i] && s.history[i].Return < deadline {
+			deadline = s.history[i].Return
+		}
+	}
+	for i := first; i < len(s.history) && s.history[i].Invoke <= deadline; i++ {
+		op := s.history[i]
+		if s.isResolved(i) {
+			continue
+		}
+		next, response := m.apply(op)
+		if !s.optional[i] && !response.matches(op) {
+			continue
+		}
+		unchanged := next.lastId == m.lastId && len(next.events) == len(m.events) &&
+			(len(m.events) == 0 || &next.events[0] == &m.events[0])
+
+		// The optional requests returned before this one are skipped
+		resolved := []int{i}
+		for j := first; j < len(s.history) && s.history[j].Invoke < op.Invoke; j++ {
+			skipped := s.history[j]
+			if s.optional[j] && !skipped.Pending && !s.isResolved(j) && skipped.Return < op.Invoke {
+				resolved = append(resolved, j)
+			}
+		}
+		for _, j := range resolved {
+			s.setResolved(j, true)
+		}
+		state := s.state(next)
+		left := remaining
+		if !s.optional[i] {
+			left--
+		}
+		found := !s.failed[state] && s.explore(next, first, left)
+		if !found {
+			s.failed[state] = true
+		}
+		for _, j := range resolved {
+			s.setResolved(j, false)
+		}
+		if found {
+			return true
+		}
+		// A request not modifying the events can take effect before the others, the other orders fail too
+		if unchanged && !s.optional[i] && len(resolved) == 1 {
+			return false
+		}
+	}
+	return false
+}
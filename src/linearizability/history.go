@@ -0,0 +1,206 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package linearizability
+// This package records the requests of concurrent clients and checks that the history is linearizable: the results
+// of the requests must be those of a sequential execution on a single copy of the events, where each request takes
+// effect between its invocation and its return.
+package linearizability
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sdr/labo1/src/dto"
+	"sdr/labo1/src/network"
+	"sdr/labo1/src/network/client_server"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unknownOutcome is in the errors of the servers that do not know if a request took effect, after a timeout of Raft
+// or of the total order broadcast
+const unknownOutcome = "may not have been applied"
+
+// Operation is a request of a client and its result
+//   - Client: the client that sent the request, its requests are sequential
+//   - Type: the endpoint called, "create", "close", "register" or "show"
+//   - UserId: the user authenticated for the request
+//   - EventId, JobId, Create: the data of the request, the event -1 shows every event
+//   - Invoke, Return: the times of the request and of its response since the start of the recording
+//   - Pending: no response was received (connection lost) or the server does not know if the request took effect
+//     (timeout), the request may have taken effect or not
+//   - Success, Error, Events: the response, the events returned on success
+type Operation struct {
+	Client  int              `json:"client"`
+	Type    dto.CommandType  `json:"type"`
+	UserId  int              `json:"userId"`
+	EventId int              `json:"eventId"`
+	JobId   int              `json:"jobId,omitempty"`
+	Create  *dto.EventCreate `json:"create,omitempty"`
+	Invoke  time.Duration    `json:"invoke"`
+	Return  time.Duration    `json:"return"`
+	Pending bool             `json:"pending,omitempty"`
+	Success bool             `json:"success"`
+	Error   string           `json:"error,omitempty"`
+	Events  []dto.Event      `json:"events,omitempty"`
+}
+
+func (op Operation) String() string {
+	var call string
+	switch op.Type {
+	case dto.CreateCommand:
+		var capacities []int
+		for _, job := range op.Create.Jobs {
+			capacities = append(capacities, job.Capacity)
+		}
+		call = fmt.Sprintf("create(%q, capacities %v)", op.Create.Name, capacities)
+	case dto.RegisterCommand:
+		call = fmt.Sprintf("register(event %d, job %d)", op.EventId, op.JobId)
+	default:
+		call = fmt.Sprintf("%s(event %d)", op.Type, op.EventId)
+	}
+	var result string
+	switch {
+	case op.Pending && op.Error != "":
+		result = "unknown: " + op.Error
+	case op.Pending:
+		result = "no response"
+	case !op.Success:
+		result = "error: " + op.Error
+	default:
+		result = "ok"
+		for _, event := range op.Events {
+			result += " " + describe(event)
+		}
+	}
+	return fmt.Sprintf("client %d user %d: %s -> %s", op.Client, op.UserId, call, result)
+}
+
+// describe summarizes an event returned to a client
+func describe(event dto.Event) string {
+	state := "open"
+	if !event.Open {
+		state = "closed"
+	}
+	var jobs []string
+	for _, job := range event.Jobs {
+		jobs = append(jobs, fmt.Sprintf("%d:%d/%d", job.Id, job.Count, job.Capacity))
+	}
+	return fmt.Sprintf("[event %d %s jobs %v]", event.Id, state, jobs)
+}
+
+// Recorder records the requests of concurrent clients, the mutex protects the history
+type Recorder struct {
+	start   time.Time
+	history []Operation
+	mutex   sync.Mutex
+}
+
+// CreateRecorder Constructor, the times of the requests are measured from now
+func CreateRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+// Create creates an event
+func (r *Recorder) Create(clientId int, client *client_server.ClientProtocol, create dto.EventCreate) Operation {
+	return r.record(clientId, client, Operation{Type: dto.CreateCommand, EventId: -1, Create: &create}, create)
+}
+
+// Close closes an event
+func (r *Recorder) Close(clientId int, client *client_server.ClientProtocol, eventId int) Operation {
+	return r.record(clientId, client, Operation{Type: dto.CloseCommand, EventId: eventId}, dto.EventClose{EventId: eventId})
+}
+
+// Register registers the user of the client to a job
+func (r *Recorder) Register(clientId int, client *client_server.ClientProtocol, eventId int, jobId int) Operation {
+	return r.record(clientId, client, Operation{Type: dto.RegisterCommand, EventId: eventId, JobId: jobId},
+		dto.EventRegister{EventId: eventId, JobId: jobId})
+}
+
+// Show reads an event, or every event if the id is -1. Only the linearizable reads are expected to pass the check,
+// the default reads return the local copy of the server.
+func (r *Recorder) Show(clientId int, client *client_server.ClientProtocol, eventId int, linearizable bool) Operation {
+	return r.record(clientId, client, Operation{Type: dto.ShowCommand, EventId: eventId},
+		dto.EventShow{EventId: eventId, Linearizable: linearizable})
+}
+
+// record sends a request and adds it to the history with its result
+func (r *Recorder) record(clientId int, client *client_server.ClientProtocol, op Operation, request any) Operation {
+	op.Client = clientId
+	op.Invoke = time.Since(r.start)
+	response, err := client.SendRequest(string(op.Type), func(auth client_server.AuthId) any {
+		op.UserId = auth
+		return request
+	})
+	op.Return = time.Since(r.start)
+	if err != nil {
+		op.Pending = true
+	} else {
+		op.parse(response)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.history = append(r.history, op)
+	return op
+}
+
+// parse reads the response of a request, a show of every event returns a list
+func (op *Operation) parse(response string) {
+	var result network.Response[json.RawMessage]
+	if err := json.Unmarshal([]byte(response), &result); err != nil {
+		op.Pending = true
+		return
+	}
+	op.Success, op.Error = result.Success, result.Error
+	if !op.Success {
+		op.Pending = strings.Contains(op.Error, unknownOutcome)
+		return
+	}
+	if op.Type == dto.ShowCommand && op.EventId == -1 {
+		_ = json.Unmarshal(result.Data, &op.Events)
+		return
+	}
+	var event dto.Event
+	_ = json.Unmarshal(result.Data, &event)
+	op.Events = []dto.Event{event}
+}
+
+// Operations gets the requests recorded, sorted by invocation
+func (r *Recorder) Operations() []Operation {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	history := append([]Operation{}, r.history...)
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Invoke < history[j].Invoke })
+	return history
+}
+
+// History is a recorded history and the events known before its first request, it can be written to a file to be
+// checked again
+type History struct {
+	Initial    []dto.Event `json:"initial"`
+	Operations []Operation `json:"operations"`
+}
+
+// Write writes the history to a file
+func (h History) Write(path string) error {
+	content, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+// ReadHistory reads a history written to a file
+func ReadHistory(path string) (History, error) {
+	var history History
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return history, err
+	}
+	err = json.Unmarshal(content, &history)
+	return history, err
+}
@@ -0,0 +1,192 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package linearizability
+
+import (
+	"fmt"
+	"sdr/labo1/src/dto"
+	"sdr/labo1/src/types"
+	"sort"
+	"strings"
+)
+
+// model is the sequential specification of the events, a single copy modified by one request at a time.
+// The events are never modified once in a model, a request creates a new model.
+//   - lastId: the id of the last event created, the next event gets the following id
+type model struct {
+	lastId int
+	events []*types.Event
+}
+
+// toModel converts an event known before the first request
+func toModel(event dto.Event) *types.Event {
+	e := &types.Event{
+		Id:           event.Id,
+		Name:         event.Name,
+		Open:         event.Open,
+		OrganizerId:  event.Organizer.Id,
+		Jobs:         make(map[int]*types.Job),
+		Participants: make(map[int]int),
+	}
+	for _, job := range event.Jobs {
+		e.Jobs[job.Id] = &types.Job{Id: job.Id, Name: job.Name, Capacity: job.Capacity, Count: job.Count}
+	}
+	for _, participant := range event.Participants {
+		e.Participants[participant.User.Id] = participant.JobId
+	}
+	return e
+}
+
+// find finds an event by its id
+func (m model) find(eventId int) int {
+	for i, event := range m.events {
+		if event.Id == eventId {
+			return i
+		}
+	}
+	return -1
+}
+
+// with gets a copy of the model where an event is replaced by a copy returned to be modified
+func (m model) with(index int) (model, *types.Event) {
+	next := model{lastId: m.lastId, events: append([]*types.Event{}, m.events...)}
+	event := *m.events[index]
+	event.Jobs = make(map[int]*types.Job, len(event.Jobs))
+	for id, job := range m.events[index].Jobs {
+		copied := *job
+		event.Jobs[id] = &copied
+	}
+	event.Participants = make(map[int]int, len(event.Participants))
+	for userId, jobId := range m.events[index].Participants {
+		event.Participants[userId] = jobId
+	}
+	next.events[index] = &event
+	return next, &event
+}
+
+// result is the response the model gives to a request
+type result struct {
+	success bool
+	err     string
+	events  []*types.Event
+}
+
+// apply executes a request on the model like the server, it gets the next model and the expected response.
+// The model is returned unchanged if the request does not modify the events.
+func (m model) apply(op Operation) (model, result) {
+	switch op.Type {
+	case dto.CreateCommand:
+		if op.Create.Name == "" {
+			return m, result{err: "name is required"}
+		}
+		for _, job := range op.Create.Jobs {
+			if job.Capacity < 1 {
+				return m, result{err: "capacity must be greater than 0"}
+			}
+			if job.Name == "" {
+				return m, result{err: "name is required"}
+			}
+		}
+		event := &types.Event{Id: m.lastId + 1, Name: op.Create.Name, Open: true, OrganizerId: op.UserId,
+			Jobs: make(map[int]*types.Job), Participants: make(map[int]int)}
+		for i, job := range op.Create.Jobs {
+			event.Jobs[i+1] = &types.Job{Id: i + 1, Name: job.Name, Capacity: job.Capacity}
+		}
+		next := model{lastId: event.Id, events: append(append([]*types.Event{}, m.events...), event)}
+		return next, result{success: true, events: []*types.Event{event}}
+	case dto.ShowCommand:
+		if op.EventId == -1 {
+			return m, result{success: true, events: m.events}
+		}
+	}
+
+	index := m.find(op.EventId)
+	if index == -1 {
+		return m, result{err: "event not found"}
+	}
+	switch op.Type {
+	case dto.CloseCommand:
+		if m.events[index].OrganizerId != op.UserId {
+			return m, result{err: "you are not the organizer"}
+		}
+		if !m.events[index].Open {
+			return m, result{err: "event already closed"}
+		}
+		next, event := m.with(index)
+		event.Open = false
+		return next, result{success: true, events: []*types.Event{event}}
+	case dto.RegisterCommand:
+		next, event := m.with(index)
+		if err := event.Register(op.UserId, op.JobId); err != nil {
+			return m, result{err: err.Error()}
+		}
+		return next, result{success: true, events: []*types.Event{event}}
+	default:
+		return m, result{success: true, events: []*types.Event{m.events[index]}}
+	}
+}
+
+// matches checks if the response received by the client is the response of the model
+func (r result) matches(op Operation) bool {
+	if op.Success != r.success {
+		return false
+	}
+	if !r.success {
+		return op.Error == r.err
+	}
+	if len(op.Events) != len(r.events) {
+		return false
+	}
+	for i, event := range r.events {
+		if !equal(event, op.Events[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// equal compares an event of the model with an event returned to a client, the names of the users are ignored
+func equal(event *types.Event, received dto.Event) bool {
+	if event.Id != received.Id || event.Name != received.Name || event.Open != received.Open ||
+		event.OrganizerId != received.Organizer.Id || len(event.Jobs) != len(received.Jobs) ||
+		len(event.Participants) != len(received.Participants) {
+		return false
+	}
+	for _, job := range received.Jobs {
+		expected, ok := event.Jobs[job.Id]
+		if !ok || expected.Capacity != job.Capacity || expected.Count != job.Count {
+			return false
+		}
+	}
+	for _, participant := range received.Participants {
+		if jobId, ok := event.Participants[participant.User.Id]; !ok || jobId != participant.JobId {
+			return false
+		}
+	}
+	return true
+}
+
+// key gets a representation of an event, two models with the same events and the same last id give the same responses
+func key(event *types.Event) string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%d:%q:%t:%d:", event.Id, event.Name, event.Open, event.OrganizerId)
+	jobIds := make([]int, 0, len(event.Jobs))
+	for id := range event.Jobs {
+		jobIds = append(jobIds, id)
+	}
+	sort.Ints(jobIds)
+	for _, id := range jobIds {
+		fmt.Fprintf(&builder, "%d/%d/%d,", id, event.Jobs[id].Count, event.Jobs[id].Capacity)
+	}
+	userIds := make([]int, 0, len(event.Participants))
+	for userId := range event.Participants {
+		userIds = append(userIds, userId)
+	}
+	sort.Ints(userIds)
+	for _, userId := range userIds {
+		fmt.Fprintf(&builder, "%d>%d,", userId, event.Participants[userId])
+	}
+	builder.WriteString(";")
+	return builder.String()
+}
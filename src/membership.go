@@ -0,0 +1,348 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sdr/labo1/src/config"
+	"sdr/labo1/src/core"
+	"sdr/labo1/src/dto"
+	"sdr/labo1/src/network"
+	"sdr/labo1/src/network/client_server"
+	"sdr/labo1/src/network/election"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"sync"
+	"time"
+)
+
+const (
+	membershipChannel = "membership"
+	membershipTimeout = 5 * time.Second // Delay to wait for the coordinator to apply a change of the servers
+)
+
+type membershipType int
+
+const (
+	membershipRequest membershipType = 0 // Join or leave asked to the coordinator
+	membershipChange  membershipType = 1 // Servers of the cluster after a change, sent by the coordinator to every server
+	membershipResult  membershipType = 2 // Answer of the coordinator to the server that asked for the change
+)
+
+// membershipMessage
+//   - Join, Leave: the change asked, Leave is the id of the server removed
+//   - Version, Servers: the servers of the cluster after the change
+//   - Error: the reason why the coordinator refused the change
+type membershipMessage struct {
+	Type      membershipType     `json:"type"`
+	Sender    int                `json:"sender"`
+	RequestId string             `json:"requestId"`
+	Join      *dto.ServerJoin    `json:"join,omitempty"`
+	Leave     *int               `json:"leave,omitempty"`
+	ServerId  int                `json:"serverId"`
+	Version   int                `json:"version"`
+	Servers   []config.ServerUrl `json:"servers,omitempty"`
+	Error     string             `json:"error,omitempty"`
+}
+
+// membership
+// adds and removes servers at runtime. The changes are asked to the elected coordinator, which orders them with a
+// version number and sends the new list of servers to every server. Each server updates its connections and writes
+// the list to its configuration file. A server reconnected after missing a change gets the list on reconnection.
+// The servers are copied from the configuration, the configuration is not modified: it is read by the other goroutines.
+//   - servers, version: the servers of the cluster and the number of changes, protected by the mutex
+type membership struct {
+	protocol    server_server.Protocol[membershipMessage]
+	transport   *server_server.InterServerProtocol[server_server.MuxMessage]
+	config      *config.ServerConfiguration
+	servers     []config.ServerUrl
+	version     int
+	coordinator election.Election
+	requests    map[string]chan membershipMessage // Changes asked by the server, waiting for the answer of the coordinator
+	changes     sync.Mutex                        // Held by the coordinator while a change is applied, the versions are ordered
+	mutex       sync.Mutex
+}
+
+// startMembership starts applying the changes of the servers of the cluster
+func startMembership(serverConfiguration *config.ServerConfiguration, transport *server_server.InterServerProtocol[server_server.MuxMessage], mux *server_server.Mux, coordinator election.Election) *membership {
+	m := &membership{
+		protocol:    server_server.OpenChannel[membershipMessage](mux, membershipChannel),
+		transport:   transport,
+		config:      serverConfiguration,
+		servers:     append([]config.ServerUrl{}, serverConfiguration.Servers...),
+		version:     serverConfiguration.MembershipVersion,
+		coordinator: coordinator,
+		requests:    make(map[string]chan membershipMessage),
+	}
+	go m.start()
+	return m
+}
+
+// current gets the servers of the cluster, the mutex must be held
+func (m *membership) current() membershipMessage {
+	return membershipMessage{
+		Type:    membershipChange,
+		Sender:  m.protocol.GetServerId(),
+		Version: m.version,
+		Servers: append([]config.ServerUrl{}, m.servers...),
+	}
+}
+
+// ask sends a change to the coordinator and waits until it is applied
+func (m *membership) ask(request membershipMessage) (dto.Membership, error) {
+	leader := m.coordinator.GetLeader()
+	if leader == -1 {
+		return dto.Membership{}, errors.New("no coordinator elected, retry later")
+	}
+	request.Type = membershipRequest
+	request.Sender = m.protocol.GetServerId()
+	request.RequestId = fmt.Sprintf("%d-%d", request.Sender, time.Now().UnixNano())
+	result := make(chan membershipMessage, 1)
+	m.mutex.Lock()
+	m.requests[request.RequestId] = result
+	m.mutex.Unlock()
+	defer func() {
+		m.mutex.Lock()
+		delete(m.requests, request.RequestId)
+		m.mutex.Unlock()
+	}()
+
+	if leader == m.protocol.GetServerId() {
+		m.handleRequest(request)
+	} else if err := m.protocol.SendTo(leader, request); err != nil {
+		return dto.Membership{}, fmt.Errorf("coordinator %d unreachable: %s", leader, err.Error())
+	}
+
+	select {
+	case answer := <-result:
+		if answer.Error != "" {
+			return dto.Membership{}, errors.New(answer.Error)
+		}
+		return toMembership(answer), nil
+	case <-time.After(membershipTimeout):
+		return dto.Membership{}, errors.New("the coordinator did not answer in time")
+	}
+}
+
+// validate checks if a change can be applied to the servers, the mutex must be held
+func (m *membership) validate(request membershipMessage) error {
+	switch {
+	case m.config.Backend == config.RaftBackend:
+		return errors.New("the servers cannot be changed with the raft backend, its majority is fixed")
+	case (m.config.Backend == "" || m.config.Backend == config.MutualExclusionBackend) && m.config.MutualExclusion == config.Raymond:
+		return errors.New("the servers cannot be changed with Raymond's algorithm, its spanning tree is fixed")
+	case (m.config.Backend == "" || m.config.Backend == config.MutualExclusionBackend) && m.config.MutualExclusion == config.Maekawa:
+		return errors.New("the servers cannot be changed with Maekawa's algorithm, its voting sets are fixed")
+	}
+
+	if request.Join != nil {
+		if request.Join.Client == "" || request.Join.Server == "" {
+			return errors.New("the client and server addresses are required")
+		}
+		for id, server := range m.servers {
+			if !server.Removed && (server.Client == request.Join.Client || server.Server == request.Join.Server) {
+				return fmt.Errorf("address already used by server %d", id)
+			}
+		}
+		return nil
+	}
+
+	if request.Leave == nil {
+		return errors.New("invalid membership request")
+	}
+	id := *request.Leave
+	if id < 0 || id >= len(m.servers) || m.servers[id].Removed {
+		return fmt.Errorf("server %d is not part of the cluster", id)
+	}
+	if m.config.Coordinator != nil && *m.config.Coordinator == id {
+		return fmt.Errorf("server %d is the configured coordinator", id)
+	}
+	members := 0
+	for _, server := range m.servers {
+		if !server.Removed {
+			members++
+		}
+	}
+	if members == 1 {
+		return errors.New("the last server cannot leave the cluster")
+	}
+	return nil
+}
+
+// handleRequest applies a change asked to the coordinator and sends the new servers to every server
+func (m *membership) handleRequest(request membershipMessage) {
+	m.changes.Lock()
+	defer m.changes.Unlock()
+	m.mutex.Lock()
+	answer := membershipMessage{Type: membershipResult, Sender: m.protocol.GetServerId(), RequestId: request.RequestId}
+	if leader := m.coordinator.GetLeader(); leader != m.protocol.GetServerId() {
+		answer.Error = fmt.Sprintf("server %d is not the coordinator", m.protocol.GetServerId())
+	} else if err := m.validate(request); err != nil {
+		answer.Error = err.Error()
+	}
+
+	var change membershipMessage
+	if answer.Error == "" {
+		change = m.current()
+		change.Version++
+		if request.Join != nil {
+			change.ServerId = len(change.Servers)
+			change.Servers = append(change.Servers, config.ServerUrl{Client: request.Join.Client, Server: request.Join.Server})
+		} else {
+			change.ServerId = *request.Leave
+			change.Servers[change.ServerId].Removed = true
+		}
+		answer.ServerId, answer.Version, answer.Servers = change.ServerId, change.Version, change.Servers
+	}
+	m.mutex.Unlock()
+
+	if answer.Error != "" {
+		utils.LogWarning(false, "membership", "change refused:", answer.Error)
+		m.handleResult(request.Sender, answer)
+		return
+	}
+	// The servers get the change before the coordinator closes the connection of a removed server
+	_ = m.protocol.SendToAll(change)
+	m.handleResult(request.Sender, answer)
+	m.apply(change)
+}
+
+// handleResult gives the answer of the coordinator to the change waiting for it
+func (m *membership) handleResult(receiver int, answer membershipMessage) {
+	if receiver != m.protocol.GetServerId() {
+		_ = m.protocol.SendTo(receiver, answer)
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if result, ok := m.requests[answer.RequestId]; ok {
+		result <- answer
+	}
+}
+
+// apply updates the connections and the configuration with the servers of a change newer than the local ones
+func (m *membership) apply(change membershipMessage) {
+	m.mutex.Lock()
+	if change.Version <= m.version {
+		m.mutex.Unlock()
+		return
+	}
+	previous := m.servers
+	m.servers = change.Servers
+	m.version = change.Version
+	m.mutex.Unlock()
+
+	removed := false
+	for id, server := range change.Servers {
+		known := id < len(previous)
+		switch {
+		case server.Removed && (!known || !previous[id].Removed):
+			if id == m.config.Id {
+				removed = true
+			} else {
+				m.transport.RemoveServer(id)
+			}
+		case !server.Removed && !known:
+			m.transport.AddServer(id, server.GetDialAddress())
+		}
+	}
+	utils.LogSuccess(true, "membership", "version", change.Version, "applied")
+
+	if m.config.Path != "" {
+		err := core.UpdateConfig(m.config.Path, map[string]any{"servers": change.Servers, "membershipVersion": change.Version})
+		if err != nil {
+			utils.LogError(false, "membership", "unable to write the configuration:", err.Error())
+		}
+	}
+	if removed {
+		utils.LogWarning(true, "membership", "the server left the cluster")
+		go StopServer(m.config.Id)
+	}
+}
+
+// getServers gets the servers of the cluster, the servers that left it included
+func (m *membership) getServers() []config.ServerUrl {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]config.ServerUrl{}, m.servers...)
+}
+
+func toMembership(message membershipMessage) dto.Membership {
+	result := dto.Membership{ServerId: message.ServerId, Version: message.Version, Servers: []dto.Member{}}
+	for id, server := range message.Servers {
+		result.Servers = append(result.Servers, dto.Member{Id: id, Client: server.Client, Server: server.Server, Removed: server.Removed})
+	}
+	return result
+}
+
+func (m *membership) start() {
+	for {
+		select {
+		case message := <-m.protocol.GetMessageChan():
+			switch message.Type {
+			case membershipRequest:
+				go m.handleRequest(message)
+			case membershipChange:
+				m.apply(message)
+			case membershipResult:
+				m.handleResult(m.protocol.GetServerId(), message)
+			}
+		case event := <-m.protocol.GetPeerChan():
+			// A server reconnected may have missed some changes
+			m.mutex.Lock()
+			current := m.current()
+			m.mutex.Unlock()
+			if event.Alive && current.Version > 0 {
+				_ = m.protocol.SendTo(event.ServerId, current)
+			}
+		}
+	}
+}
+
+// isAdmin checks if a user can change the servers of the cluster, the users are not modified once the server started
+func isAdmin(appData *Data, userId int) bool {
+	user, ok := appData.users[userId]
+	return ok && user.Admin
+}
+
+// joinEndpoint defines an endpoint that adds a server to the cluster, the server must be started afterwards.
+// Only the administrators can use it.
+func joinEndpoint(m *membership, appData *Data) client_server.ServerEndpoint {
+	return client_server.ServerEndpoint{
+		NeedsAuth: true,
+		HandlerFunc: func(request request) network.Response[any] {
+			if !isAdmin(appData, request.Header.AuthId) {
+				return network.CreateResponse(false, "only an administrator can change the servers of the cluster")
+			}
+			data := dto.ServerJoin{}
+			request.GetJson(&data)
+			result, err := m.ask(membershipMessage{Join: &data})
+			if err != nil {
+				return network.CreateResponse(false, err.Error())
+			}
+			return network.CreateResponse(true, result)
+		},
+	}
+}
+
+// leaveEndpoint defines an endpoint that removes a server from the cluster, the removed server stops.
+// Only the administrators can use it.
+func leaveEndpoint(m *membership, appData *Data) client_server.ServerEndpoint {
+	return client_server.ServerEndpoint{
+		NeedsAuth: true,
+		HandlerFunc: func(request request) network.Response[any] {
+			if !isAdmin(appData, request.Header.AuthId) {
+				return network.CreateResponse(false, "only an administrator can change the servers of the cluster")
+			}
+			data := dto.ServerLeave{ServerId: -1}
+			request.GetJson(&data)
+			result, err := m.ask(membershipMessage{Leave: &data.ServerId})
+			if err != nil {
+				return network.CreateResponse(false, err.Error())
+			}
+			return network.CreateResponse(true, result)
+		},
+	}
+}
@@ -0,0 +1,220 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package server
+
+import (
+	"os"
+	"sdr/labo1/src/config"
+	"sdr/labo1/src/dto"
+	"sdr/labo1/src/network"
+	"sdr/labo1/src/network/causal"
+	"sdr/labo1/src/network/centralized"
+	"sdr/labo1/src/network/election"
+	"sdr/labo1/src/network/lamport"
+	"sdr/labo1/src/network/maekawa"
+	"sdr/labo1/src/network/mutual_exclusion"
+	"sdr/labo1/src/network/raymond"
+	"sdr/labo1/src/network/ricart_agrawala"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/network/suzuki_kasami"
+	"sdr/labo1/src/utils"
+	"sync"
+)
+
+type mutualExclusion = mutual_exclusion.MutualExclusion[[]dto.Operation]
+
+const mutualExclusionChannel = "mutual-exclusion"
+
+// mutualExclusionWriter
+// executes the commands in the critical section of the resource they modify,
+// the operations are replicated to the other servers when the critical section is released.
+// The server asks for a single access at a time to each resource, the concurrent asks wait for the lock of the resource.
+type mutualExclusionWriter struct {
+	appData *Data
+	mutex   mutual_exclusion.ResourceMutualExclusion[[]dto.Operation]
+	asking  map[string]*sync.Mutex
+	locks   sync.Mutex // Protects asking
+}
+
+// startMutualExclusion starts the mutual exclusion algorithm and gets the events of the cluster.
+// The coordinator election is used by the centralized mutual exclusion.
+func startMutualExclusion(serverConfiguration *config.ServerConfiguration, mux *server_server.Mux, coordinator election.Election, appData *Data) writer {
+	var mutex mutual_exclusion.ResourceMutualExclusion[[]dto.Operation]
+	mutex = createMutualExclusion(serverConfiguration, mux, coordinator, func(operations []dto.Operation) {
+		appData.mutex.Lock()
+		defer appData.mutex.Unlock()
+		if missing := applyOperations(appData, operations); missing {
+			utils.LogWarning(false, "replication", "operations missing, asking for the full state")
+			go mutex.Synchronize()
+		}
+		utils.LogInfo(false, "Mutual exclusion callback called")
+	}, func() []dto.Operation {
+		appData.mutex.RLock()
+		defer appData.mutex.RUnlock()
+		return stateOperations(appData)
+	})
+
+	appData.mutex.Lock()
+	appData.flush = mutex.Flush
+	appData.mutex.Unlock()
+	go mutex.Start()    // Start listening to the mutual exclusion messages
+	mutex.Synchronize() // Get the events of the cluster, the server may have been restarted after a crash
+	startAntiEntropy(mux, appData)
+	return &mutualExclusionWriter{appData: appData, mutex: mutex, asking: make(map[string]*sync.Mutex)}
+}
+
+func (w *mutualExclusionWriter) write(command dto.Command) network.Response[any] {
+	resource := eventsResource
+	if command.Type != dto.CreateCommand {
+		if !w.knownEvent(command.EventId) {
+			return network.CreateResponse(false, "event not found")
+		}
+		resource = eventResource(command.EventId)
+	}
+
+	var changes []dto.Operation
+	w.ask(resource)
+	defer func() {
+		w.release(resource, changes)
+	}()
+	w.appData.mutex.Lock()
+	defer w.appData.mutex.Unlock()
+	response, operation := executeCommand(w.appData, command)
+	if operation != nil {
+		changes = append(changes, *operation)
+	}
+	return response
+}
+
+// read reads the events in the critical section of the resources they depend on. Every event is read in its critical
+// section, the critical sections are asked in the same order by all the reads and the writes hold a single one:
+// the reads never wait for each other in a cycle.
+func (w *mutualExclusionWriter) read(eventId int) network.Response[any] {
+	resources := []string{eventsResource}
+	if eventId != -1 {
+		if !w.knownEvent(eventId) {
+			return network.CreateResponse(false, "event not found")
+		}
+		resources = []string{eventResource(eventId)}
+	}
+
+	for i := 0; i < len(resources); i++ {
+		w.ask(resources[i])
+		defer w.release(resources[i], nil)
+		if i == 0 && eventId == -1 { // The events created before the read are known once the first resource is held
+			w.appData.mutex.RLock()
+			for _, event := range w.appData.events {
+				resources = append(resources, eventResource(event.Id))
+			}
+			w.appData.mutex.RUnlock()
+		}
+	}
+	return readEvents(w.appData, eventId)
+}
+
+// knownEvent checks if an event exists. An event unknown by the server may have been created on another server and
+// not be replicated yet: the critical section of the events is held once, the events created before are received.
+func (w *mutualExclusionWriter) knownEvent(eventId int) bool {
+	if eventExists(w.appData, eventId) {
+		return true
+	}
+	w.ask(eventsResource)
+	w.release(eventsResource, nil)
+	return eventExists(w.appData, eventId)
+}
+
+// ask gets the critical section of a resource, once the previous access of the server to the resource is released
+func (w *mutualExclusionWriter) ask(resource string) {
+	w.locks.Lock()
+	lock, ok := w.asking[resource]
+	if !ok {
+		lock = &sync.Mutex{}
+		w.asking[resource] = lock
+	}
+	w.locks.Unlock()
+	lock.Lock()
+	<-w.mutex.SendClientAskCriticalSection(resource)
+}
+
+// release leaves the critical section of a resource, nothing is replicated when the resource was not modified
+func (w *mutualExclusionWriter) release(resource string, changes []dto.Operation) {
+	if len(changes) > 0 {
+		w.mutex.SendClientReleaseCriticalSection(resource, changes)
+	} else {
+		w.mutex.SendClientLeaveCriticalSection(resource)
+	}
+	w.locks.Lock()
+	lock := w.asking[resource]
+	w.locks.Unlock()
+	lock.Unlock()
+}
+
+// createMutualExclusion creates the mutual exclusion algorithm defined in the configuration.
+// An instance of the algorithm is used for each resource, the replicated data is given to the apply function.
+// The snapshot function gets the data sent to the servers joining the cluster.
+func createMutualExclusion(serverConfiguration *config.ServerConfiguration, mux *server_server.Mux, coordinator election.Election, apply func(data []dto.Operation), snapshot func() []dto.Operation) mutual_exclusion.ResourceMutualExclusion[[]dto.Operation] {
+	switch serverConfiguration.MutualExclusion {
+	case "", config.Lamport:
+		return createResources(serverConfiguration, mux, apply, snapshot, func(p server_server.Protocol[lamport.Request[[]dto.Operation]]) mutualExclusion {
+			lmpt := lamport.InitLamport[[]dto.Operation](p)
+			return &lmpt
+		})
+	case config.RicartAgrawala:
+		return createResources(serverConfiguration, mux, apply, snapshot, func(p server_server.Protocol[ricart_agrawala.Request[[]dto.Operation]]) mutualExclusion {
+			ra := ricart_agrawala.InitRicartAgrawala[[]dto.Operation](p)
+			return &ra
+		})
+	case config.SuzukiKasami:
+		return createResources(serverConfiguration, mux, apply, snapshot, func(p server_server.Protocol[suzuki_kasami.Request[[]dto.Operation]]) mutualExclusion {
+			sk := suzuki_kasami.InitSuzukiKasami[[]dto.Operation](p)
+			return &sk
+		})
+	case config.Raymond:
+		parents, err := serverConfiguration.GetParents()
+		if err != nil {
+			utils.LogError(true, "Invalid spanning tree:", err.Error())
+			os.Exit(1)
+		}
+		return createResources(serverConfiguration, mux, apply, snapshot, func(p server_server.Protocol[raymond.Request[[]dto.Operation]]) mutualExclusion {
+			r := raymond.InitRaymond[[]dto.Operation](p, parents)
+			return &r
+		})
+	case config.Maekawa:
+		quorums, err := serverConfiguration.GetQuorums()
+		if err != nil {
+			utils.LogError(true, "Invalid voting sets:", err.Error())
+			os.Exit(1)
+		}
+		return createResources(serverConfiguration, mux, apply, snapshot, func(p server_server.Protocol[maekawa.Request[[]dto.Operation]]) mutualExclusion {
+			m := maekawa.InitMaekawa[[]dto.Operation](p, quorums[serverConfiguration.Id])
+			return &m
+		})
+	case config.Centralized:
+		getCoordinator := coordinator.GetLeader
+		if configured := serverConfiguration.Coordinator; configured != nil {
+			if *configured < 0 || *configured >= len(serverConfiguration.Servers) {
+				utils.LogError(true, "Invalid coordinator:", *configured)
+				os.Exit(1)
+			}
+			getCoordinator = func() int { return *configured }
+		}
+		return createResources(serverConfiguration, mux, apply, snapshot, func(p server_server.Protocol[centralized.Request[[]dto.Operation]]) mutualExclusion {
+			c := centralized.InitCentralized[[]dto.Operation](p, getCoordinator)
+			return &c
+		})
+	}
+	utils.LogError(true, "Unknown mutual exclusion algorithm:", serverConfiguration.MutualExclusion)
+	os.Exit(1)
+	return nil
+}
+
+// createResources opens the channel carrying the messages of the algorithm M
+func createResources[M any](serverConfiguration *config.ServerConfiguration, mux *server_server.Mux, apply func(data []dto.Operation), snapshot func() []dto.Operation, create func(p server_server.Protocol[M]) mutualExclusion) mutual_exclusion.ResourceMutualExclusion[[]dto.Operation] {
+	p := openChannel[mutual_exclusion.ResourceMessage[M, []dto.Operation]](serverConfiguration, mux, mutualExclusionChannel)
+	resources := mutual_exclusion.CreateResources[M, []dto.Operation](p, create, apply, snapshot)
+	if repairable, ok := p.(causal.Repairable); ok { // The data dropped by the causal order is in the state
+		repairable.SetRepair(resources.Synchronize)
+	}
+	return resources
+}
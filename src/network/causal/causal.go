@@ -0,0 +1,274 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package causal
+// This package stamps the messages between the servers with vector clocks and delivers them in causal order.
+// A broadcast is delivered once all the broadcasts that happened before it are delivered, a message sent to a single
+// server is delivered once the broadcasts known by its sender when it was sent are delivered.
+package causal
+
+import (
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"sync"
+	"time"
+)
+
+const (
+	DeliveryTimeout = 2 * time.Second // Delay after which a message whose dependencies are missing is dropped
+	CheckInterval   = 100 * time.Millisecond
+)
+
+// Message
+//   - Clock: the vector clock of the sender, its own entry counts its broadcasts
+//   - Incarnation: changes when the sender is restarted, its broadcasts are counted again from zero
+type Message[T any] struct {
+	Data        T           `json:"data"`
+	Sender      int         `json:"sender"`
+	Clock       VectorClock `json:"clock"`
+	Broadcast   bool        `json:"broadcast"`
+	Incarnation int64       `json:"incarnation"`
+}
+
+type waiting[T any] struct {
+	message  Message[T]
+	received time.Time
+}
+
+// Repairable
+// is implemented by the protocols dropping the messages whose dependencies are lost, the state is then repaired.
+type Repairable interface {
+	SetRepair(repair func())
+}
+
+// CausalProtocol
+// is an inter server protocol delivering the messages of the underlying protocol in causal order.
+// The messages arrived too early are kept until the messages they depend on are delivered. A message is never
+// delivered before its dependencies: when they are considered lost, the message is dropped and the state repaired.
+//   - repair: transfers the state of another server after messages are dropped, nil if none
+type CausalProtocol[T any] struct {
+	protocol     server_server.Protocol[Message[T]]
+	clock        VectorClock
+	incarnation  int64
+	incarnations map[int]int64
+	buffer       []waiting[T]
+	last         *Message[T] // Last message delivered, its relation with the next one is logged
+	chanMessage  chan T
+	chanPeer     chan server_server.PeerEvent
+	repair       func()
+	mutex        sync.Mutex
+}
+
+// CreateCausalProtocol Constructor, the messages are received in a go routine
+func CreateCausalProtocol[T any](p server_server.Protocol[Message[T]]) *CausalProtocol[T] {
+	c := &CausalProtocol[T]{
+		protocol:     p,
+		clock:        make(VectorClock, p.GetNumberOfServers()),
+		incarnation:  time.Now().UnixNano(),
+		incarnations: make(map[int]int64),
+		chanMessage:  make(chan T),
+		chanPeer:     make(chan server_server.PeerEvent),
+	}
+	go c.receive()
+	return c
+}
+
+// stamp creates the message sent to the other servers, a broadcast increments the clock of the server
+func (c *CausalProtocol[T]) stamp(data T, broadcast bool) Message[T] {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if broadcast {
+		c.clock[c.GetServerId()]++
+	}
+	return Message[T]{
+		Data:        data,
+		Sender:      c.GetServerId(),
+		Clock:       append(VectorClock{}, c.clock...),
+		Broadcast:   broadcast,
+		Incarnation: c.incarnation,
+	}
+}
+
+func (c *CausalProtocol[T]) SendTo(serverId int, data T) error {
+	return c.protocol.SendTo(serverId, c.stamp(data, false))
+}
+
+func (c *CausalProtocol[T]) SendToAll(data T) error {
+	return c.protocol.SendToAll(c.stamp(data, true))
+}
+
+// SetRepair sets the function transferring the state of another server, it is called in a go routine after messages
+// are dropped. The state received must contain the effects of the dropped and lost messages.
+func (c *CausalProtocol[T]) SetRepair(repair func()) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.repair = repair
+}
+
+// GetClock gets a copy of the vector clock of the server
+func (c *CausalProtocol[T]) GetClock() VectorClock {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append(VectorClock{}, c.clock...)
+}
+
+func (c *CausalProtocol[T]) receive() {
+	ticker := time.NewTicker(CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case message := <-c.protocol.GetMessageChan():
+			c.mutex.Lock()
+			c.checkIncarnation(message)
+			c.buffer = append(c.buffer, waiting[T]{message: message, received: time.Now()})
+			c.mutex.Unlock()
+		case event := <-c.protocol.GetPeerChan():
+			c.deliver()
+			if !event.Alive {
+				c.drop(event.ServerId)
+			}
+			c.chanPeer <- event
+		case <-ticker.C:
+		}
+		c.deliver()
+	}
+}
+
+// checkIncarnation counts the broadcasts of a server from its first message, or again from zero when it is restarted.
+// The broadcasts sent before the server was known are never received, its state is transferred instead.
+func (c *CausalProtocol[T]) checkIncarnation(message Message[T]) {
+	c.grow(len(message.Clock))
+	c.grow(message.Sender + 1)
+	known, ok := c.incarnations[message.Sender]
+	if ok && known == message.Incarnation {
+		return
+	}
+	c.incarnations[message.Sender] = message.Incarnation
+	if ok {
+		c.removeMessages(message.Sender)
+	}
+	c.clock[message.Sender] = message.Clock.get(message.Sender)
+	if message.Broadcast {
+		c.clock[message.Sender]--
+	}
+}
+
+// grow extends the clock to the servers that joined the cluster, the mutex must be held
+func (c *CausalProtocol[T]) grow(size int) {
+	if n := c.GetNumberOfServers(); n > size {
+		size = n
+	}
+	for len(c.clock) < size {
+		c.clock = append(c.clock, 0)
+	}
+}
+
+// drop removes the messages of a crashed server that are not deliverable, they must not be delivered after its crash
+func (c *CausalProtocol[T]) drop(serverId int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.removeMessages(serverId)
+}
+
+func (c *CausalProtocol[T]) removeMessages(serverId int) {
+	buffer := c.buffer[:0]
+	for _, w := range c.buffer {
+		if w.message.Sender != serverId {
+			buffer = append(buffer, w)
+		}
+	}
+	c.buffer = buffer
+}
+
+// deliverable checks if the messages that happened before the given one are delivered
+func (c *CausalProtocol[T]) deliverable(message Message[T]) bool {
+	for i := range c.clock {
+		switch {
+		case i == c.GetServerId():
+			continue
+		case i == message.Sender && message.Broadcast:
+			if message.Clock.get(i) > c.clock[i]+1 {
+				return false
+			}
+		case message.Clock.get(i) > c.clock[i]:
+			return false
+		}
+	}
+	return true
+}
+
+// next removes the next deliverable message from the buffer, in the order of arrival.
+// A message waiting for too long is dropped: the messages it depends on are considered lost and are skipped, the
+// following messages of its sender are not blocked. The state is repaired once the messages are dropped.
+func (c *CausalProtocol[T]) next() (Message[T], bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := 0; i < len(c.buffer); i++ {
+		w := c.buffer[i]
+		if c.deliverable(w.message) {
+			c.buffer = append(c.buffer[:i], c.buffer[i+1:]...)
+			c.merge(w.message.Clock)
+			return w.message, true
+		}
+		if time.Since(w.received) > DeliveryTimeout {
+			utils.LogWarning(false, "causal order:", "message of server", w.message.Sender, "stamped", w.message.Clock,
+				"dropped, the messages it depends on are missing, clock", c.clock)
+			c.buffer = append(c.buffer[:i], c.buffer[i+1:]...)
+			c.merge(w.message.Clock)
+			if c.repair != nil {
+				go c.repair()
+			}
+			i = -1 // The messages waiting for the dropped one may be deliverable
+		}
+	}
+	return Message[T]{}, false
+}
+
+// merge advances the clock of the other servers to the given one, the mutex must be held
+func (c *CausalProtocol[T]) merge(clock VectorClock) {
+	for j := range c.clock {
+		if j != c.GetServerId() && clock.get(j) > c.clock[j] {
+			c.clock[j] = clock.get(j)
+		}
+	}
+}
+
+// deliver gives the deliverable messages to the reader of the protocol
+func (c *CausalProtocol[T]) deliver() {
+	for {
+		message, ok := c.next()
+		if !ok {
+			return
+		}
+		if c.last != nil {
+			utils.LogInfo(false, "causal order:", "message of server", message.Sender, "stamped", message.Clock,
+				Compare(message.Clock, c.last.Clock), "the message of server", c.last.Sender, "stamped", c.last.Clock)
+		}
+		c.last = &message
+		c.chanMessage <- message.Data
+	}
+}
+
+func (c *CausalProtocol[T]) GetMessageChan() chan T {
+	return c.chanMessage
+}
+
+func (c *CausalProtocol[T]) GetPeerChan() chan server_server.PeerEvent {
+	return c.chanPeer
+}
+
+func (c *CausalProtocol[T]) GetServerId() int {
+	return c.protocol.GetServerId()
+}
+
+func (c *CausalProtocol[T]) GetNumberOfServers() int {
+	return c.protocol.GetNumberOfServers()
+}
+
+func (c *CausalProtocol[T]) IsConnected(serverId int) bool {
+	return c.protocol.IsConnected(serverId)
+}
+
+func (c *CausalProtocol[T]) GetSentMessages() int64 {
+	return c.protocol.GetSentMessages()
+}
@@ -0,0 +1,80 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package causal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VectorClock contains the number of broadcasts of each server known by the owner of the clock
+type VectorClock []int
+
+type Relation int
+
+const (
+	Equal      Relation = 0
+	Before     Relation = 1 // The first update happened before the second one
+	After      Relation = 2 // The second update happened before the first one
+	Concurrent Relation = 3
+)
+
+func (r Relation) String() string {
+	switch r {
+	case Equal:
+		return "equal to"
+	case Before:
+		return "happened before"
+	case After:
+		return "happened after"
+	}
+	return "concurrent with"
+}
+
+func (v VectorClock) get(serverId int) int {
+	if serverId < len(v) {
+		return v[serverId]
+	}
+	return 0
+}
+
+func (v VectorClock) String() string {
+	values := make([]string, len(v))
+	for i, value := range v {
+		values[i] = fmt.Sprint(value)
+	}
+	return "[" + strings.Join(values, " ") + "]"
+}
+
+// Compare gets the relation between two stamped updates, used to debug the replicated changes
+func Compare(a VectorClock, b VectorClock) Relation {
+	less, greater := false, false
+	for i := 0; i < len(a) || i < len(b); i++ {
+		switch {
+		case a.get(i) < b.get(i):
+			less = true
+		case a.get(i) > b.get(i):
+			greater = true
+		}
+	}
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	}
+	return Equal
+}
+
+// HappenedBefore checks if the update stamped with v happened before the one stamped with other
+func (v VectorClock) HappenedBefore(other VectorClock) bool {
+	return Compare(v, other) == Before
+}
+
+// ConcurrentWith checks if none of the updates happened before the other
+func (v VectorClock) ConcurrentWith(other VectorClock) bool {
+	return Compare(v, other) == Concurrent
+}
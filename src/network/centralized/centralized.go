@@ -0,0 +1,290 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package centralized
+// This package implements a mutual exclusion where a coordinator grants the critical section in the order of the requests.
+// It is used to compare the distributed algorithms with the simplest solution.
+package centralized
+
+import (
+	"fmt"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"strings"
+	"time"
+)
+
+const CheckInterval = 100 * time.Millisecond // Interval to check if the coordinator has changed
+
+type RequestType int
+
+const (
+	REQUEST RequestType = 0 // Ask the coordinator for the critical section
+	GRANT   RequestType = 1 // The coordinator gives the critical section, carries the data of the last release
+	RELEASE RequestType = 2 // Leave the critical section, carries the replicated data to the coordinator
+	UPD     RequestType = 3 // Replicated data sent to the other servers when leaving the critical section
+)
+
+// Request
+//   - Held: the sender already holds the critical section, sent to a new coordinator
+type Request[T any] struct {
+	ReqType RequestType `json:"req_type"`
+	Data    T           `json:"data"`
+	HasData bool        `json:"has_data"`
+	Sender  int         `json:"sender"`
+	Held    bool        `json:"held"`
+}
+
+type Centralized[T any] struct {
+	protocol    server_server.Protocol[Request[T]]
+	coordinator func() int // Gets the coordinator, -1 while it is unknown
+
+	// State of the server as a client of the coordinator
+	requesting    bool
+	hasAccess     bool
+	requestedFrom int         // Coordinator that knows our request, -1 if it must be sent
+	release       *Request[T] // Release waiting for a coordinator
+	waitForAccess chan bool
+	Data          chan T
+
+	// State of the server as the coordinator
+	coordinating bool
+	holder       int   // Server in the critical section, -1 if free
+	queue        []int // Servers waiting for the critical section, in the order of their requests
+	latest       *T    // Data of the last release, given to the next server in the critical section
+
+	peerEvents chan server_server.PeerEvent
+}
+
+// InitCentralized inits the needed structure for the centralized mutual exclusion.
+// The coordinator function gets the server granting the critical section, configured or elected.
+func InitCentralized[T any](p server_server.Protocol[Request[T]], coordinator func() int) Centralized[T] {
+	return Centralized[T]{
+		protocol:      p,
+		coordinator:   coordinator,
+		requestedFrom: -1,
+		holder:        -1,
+		waitForAccess: make(chan bool, 1),
+		Data:          make(chan T, 1),
+		peerEvents:    make(chan server_server.PeerEvent),
+	}
+}
+
+func (c *Centralized[T]) id() int {
+	return c.protocol.GetServerId()
+}
+
+func (c *Centralized[T]) debug() {
+	if !utils.IsLogEnabled() {
+		return
+	}
+
+	headers := []string{"Servers"}
+	data := []string{fmt.Sprintf("C:%d SC:%t M:%d", c.coordinator(), c.hasAccess, c.protocol.GetSentMessages())}
+	for i := 0; i < c.protocol.GetNumberOfServers(); i++ {
+		headers = append(headers, fmt.Sprintf("Server %d", i))
+		state := "-"
+		if c.holder == i {
+			state = "HOLD"
+		}
+		for position, serverId := range c.queue {
+			if serverId == i {
+				state = fmt.Sprintf("WAIT(%d)", position)
+			}
+		}
+		data = append(data, state)
+	}
+	utils.PrintTable(headers, []string{strings.Join(data, "\t")})
+}
+
+// SendClientAskCriticalSection indique que le client souhaite l'accès
+func (c *Centralized[T]) SendClientAskCriticalSection() chan bool {
+	c.protocol.GetMessageChan() <- Request[T]{
+		ReqType: REQUEST,
+		Sender:  c.id(),
+	}
+	return c.waitForAccess
+}
+
+// SendClientReleaseCriticalSection indique que le client sort de SC
+func (c *Centralized[T]) SendClientReleaseCriticalSection(data T) {
+	c.protocol.GetMessageChan() <- Request[T]{
+		ReqType: RELEASE,
+		Sender:  c.id(),
+		Data:    data,
+		HasData: true,
+	}
+}
+
+// SendClientLeaveCriticalSection indique que le client sort de SC sans données à répliquer
+func (c *Centralized[T]) SendClientLeaveCriticalSection() {
+	c.protocol.GetMessageChan() <- Request[T]{
+		ReqType: RELEASE,
+		Sender:  c.id(),
+	}
+}
+
+func (c *Centralized[T]) GetDataChan() chan T {
+	return c.Data
+}
+
+// HandlePeerEvent notifies the crash or the return of a server
+func (c *Centralized[T]) HandlePeerEvent(event server_server.PeerEvent) {
+	c.peerEvents <- event
+}
+
+// send sends a request to a server, the requests to itself are handled directly
+func (c *Centralized[T]) send(serverId int, req Request[T]) {
+	if serverId == c.id() {
+		c.handleIngoingRequest(req)
+	} else {
+		_ = c.protocol.SendTo(serverId, req)
+	}
+}
+
+// checkCoordinator sends the request and the release to the coordinator once it is known.
+// A new coordinator does not know the requests sent to the previous one, they are sent again.
+// The queue is kept during an election, the coordinator may be elected again.
+func (c *Centralized[T]) checkCoordinator() {
+	coordinator := c.coordinator()
+	if c.coordinating && coordinator != -1 && coordinator != c.id() {
+		c.coordinating = false
+		c.holder = -1
+		c.queue = nil
+	}
+	if coordinator == -1 {
+		return
+	}
+	if coordinator == c.id() {
+		c.coordinating = true
+	}
+
+	if c.requesting && c.requestedFrom != coordinator {
+		c.requestedFrom = coordinator
+		c.send(coordinator, Request[T]{ReqType: REQUEST, Sender: c.id(), Held: c.hasAccess})
+	}
+	if c.release != nil {
+		release := *c.release
+		c.release = nil
+		// The data is sent by the server leaving the critical section, it is not lost if the coordinator crashes
+		for i := 0; i < c.protocol.GetNumberOfServers() && release.HasData; i++ {
+			if i != c.id() && i != coordinator {
+				_ = c.protocol.SendTo(i, Request[T]{ReqType: UPD, Sender: c.id(), Data: release.Data, HasData: true})
+			}
+		}
+		c.send(coordinator, release)
+	}
+}
+
+// grantNext gives the critical section to the first server of the queue
+func (c *Centralized[T]) grantNext() {
+	if c.holder != -1 || len(c.queue) == 0 {
+		return
+	}
+	c.holder = c.queue[0]
+	c.queue = c.queue[1:]
+	grant := Request[T]{ReqType: GRANT, Sender: c.id()}
+	if c.latest != nil {
+		grant.Data = *c.latest
+		grant.HasData = true
+	}
+	c.send(c.holder, grant)
+}
+
+// handleOutgoingRequest
+func (c *Centralized[T]) handleOutgoingRequest(req Request[T]) {
+	switch req.ReqType {
+	case REQUEST:
+		c.requesting = true
+		c.requestedFrom = -1
+	case RELEASE:
+		c.requesting = false
+		c.hasAccess = false
+		c.requestedFrom = -1
+		if req.HasData {
+			c.Data <- req.Data
+		}
+		c.release = &req
+	}
+	c.checkCoordinator()
+	c.debug()
+}
+
+// handleIngoingRequest Traitment des messages entre serveurs
+func (c *Centralized[T]) handleIngoingRequest(req Request[T]) {
+	switch req.ReqType {
+	case REQUEST:
+		if coordinator := c.coordinator(); coordinator != -1 && coordinator != c.id() {
+			return // The sender will send its request again to the new coordinator
+		}
+		c.coordinating = true
+		if req.Held && c.holder == -1 {
+			c.holder = req.Sender
+		} else if !req.Held {
+			c.queue = append(c.queue, req.Sender)
+		}
+		c.grantNext()
+	case GRANT:
+		if req.HasData && req.Sender != c.id() {
+			c.Data <- req.Data
+		}
+		if c.requesting && !c.hasAccess {
+			c.hasAccess = true
+			c.waitForAccess <- true
+		}
+	case RELEASE:
+		if req.HasData {
+			if req.Sender != c.id() {
+				c.Data <- req.Data
+			}
+			c.latest = &req.Data
+		}
+		if c.holder == req.Sender {
+			c.holder = -1
+		}
+		c.grantNext()
+	case UPD:
+		c.Data <- req.Data
+	}
+	c.debug()
+}
+
+// handlePeerEvent removes a crashed server from the queue, the critical section it held is given to the next server
+func (c *Centralized[T]) handlePeerEvent(event server_server.PeerEvent) {
+	if event.Alive || !c.coordinating {
+		return
+	}
+	queue := c.queue[:0]
+	for _, serverId := range c.queue {
+		if serverId != event.ServerId {
+			queue = append(queue, serverId)
+		}
+	}
+	c.queue = queue
+	if c.holder == event.ServerId {
+		c.holder = -1
+		c.grantNext()
+	}
+	c.debug()
+}
+
+func (c *Centralized[T]) Start() {
+	utils.LogInfo(false, "Centralized:", "started")
+	ticker := time.NewTicker(CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-c.peerEvents:
+			c.handlePeerEvent(event)
+		case <-ticker.C:
+			c.checkCoordinator()
+		// REQUEST, GRANT, RELEASE, UPD
+		case request := <-c.protocol.GetMessageChan():
+			if request.Sender == c.id() {
+				c.handleOutgoingRequest(request)
+			} else {
+				c.handleIngoingRequest(request)
+			}
+		}
+	}
+}
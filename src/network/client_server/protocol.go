@@ -38,7 +38,10 @@ type AuthFunc func(credentials types.Credentials) (bool, AuthId)
 //   - NeedsAuth: true if the endpoint needs authentication
 //   - HandlerFunc: the function that is called after the request is received and the authentication is done.
 //     The function returns the response of the endpoint.
+//   - Concurrent: true if the requests are handled outside the critical section of the requests,
+//     the function protects the data it accesses itself
 type Endpoint[T any] struct {
 	NeedsAuth   bool
 	HandlerFunc func(request network.Request[T]) network.Response[any]
+	Concurrent  bool
 }
@@ -81,8 +81,8 @@ func (p ServerProtocol) ProcessRequests() {
 		case pending := <-p.pendingRequest: // Process the pending requests
 			p.ProcessPriorityRequests() // Process the priority requests
 			utils.CreateCriticalSection(fmt.Sprintf("sync %s", pending.name), pending.callback)
-		default:
-			p.ProcessPriorityRequests() // Process the priority requests
+		case pending := <-p.pendingPriorityRequest: // Wait for a request without spinning
+			utils.CreateCriticalSection(fmt.Sprintf("sync priority %s", pending.name), pending.callback)
 		}
 	}
 }
@@ -97,6 +97,15 @@ func (p ServerProtocol) AddPending(name string, priority bool, callback func())
 	}
 }
 
+// process handles a step of a request in the critical section of the requests, or right away for a concurrent endpoint
+func (p ServerProtocol) process(endpoint ServerEndpoint, name string, callback func()) {
+	if endpoint.Concurrent {
+		callback()
+	} else {
+		p.AddPending(name, false, callback)
+	}
+}
+
 // HandleConnection is the function that is called to process the connection. It is called in a go routine.
 func (p ServerProtocol) HandleConnection(c net.Conn) {
 	utils.LogInfo(false, "new connection", c.RemoteAddr())
@@ -142,8 +151,8 @@ func (p ServerProtocol) HandleConnection(c net.Conn) {
 				utils.LogWarning(false, "invalid endpoint, canceling request")
 				continue
 			}
-			// Process the authentication in a critical section
-			go p.AddPending(fmt.Sprintf("Request %s (auth)", request.EndpointId), false, func() {
+			// Process the authentication in a critical section, unless the endpoint is concurrent
+			go p.process(endpoint, fmt.Sprintf("Request %s (auth)", request.EndpointId), func() {
 				if request.Header.NeedsAuth {
 					var credentials types.Credentials
 
@@ -169,7 +178,7 @@ func (p ServerProtocol) HandleConnection(c net.Conn) {
 					}
 				}
 				// Process the request in a critical section in the pending channel
-				go p.AddPending(fmt.Sprintf("Request %s (data)", request.EndpointId), false, func() {
+				go p.process(endpoint, fmt.Sprintf("Request %s (data)", request.EndpointId), func() {
 					defer func() {
 						ready <- struct{}{} // The request is done
 					}()
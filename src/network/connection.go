@@ -37,6 +37,12 @@ func (c Connection) SendData(data string) error {
 	return err
 }
 
+// SendHeartbeat sends an empty line to show that the connection is alive, it is not logged
+func (c Connection) SendHeartbeat() error {
+	_, err := fmt.Fprintln(c)
+	return err
+}
+
 func (c Connection) SendJSON(data any) error {
 	bytes, err := json.Marshal(data)
 	if err != nil {
@@ -55,7 +61,9 @@ func (c Connection) SendResponse(endpointId string, success bool, data any) erro
 func (c Connection) GetLine() (string, error) {
 	data, err := c.reader.ReadString('\n')
 	data = strings.TrimSpace(data)
-	utils.LogInfo(false, fmt.Sprintf("📥GOT FROM %s", c.RemoteAddr().String()), data)
+	if data != "" { // Heartbeats are not logged
+		utils.LogInfo(false, fmt.Sprintf("📥GOT FROM %s", c.RemoteAddr().String()), data)
+	}
 	return data, err
 }
 
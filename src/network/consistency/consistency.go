@@ -0,0 +1,159 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package consistency
+// This package detects the replicas that diverged. After each change of its data, a server sends the hash of its data
+// to the other servers, with the hash of the versions of the data. Two servers having applied the same versions must
+// have the same data: an alert is raised if their hashes differ.
+package consistency
+
+import (
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"sync"
+	"time"
+)
+
+const HistorySize = 128 // Number of local states kept to be compared with the states received late
+
+// State is the summary of the data of a server
+//   - Versions: hash of the versions of the data, the states having the same versions are compared
+//   - Hash: hash of the content of the data
+type State struct {
+	Versions string `json:"versions"`
+	Hash     string `json:"hash"`
+}
+
+type Message struct {
+	Sender int   `json:"sender"`
+	State  State `json:"state"`
+}
+
+// Alert is raised when a server has the same versions as the local server but another content
+type Alert struct {
+	Server   int       `json:"server"`
+	Versions string    `json:"versions"`
+	Local    string    `json:"local"`
+	Remote   string    `json:"remote"`
+	Time     time.Time `json:"time"`
+}
+
+// Status is the consistency of the local server with the last state received from each server
+type Status struct {
+	Server     int           `json:"server"`
+	State      State         `json:"state"`
+	Peers      map[int]State `json:"peers"`
+	Consistent bool          `json:"consistent"`
+	Alerts     []Alert       `json:"alerts"`
+}
+
+type Checker struct {
+	protocol server_server.Protocol[Message]
+	state    State
+	history  []State       // Last local states, the oldest first
+	peers    map[int]State // Last state received from each connected server
+	alerts   []Alert
+	latest   chan State // Last local state not sent yet
+	mutex    sync.Mutex
+}
+
+// CreateChecker Constructor
+func CreateChecker(p server_server.Protocol[Message]) *Checker {
+	return &Checker{
+		protocol: p,
+		peers:    make(map[int]State),
+		latest:   make(chan State, 1),
+	}
+}
+
+// Update sets the state of the local server after a change of its data, it is sent to the other servers
+func (c *Checker) Update(state State) {
+	c.mutex.Lock()
+	if state == c.state {
+		c.mutex.Unlock()
+		return
+	}
+	c.state = state
+	c.history = append(c.history, state)
+	if len(c.history) > HistorySize {
+		c.history = c.history[1:]
+	}
+	for serverId, peer := range c.peers {
+		c.compare(serverId, state, peer)
+	}
+	c.mutex.Unlock()
+
+	// Only the last state is sent, the states changed in the meantime are skipped
+	for {
+		select {
+		case c.latest <- state:
+			return
+		case <-c.latest:
+		}
+	}
+}
+
+// compare raises an alert if the states have the same versions but different contents, the mutex must be held
+func (c *Checker) compare(serverId int, local State, remote State) {
+	if local.Versions != remote.Versions || local.Hash == remote.Hash {
+		return
+	}
+	for _, alert := range c.alerts {
+		if alert.Server == serverId && alert.Versions == remote.Versions {
+			return
+		}
+	}
+	c.alerts = append(c.alerts, Alert{Server: serverId, Versions: remote.Versions, Local: local.Hash, Remote: remote.Hash, Time: time.Now()})
+	utils.LogError(true, "consistency", "server", serverId, "diverged: versions", remote.Versions,
+		"local hash", local.Hash, "remote hash", remote.Hash)
+}
+
+func (c *Checker) handleMessage(message Message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.peers[message.Sender] = message.State
+	for _, state := range c.history {
+		c.compare(message.Sender, state, message.State)
+	}
+}
+
+// handlePeerEvent forgets the state of a crashed server, a server joining the cluster gets the local state
+func (c *Checker) handlePeerEvent(event server_server.PeerEvent) {
+	c.mutex.Lock()
+	delete(c.peers, event.ServerId)
+	state := c.state
+	c.mutex.Unlock()
+	if event.Alive && state != (State{}) {
+		_ = c.protocol.SendTo(event.ServerId, Message{Sender: c.protocol.GetServerId(), State: state})
+	}
+}
+
+// GetStatus gets the consistency of the local server with the other servers
+func (c *Checker) GetStatus() Status {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	status := Status{
+		Server:     c.protocol.GetServerId(),
+		State:      c.state,
+		Peers:      make(map[int]State, len(c.peers)),
+		Consistent: len(c.alerts) == 0,
+		Alerts:     append([]Alert{}, c.alerts...),
+	}
+	for serverId, state := range c.peers {
+		status.Peers[serverId] = state
+	}
+	return status
+}
+
+func (c *Checker) Start() {
+	for {
+		select {
+		case message := <-c.protocol.GetMessageChan():
+			c.handleMessage(message)
+		case event := <-c.protocol.GetPeerChan():
+			c.handlePeerEvent(event)
+		case state := <-c.latest:
+			_ = c.protocol.SendToAll(Message{Sender: c.protocol.GetServerId(), State: state})
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package election
+
+import (
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"time"
+)
+
+// Bully
+// elects the connected server with the greatest id. A server asks the servers with a greater id to take over the election,
+// it becomes the coordinator if none of them answers.
+type Bully struct {
+	leader
+	protocol server_server.Protocol[Message]
+	electing bool
+	answered bool      // A server with a greater id took over the election
+	deadline time.Time // End of the current step of the election
+}
+
+// InitBully inits the needed structure for the Bully algorithm
+func InitBully(p server_server.Protocol[Message]) Bully {
+	return Bully{
+		leader:   createLeader(),
+		protocol: p,
+	}
+}
+
+func (b *Bully) id() int {
+	return b.protocol.GetServerId()
+}
+
+func (b *Bully) startElection() {
+	b.electing = true
+	b.answered = false
+	b.deadline = time.Now().Add(ElectionTimeout)
+	b.set(-1)
+	utils.LogInfo(false, "Bully:", "election started")
+
+	greater := false
+	for i := b.id() + 1; i < b.protocol.GetNumberOfServers(); i++ {
+		if b.protocol.IsConnected(i) {
+			greater = true
+			_ = b.protocol.SendTo(i, Message{Type: ELECTION, Sender: b.id()})
+		}
+	}
+	if !greater {
+		b.becomeLeader()
+	}
+}
+
+func (b *Bully) becomeLeader() {
+	b.electing = false
+	b.set(b.id())
+	_ = b.protocol.SendToAll(Message{Type: ELECTED, Sender: b.id(), Candidate: b.id()})
+}
+
+func (b *Bully) handleMessage(m Message) {
+	switch m.Type {
+	case ELECTION:
+		_ = b.protocol.SendTo(m.Sender, Message{Type: ANSWER, Sender: b.id()})
+		if !b.electing {
+			b.startElection()
+		}
+	case ANSWER:
+		// The coordinator must be announced before the deadline, otherwise the election is started again
+		b.answered = true
+		b.deadline = time.Now().Add(ElectionTimeout)
+	case ELECTED:
+		if m.Candidate < b.id() {
+			b.startElection()
+			return
+		}
+		b.electing = false
+		b.set(m.Candidate)
+	}
+}
+
+// handlePeerEvent starts an election when the coordinator is lost or when a better candidate is connected
+func (b *Bully) handlePeerEvent(event server_server.PeerEvent) {
+	if b.electing {
+		return
+	}
+	if !event.Alive && event.ServerId == b.GetLeader() || event.Alive && event.ServerId > b.GetLeader() {
+		b.startElection()
+	}
+}
+
+func (b *Bully) Start() {
+	utils.LogInfo(false, "Bully:", "started")
+	ticker := time.NewTicker(TickInterval)
+	defer ticker.Stop()
+	b.startElection()
+	for {
+		select {
+		// ELECTION, ANSWER, ELECTED
+		case message := <-b.protocol.GetMessageChan():
+			b.handleMessage(message)
+		case event := <-b.protocol.GetPeerChan():
+			b.handlePeerEvent(event)
+		case <-ticker.C:
+			if b.electing && time.Now().After(b.deadline) {
+				if b.answered {
+					b.startElection()
+				} else {
+					b.becomeLeader()
+				}
+			}
+		}
+	}
+}
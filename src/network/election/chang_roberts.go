@@ -0,0 +1,118 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package election
+
+import (
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"time"
+)
+
+// ChangRoberts
+// elects the connected server with the greatest id. The servers form a ring ordered by id, the servers not connected
+// are skipped. The best candidate is carried around the ring, the server receiving its own candidacy is elected.
+type ChangRoberts struct {
+	leader
+	protocol    server_server.Protocol[Message]
+	participant bool
+	deadline    time.Time // The election is started again if no coordinator is elected before the deadline
+}
+
+// InitChangRoberts inits the needed structure for the Chang-Roberts algorithm
+func InitChangRoberts(p server_server.Protocol[Message]) ChangRoberts {
+	return ChangRoberts{
+		leader:   createLeader(),
+		protocol: p,
+	}
+}
+
+func (c *ChangRoberts) id() int {
+	return c.protocol.GetServerId()
+}
+
+// next gets the next connected server of the ring, -1 if the server is alone
+func (c *ChangRoberts) next() int {
+	n := c.protocol.GetNumberOfServers()
+	for k := 1; k < n; k++ {
+		if serverId := (c.id() + k) % n; c.protocol.IsConnected(serverId) {
+			return serverId
+		}
+	}
+	return -1
+}
+
+// forward sends a message to the next server of the ring, a server alone is its own coordinator
+func (c *ChangRoberts) forward(m Message) {
+	m.Sender = c.id()
+	next := c.next()
+	if next == -1 {
+		c.participant = false
+		c.set(c.id())
+		return
+	}
+	_ = c.protocol.SendTo(next, m)
+}
+
+func (c *ChangRoberts) startElection() {
+	c.participant = true
+	c.deadline = time.Now().Add(ElectionTimeout)
+	c.set(-1)
+	utils.LogInfo(false, "Chang-Roberts:", "election started")
+	c.forward(Message{Type: ELECTION, Candidate: c.id()})
+}
+
+func (c *ChangRoberts) handleMessage(m Message) {
+	switch m.Type {
+	case ELECTION:
+		c.deadline = time.Now().Add(ElectionTimeout)
+		switch {
+		case m.Candidate > c.id():
+			c.participant = true
+			c.forward(m)
+		case m.Candidate < c.id() && !c.participant:
+			c.participant = true
+			c.forward(Message{Type: ELECTION, Candidate: c.id()})
+		case m.Candidate == c.id():
+			c.participant = false
+			c.set(c.id())
+			c.forward(Message{Type: ELECTED, Candidate: c.id()})
+		}
+	case ELECTED:
+		c.participant = false
+		c.set(m.Candidate)
+		if m.Candidate != c.id() {
+			c.forward(m)
+		}
+	}
+}
+
+// handlePeerEvent starts an election when the coordinator is lost or when a better candidate is connected
+func (c *ChangRoberts) handlePeerEvent(event server_server.PeerEvent) {
+	if c.participant {
+		return
+	}
+	if !event.Alive && event.ServerId == c.GetLeader() || event.Alive && event.ServerId > c.GetLeader() {
+		c.startElection()
+	}
+}
+
+func (c *ChangRoberts) Start() {
+	utils.LogInfo(false, "Chang-Roberts:", "started")
+	ticker := time.NewTicker(TickInterval)
+	defer ticker.Stop()
+	c.startElection()
+	for {
+		select {
+		// ELECTION, ELECTED
+		case message := <-c.protocol.GetMessageChan():
+			c.handleMessage(message)
+		case event := <-c.protocol.GetPeerChan():
+			c.handlePeerEvent(event)
+		case <-ticker.C:
+			if c.participant && time.Now().After(c.deadline) {
+				c.startElection()
+			}
+		}
+	}
+}
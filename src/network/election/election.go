@@ -0,0 +1,83 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package election
+// This package elects a coordinator among the servers with the Bully or the Chang-Roberts algorithm.
+// The coordinator is elected again when its connection is lost or when a server with a greater id joins the cluster.
+package election
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TickInterval    = 50 * time.Millisecond
+	ElectionTimeout = 1 * time.Second // Delay to wait for an answer before the election is continued or started again
+)
+
+// Election
+// is the API used by the server to know the coordinator.
+//   - Start: starts listening to the election messages, must be called in a go routine
+//   - GetLeader: the current coordinator, -1 while it is being elected
+//   - GetLeaderChan: the channel receiving the coordinator after each election, only the latest one is kept
+type Election interface {
+	Start()
+	GetLeader() int
+	GetLeaderChan() chan int
+}
+
+type MessageType int
+
+const (
+	ELECTION MessageType = 0 // Starts an election (Bully), or carries the best candidate around the ring (Chang-Roberts)
+	ANSWER   MessageType = 1 // Bully only, a server with a greater id takes over the election
+	ELECTED  MessageType = 2 // Announces the coordinator
+)
+
+type Message struct {
+	Type      MessageType `json:"type"`
+	Sender    int         `json:"sender"`
+	Candidate int         `json:"candidate"`
+}
+
+// leader keeps the coordinator and notifies its changes
+type leader struct {
+	current  int64 // Read by the server while the election runs
+	notified int
+	changes  chan int
+}
+
+func createLeader() leader {
+	return leader{
+		current:  -1,
+		notified: -1,
+		changes:  make(chan int, 1),
+	}
+}
+
+func (l *leader) GetLeader() int {
+	return int(atomic.LoadInt64(&l.current))
+}
+
+func (l *leader) GetLeaderChan() chan int {
+	return l.changes
+}
+
+// set changes the coordinator, a new coordinator replaces the one not read yet from the channel
+func (l *leader) set(serverId int) {
+	atomic.StoreInt64(&l.current, int64(serverId))
+	if serverId == -1 || serverId == l.notified {
+		return
+	}
+	l.notified = serverId
+	select {
+	case l.changes <- serverId:
+	default:
+		select {
+		case <-l.changes:
+		default:
+		}
+		l.changes <- serverId
+	}
+}
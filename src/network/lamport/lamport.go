@@ -17,24 +17,31 @@ const (
 	REQ RequestType = 0
 	ACK RequestType = 1
 	REL RequestType = 2
+	SYN RequestType = 3 // Asks a server for its state, sent when it joins the cluster
+	STA RequestType = 4 // State of the server, answer to SYN
 )
 
 type Request[T any] struct {
 	ReqType  RequestType `json:"req_type"`
 	Stamp    int         `json:"stamp"`
 	Data     T           `json:"data"`
+	HasData  bool        `json:"has_data"`
 	Sender   int         `json:"sender"`
 	Global   bool        `json:"global"`
 	Receiver int         `json:"receiver"`
+	State    RequestType `json:"state"`
 }
 
 type Lamport[T any] struct {
 	stamp         int
-	protocol      *server_server.InterServerProtocol[Request[T]]
+	protocol      server_server.Protocol[Request[T]]
 	hasAccess     bool
 	states        map[int]Request[T]
+	pending       map[int]bool // Servers whose state is unknown, requests are deferred until they answer
+	deferred      []Request[T]
+	peerEvents    chan server_server.PeerEvent
+	clock         chan chan int // Asks for the clock from another goroutine
 	waitForAccess chan bool
-	setAccess     chan bool
 	Data          chan T
 }
 
@@ -60,23 +67,32 @@ func (l *Lamport[T]) setLamportState(request Request[T]) {
 	l.debug()
 }
 
-// InitLamport inits the needed structure for lamport's algorithm
-func InitLamport[T any](p *server_server.InterServerProtocol[Request[T]]) Lamport[T] {
+// InitLamport inits the needed structure for lamport's algorithm.
+// The servers that are not connected are ignored until they join the cluster again.
+func InitLamport[T any](p server_server.Protocol[Request[T]]) Lamport[T] {
 	var lmp = Lamport[T]{
 		stamp:         0,
 		protocol:      p,
 		hasAccess:     false,
 		states:        make(map[int]Request[T], p.GetNumberOfServers()),
+		pending:       make(map[int]bool),
+		peerEvents:    make(chan server_server.PeerEvent),
+		clock:         make(chan chan int),
 		waitForAccess: make(chan bool, 1),
-		setAccess:     make(chan bool, 1),
 		Data:          make(chan T, 1),
 	}
 
 	for i := 0; i < p.GetNumberOfServers(); i++ {
+		if i != p.GetServerId() && !p.IsConnected(i) {
+			continue
+		}
 		lmp.states[i] = Request[T]{
 			ReqType: REL,
 			Stamp:   0,
 		}
+		if i != p.GetServerId() {
+			lmp.pending[i] = true
+		}
 	}
 	return lmp
 }
@@ -92,7 +108,7 @@ func (l *Lamport[T]) debug() {
 		REL: "REL",
 	}
 	headers := []string{"Servers"}
-	data := []string{fmt.Sprintf("T:%d SC:%t", l.stamp, l.hasAccess)}
+	data := []string{fmt.Sprintf("T:%d SC:%t M:%d", l.stamp, l.hasAccess, l.protocol.GetSentMessages())}
 	for key, state := range l.states {
 		headers = append(headers, fmt.Sprintf("Server %d", key))
 		data = append(data, fmt.Sprintf("%s(%d)", str[state.ReqType], state.Stamp))
@@ -116,18 +132,91 @@ func (l *Lamport[T]) SendClientReleaseCriticalSection(data T) {
 		ReqType: REL,
 		Sender:  l.id(),
 		Data:    data,
+		HasData: true,
 		Global:  true,
 	}
 }
 
+// SendClientLeaveCriticalSection indique que le client sort de SC sans données à répliquer
+func (l *Lamport[T]) SendClientLeaveCriticalSection() {
+	l.protocol.GetMessageChan() <- Request[T]{
+		ReqType: REL,
+		Sender:  l.id(),
+		Global:  true,
+	}
+}
+
+func (l *Lamport[T]) GetDataChan() chan T {
+	return l.Data
+}
+
+// GetClock gets the logical clock, sent to the servers joining the cluster
+func (l *Lamport[T]) GetClock() int {
+	stamp := make(chan int)
+	l.clock <- stamp
+	return <-stamp
+}
+
+// SetClock sets the logical clock received from the cluster, it must be called before Start
+func (l *Lamport[T]) SetClock(stamp int) {
+	l.stamp = stamp
+}
+
+// HandlePeerEvent notifies the crash or the return of a server
+func (l *Lamport[T]) HandlePeerEvent(event server_server.PeerEvent) {
+	l.peerEvents <- event
+}
+
+// handlePeerEvent removes a crashed server from the states, a server that joins again must give its state
+func (l *Lamport[T]) handlePeerEvent(event server_server.PeerEvent) {
+	if event.Alive {
+		l.states[event.ServerId] = Request[T]{
+			ReqType: REL,
+			Stamp:   0,
+		}
+		l.pending[event.ServerId] = true
+		l.sendRequest(Request[T]{
+			ReqType:  SYN,
+			Stamp:    l.stamp,
+			Sender:   l.id(),
+			Receiver: event.ServerId,
+		})
+	} else {
+		delete(l.states, event.ServerId)
+		delete(l.pending, event.ServerId)
+		l.processDeferredRequests()
+		l.checkCriticalSectionAccess()
+	}
+	l.debug()
+}
+
+// processDeferredRequests sends the requests deferred while the state of a server was unknown
+func (l *Lamport[T]) processDeferredRequests() {
+	if len(l.pending) > 0 {
+		return
+	}
+	deferred := l.deferred
+	l.deferred = nil
+	for _, req := range deferred {
+		l.handleLamportOutgoingRequest(req)
+	}
+}
+
 // handleLamportOutgoingMessage
 func (l *Lamport[T]) handleLamportOutgoingRequest(req Request[T]) {
+	if req.ReqType == REQ && len(l.pending) > 0 {
+		// The stamp of the request must be greater than the stamps of the servers joining the cluster
+		l.deferred = append(l.deferred, req)
+		return
+	}
 	l.stamp += 1
 	req.Stamp = l.stamp
 	l.setLamportState(req)
 	if req.ReqType == REL {
-		l.setAccess <- false
-		l.Data <- req.Data
+		l.hasAccess = false
+		if req.HasData {
+			l.Data <- req.Data
+		}
 	}
 	l.sendRequest(req)
 }
@@ -155,13 +244,35 @@ func (l *Lamport[T]) handleLamportIngoingRequest(req Request[T]) {
 			l.setLamportState(req)
 		}
 	case REL:
-		l.Data <- req.Data
+		if req.HasData {
+			l.Data <- req.Data
+		}
 		l.setLamportState(req)
+
+	case SYN:
+		state := Request[T]{
+			ReqType:  STA,
+			Stamp:    l.stamp,
+			Sender:   l.id(),
+			Receiver: req.Sender,
+			State:    l.currentState().ReqType,
+		}
+		if state.State == REQ {
+			state.Stamp = l.currentState().Stamp
+		}
+		l.sendRequest(state)
+
+	case STA:
+		delete(l.pending, req.Sender)
+		req.ReqType = req.State
+		l.handleLamportIngoingRequest(req)
+		l.processDeferredRequests()
 	}
 }
 
+// checkCriticalSectionAccess grants the access once, when the request is the oldest one
 func (l *Lamport[T]) checkCriticalSectionAccess() {
-	if l.currentState().ReqType != REQ {
+	if l.currentState().ReqType != REQ || l.hasAccess {
 		return
 	}
 	for i := range l.states {
@@ -172,13 +283,26 @@ func (l *Lamport[T]) checkCriticalSectionAccess() {
 			return
 		}
 	}
-	l.setAccess <- true
+	l.hasAccess = true
+	l.waitForAccess <- true
 }
 
 func (l *Lamport[T]) Start() {
 	utils.LogInfo(false, "Lamport:", "started")
+	for serverId := range l.pending {
+		l.sendRequest(Request[T]{
+			ReqType:  SYN,
+			Stamp:    l.stamp,
+			Sender:   l.id(),
+			Receiver: serverId,
+		})
+	}
 	for {
 		select {
+		case event := <-l.peerEvents:
+			l.handlePeerEvent(event)
+		case stamp := <-l.clock:
+			stamp <- l.stamp
 		// REQ, ACK, REL
 		case request := <-l.protocol.GetMessageChan():
 			if request.Sender == l.id() {
@@ -186,11 +310,6 @@ func (l *Lamport[T]) Start() {
 			} else {
 				l.handleLamportIngoingRequest(request)
 			}
-		case hasAccess := <-l.setAccess:
-			if hasAccess && !l.hasAccess {
-				l.waitForAccess <- true
-			}
-			l.hasAccess = hasAccess
 		}
 	}
 }
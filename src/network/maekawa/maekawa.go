@@ -0,0 +1,343 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package maekawa
+// This package implements Maekawa's mutual exclusion algorithm. A server asks for the critical section to the servers
+// of its voting set only, any two voting sets intersect so a voter never grants two requests at once. A voter that
+// granted a request asks it back (INQUIRE) when a request with a higher priority arrives, a requester that cannot get
+// all the votes gives it back (RELINQUISH): the requests are granted in the order of their timestamps and the
+// algorithm never deadlocks.
+package maekawa
+
+import (
+	"fmt"
+	"math"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"sort"
+)
+
+type RequestType int
+
+const (
+	REQ        RequestType = 0 // Ask the voters for the critical section
+	LOCKED     RequestType = 1 // Vote for a request, carries the last replicated data known by the voter
+	FAILED     RequestType = 2 // The voter granted a request with a higher priority
+	INQUIRE    RequestType = 3 // The voter asks its vote back for a request with a higher priority
+	RELINQUISH RequestType = 4 // The requester gives the vote back, it cannot get all the votes yet
+	RELEASE    RequestType = 5 // The requester left the critical section, carries the replicated data
+	UPD        RequestType = 6 // Replicated data sent to the servers outside the voting set
+	REL        RequestType = 7 // Local only, the client leaves the critical section
+)
+
+// Request
+//   - Stamp: the timestamp of the request concerned by the message, stale messages are ignored
+type Request[T any] struct {
+	ReqType RequestType `json:"req_type"`
+	Stamp   int         `json:"stamp"`
+	Data    T           `json:"data"`
+	HasData bool        `json:"has_data"`
+	Version int         `json:"version"`
+	Sender  int         `json:"sender"`
+}
+
+// vote is a request waiting for or holding the vote of the server
+//   - failed: the requester has been told that a request with a higher priority is waiting for the vote
+type vote struct {
+	stamp  int
+	sender int
+	failed bool
+}
+
+// before checks if a request has a higher priority than another one, the oldest first then the smallest id
+func (v vote) before(other vote) bool {
+	return v.stamp < other.stamp || v.stamp == other.stamp && v.sender < other.sender
+}
+
+type Maekawa[T any] struct {
+	quorum []int // Voting set of the server, including itself
+	stamp  int
+
+	// Requester
+	requesting   bool
+	hasAccess    bool
+	requestStamp int
+	grants       map[int]bool // Voters that granted the request
+	failed       bool         // A voter granted a request with a higher priority
+	inquiries    []int        // Voters that asked their vote back, answered once a FAILED is received
+
+	// Voter
+	voted    *vote  // Request holding the vote of the server
+	inquired bool   // The vote has been asked back to its holder
+	queue    []vote // Requests waiting for the vote, sorted by priority
+
+	data          T   // Last replicated data known by the server, sent with the votes
+	version       int // Number of critical sections whose data has been delivered
+	inbox         []Request[T]
+	protocol      server_server.Protocol[Request[T]]
+	waitForAccess chan bool
+	Data          chan T
+}
+
+// InitMaekawa inits the needed structure for Maekawa's algorithm with the voting set of the server
+func InitMaekawa[T any](p server_server.Protocol[Request[T]], quorum []int) Maekawa[T] {
+	return Maekawa[T]{
+		quorum:        quorum,
+		grants:        make(map[int]bool),
+		protocol:      p,
+		waitForAccess: make(chan bool, 1),
+		Data:          make(chan T, 1),
+	}
+}
+
+func (m *Maekawa[T]) id() int {
+	return m.protocol.GetServerId()
+}
+
+func (m *Maekawa[T]) debug() {
+	if !utils.IsLogEnabled() {
+		return
+	}
+
+	voted := "-"
+	if m.voted != nil {
+		voted = fmt.Sprintf("%d(%d)", m.voted.sender, m.voted.stamp)
+	}
+	headers := []string{"Server", "Quorum", "Grants", "Voted", "Queue", "SC", "V", "M"}
+	data := fmt.Sprintf("%d\t%v\t%d/%d\t%s\t%d\t%t\t%d\t%d", m.id(), m.quorum, len(m.grants), len(m.quorum),
+		voted, len(m.queue), m.hasAccess, m.version, m.protocol.GetSentMessages())
+	utils.PrintTable(headers, []string{data})
+}
+
+// SendClientAskCriticalSection indique que le client souhaite l'accès
+func (m *Maekawa[T]) SendClientAskCriticalSection() chan bool {
+	m.protocol.GetMessageChan() <- Request[T]{
+		ReqType: REQ,
+		Sender:  m.id(),
+	}
+	return m.waitForAccess
+}
+
+// SendClientReleaseCriticalSection indique que le client sort de SC
+func (m *Maekawa[T]) SendClientReleaseCriticalSection(data T) {
+	m.protocol.GetMessageChan() <- Request[T]{
+		ReqType: REL,
+		Sender:  m.id(),
+		Data:    data,
+		HasData: true,
+	}
+}
+
+// SendClientLeaveCriticalSection indique que le client sort de SC sans données à répliquer
+func (m *Maekawa[T]) SendClientLeaveCriticalSection() {
+	m.protocol.GetMessageChan() <- Request[T]{
+		ReqType: REL,
+		Sender:  m.id(),
+	}
+}
+
+func (m *Maekawa[T]) GetDataChan() chan T {
+	return m.Data
+}
+
+// send sends a message to a server, the messages of the server to itself are handled after the current one
+func (m *Maekawa[T]) send(serverId int, req Request[T]) {
+	req.Sender = m.id()
+	if serverId == m.id() {
+		m.inbox = append(m.inbox, req)
+		return
+	}
+	_ = m.protocol.SendTo(serverId, req)
+}
+
+// deliver forwards the replicated data, the most recent one is kept to be sent with the votes.
+// A vote carries the last data known by its voter, it is forwarded only if the server does not know it yet.
+func (m *Maekawa[T]) deliver(req Request[T]) {
+	if !req.HasData || req.ReqType == LOCKED && req.Version <= m.version {
+		return
+	}
+	if req.Version > m.version {
+		m.version = req.Version
+		m.data = req.Data
+	}
+	m.Data <- req.Data
+}
+
+// grant gives the vote of the server to a request, with the last replicated data
+func (m *Maekawa[T]) grant(request vote) {
+	m.voted = &request
+	m.inquired = false
+	m.send(request.sender, Request[T]{
+		ReqType: LOCKED,
+		Stamp:   request.stamp,
+		Data:    m.data,
+		HasData: m.version > 0,
+		Version: m.version,
+	})
+}
+
+// enqueue adds a request waiting for the vote, sorted by priority
+func (m *Maekawa[T]) enqueue(request vote) {
+	m.queue = append(m.queue, request)
+	sort.Slice(m.queue, func(i, j int) bool { return m.queue[i].before(m.queue[j]) })
+}
+
+// grantNext gives the vote to the request with the highest priority, if any
+func (m *Maekawa[T]) grantNext() {
+	m.voted = nil
+	m.inquired = false
+	if len(m.queue) > 0 {
+		next := m.queue[0]
+		m.queue = m.queue[1:]
+		m.grant(next)
+	}
+}
+
+// relinquish gives back the votes asked back by their voters
+func (m *Maekawa[T]) relinquish() {
+	for _, voter := range m.inquiries {
+		if m.grants[voter] {
+			delete(m.grants, voter)
+			m.send(voter, Request[T]{ReqType: RELINQUISH, Stamp: m.requestStamp})
+		}
+	}
+	m.inquiries = nil
+}
+
+// checkCriticalSectionAccess grants the access once every voter of the voting set voted for the request
+func (m *Maekawa[T]) checkCriticalSectionAccess() {
+	if m.requesting && !m.hasAccess && len(m.grants) == len(m.quorum) {
+		m.hasAccess = true
+		m.inquiries = nil
+		m.waitForAccess <- true
+	}
+}
+
+// handleOutgoingRequest
+func (m *Maekawa[T]) handleOutgoingRequest(req Request[T]) {
+	m.stamp += 1
+
+	switch req.ReqType {
+	case REQ:
+		m.requesting = true
+		m.requestStamp = m.stamp
+		m.grants = make(map[int]bool)
+		m.failed = false
+		m.inquiries = nil
+		for _, voter := range m.quorum {
+			m.send(voter, Request[T]{ReqType: REQ, Stamp: m.requestStamp})
+		}
+
+	case REL:
+		m.requesting = false
+		m.hasAccess = false
+		if req.HasData {
+			req.Version = m.version + 1
+			m.deliver(req)
+		}
+		// The voters get the data with the release, the other servers need an update to keep their data in sync
+		inQuorum := make(map[int]bool, len(m.quorum))
+		for _, voter := range m.quorum {
+			inQuorum[voter] = true
+			release := Request[T]{ReqType: RELEASE, Stamp: m.requestStamp}
+			if voter != m.id() && req.HasData { // The data has already been delivered locally
+				release.Data, release.HasData, release.Version = req.Data, true, req.Version
+			}
+			m.send(voter, release)
+		}
+		for i := 0; i < m.protocol.GetNumberOfServers() && req.HasData; i++ {
+			if !inQuorum[i] && m.protocol.IsConnected(i) {
+				m.send(i, Request[T]{ReqType: UPD, Stamp: m.stamp, Data: req.Data, HasData: true, Version: req.Version})
+			}
+		}
+		m.grants = make(map[int]bool)
+	}
+}
+
+// handleIngoingRequest Traitment des messages entre serveurs
+func (m *Maekawa[T]) handleIngoingRequest(req Request[T]) {
+	m.deliver(req)
+
+	switch req.ReqType {
+	// Voter
+	case REQ:
+		m.stamp = int(math.Max(float64(m.stamp), float64(req.Stamp)) + 1)
+		request := vote{stamp: req.Stamp, sender: req.Sender}
+		if m.voted == nil {
+			m.grant(request)
+			break
+		}
+		if m.voted.before(request) || len(m.queue) > 0 && m.queue[0].before(request) {
+			request.failed = true
+			m.send(req.Sender, Request[T]{ReqType: FAILED, Stamp: req.Stamp})
+		} else {
+			// The request has the highest priority, the requests waiting before it must give their votes back
+			for i := range m.queue {
+				if !m.queue[i].failed {
+					m.queue[i].failed = true
+					m.send(m.queue[i].sender, Request[T]{ReqType: FAILED, Stamp: m.queue[i].stamp})
+				}
+			}
+			if !m.inquired {
+				m.inquired = true
+				m.send(m.voted.sender, Request[T]{ReqType: INQUIRE, Stamp: m.voted.stamp})
+			}
+		}
+		m.enqueue(request)
+	case RELINQUISH:
+		if m.voted != nil && m.voted.sender == req.Sender && m.voted.stamp == req.Stamp {
+			m.enqueue(vote{stamp: m.voted.stamp, sender: m.voted.sender, failed: true})
+			m.grantNext()
+		}
+	case RELEASE:
+		if m.voted != nil && m.voted.sender == req.Sender && m.voted.stamp == req.Stamp {
+			m.grantNext()
+		}
+
+	// Requester
+	case LOCKED:
+		if m.requesting && req.Stamp == m.requestStamp {
+			m.grants[req.Sender] = true
+			m.checkCriticalSectionAccess()
+		}
+	case FAILED:
+		if m.requesting && req.Stamp == m.requestStamp {
+			m.failed = true
+			m.relinquish()
+		}
+	case INQUIRE:
+		if !m.requesting || m.hasAccess || req.Stamp != m.requestStamp {
+			break // The vote is given back with the release
+		}
+		m.inquiries = append(m.inquiries, req.Sender)
+		if m.failed {
+			m.relinquish()
+		}
+	}
+}
+
+// handle handles a message, then the messages sent by the server to itself
+func (m *Maekawa[T]) handle(req Request[T]) {
+	m.inbox = append(m.inbox, req)
+	for len(m.inbox) > 0 {
+		next := m.inbox[0]
+		m.inbox = m.inbox[1:]
+		if next.ReqType == REQ && next.Stamp == 0 || next.ReqType == REL {
+			m.handleOutgoingRequest(next)
+		} else {
+			m.handleIngoingRequest(next)
+		}
+	}
+	m.debug()
+}
+
+func (m *Maekawa[T]) Start() {
+	utils.LogInfo(false, "Maekawa:", "started", "quorum", m.quorum)
+	for {
+		select {
+		// REQ, LOCKED, FAILED, INQUIRE, RELINQUISH, RELEASE, UPD, REL
+		case request := <-m.protocol.GetMessageChan():
+			m.handle(request)
+		}
+	}
+}
@@ -0,0 +1,467 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package memory
+// This package implements an in-memory network used by the tests to run several servers in the same process.
+// The lines written on the connections are not delivered right away: a scheduler delivers them one at a time, once no
+// line has been written or delivered for QuietDelay, the servers have handled the previous one. The connection whose
+// next line is delivered is picked with a random generator: with the same seed, the servers receive the lines in the
+// same order. The delivered lines are recorded in the trace of the network.
+//
+// The servers also write lines on their own (startup, timers): the lines waiting at each step may differ from one run to
+// another. A network created with a trace replays it: each line is delivered in the recorded order once it has been
+// written, the scheduler falls back to the random generator if a line of the trace is not written in time. The lines
+// written on a connection by concurrent go routines may be written in another order than in the recorded run, they
+// are delivered in the recorded order.
+//
+// The scheduling is best-effort, the same seed does not guarantee the same interleaving: the quiet network is detected
+// with the clock, a server slower than QuietDelay to handle a line lets the scheduler pick among fewer lines, and the
+// timers of the servers write lines at times that depend on the load of the machine. A replay detects it: Divergence
+// gives the first line of the trace not written in time, the lines after it are delivered in a random order.
+package memory
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sdr/labo1/src/network"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	QuietDelay    = 2 * time.Millisecond // Delay without activity before the next line is delivered
+	ReplayTimeout = 2 * time.Second      // Delay to wait for the next line of a replayed trace
+	Backlog       = 16                   // Number of connections waiting to be accepted by a listener
+)
+
+// Delivery is a line delivered by the network
+//   - From, To: the names of the ends of the connection, the node that dialed it, the address and the number of the connection
+type Delivery struct {
+	From string
+	To   string
+	Line string
+}
+
+func (d Delivery) String() string {
+	return fmt.Sprintf("%s -> %s: %s", d.From, d.To, d.Line)
+}
+
+// Network
+// connects the transports of its nodes. A single mutex protects the listeners and the connections.
+type Network struct {
+	random       *rand.Rand
+	listeners    map[string]*listener
+	dials        map[string]int  // Number of connections dialed by a node to an address, used to name them
+	pending      map[string]*end // Ends whose lines are waiting to be delivered, by name
+	ends         []*end
+	trace        []Delivery
+	replay       []Delivery // Lines of the replayed trace not delivered yet
+	replayWait   time.Time  // Start of the wait for the next line of the replayed trace
+	divergence   int        // Index of the first line of the replayed trace not written in time, -1 if none
+	lastActivity time.Time  // Last line written or delivered
+	closed       bool
+	wake         chan bool
+	done         chan bool
+	mutex        sync.Mutex
+}
+
+// CreateNetwork Constructor, the scheduler picks the connections with a random generator initialized with the seed.
+// The interleaving of two runs with the same seed is the same only if the servers handle each line within QuietDelay.
+func CreateNetwork(seed int64) *Network {
+	n := &Network{
+		random:     rand.New(rand.NewSource(seed)),
+		listeners:  make(map[string]*listener),
+		dials:      make(map[string]int),
+		pending:    make(map[string]*end),
+		divergence: -1,
+		wake:       make(chan bool, 1),
+		done:       make(chan bool),
+	}
+	go n.schedule()
+	return n
+}
+
+// ReplayNetwork Constructor, the lines are delivered in the order of the trace of a previous run until a line is not
+// written within ReplayTimeout, see Divergence
+func ReplayNetwork(seed int64, trace []Delivery) *Network {
+	n := CreateNetwork(seed)
+	n.mutex.Lock()
+	n.replay = append([]Delivery{}, trace...)
+	n.mutex.Unlock()
+	return n
+}
+
+// Divergence gets the index of the first line of the replayed trace that was not written in time, -1 if the servers
+// wrote every line of the trace so far
+func (n *Network) Divergence() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.divergence
+}
+
+// Transport gets the transport of a node, the name of the node identifies its connections in the trace
+func (n *Network) Transport(node string) network.Transport {
+	return &transport{network: n, node: node}
+}
+
+// Trace gets the lines delivered since the creation of the network, in the order of their delivery
+func (n *Network) Trace() []Delivery {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return append([]Delivery{}, n.trace...)
+}
+
+// Close stops the scheduler and closes the listeners and the connections
+func (n *Network) Close() {
+	n.mutex.Lock()
+	if n.closed {
+		n.mutex.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.done)
+	var listeners []*listener
+	for _, l := range n.listeners {
+		listeners = append(listeners, l)
+	}
+	ends := n.ends
+	n.mutex.Unlock()
+
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+	for _, e := range ends {
+		_ = e.Close()
+	}
+}
+
+// touch records an activity and wakes the scheduler up, the mutex must be held
+func (n *Network) touch() {
+	n.lastActivity = time.Now()
+	select {
+	case n.wake <- true:
+	default:
+	}
+}
+
+// schedule delivers the lines written until the network is closed
+func (n *Network) schedule() {
+	ticker := time.NewTicker(QuietDelay)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.wake:
+		case <-ticker.C: // The next line of a replayed trace may be late
+		case <-n.done:
+			return
+		}
+		for n.deliverNext() {
+		}
+	}
+}
+
+// next picks the end whose line is delivered and moves the line to the head of its outbox, nil if the next line of the
+// replayed trace is not written yet. The mutex must be held.
+func (n *Network) next() *end {
+	for len(n.replay) > 0 {
+		expected := n.replay[0]
+		if e, ok := n.pending[expected.From]; ok {
+			for i, line := range e.outbox {
+				if line == expected.Line+"\n" {
+					copy(e.outbox[1:i+1], e.outbox[:i])
+					e.outbox[0] = line
+					n.replay = n.replay[1:]
+					n.replayWait = time.Time{}
+					return e
+				}
+			}
+		}
+		if n.replayWait.IsZero() {
+			n.replayWait = time.Now()
+		}
+		if time.Since(n.replayWait) < ReplayTimeout {
+			return nil
+		}
+		n.divergence = len(n.trace)
+		n.replay = nil
+	}
+
+	// The ends are sorted by name, their order does not depend on the order of the writes
+	names := make([]string, 0, len(n.pending))
+	for name := range n.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return n.pending[names[n.random.Intn(len(names))]]
+}
+
+// deliverNext waits until the network is quiet and delivers the next line of a connection.
+// It returns false if no line can be delivered.
+func (n *Network) deliverNext() bool {
+	n.mutex.Lock()
+	for {
+		if len(n.pending) == 0 || n.closed {
+			n.mutex.Unlock()
+			return false
+		}
+		wait := time.Until(n.lastActivity.Add(QuietDelay))
+		if wait <= 0 {
+			break
+		}
+		n.mutex.Unlock()
+		time.Sleep(wait)
+		n.mutex.Lock()
+	}
+	defer n.mutex.Unlock()
+
+	e := n.next()
+	if e == nil {
+		return false
+	}
+	line := e.outbox[0]
+	e.outbox = e.outbox[1:]
+	if len(e.outbox) == 0 {
+		delete(n.pending, e.name)
+	}
+	n.trace = append(n.trace, Delivery{From: e.name, To: e.peer.name, Line: strings.TrimSuffix(line, "\n")})
+	e.peer.deliver(line)
+	n.touch()
+	return true
+}
+
+type transport struct {
+	network *Network
+	node    string
+}
+
+func (t *transport) Listen(address string) (net.Listener, error) {
+	n := t.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		return nil, net.ErrClosed
+	}
+	if _, ok := n.listeners[address]; ok {
+		return nil, fmt.Errorf("listen %s: address already in use", address)
+	}
+	l := &listener{
+		network: n,
+		address: address,
+		accepts: make(chan *end, Backlog),
+		closed:  make(chan bool),
+	}
+	n.listeners[address] = l
+	return l, nil
+}
+
+// Dial connects to the listener of an address, the connection is accepted by the listener
+func (t *transport) Dial(address string) (net.Conn, error) {
+	n := t.network
+	n.mutex.Lock()
+	l, ok := n.listeners[address]
+	if !ok || n.closed {
+		n.mutex.Unlock()
+		return nil, fmt.Errorf("dial %s: connection refused", address)
+	}
+	key := t.node + ">" + address
+	n.dials[key]++
+	number := n.dials[key]
+	dialer := &end{
+		network: n,
+		name:    fmt.Sprintf("%s#%d", key, number),
+		local:   addr(fmt.Sprintf("%s#%d", t.node, number)),
+		remote:  addr(address),
+		ready:   make(chan bool, 1),
+	}
+	accepted := &end{
+		network: n,
+		name:    fmt.Sprintf("%s<%s#%d", address, t.node, number),
+		local:   addr(address),
+		remote:  dialer.local,
+		ready:   make(chan bool, 1),
+	}
+	dialer.peer, accepted.peer = accepted, dialer
+	n.ends = append(n.ends, dialer, accepted)
+	n.mutex.Unlock()
+
+	select {
+	case l.accepts <- accepted:
+		return dialer, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("dial %s: connection refused", address)
+	}
+}
+
+// listener accepts the connections dialed to its address
+type listener struct {
+	network *Network
+	address string
+	accepts chan *end
+	closed  chan bool
+	once    sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case e := <-l.accepts:
+		return e, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.network.mutex.Lock()
+	if l.network.listeners[l.address] == l {
+		delete(l.network.listeners, l.address)
+	}
+	l.network.mutex.Unlock()
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return addr(l.address)
+}
+
+// end is an end of a connection, the network mutex protects its buffers.
+// The lines written before the end is closed are still delivered, the lines written to a closed end are lost.
+//   - partial: the bytes written after the last complete line
+//   - outbox: the lines written, waiting to be delivered to the peer
+//   - inbox: the bytes delivered, waiting to be read
+//   - ready: notified when bytes are delivered or when the connection is closed
+type end struct {
+	network *Network
+	name    string
+	local   addr
+	remote  addr
+	peer    *end
+	partial []byte
+	outbox  []string
+	inbox   []byte
+	closed  bool
+	ready   chan bool
+}
+
+// notify wakes the reader of the end up
+func (e *end) notify() {
+	select {
+	case e.ready <- true:
+	default:
+	}
+}
+
+// deliver adds a line delivered to the end, the mutex must be held
+func (e *end) deliver(line string) {
+	if e.closed {
+		return
+	}
+	e.inbox = append(e.inbox, line...)
+	e.notify()
+}
+
+func (e *end) Read(p []byte) (int, error) {
+	for {
+		e.network.mutex.Lock()
+		switch {
+		case e.closed:
+			e.network.mutex.Unlock()
+			return 0, net.ErrClosed
+		case len(e.inbox) > 0 || len(p) == 0:
+			read := copy(p, e.inbox)
+			e.inbox = e.inbox[read:]
+			e.network.mutex.Unlock()
+			return read, nil
+		case e.peer.closed && len(e.peer.outbox) == 0:
+			e.network.mutex.Unlock()
+			return 0, io.EOF
+		}
+		e.network.mutex.Unlock()
+		<-e.ready
+	}
+}
+
+// Write queues the complete lines written, the empty lines (heartbeats) are delivered right away
+func (e *end) Write(p []byte) (int, error) {
+	n := e.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if e.closed {
+		return 0, net.ErrClosed
+	}
+	if e.peer.closed {
+		return 0, io.ErrClosedPipe
+	}
+	e.partial = append(e.partial, p...)
+	for {
+		i := bytes.IndexByte(e.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(e.partial[:i+1])
+		e.partial = e.partial[i+1:]
+		if strings.TrimSpace(line) == "" {
+			e.peer.deliver(line)
+			continue
+		}
+		e.outbox = append(e.outbox, line)
+		n.pending[e.name] = e
+		n.touch()
+	}
+	return len(p), nil
+}
+
+func (e *end) Close() error {
+	n := e.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if e.closed {
+		return net.ErrClosed
+	}
+	e.closed = true
+	e.inbox = nil
+	e.peer.outbox = nil
+	delete(n.pending, e.peer.name)
+	e.notify()
+	e.peer.notify()
+	return nil
+}
+
+func (e *end) LocalAddr() net.Addr {
+	return e.local
+}
+
+func (e *end) RemoteAddr() net.Addr {
+	return e.remote
+}
+
+var errDeadline = errors.New("deadlines are not supported by the in-memory network")
+
+func (e *end) SetDeadline(time.Time) error {
+	return errDeadline
+}
+
+func (e *end) SetReadDeadline(time.Time) error {
+	return errDeadline
+}
+
+func (e *end) SetWriteDeadline(time.Time) error {
+	return errDeadline
+}
+
+// addr is the address of a listener or the name of a node
+type addr string
+
+func (a addr) Network() string {
+	return "memory"
+}
+
+func (a addr) String() string {
+	return string(a)
+}
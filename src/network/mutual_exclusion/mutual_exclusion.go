@@ -0,0 +1,24 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package mutual_exclusion
+// This package defines the API shared by the distributed mutual exclusion algorithms.
+// The server only depends on this API, the algorithm used is selected in the server configuration.
+package mutual_exclusion
+
+// MutualExclusion
+// is the API used by the server to access the critical section shared by all the servers.
+//   - Start: starts listening to the algorithm messages, must be called in a go routine
+//   - SendClientAskCriticalSection: asks for the critical section, the returned channel receives when the access is granted
+//   - SendClientReleaseCriticalSection: leaves the critical section and replicates the data to the other servers
+//   - SendClientLeaveCriticalSection: leaves the critical section without data to replicate, only the messages needed
+//     by the algorithm are sent
+//   - GetDataChan: the channel receiving the data replicated when a server leaves the critical section,
+//     the data may be received more than once and out of order
+type MutualExclusion[T any] interface {
+	Start()
+	SendClientAskCriticalSection() chan bool
+	SendClientReleaseCriticalSection(data T)
+	SendClientLeaveCriticalSection()
+	GetDataChan() chan T
+}
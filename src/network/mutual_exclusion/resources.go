@@ -0,0 +1,437 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package mutual_exclusion
+
+import (
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"sync"
+	"time"
+)
+
+const TransferTimeout = 2 * time.Second // Delay to wait for the states of the servers
+
+// ResourceMutualExclusion
+// is the API used by the server to access the critical section of a named resource.
+// The critical sections of two different resources can be held at the same time by two different servers.
+type ResourceMutualExclusion[T any] interface {
+	Start()
+	Synchronize()
+	Flush()
+	SendClientAskCriticalSection(resource string) chan bool
+	SendClientReleaseCriticalSection(resource string, data T)
+	SendClientLeaveCriticalSection(resource string)
+}
+
+// PeerAware
+// is implemented by the algorithms that handle the crash and the return of a server.
+type PeerAware interface {
+	HandlePeerEvent(event server_server.PeerEvent)
+}
+
+// Clocked
+// is implemented by the algorithms using a logical clock, the clock is given to the servers joining the cluster.
+type Clocked interface {
+	GetClock() int
+	SetClock(stamp int)
+}
+
+// ResourceMessage is a message of the algorithm instance handling a resource, or a state transfer between two servers
+type ResourceMessage[M any, T any] struct {
+	Resource string       `json:"resource"`
+	Message  M            `json:"message"`
+	Transfer *Transfer[T] `json:"transfer,omitempty"`
+}
+
+// Transfer is the state of a server sent to a server joining the cluster
+//   - Request: the sender asks for the state
+//   - Data: the replicated data
+//   - Clocks: the logical clock of each resource
+type Transfer[T any] struct {
+	Sender  int            `json:"sender"`
+	Request bool           `json:"request"`
+	Data    T              `json:"data"`
+	Clocks  map[string]int `json:"clocks"`
+}
+
+// Resources
+// runs an instance of a mutual exclusion algorithm for each resource, created when the resource is first used.
+// All the instances share the same inter server protocol, their messages are tagged with the resource name.
+// The instances are never stopped: each resource used keeps its instance and 3 goroutines (the algorithm, the delivery
+// of its messages and of its data) until the server stops, the memory grows with the number of resources. An idle
+// instance cannot be stopped safely, it may hold the token or the privilege, or the votes of other servers.
+type Resources[M any, T any] struct {
+	protocol  server_server.Protocol[ResourceMessage[M, T]]
+	create    func(p server_server.Protocol[M]) MutualExclusion[T]
+	apply     func(data T)
+	snapshot  func() T
+	resources map[string]*resource[M, T]
+	clocks    map[string]int // Greatest clocks received from the cluster, given to the instances when they are created
+	clock     int            // Greatest clock received, given to the instances of the resources unknown by the senders
+	transfers chan Transfer[T]
+	mutex     sync.Mutex
+	syncing   sync.Mutex // Held while the state is fetched from the cluster
+}
+
+type resource[M any, T any] struct {
+	instance MutualExclusion[T]
+	protocol *resourceProtocol[M, T]
+	queue    *resourceQueue[M]
+	asks     chan ask
+	flushes  chan chan bool
+}
+
+// resourceItem is a message or a peer event waiting to be given to the instance of a resource
+type resourceItem[M any] struct {
+	message M
+	event   *server_server.PeerEvent
+}
+
+// resourceQueue
+// is the messages and peer events of a resource waiting to be given to its instance, in their order of arrival.
+// The queue is not bounded: a resource whose instance is slow does not block the messages of the other resources.
+//   - pending: the items pushed and not yet received by the instance
+type resourceQueue[M any] struct {
+	items   []resourceItem[M]
+	pending int
+	cond    *sync.Cond
+	mutex   sync.Mutex
+}
+
+func createResourceQueue[M any]() *resourceQueue[M] {
+	q := &resourceQueue[M]{}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+func (q *resourceQueue[M]) push(item resourceItem[M]) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.items = append(q.items, item)
+	q.pending++
+	q.cond.Broadcast()
+}
+
+// pop waits for the next item, done must be called once it is received by the instance
+func (q *resourceQueue[M]) pop() resourceItem[M] {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.items) == 0 {
+		q.cond.Wait()
+	}
+	item := q.items[0]
+	q.items[0] = resourceItem[M]{}
+	q.items = q.items[1:]
+	return item
+}
+
+func (q *resourceQueue[M]) done() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.pending--
+	q.cond.Broadcast()
+}
+
+// wait waits until every item pushed is received by the instance
+func (q *resourceQueue[M]) wait() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for q.pending > 0 {
+		q.cond.Wait()
+	}
+}
+
+// ask is a pending access to the critical section of a resource
+// - access: the channel of the algorithm instance notifying the access
+// - granted: the channel notifying the server once the replicated data is applied
+type ask struct {
+	access  chan bool
+	granted chan bool
+}
+
+// CreateResources Constructor
+//   - create: creates the algorithm instance of a resource using the given protocol
+//   - apply: the function called with the data replicated when a server leaves a critical section
+//   - snapshot: gets the current data, sent to the servers joining the cluster
+func CreateResources[M any, T any](p server_server.Protocol[ResourceMessage[M, T]], create func(p server_server.Protocol[M]) MutualExclusion[T], apply func(data T), snapshot func() T) *Resources[M, T] {
+	return &Resources[M, T]{
+		protocol:  p,
+		create:    create,
+		apply:     apply,
+		snapshot:  snapshot,
+		resources: make(map[string]*resource[M, T]),
+		clocks:    make(map[string]int),
+		transfers: make(chan Transfer[T], p.GetNumberOfServers()),
+	}
+}
+
+// get gets the instance of a resource, the instance is created and started if needed
+func (r *Resources[M, T]) get(name string) *resource[M, T] {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if res, ok := r.resources[name]; ok {
+		return res
+	}
+	p := &resourceProtocol[M, T]{
+		name:        name,
+		protocol:    r.protocol,
+		chanMessage: make(chan M),
+	}
+	res := &resource[M, T]{
+		instance: r.create(p),
+		protocol: p,
+		queue:    createResourceQueue[M](),
+		asks:     make(chan ask),
+		flushes:  make(chan chan bool),
+	}
+	r.resources[name] = res
+	if clocked, ok := res.instance.(Clocked); ok {
+		clock, known := r.clocks[name]
+		if !known { // The resource was not used by the senders of the state yet
+			clock = r.clock
+		}
+		clocked.SetClock(clock)
+	}
+	go res.instance.Start()
+	go r.deliver(res)
+	go r.handleData(res)
+	utils.LogInfo(false, "mutual exclusion", "resource", name, "created")
+	return res
+}
+
+// deliver gives the messages and the peer events of a resource to its instance, in their order of arrival
+func (r *Resources[M, T]) deliver(res *resource[M, T]) {
+	for {
+		item := res.queue.pop()
+		if item.event == nil {
+			res.protocol.chanMessage <- item.message
+		} else if handler, ok := res.instance.(PeerAware); ok {
+			handler.HandlePeerEvent(*item.event)
+		}
+		res.queue.done()
+	}
+}
+
+// handleData applies the replicated data of a resource. When the access is granted,
+// the data received before the access is applied before the server is notified.
+func (r *Resources[M, T]) handleData(res *resource[M, T]) {
+	data := res.instance.GetDataChan()
+	applyReceived := func() { // Applies the data already received, without waiting for more
+		for applied := true; applied; {
+			select {
+			case d := <-data:
+				r.apply(d)
+			default:
+				applied = false
+			}
+		}
+	}
+	for {
+		select {
+		case d := <-data:
+			r.apply(d)
+		case done := <-res.flushes:
+			applyReceived()
+			close(done)
+		case a := <-res.asks:
+			for waiting := true; waiting; {
+				select {
+				case d := <-data:
+					r.apply(d)
+				case done := <-res.flushes:
+					applyReceived()
+					close(done)
+				case <-a.access:
+					applyReceived()
+					waiting = false
+				}
+			}
+			a.granted <- true
+		}
+	}
+}
+
+// Flush gives the messages received to the instances of the resources and applies the replicated data not applied yet.
+// The messages must not be received meanwhile.
+func (r *Resources[M, T]) Flush() {
+	r.mutex.Lock()
+	resources := make([]*resource[M, T], 0, len(r.resources))
+	for _, res := range r.resources {
+		resources = append(resources, res)
+	}
+	r.mutex.Unlock()
+	for _, res := range resources {
+		res.queue.wait()
+		done := make(chan bool)
+		res.flushes <- done
+		<-done
+	}
+}
+
+// SendClientAskCriticalSection asks for the critical section of a resource
+func (r *Resources[M, T]) SendClientAskCriticalSection(resource string) chan bool {
+	res := r.get(resource)
+	a := ask{
+		access:  res.instance.SendClientAskCriticalSection(),
+		granted: make(chan bool, 1),
+	}
+	res.asks <- a
+	return a.granted
+}
+
+// SendClientReleaseCriticalSection leaves the critical section of a resource
+func (r *Resources[M, T]) SendClientReleaseCriticalSection(resource string, data T) {
+	r.get(resource).instance.SendClientReleaseCriticalSection(data)
+}
+
+// SendClientLeaveCriticalSection leaves the critical section of a resource without data to replicate
+func (r *Resources[M, T]) SendClientLeaveCriticalSection(resource string) {
+	r.get(resource).instance.SendClientLeaveCriticalSection()
+}
+
+// Start dispatches the messages received from the other servers to the queues of the resources, it never waits for
+// an instance. The crashes and returns of the servers are queued with the messages of every resource, they are
+// notified to the instances able to handle them.
+func (r *Resources[M, T]) Start() {
+	utils.LogInfo(false, "mutual exclusion:", "started")
+	for {
+		select {
+		case message := <-r.protocol.GetMessageChan():
+			if message.Transfer != nil {
+				r.handleTransfer(*message.Transfer)
+				continue
+			}
+			r.get(message.Resource).queue.push(resourceItem[M]{message: message.Message})
+		case event := <-r.protocol.GetPeerChan():
+			r.mutex.Lock()
+			for _, res := range r.resources {
+				e := event
+				res.queue.push(resourceItem[M]{event: &e})
+			}
+			r.mutex.Unlock()
+		}
+	}
+}
+
+// Synchronize fetches the data and the clocks of the resources from every connected server of the cluster.
+// It is called after Start and before the server handles its first client, or when replicated data has been missed.
+// A server may not have received the last data released by another one yet: the data of every server is applied, the
+// apply function keeps the newest version, and the greatest clock of each resource is kept. The server releasing the
+// data applies it before its release, the newest data is therefore received from it if it is connected.
+// It returns when every server has answered or after TransferTimeout, or when the state is already being fetched.
+func (r *Resources[M, T]) Synchronize() {
+	if !r.syncing.TryLock() {
+		return
+	}
+	defer r.syncing.Unlock()
+	waiting := make(map[int]bool)
+	for serverId := 0; serverId < r.protocol.GetNumberOfServers(); serverId++ {
+		if serverId == r.protocol.GetServerId() || !r.protocol.IsConnected(serverId) {
+			continue
+		}
+		err := r.protocol.SendTo(serverId, ResourceMessage[M, T]{
+			Transfer: &Transfer[T]{Sender: r.protocol.GetServerId(), Request: true},
+		})
+		if err == nil {
+			waiting[serverId] = true
+		}
+	}
+	timeout := time.After(TransferTimeout)
+	for len(waiting) > 0 {
+		select {
+		case transfer := <-r.transfers:
+			delete(waiting, transfer.Sender)
+			r.apply(transfer.Data)
+			r.mutex.Lock()
+			for name, stamp := range transfer.Clocks {
+				if known, ok := r.clocks[name]; !ok || stamp > known {
+					r.clocks[name] = stamp
+				}
+				if stamp > r.clock {
+					r.clock = stamp
+				}
+			}
+			r.mutex.Unlock()
+			utils.LogSuccess(false, "mutual exclusion", "state received from server", transfer.Sender)
+		case <-timeout:
+			utils.LogWarning(false, "mutual exclusion", len(waiting), "servers did not send their state")
+			return
+		}
+	}
+}
+
+// handleTransfer answers to a server asking for the state, or gives the state received to Synchronize
+func (r *Resources[M, T]) handleTransfer(transfer Transfer[T]) {
+	if transfer.Request {
+		go r.sendState(transfer.Sender)
+		return
+	}
+	select {
+	case r.transfers <- transfer:
+	default: // The state of every server has already been received
+	}
+}
+
+// sendState sends the data and the clocks of the resources to a server joining the cluster
+func (r *Resources[M, T]) sendState(serverId int) {
+	transfer := Transfer[T]{
+		Sender: r.protocol.GetServerId(),
+		Data:   r.snapshot(),
+		Clocks: make(map[string]int),
+	}
+	r.mutex.Lock()
+	instances := make(map[string]MutualExclusion[T], len(r.resources))
+	for name, res := range r.resources {
+		instances[name] = res.instance
+	}
+	r.mutex.Unlock()
+	for name, instance := range instances {
+		if clocked, ok := instance.(Clocked); ok {
+			transfer.Clocks[name] = clocked.GetClock()
+		}
+	}
+	_ = r.protocol.SendTo(serverId, ResourceMessage[M, T]{Transfer: &transfer})
+}
+
+// resourceProtocol
+// is the protocol given to the instance of a resource, it tags the messages with the resource name.
+type resourceProtocol[M any, T any] struct {
+	name        string
+	protocol    server_server.Protocol[ResourceMessage[M, T]]
+	chanMessage chan M
+}
+
+func (p *resourceProtocol[M, T]) SendTo(serverId int, data M) error {
+	return p.protocol.SendTo(serverId, ResourceMessage[M, T]{Resource: p.name, Message: data})
+}
+
+func (p *resourceProtocol[M, T]) SendToAll(data M) error {
+	return p.protocol.SendToAll(ResourceMessage[M, T]{Resource: p.name, Message: data})
+}
+
+func (p *resourceProtocol[M, T]) GetMessageChan() chan M {
+	return p.chanMessage
+}
+
+// GetPeerChan returns nil, the peer events are given to the instance by Resources
+func (p *resourceProtocol[M, T]) GetPeerChan() chan server_server.PeerEvent {
+	return nil
+}
+
+func (p *resourceProtocol[M, T]) GetServerId() int {
+	return p.protocol.GetServerId()
+}
+
+func (p *resourceProtocol[M, T]) GetNumberOfServers() int {
+	return p.protocol.GetNumberOfServers()
+}
+
+func (p *resourceProtocol[M, T]) IsConnected(serverId int) bool {
+	return p.protocol.IsConnected(serverId)
+}
+
+func (p *resourceProtocol[M, T]) GetSentMessages() int64 {
+	return p.protocol.GetSentMessages()
+}
@@ -0,0 +1,659 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package raft
+// This package replicates a log of commands with the Raft consensus algorithm.
+// The commands are applied in the same order by every server, the log is compacted with snapshots of the state.
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"time"
+)
+
+type MessageType int
+
+const (
+	VOTE     MessageType = 0 // A candidate asks for a vote
+	VOTED    MessageType = 1 // Answer to VOTE
+	APPEND   MessageType = 2 // The leader replicates its entries, also used as heartbeat
+	APPENDED MessageType = 3 // Answer to APPEND and SNAPSHOT
+	SNAPSHOT MessageType = 4 // The leader sends its snapshot to a follower missing compacted entries
+	FORWARD  MessageType = 5 // A follower forwards a command to the leader
+)
+
+type Role int
+
+const (
+	Follower  Role = 0
+	Candidate Role = 1
+	Leader    Role = 2
+)
+
+func (role Role) String() string {
+	return [...]string{"follower", "candidate", "leader"}[role]
+}
+
+const (
+	TickInterval       = 20 * time.Millisecond
+	HeartbeatInterval  = 100 * time.Millisecond  // Delay between two APPEND sent by the leader
+	MinElectionTimeout = 500 * time.Millisecond  // Minimum delay without APPEND before an election
+	MaxElectionTimeout = 1000 * time.Millisecond // Maximum delay without APPEND before an election, the delay is random
+	SubmitTimeout      = 5 * time.Second         // Delay to wait for a command to be applied
+	SnapshotThreshold  = 64                      // Number of applied entries in the log before it is compacted
+	MaxEntries         = 64                      // Maximum number of entries sent in an APPEND
+)
+
+// RequestId identifies a command submitted by a server, the server is notified when it is applied
+type RequestId struct {
+	Server int `json:"server"`
+	Number int `json:"number"`
+}
+
+// Entry is an entry of the replicated log
+//   - Noop: entry appended by a new leader to commit the entries of the previous terms
+type Entry[C any] struct {
+	Term    int       `json:"term"`
+	Command C         `json:"command"`
+	Noop    bool      `json:"noop,omitempty"`
+	Request RequestId `json:"request"`
+}
+
+// Snapshot is the state of the server once the entries up to LastIndex are applied
+type Snapshot[S any] struct {
+	LastIndex int `json:"lastIndex"`
+	LastTerm  int `json:"lastTerm"`
+	State     S   `json:"state"`
+}
+
+// Message is a message exchanged by the servers, the fields used depend on its type
+//   - VOTE: LastLogIndex, LastLogTerm
+//   - VOTED: Granted
+//   - APPEND: PrevLogIndex, PrevLogTerm, Entries, LeaderCommit
+//   - APPENDED: Success, MatchIndex (the last index known to match, or a hint for the next APPEND on failure)
+//   - SNAPSHOT: Snapshot
+//   - FORWARD: Entry
+type Message[C any, S any] struct {
+	Type         MessageType  `json:"type"`
+	Term         int          `json:"term"`
+	Sender       int          `json:"sender"`
+	LastLogIndex int          `json:"lastLogIndex,omitempty"`
+	LastLogTerm  int          `json:"lastLogTerm,omitempty"`
+	Granted      bool         `json:"granted,omitempty"`
+	PrevLogIndex int          `json:"prevLogIndex,omitempty"`
+	PrevLogTerm  int          `json:"prevLogTerm,omitempty"`
+	Entries      []Entry[C]   `json:"entries,omitempty"`
+	LeaderCommit int          `json:"leaderCommit,omitempty"`
+	Success      bool         `json:"success,omitempty"`
+	MatchIndex   int          `json:"matchIndex,omitempty"`
+	Snapshot     *Snapshot[S] `json:"snapshot,omitempty"`
+	Entry        *Entry[C]    `json:"entry,omitempty"`
+}
+
+// submit is a command submitted by the server, the result is sent once the command is applied
+type submit[C any, R any] struct {
+	command C
+	result  chan R
+}
+
+// Raft
+// replicates the commands C, applied by the server with a result R. The state S of the server is used for the snapshots.
+type Raft[C any, S any, R any] struct {
+	protocol     server_server.Protocol[Message[C, S]]
+	apply        func(command C) R
+	takeSnapshot func() S
+	restore      func(state S)
+	storage      Storage[C, S]
+	dirty        bool // The state changed since it was saved
+
+	role     Role
+	term     int
+	votedFor int
+	leader   int
+	votes    map[int]bool
+
+	log         []Entry[C] // The first entry is the last entry of the snapshot
+	snapshot    Snapshot[S]
+	commitIndex int
+	lastApplied int
+	nextIndex   map[int]int
+	matchIndex  map[int]int
+
+	electionDeadline time.Time
+	lastHeartbeat    time.Time
+	random           *rand.Rand
+
+	requests int                  // Number of commands submitted by the server
+	waiting  []Entry[C]           // Commands submitted while the leader is unknown
+	results  map[RequestId]chan R // Submitted commands waiting to be applied
+	submits  chan submit[C, R]
+	cancels  chan chan R // Submitted commands no longer waited for
+}
+
+// InitRaft inits the needed structure for Raft
+//   - apply: applies a committed command to the state of the server
+//   - takeSnapshot: gets the state of the server, used to compact the log
+//   - restore: replaces the state of the server by the snapshot received from the leader
+//   - storage: keeps the term, the vote and the log between the restarts, nil to keep them only in memory
+//
+// The saved state is restored before the function returns.
+func InitRaft[C any, S any, R any](p server_server.Protocol[Message[C, S]], apply func(command C) R, takeSnapshot func() S, restore func(state S), storage Storage[C, S]) Raft[C, S, R] {
+	r := Raft[C, S, R]{
+		protocol:     p,
+		apply:        apply,
+		takeSnapshot: takeSnapshot,
+		restore:      restore,
+		storage:      storage,
+		role:         Follower,
+		votedFor:     -1,
+		leader:       -1,
+		log:          []Entry[C]{{}},
+		nextIndex:    make(map[int]int),
+		matchIndex:   make(map[int]int),
+		results:      make(map[RequestId]chan R),
+		submits:      make(chan submit[C, R]),
+		cancels:      make(chan chan R),
+		random:       rand.New(rand.NewSource(time.Now().UnixNano() + int64(p.GetServerId()))),
+	}
+	r.load()
+	return r
+}
+
+func (r *Raft[C, S, R]) id() int {
+	return r.protocol.GetServerId()
+}
+
+func (r *Raft[C, S, R]) majority() int {
+	return r.protocol.GetNumberOfServers()/2 + 1
+}
+
+func (r *Raft[C, S, R]) lastIndex() int {
+	return r.snapshot.LastIndex + len(r.log) - 1
+}
+
+// entry gets the entry at an index of the log, the index must not be compacted
+func (r *Raft[C, S, R]) entry(index int) Entry[C] {
+	return r.log[index-r.snapshot.LastIndex]
+}
+
+func (r *Raft[C, S, R]) termAt(index int) int {
+	return r.entry(index).Term
+}
+
+func (r *Raft[C, S, R]) debug() {
+	if !utils.IsLogEnabled() {
+		return
+	}
+
+	headers := []string{"Server", "Role", "Term", "Leader", "Last", "Commit", "Applied", "Snapshot", "M"}
+	data := fmt.Sprintf("%d\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d", r.id(), r.role, r.term, r.leader, r.lastIndex(),
+		r.commitIndex, r.lastApplied, r.snapshot.LastIndex, r.protocol.GetSentMessages())
+	utils.PrintTable(headers, []string{data})
+}
+
+// Submit replicates a command and waits until it is applied by the server, the result of the command is returned
+func (r *Raft[C, S, R]) Submit(command C) (R, error) {
+	result := make(chan R, 1)
+	r.submits <- submit[C, R]{command: command, result: result}
+	select {
+	case res := <-result:
+		return res, nil
+	case <-time.After(SubmitTimeout):
+		r.cancels <- result
+		var zero R
+		return zero, errors.New("timeout, the command may not have been applied (no leader available)")
+	}
+}
+
+// save saves the state if it changed, it must be called before sending a message depending on it
+func (r *Raft[C, S, R]) save() bool {
+	if !r.dirty || r.storage == nil {
+		return true
+	}
+	err := r.storage.Save(State[C, S]{
+		Term:     r.term,
+		VotedFor: r.votedFor,
+		Requests: r.requests,
+		Log:      r.log,
+		Snapshot: r.snapshot,
+	})
+	if err != nil {
+		utils.LogError(false, "Raft:", "cannot save the state:", err.Error())
+		return false
+	}
+	r.dirty = false
+	return true
+}
+
+// load restores the state saved before a restart, the entries of the snapshot are applied again
+func (r *Raft[C, S, R]) load() {
+	if r.storage == nil {
+		return
+	}
+	state, found, err := r.storage.Load()
+	if err != nil {
+		utils.LogError(true, "Raft:", "cannot load the state:", err.Error())
+		os.Exit(1)
+	}
+	if !found {
+		return
+	}
+	r.term, r.votedFor, r.requests, r.log, r.snapshot = state.Term, state.VotedFor, state.Requests, state.Log, state.Snapshot
+	if len(r.log) == 0 {
+		r.log = []Entry[C]{{Term: r.snapshot.LastTerm}}
+	}
+	if r.snapshot.LastIndex > 0 {
+		r.restore(r.snapshot.State)
+	}
+	r.commitIndex = r.snapshot.LastIndex
+	r.lastApplied = r.snapshot.LastIndex
+	utils.LogInfo(false, "Raft:", "state restored in term", r.term, "up to", r.lastIndex())
+}
+
+// sendTo sends a message once the state it depends on is saved, it is dropped if the state cannot be saved
+func (r *Raft[C, S, R]) sendTo(serverId int, m Message[C, S]) {
+	if r.save() {
+		_ = r.protocol.SendTo(serverId, m)
+	}
+}
+
+func (r *Raft[C, S, R]) sendToAll(m Message[C, S]) {
+	if r.save() {
+		_ = r.protocol.SendToAll(m)
+	}
+}
+
+func (r *Raft[C, S, R]) resetElectionTimer() {
+	timeout := MinElectionTimeout + time.Duration(r.random.Int63n(int64(MaxElectionTimeout-MinElectionTimeout)))
+	r.electionDeadline = time.Now().Add(timeout)
+}
+
+// becomeFollower follows the leader of a term, the vote is reset when the term changes
+func (r *Raft[C, S, R]) becomeFollower(term int, leader int) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = -1
+		r.dirty = true
+	}
+	changed := r.role != Follower || r.leader != leader
+	r.role = Follower
+	r.leader = leader
+	if changed {
+		if leader != -1 {
+			utils.LogInfo(false, "Raft:", "following server", leader, "in term", term)
+			r.flushWaiting()
+		}
+		r.debug()
+	}
+}
+
+func (r *Raft[C, S, R]) startElection() {
+	r.role = Candidate
+	r.term++
+	r.votedFor = r.id()
+	r.dirty = true
+	r.leader = -1
+	r.votes = map[int]bool{r.id(): true}
+	r.resetElectionTimer()
+	utils.LogInfo(false, "Raft:", "election for term", r.term)
+	r.sendToAll(Message[C, S]{
+		Type:         VOTE,
+		Term:         r.term,
+		Sender:       r.id(),
+		LastLogIndex: r.lastIndex(),
+		LastLogTerm:  r.termAt(r.lastIndex()),
+	})
+	r.checkVotes()
+}
+
+func (r *Raft[C, S, R]) checkVotes() {
+	if r.role == Candidate && len(r.votes) >= r.majority() {
+		r.becomeLeader()
+	}
+}
+
+// becomeLeader appends an empty entry to commit the entries of the previous terms
+func (r *Raft[C, S, R]) becomeLeader() {
+	r.role = Leader
+	r.leader = r.id()
+	for i := 0; i < r.protocol.GetNumberOfServers(); i++ {
+		r.nextIndex[i] = r.lastIndex() + 1
+		r.matchIndex[i] = 0
+	}
+	utils.LogSuccess(true, "Raft:", "leader of term", r.term)
+	r.log = append(r.log, Entry[C]{Term: r.term, Noop: true})
+	r.dirty = true
+	r.flushWaiting()
+	r.advanceCommit()
+	r.broadcastAppend()
+	r.debug()
+}
+
+// route appends a command if the server is the leader, otherwise forwards it to the leader
+func (r *Raft[C, S, R]) route(entry Entry[C]) {
+	switch {
+	case r.role == Leader:
+		entry.Term = r.term
+		r.log = append(r.log, entry)
+		r.dirty = true
+		r.advanceCommit()
+		r.broadcastAppend()
+	case r.leader != -1:
+		r.sendTo(r.leader, Message[C, S]{
+			Type:   FORWARD,
+			Term:   r.term,
+			Sender: r.id(),
+			Entry:  &entry,
+		})
+	default:
+		r.waiting = append(r.waiting, entry)
+	}
+}
+
+// flushWaiting routes the commands submitted while the leader was unknown
+func (r *Raft[C, S, R]) flushWaiting() {
+	waiting := r.waiting
+	r.waiting = nil
+	for _, entry := range waiting {
+		r.route(entry)
+	}
+}
+
+func (r *Raft[C, S, R]) broadcastAppend() {
+	r.lastHeartbeat = time.Now()
+	for i := 0; i < r.protocol.GetNumberOfServers(); i++ {
+		if i != r.id() {
+			r.sendAppend(i)
+		}
+	}
+}
+
+// sendAppend sends the entries a follower is missing, or the snapshot if they are compacted
+func (r *Raft[C, S, R]) sendAppend(serverId int) {
+	next := r.nextIndex[serverId]
+	if next <= r.snapshot.LastIndex {
+		snapshot := r.snapshot
+		r.sendTo(serverId, Message[C, S]{
+			Type:     SNAPSHOT,
+			Term:     r.term,
+			Sender:   r.id(),
+			Snapshot: &snapshot,
+		})
+		return
+	}
+	last := r.lastIndex()
+	if last >= next+MaxEntries {
+		last = next + MaxEntries - 1
+	}
+	var entries []Entry[C]
+	for index := next; index <= last; index++ {
+		entries = append(entries, r.entry(index))
+	}
+	r.sendTo(serverId, Message[C, S]{
+		Type:         APPEND,
+		Term:         r.term,
+		Sender:       r.id(),
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  r.termAt(next - 1),
+		Entries:      entries,
+		LeaderCommit: r.commitIndex,
+	})
+}
+
+// advanceCommit commits the entries of the current term replicated on a majority of servers
+func (r *Raft[C, S, R]) advanceCommit() {
+	for index := r.lastIndex(); index > r.commitIndex && r.termAt(index) == r.term; index-- {
+		count := 1
+		for serverId, match := range r.matchIndex {
+			if serverId != r.id() && match >= index {
+				count++
+			}
+		}
+		if count >= r.majority() {
+			r.commitIndex = index
+			return
+		}
+	}
+}
+
+func (r *Raft[C, S, R]) handleVote(m Message[C, S]) {
+	lastTerm := r.termAt(r.lastIndex())
+	upToDate := m.LastLogTerm > lastTerm || m.LastLogTerm == lastTerm && m.LastLogIndex >= r.lastIndex()
+	granted := m.Term == r.term && (r.votedFor == -1 || r.votedFor == m.Sender) && upToDate
+	if granted {
+		r.votedFor = m.Sender
+		r.dirty = true
+		r.resetElectionTimer()
+	}
+	r.sendTo(m.Sender, Message[C, S]{
+		Type:    VOTED,
+		Term:    r.term,
+		Sender:  r.id(),
+		Granted: granted,
+	})
+}
+
+func (r *Raft[C, S, R]) handleAppend(m Message[C, S]) {
+	reply := Message[C, S]{
+		Type:   APPENDED,
+		Term:   r.term,
+		Sender: r.id(),
+	}
+	if m.Term < r.term {
+		r.sendTo(m.Sender, reply)
+		return
+	}
+	r.resetElectionTimer()
+	r.becomeFollower(m.Term, m.Sender)
+
+	prevIndex, entries := m.PrevLogIndex, m.Entries
+	switch {
+	case prevIndex > r.lastIndex(): // Entries are missing
+		reply.MatchIndex = r.lastIndex()
+		r.sendTo(m.Sender, reply)
+		return
+	case prevIndex < r.snapshot.LastIndex: // The entries in the snapshot are committed, they match
+		skip := r.snapshot.LastIndex - prevIndex
+		if skip >= len(entries) {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prevIndex = r.snapshot.LastIndex
+	case r.termAt(prevIndex) != m.PrevLogTerm: // The committed entries match
+		reply.MatchIndex = r.commitIndex
+		r.sendTo(m.Sender, reply)
+		return
+	}
+
+	for k, entry := range entries {
+		index := prevIndex + 1 + k
+		if index <= r.lastIndex() {
+			if r.termAt(index) == entry.Term {
+				continue
+			}
+			r.log = r.log[:index-r.snapshot.LastIndex] // Conflict, the following entries are removed
+		}
+		r.log = append(r.log, entries[k:]...)
+		r.dirty = true
+		break
+	}
+	match := prevIndex + len(entries)
+	if m.LeaderCommit > r.commitIndex {
+		r.commitIndex = m.LeaderCommit
+		if match < r.commitIndex {
+			r.commitIndex = match
+		}
+	}
+	reply.Success = true
+	reply.MatchIndex = match
+	r.sendTo(m.Sender, reply)
+}
+
+func (r *Raft[C, S, R]) handleAppended(m Message[C, S]) {
+	if r.role != Leader || m.Term != r.term {
+		return
+	}
+	if !m.Success {
+		r.nextIndex[m.Sender] = m.MatchIndex + 1
+		r.sendAppend(m.Sender)
+		return
+	}
+	if m.MatchIndex > r.matchIndex[m.Sender] {
+		r.matchIndex[m.Sender] = m.MatchIndex
+	}
+	if r.nextIndex[m.Sender] <= m.MatchIndex {
+		r.nextIndex[m.Sender] = m.MatchIndex + 1
+	}
+	r.advanceCommit()
+	if r.nextIndex[m.Sender] <= r.lastIndex() {
+		r.sendAppend(m.Sender)
+	}
+}
+
+// handleSnapshot installs the snapshot of the leader, the entries following the snapshot are kept if they match
+func (r *Raft[C, S, R]) handleSnapshot(m Message[C, S]) {
+	reply := Message[C, S]{
+		Type:   APPENDED,
+		Term:   r.term,
+		Sender: r.id(),
+	}
+	if m.Term < r.term || m.Snapshot == nil {
+		r.sendTo(m.Sender, reply)
+		return
+	}
+	r.resetElectionTimer()
+	r.becomeFollower(m.Term, m.Sender)
+
+	snapshot := *m.Snapshot
+	if snapshot.LastIndex > r.snapshot.LastIndex {
+		if snapshot.LastIndex <= r.lastIndex() && r.termAt(snapshot.LastIndex) == snapshot.LastTerm {
+			r.log = r.log[snapshot.LastIndex-r.snapshot.LastIndex:]
+		} else {
+			r.log = []Entry[C]{{Term: snapshot.LastTerm}}
+		}
+		r.snapshot = snapshot
+		r.dirty = true
+		if snapshot.LastIndex > r.lastApplied {
+			r.restore(snapshot.State)
+			r.lastApplied = snapshot.LastIndex
+		}
+		if snapshot.LastIndex > r.commitIndex {
+			r.commitIndex = snapshot.LastIndex
+		}
+		utils.LogInfo(false, "Raft:", "snapshot installed up to", snapshot.LastIndex)
+	}
+	reply.Success = true
+	reply.MatchIndex = snapshot.LastIndex
+	r.sendTo(m.Sender, reply)
+}
+
+func (r *Raft[C, S, R]) handleMessage(m Message[C, S]) {
+	if m.Term > r.term {
+		r.becomeFollower(m.Term, -1)
+	}
+	switch m.Type {
+	case VOTE:
+		r.handleVote(m)
+	case VOTED:
+		if r.role == Candidate && m.Term == r.term && m.Granted {
+			r.votes[m.Sender] = true
+			r.checkVotes()
+		}
+	case APPEND:
+		r.handleAppend(m)
+	case APPENDED:
+		r.handleAppended(m)
+	case SNAPSHOT:
+		r.handleSnapshot(m)
+	case FORWARD:
+		if m.Entry != nil {
+			r.route(*m.Entry)
+		}
+	}
+}
+
+// applyCommitted applies the committed entries and compacts the log once it is too long
+func (r *Raft[C, S, R]) applyCommitted() {
+	if r.lastApplied >= r.commitIndex || !r.save() { // The entries are saved before they are applied
+		return
+	}
+	for r.lastApplied < r.commitIndex {
+		r.lastApplied++
+		entry := r.entry(r.lastApplied)
+		if entry.Noop {
+			continue
+		}
+		result := r.apply(entry.Command)
+		if res, ok := r.results[entry.Request]; ok {
+			res <- result
+			delete(r.results, entry.Request)
+		}
+	}
+	if r.lastApplied-r.snapshot.LastIndex >= SnapshotThreshold {
+		r.log = append([]Entry[C]{{Term: r.termAt(r.lastApplied)}}, r.log[r.lastApplied-r.snapshot.LastIndex+1:]...)
+		r.snapshot = Snapshot[S]{
+			LastIndex: r.lastApplied,
+			LastTerm:  r.log[0].Term,
+			State:     r.takeSnapshot(),
+		}
+		r.dirty = true
+		utils.LogInfo(false, "Raft:", "log compacted up to", r.lastApplied)
+	}
+	r.debug()
+}
+
+func (r *Raft[C, S, R]) handleSubmit(s submit[C, R]) {
+	r.requests++
+	r.dirty = true
+	request := RequestId{Server: r.id(), Number: r.requests}
+	r.results[request] = s.result
+	r.route(Entry[C]{Command: s.command, Request: request})
+}
+
+// cancel forgets a submitted command after its timeout, its entry may be lost or applied later without result
+func (r *Raft[C, S, R]) cancel(result chan R) {
+	for request, res := range r.results {
+		if res == result {
+			delete(r.results, request)
+		}
+	}
+}
+
+func (r *Raft[C, S, R]) tick() {
+	if r.role == Leader {
+		if time.Since(r.lastHeartbeat) >= HeartbeatInterval {
+			r.broadcastAppend()
+		}
+	} else if time.Now().After(r.electionDeadline) {
+		r.startElection()
+	}
+}
+
+func (r *Raft[C, S, R]) Start() {
+	utils.LogInfo(false, "Raft:", "started")
+	r.resetElectionTimer()
+	ticker := time.NewTicker(TickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		// VOTE, VOTED, APPEND, APPENDED, SNAPSHOT, FORWARD
+		case message := <-r.protocol.GetMessageChan():
+			r.handleMessage(message)
+		case s := <-r.submits:
+			r.handleSubmit(s)
+		case result := <-r.cancels:
+			r.cancel(result)
+		case <-r.protocol.GetPeerChan():
+			// The connections are restored by the protocol, the missing entries are sent with the next APPEND
+		case <-ticker.C:
+			r.tick()
+		}
+		r.applyCommitted()
+	}
+}
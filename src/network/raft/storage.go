@@ -0,0 +1,81 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// State is the part of the server that must survive a crash, it is saved before the server answers a message.
+// Without it, a restarted server could vote twice in a term or forget entries it acknowledged.
+//   - Requests: number of commands submitted by the server, the request ids are not reused after a restart
+type State[C any, S any] struct {
+	Term     int         `json:"term"`
+	VotedFor int         `json:"votedFor"`
+	Requests int         `json:"requests"`
+	Log      []Entry[C]  `json:"log"`
+	Snapshot Snapshot[S] `json:"snapshot"`
+}
+
+// Storage keeps the state of the server between its restarts
+type Storage[C any, S any] interface {
+	// Save replaces the saved state, the state must be kept once it returns
+	Save(state State[C, S]) error
+	// Load gets the saved state, false if nothing was saved yet
+	Load() (State[C, S], bool, error)
+}
+
+// FileStorage
+// keeps the state in a JSON file. The file is replaced atomically, a crash during a save keeps the previous state.
+type FileStorage[C any, S any] struct {
+	path string
+}
+
+// CreateFileStorage Constructor, the directory of the file is created if needed
+func CreateFileStorage[C any, S any](path string) *FileStorage[C, S] {
+	return &FileStorage[C, S]{path: path}
+}
+
+func (f *FileStorage[C, S]) Save(state State[C, S]) error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), f.path)
+}
+
+func (f *FileStorage[C, S]) Load() (State[C, S], bool, error) {
+	var state State[C, S]
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, false, nil
+	}
+	if err != nil {
+		return state, false, err
+	}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return state, false, err
+	}
+	return state, true, nil
+}
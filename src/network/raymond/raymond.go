@@ -0,0 +1,201 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package raymond
+
+import (
+	"fmt"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+)
+
+type RequestType int
+
+const (
+	REQ RequestType = 0 // Ask the neighbor in the direction of the token for the privilege
+	PRV RequestType = 1 // Transfer of the privilege, carries the replicated data
+	UPD RequestType = 2 // Replicated data flooded along the tree edges
+	REL RequestType = 3 // Local only, the client leaves the critical section
+)
+
+type Request[T any] struct {
+	ReqType RequestType `json:"req_type"`
+	Data    T           `json:"data"`
+	HasData bool        `json:"has_data"`
+	Version int         `json:"version"`
+	Sender  int         `json:"sender"`
+}
+
+type Raymond[T any] struct {
+	neighbors     []int // Parent and children of the server in the spanning tree
+	holder        int   // Neighbor in the direction of the privilege, the server itself if it holds it
+	queue         []int // Neighbors ( or the server itself ) waiting for the privilege
+	asked         bool  // True if a request has already been sent to the holder
+	using         bool
+	data          T   // Data carried with the privilege
+	version       int // Number of critical sections whose data has been delivered
+	protocol      server_server.Protocol[Request[T]]
+	waitForAccess chan bool
+	Data          chan T
+}
+
+// InitRaymond inits the needed structure for Raymond's algorithm.
+// The parents define the spanning tree ( -1 for the root ), the root holds the privilege at start.
+func InitRaymond[T any](p server_server.Protocol[Request[T]], parents []int) Raymond[T] {
+	r := Raymond[T]{
+		holder:        parents[p.GetServerId()],
+		queue:         []int{},
+		protocol:      p,
+		waitForAccess: make(chan bool, 1),
+		Data:          make(chan T, 1),
+	}
+	if r.holder == -1 {
+		r.holder = p.GetServerId()
+	} else {
+		r.neighbors = append(r.neighbors, r.holder)
+	}
+	for id, parent := range parents {
+		if parent == p.GetServerId() {
+			r.neighbors = append(r.neighbors, id)
+		}
+	}
+	return r
+}
+
+func (r *Raymond[T]) id() int {
+	return r.protocol.GetServerId()
+}
+
+func (r *Raymond[T]) debug() {
+	if !utils.IsLogEnabled() {
+		return
+	}
+
+	headers := []string{"Server", "Holder", "Queue", "Asked", "SC", "V", "M"}
+	data := fmt.Sprintf("%d\t%d\t%v\t%t\t%t\t%d\t%d", r.id(), r.holder, r.queue, r.asked, r.using, r.version, r.protocol.GetSentMessages())
+	utils.PrintTable(headers, []string{data})
+}
+
+// SendClientAskCriticalSection indique que le client souhaite l'accès
+func (r *Raymond[T]) SendClientAskCriticalSection() chan bool {
+	r.protocol.GetMessageChan() <- Request[T]{
+		ReqType: REQ,
+		Sender:  r.id(),
+	}
+	return r.waitForAccess
+}
+
+// SendClientReleaseCriticalSection indique que le client sort de SC
+func (r *Raymond[T]) SendClientReleaseCriticalSection(data T) {
+	r.protocol.GetMessageChan() <- Request[T]{
+		ReqType: REL,
+		Sender:  r.id(),
+		Data:    data,
+		HasData: true,
+	}
+}
+
+// SendClientLeaveCriticalSection indique que le client sort de SC sans données à répliquer
+func (r *Raymond[T]) SendClientLeaveCriticalSection() {
+	r.protocol.GetMessageChan() <- Request[T]{
+		ReqType: REL,
+		Sender:  r.id(),
+	}
+}
+
+func (r *Raymond[T]) GetDataChan() chan T {
+	return r.Data
+}
+
+// deliver forwards the replicated data, the most recent one is kept to be sent with the privilege
+func (r *Raymond[T]) deliver(req Request[T]) {
+	if !req.HasData {
+		return
+	}
+	if req.Version > r.version {
+		r.version = req.Version
+		r.data = req.Data
+	}
+	r.Data <- req.Data
+}
+
+// flood sends the data to every neighbor except the one it comes from
+func (r *Raymond[T]) flood(req Request[T], from int) {
+	req.ReqType = UPD
+	req.Sender = r.id()
+	for _, neighbor := range r.neighbors {
+		if neighbor != from {
+			_ = r.protocol.SendTo(neighbor, req)
+		}
+	}
+}
+
+// assignPrivilege gives the privilege to the first of the queue if the server holds it and does not use it
+func (r *Raymond[T]) assignPrivilege() {
+	if r.holder != r.id() || r.using || len(r.queue) == 0 {
+		return
+	}
+	r.holder = r.queue[0]
+	r.queue = r.queue[1:]
+	r.asked = false
+	if r.holder == r.id() {
+		r.using = true
+		r.waitForAccess <- true
+		return
+	}
+	_ = r.protocol.SendTo(r.holder, Request[T]{
+		ReqType: PRV,
+		Data:    r.data,
+		HasData: r.version > 0,
+		Version: r.version,
+		Sender:  r.id(),
+	})
+}
+
+// makeRequest asks the holder for the privilege if someone is waiting for it
+func (r *Raymond[T]) makeRequest() {
+	if r.holder == r.id() || len(r.queue) == 0 || r.asked {
+		return
+	}
+	r.asked = true
+	_ = r.protocol.SendTo(r.holder, Request[T]{
+		ReqType: REQ,
+		Sender:  r.id(),
+	})
+}
+
+// handleRequest Traitment des messages locaux et entre serveurs
+func (r *Raymond[T]) handleRequest(req Request[T]) {
+	switch req.ReqType {
+	case REQ:
+		r.queue = append(r.queue, req.Sender)
+	case PRV:
+		r.deliver(req)
+		r.holder = r.id()
+	case UPD:
+		// The tree has no cycle, each update is received once
+		r.deliver(req)
+		r.flood(req, req.Sender)
+	case REL:
+		r.using = false
+		if req.HasData {
+			req.Version = r.version + 1
+			r.deliver(req)
+			r.flood(req, r.id())
+		}
+	}
+	r.assignPrivilege()
+	r.makeRequest()
+	r.debug()
+}
+
+func (r *Raymond[T]) Start() {
+	utils.LogInfo(false, "Raymond:", "started")
+	for {
+		select {
+		// REQ, PRV, UPD, REL
+		case request := <-r.protocol.GetMessageChan():
+			r.handleRequest(request)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package ricart_agrawala
+
+import (
+	"fmt"
+	"math"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"strings"
+)
+
+type RequestType int
+
+const (
+	REQ RequestType = 0 // Ask for the critical section
+	OK  RequestType = 1 // Permission to enter the critical section, carries the replicated data not yet sent
+	REL RequestType = 3 // Local only, the client leaves the critical section
+)
+
+// Request is a message of Ricart-Agrawala
+//   - Data: the data released by the sender and not yet sent to the receiver, in their order of release
+type Request[T any] struct {
+	ReqType RequestType `json:"req_type"`
+	Stamp   int         `json:"stamp"`
+	Data    []T         `json:"data"`
+	Sender  int         `json:"sender"`
+}
+
+type RicartAgrawala[T any] struct {
+	stamp         int
+	requestStamp  int
+	requesting    bool
+	hasAccess     bool
+	replies       map[int]bool // Servers that have not yet given their permission
+	deferred      map[int]bool // Servers waiting for our permission
+	pending       map[int][]T  // Data released and not yet sent to each server, kept until our next permission to it
+	peerEvents    chan server_server.PeerEvent
+	protocol      server_server.Protocol[Request[T]]
+	waitForAccess chan bool
+	Data          chan T
+}
+
+// InitRicartAgrawala inits the needed structure for Ricart-Agrawala's algorithm.
+// The permission of the servers that are not connected is not waited for.
+// The replicated data is not broadcast on release: a server receives it with the permission of the servers that
+// released it, before it enters the critical section. The data of a server that crashed before giving its permission
+// is lost, the receiver detects the missing data and fetches the state of the cluster.
+func InitRicartAgrawala[T any](p server_server.Protocol[Request[T]]) RicartAgrawala[T] {
+	return RicartAgrawala[T]{
+		stamp:         0,
+		protocol:      p,
+		replies:       make(map[int]bool),
+		deferred:      make(map[int]bool),
+		pending:       make(map[int][]T),
+		peerEvents:    make(chan server_server.PeerEvent),
+		waitForAccess: make(chan bool, 1),
+		Data:          make(chan T, 1),
+	}
+}
+
+func (r *RicartAgrawala[T]) id() int {
+	return r.protocol.GetServerId()
+}
+
+// hasPriority checks if our pending request is older than the one of the sender
+func (r *RicartAgrawala[T]) hasPriority(stamp int, sender int) bool {
+	return r.requestStamp < stamp || r.requestStamp == stamp && r.id() < sender
+}
+
+func (r *RicartAgrawala[T]) debug() {
+	if !utils.IsLogEnabled() {
+		return
+	}
+
+	headers := []string{"Servers"}
+	data := []string{fmt.Sprintf("T:%d SC:%t M:%d", r.stamp, r.hasAccess, r.protocol.GetSentMessages())}
+	for i := 0; i < r.protocol.GetNumberOfServers(); i++ {
+		headers = append(headers, fmt.Sprintf("Server %d", i))
+		switch {
+		case i == r.id() && r.requesting:
+			data = append(data, fmt.Sprintf("REQ(%d)", r.requestStamp))
+		case i == r.id():
+			data = append(data, "-")
+		case r.deferred[i]:
+			data = append(data, "DEFER")
+		case r.replies[i]:
+			data = append(data, "WAIT")
+		default:
+			data = append(data, "OK")
+		}
+	}
+	utils.PrintTable(headers, []string{strings.Join(data, "\t")})
+}
+
+// SendClientAskCriticalSection indique que le client souhaite l'accès
+func (r *RicartAgrawala[T]) SendClientAskCriticalSection() chan bool {
+	r.protocol.GetMessageChan() <- Request[T]{
+		ReqType: REQ,
+		Sender:  r.id(),
+	}
+	return r.waitForAccess
+}
+
+// SendClientReleaseCriticalSection indique que le client sort de SC
+func (r *RicartAgrawala[T]) SendClientReleaseCriticalSection(data T) {
+	r.protocol.GetMessageChan() <- Request[T]{
+		ReqType: REL,
+		Sender:  r.id(),
+		Data:    []T{data},
+	}
+}
+
+// SendClientLeaveCriticalSection indique que le client sort de SC sans données à répliquer
+func (r *RicartAgrawala[T]) SendClientLeaveCriticalSection() {
+	r.protocol.GetMessageChan() <- Request[T]{
+		ReqType: REL,
+		Sender:  r.id(),
+	}
+}
+
+func (r *RicartAgrawala[T]) GetDataChan() chan T {
+	return r.Data
+}
+
+// checkCriticalSectionAccess grants the access once every server gave its permission
+func (r *RicartAgrawala[T]) checkCriticalSectionAccess() {
+	if r.requesting && !r.hasAccess && len(r.replies) == 0 {
+		r.hasAccess = true
+		r.waitForAccess <- true
+	}
+}
+
+// HandlePeerEvent notifies the crash or the return of a server
+func (r *RicartAgrawala[T]) HandlePeerEvent(event server_server.PeerEvent) {
+	r.peerEvents <- event
+}
+
+// handlePeerEvent stops waiting for the permission of a crashed server or of a server that left the cluster.
+// The data pending for the server is dropped, a restarted server gets the state of the cluster.
+func (r *RicartAgrawala[T]) handlePeerEvent(event server_server.PeerEvent) {
+	if event.Alive {
+		return
+	}
+	delete(r.replies, event.ServerId)
+	delete(r.deferred, event.ServerId)
+	delete(r.pending, event.ServerId)
+	r.checkCriticalSectionAccess()
+	r.debug()
+}
+
+// handleOutgoingRequest
+func (r *RicartAgrawala[T]) handleOutgoingRequest(req Request[T]) {
+	r.stamp += 1
+	req.Stamp = r.stamp
+
+	switch req.ReqType {
+	case REQ:
+		r.requesting = true
+		r.requestStamp = req.Stamp
+		for i := 0; i < r.protocol.GetNumberOfServers(); i++ {
+			if i != r.id() && r.protocol.IsConnected(i) {
+				r.replies[i] = true
+			}
+		}
+		_ = r.protocol.SendToAll(req)
+		r.checkCriticalSectionAccess()
+
+	case REL:
+		r.requesting = false
+		r.hasAccess = false
+		for _, data := range req.Data {
+			r.Data <- data
+		}
+		// The data is kept for every server and piggybacked on the permissions, deferred now or given later
+		for i := 0; i < r.protocol.GetNumberOfServers(); i++ {
+			if i != r.id() && len(req.Data) > 0 {
+				r.pending[i] = append(r.pending[i], req.Data...)
+			}
+		}
+		for i := range r.deferred {
+			r.sendPermission(i)
+		}
+		r.deferred = make(map[int]bool)
+	}
+	r.debug()
+}
+
+// handleIngoingRequest Traitment des messages entre serveurs
+func (r *RicartAgrawala[T]) handleIngoingRequest(req Request[T]) {
+	r.stamp = int(math.Max(float64(r.stamp), float64(req.Stamp)) + 1)
+
+	for _, data := range req.Data {
+		r.Data <- data
+	}
+
+	switch req.ReqType {
+	case REQ:
+		if r.requesting && r.hasPriority(req.Stamp, req.Sender) {
+			r.deferred[req.Sender] = true
+		} else {
+			r.sendPermission(req.Sender)
+		}
+	case OK:
+		delete(r.replies, req.Sender)
+		r.checkCriticalSectionAccess()
+	}
+	r.debug()
+}
+
+// sendPermission gives our permission to a server with the data it has not received yet, the data is kept if the
+// permission is not sent
+func (r *RicartAgrawala[T]) sendPermission(serverId int) {
+	err := r.protocol.SendTo(serverId, Request[T]{
+		ReqType: OK,
+		Stamp:   r.stamp,
+		Data:    r.pending[serverId],
+		Sender:  r.id(),
+	})
+	if err == nil {
+		delete(r.pending, serverId)
+	}
+}
+
+func (r *RicartAgrawala[T]) Start() {
+	utils.LogInfo(false, "Ricart-Agrawala:", "started")
+	for {
+		select {
+		case event := <-r.peerEvents:
+			r.handlePeerEvent(event)
+		// REQ, OK, REL
+		case request := <-r.protocol.GetMessageChan():
+			if request.Sender == r.id() {
+				r.handleOutgoingRequest(request)
+			} else {
+				r.handleIngoingRequest(request)
+			}
+		}
+	}
+}
@@ -0,0 +1,415 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package server_server
+
+import (
+	"encoding/json"
+	"sdr/labo1/src/utils"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const MuxQueueSize = 1024 // Number of messages kept for a channel not opened yet, the next ones are dropped
+
+// MuxMessage is a message of a protocol sharing the connections with other protocols
+type MuxMessage struct {
+	Channel string          `json:"channel"`
+	Sender  int             `json:"sender"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Observer
+// sees every message received by a Mux, before it is dispatched to its channel, and every crash or return of a server.
+// The observer is called by the go routine of the Mux, in the order of arrival of the messages.
+type Observer interface {
+	HandleMessage(message MuxMessage)
+	HandlePeerEvent(event PeerEvent)
+}
+
+// Mux
+// shares the connections of an inter server protocol between several protocols, each one using a named channel.
+// The messages received before the channel is opened are kept until it is opened, up to MuxQueueSize messages: a
+// channel never opened does not fill the memory. The crashes and returns of the servers are queued with the messages,
+// so a protocol never gets the message of a server after its crash. The Mux never waits for a protocol to read its
+// messages, a blocked protocol does not stop the others.
+type Mux struct {
+	protocol  Protocol[MuxMessage]
+	queues    map[string]*muxQueue
+	opened    []string
+	observers map[string]Observer      // Observers by reserved channel, the messages of the channel are only given to the observer
+	sent      map[string]*atomic.Int64 // Messages sent by channel since the start
+	calls     chan func()              // Functions run by the go routine of the Mux, between two messages
+	mutex     sync.Mutex
+	sending   sync.RWMutex // Held by the channels while sending, Exclusive stops the sending
+}
+
+// muxItem is a message or a peer event waiting to be delivered to a channel
+type muxItem struct {
+	sender  int
+	payload json.RawMessage
+	event   *PeerEvent
+}
+
+// muxQueue
+// is the messages and peer events of a channel waiting to be delivered, in their order of arrival. The queue of an
+// opened channel is not bounded: the Mux never waits for a channel, a slow protocol does not block the others.
+// The first item stays in the queue until the protocol has received it.
+//   - ready: notified when an item is added
+//   - delivering: held while the first item is given to the protocol, Pause holds it to stop the deliveries
+//   - interrupt: stops the delivery of the first item, it is given again once the deliveries are resumed
+//   - paused: closed when the deliveries are resumed, nil if they are not paused
+type muxQueue struct {
+	items      []muxItem
+	opened     bool
+	ready      chan bool
+	interrupt  chan bool
+	paused     chan bool
+	mutex      sync.Mutex
+	delivering sync.Mutex
+}
+
+// push adds an item to the queue, it returns false if the item is dropped: the channel is not opened and its queue is full
+func (q *muxQueue) push(item muxItem) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if !q.opened && len(q.items) >= MuxQueueSize {
+		return false
+	}
+	q.items = append(q.items, item)
+	select {
+	case q.ready <- true:
+	default:
+	}
+	return true
+}
+
+// first waits for the first item of the queue, it is removed once delivered
+func (q *muxQueue) first() muxItem {
+	for {
+		q.mutex.Lock()
+		if len(q.items) > 0 {
+			item := q.items[0]
+			q.mutex.Unlock()
+			return item
+		}
+		q.mutex.Unlock()
+		<-q.ready
+	}
+}
+
+// remove removes the first item of the queue
+func (q *muxQueue) remove() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.items[0] = muxItem{}
+	q.items = q.items[1:]
+}
+
+// pause stops the deliveries, the item being delivered is given back to the queue
+func (q *muxQueue) pause() {
+	q.mutex.Lock()
+	q.paused = make(chan bool)
+	q.mutex.Unlock()
+	select {
+	case q.interrupt <- true:
+	default:
+	}
+	q.delivering.Lock()
+}
+
+// resume resumes the deliveries
+func (q *muxQueue) resume() {
+	q.mutex.Lock()
+	close(q.paused)
+	q.paused = nil
+	q.mutex.Unlock()
+	q.delivering.Unlock()
+}
+
+// waitResumed waits until the deliveries are resumed, it returns false if they were not paused
+func (q *muxQueue) waitResumed() bool {
+	q.mutex.Lock()
+	paused := q.paused
+	q.mutex.Unlock()
+	if paused == nil {
+		return false
+	}
+	<-paused
+	return true
+}
+
+// messages gets the messages of the queue, the peer events are skipped
+func (q *muxQueue) messages(channel string) []MuxMessage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var messages []MuxMessage
+	for _, item := range q.items {
+		if item.event == nil {
+			messages = append(messages, MuxMessage{Channel: channel, Sender: item.sender, Payload: item.payload})
+		}
+	}
+	return messages
+}
+
+// CreateMux Constructor
+func CreateMux(p Protocol[MuxMessage]) *Mux {
+	return &Mux{
+		protocol:  p,
+		queues:    make(map[string]*muxQueue),
+		observers: make(map[string]Observer),
+		sent:      make(map[string]*atomic.Int64),
+		calls:     make(chan func()),
+	}
+}
+
+// Observe adds an observer, the messages of its reserved channel are not dispatched
+func (m *Mux) Observe(channel string, observer Observer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.observers[channel] = observer
+}
+
+// Exclusive runs the function while no message is sent by the channels, the messages sent by the function with
+// SendRaw are sent before the messages of the channels sent after it
+func (m *Mux) Exclusive(f func()) {
+	m.sending.Lock()
+	defer m.sending.Unlock()
+	f()
+}
+
+// Run runs the function in the go routine of the Mux and waits for it: no message is dispatched to the observers
+// and the channels while it runs. The Mux must be started.
+func (m *Mux) Run(f func()) {
+	done := make(chan bool)
+	m.calls <- func() {
+		defer close(done)
+		f()
+	}
+	<-done
+}
+
+// Pause runs the function while no message is delivered to the protocols of the channels. The function gets the
+// messages dispatched to the channels and not yet received by their protocol, in their order of arrival by channel.
+// It must be called by the go routine of the Mux (an observer or Run), so no message is dispatched meanwhile.
+func (m *Mux) Pause(f func(undelivered []MuxMessage)) {
+	m.mutex.Lock()
+	names := make([]string, 0, len(m.queues))
+	for name := range m.queues {
+		names = append(names, name)
+	}
+	m.mutex.Unlock()
+	sort.Strings(names)
+
+	var undelivered []MuxMessage
+	for _, name := range names {
+		queue := m.queue(name)
+		queue.pause()
+		defer queue.resume()
+		undelivered = append(undelivered, queue.messages(name)...)
+	}
+	f(undelivered)
+}
+
+// SendRaw sends the message of a reserved channel to a server
+func (m *Mux) SendRaw(serverId int, channel string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	m.counter(channel).Add(1)
+	return m.protocol.SendTo(serverId, MuxMessage{Channel: channel, Sender: m.protocol.GetServerId(), Payload: payload})
+}
+
+// counter gets the number of messages sent on a channel
+func (m *Mux) counter(channel string) *atomic.Int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if sent, ok := m.sent[channel]; ok {
+		return sent
+	}
+	sent := &atomic.Int64{}
+	m.sent[channel] = sent
+	return sent
+}
+
+// GetSentMessages gets the number of messages sent on each channel since the start
+func (m *Mux) GetSentMessages() map[string]int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sent := make(map[string]int64, len(m.sent))
+	for channel, counter := range m.sent {
+		sent[channel] = counter.Load()
+	}
+	return sent
+}
+
+func (m *Mux) getObservers() map[string]Observer {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	observers := make(map[string]Observer, len(m.observers))
+	for channel, observer := range m.observers {
+		observers[channel] = observer
+	}
+	return observers
+}
+
+// queue gets the messages and peer events of a channel, in their order of arrival
+func (m *Mux) queue(name string) *muxQueue {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if queue, ok := m.queues[name]; ok {
+		return queue
+	}
+	queue := &muxQueue{ready: make(chan bool, 1), interrupt: make(chan bool, 1)}
+	m.queues[name] = queue
+	return queue
+}
+
+// Start dispatches the messages to the channels and notifies every opened channel of the crashes and returns of the servers
+func (m *Mux) Start() {
+	for {
+		select {
+		case message := <-m.protocol.GetMessageChan():
+			observers := m.getObservers()
+			for _, observer := range observers {
+				observer.HandleMessage(message)
+			}
+			item := muxItem{sender: message.Sender, payload: message.Payload}
+			if _, reserved := observers[message.Channel]; !reserved && !m.queue(message.Channel).push(item) {
+				utils.LogWarning(false, "mux", "channel", message.Channel, "not opened, message of server", message.Sender, "dropped")
+			}
+		case event := <-m.protocol.GetPeerChan():
+			for _, observer := range m.getObservers() {
+				observer.HandlePeerEvent(event)
+			}
+			m.mutex.Lock()
+			opened := append([]string{}, m.opened...)
+			m.mutex.Unlock()
+			for _, name := range opened {
+				e := event
+				m.queue(name).push(muxItem{sender: e.ServerId, event: &e})
+			}
+		case f := <-m.calls:
+			f()
+		}
+	}
+}
+
+// Channel
+// is the protocol of a named channel of a Mux, its messages are sent with the connections of the Mux.
+type Channel[T any] struct {
+	name        string
+	mux         *Mux
+	chanMessage chan T
+	chanPeer    chan PeerEvent
+	sent        *atomic.Int64
+}
+
+// OpenChannel opens a named channel carrying messages of type T
+func OpenChannel[T any](m *Mux, name string) *Channel[T] {
+	c := &Channel[T]{
+		name:        name,
+		mux:         m,
+		chanMessage: make(chan T),
+		chanPeer:    make(chan PeerEvent),
+		sent:        m.counter(name),
+	}
+	queue := m.queue(name)
+	queue.mutex.Lock()
+	queue.opened = true
+	queue.mutex.Unlock()
+	m.mutex.Lock()
+	m.opened = append(m.opened, name)
+	m.mutex.Unlock()
+
+	go func() {
+		for {
+			item := queue.first()
+			var messages chan T // Only one of the channels is used, a nil channel is never ready
+			var peers chan PeerEvent
+			var data T
+			var event PeerEvent
+			if item.event != nil {
+				peers, event = c.chanPeer, *item.event
+			} else if err := json.Unmarshal(item.payload, &data); err != nil {
+				utils.LogError(false, "Error receiving message on channel", name, ":", err.Error())
+				queue.remove()
+				continue
+			} else {
+				messages = c.chanMessage
+			}
+
+			if queue.waitResumed() {
+				continue
+			}
+			queue.delivering.Lock()
+			select {
+			case messages <- data:
+				queue.remove()
+			case peers <- event:
+				queue.remove()
+			case <-queue.interrupt: // The deliveries are paused, the item is given again after the pause
+			}
+			queue.delivering.Unlock()
+		}
+	}()
+	return c
+}
+
+func (c *Channel[T]) message(data T) (MuxMessage, error) {
+	payload, err := json.Marshal(data)
+	return MuxMessage{Channel: c.name, Sender: c.GetServerId(), Payload: payload}, err
+}
+
+func (c *Channel[T]) SendTo(serverId int, data T) error {
+	message, err := c.message(data)
+	if err != nil {
+		return err
+	}
+	c.mux.sending.RLock()
+	defer c.mux.sending.RUnlock()
+	c.sent.Add(1)
+	return c.mux.protocol.SendTo(serverId, message)
+}
+
+func (c *Channel[T]) SendToAll(data T) error {
+	message, err := c.message(data)
+	if err != nil {
+		return err
+	}
+	c.mux.sending.RLock()
+	defer c.mux.sending.RUnlock()
+	for i := 0; i < c.GetNumberOfServers(); i++ {
+		if i != c.GetServerId() && c.IsConnected(i) {
+			c.sent.Add(1)
+		}
+	}
+	return c.mux.protocol.SendToAll(message)
+}
+
+func (c *Channel[T]) GetMessageChan() chan T {
+	return c.chanMessage
+}
+
+func (c *Channel[T]) GetPeerChan() chan PeerEvent {
+	return c.chanPeer
+}
+
+func (c *Channel[T]) GetServerId() int {
+	return c.mux.protocol.GetServerId()
+}
+
+func (c *Channel[T]) GetNumberOfServers() int {
+	return c.mux.protocol.GetNumberOfServers()
+}
+
+func (c *Channel[T]) IsConnected(serverId int) bool {
+	return c.mux.protocol.IsConnected(serverId)
+}
+
+// GetSentMessages gets the number of messages sent on the channel since the start
+func (c *Channel[T]) GetSentMessages() int64 {
+	return c.sent.Load()
+}
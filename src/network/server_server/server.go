@@ -4,99 +4,370 @@
 package server_server
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"sdr/labo1/src/network"
 	"sdr/labo1/src/utils"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	HeartbeatInterval = 500 * time.Millisecond // Delay between two heartbeats sent to each server
+	HeartbeatTimeout  = 2 * time.Second        // Delay without message before a server is suspected to have crashed
+	MinReconnectDelay = 100 * time.Millisecond // Delay before the second attempt to connect to a server
+	MaxReconnectDelay = 5 * time.Second        // Maximum delay between two attempts to connect to a server
+)
+
+// Protocol
+// is the API used by the algorithms to communicate with the other servers.
+type Protocol[T any] interface {
+	SendTo(serverId int, data T) error
+	SendToAll(data T) error
+	GetMessageChan() chan T
+	GetPeerChan() chan PeerEvent
+	GetServerId() int
+	GetNumberOfServers() int
+	IsConnected(serverId int) bool
+	GetSentMessages() int64
+}
+
+// PeerEvent
+// is emitted when a server is suspected to have crashed or when it is connected again.
+type PeerEvent struct {
+	ServerId int
+	Alive    bool
+}
+
 type InterServerProtocol[T any] struct {
-	serverId    int
-	listener    net.Listener
-	connections map[int]*network.Connection
-	chanMessage chan T
+	serverId        int
+	numberOfServers int
+	transport       network.Transport
+	listener        net.Listener
+	urls            map[int]string // Addresses of the other servers
+	removed         map[int]bool   // Servers that left the cluster, their ids are not reused
+	connections     map[int]*network.Connection
+	mutex           sync.RWMutex
+	chanMessage     chan T
+	chanPeer        chan PeerEvent
+	connected       chan bool // Closed once all the servers have been connected at startup
+	startup         sync.Once
+	silenceTimeout  atomic.Bool  // The silent servers are suspected, disabled when another failure detector is used
+	sent            atomic.Int64 // Number of messages sent to the other servers
+	closed          atomic.Bool  // The server stopped, its connections are closed and never dialed again
 }
 
-func CreateInterServerProtocol[T any](serverId int, listener net.Listener) *InterServerProtocol[T] {
-	return &InterServerProtocol[T]{
-		serverId:    serverId,
-		listener:    listener,
-		connections: make(map[int]*network.Connection),
-		chanMessage: make(chan T),
+// CreateInterServerProtocol Constructor, the connections of the servers are dialed with the transport and accepted with
+// the listener
+func CreateInterServerProtocol[T any](serverId int, transport network.Transport, listener net.Listener) *InterServerProtocol[T] {
+	p := &InterServerProtocol[T]{
+		serverId:        serverId,
+		numberOfServers: 1,
+		transport:       transport,
+		listener:        listener,
+		removed:         make(map[int]bool),
+		connections:     make(map[int]*network.Connection),
+		chanMessage:     make(chan T),
+		chanPeer:        make(chan PeerEvent, 16),
+		connected:       make(chan bool),
 	}
+	p.silenceTimeout.Store(true)
+	return p
 }
 
-type serverConnection struct {
-	serverId int
-	conn     *network.Connection
+// handshake is exchanged by two servers when they connect
+//   - Started: the server is already part of the cluster, a server restarted after a crash joins it without waiting for the others
+type handshake struct {
+	ServerId int  `json:"serverId"`
+	Started  bool `json:"started"`
 }
 
+// ConnectToServers connects to the other servers, given in the order of their ids, and waits until all of them are connected
+// or until a server already started is connected. An empty address is a server that left the cluster.
+// The connection between two servers is dialed by the server with the greatest id and accepted by the other one,
+// a lost connection is dialed again with an exponential backoff.
 func (p *InterServerProtocol[T]) ConnectToServers(urls []string) {
-	ready := make(chan serverConnection) // Channel to wait for all connections to be ready
-	useListener := make(chan bool)       // Channel to wait if the listener is used
-	go func() {
-		for {
-			if !<-useListener { // Close the listener if no more connections are needed
+	p.numberOfServers = len(urls) + 1
+	p.urls = make(map[int]string, len(urls))
+	for i, url := range urls {
+		serverId := i
+		if serverId >= p.serverId {
+			serverId++
+		}
+		if url == "" {
+			p.removed[serverId] = true
+		} else {
+			p.urls[serverId] = url
+		}
+	}
+	if len(p.urls) == 0 {
+		close(p.connected)
+	}
+
+	go p.acceptServers()
+	for serverId := range p.urls {
+		if serverId < p.serverId {
+			go p.dial(serverId)
+		}
+	}
+	utils.LogInfo(false, "Waiting for all servers to connect...")
+	<-p.connected
+	utils.LogSuccess(false, "All servers connected!")
+}
+
+// acceptServers accepts the connections of the servers with a greater id
+func (p *InterServerProtocol[T]) acceptServers() {
+	for {
+		c, err := p.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
 				utils.LogInfo(false, "inter server protocol", "listener closed")
 				return
 			}
-			c, err := p.listener.Accept()
-			if err != nil {
-				utils.LogError(false, "Error accepting: ", err.Error())
-				useListener <- true // The listener is still needed
-				continue
-			}
+			utils.LogError(false, "Error accepting: ", err.Error())
+			continue
+		}
+		go func() {
 			conn := network.CreateConnection(c)
-			if value, e := network.GetJson[int](*conn); e == nil {
-				// Send the serverId to the server
-				_ = conn.SendJSON(p.serverId)
-				ready <- serverConnection{value, conn}
-			} else {
-				utils.LogError(false, "Error accepting: ", e.Error())
+			value, e := network.GetJson[handshake](*conn)
+			if e != nil || value.ServerId <= p.serverId || !p.isMember(value.ServerId) {
+				utils.LogError(false, "Error accepting: invalid server", value.ServerId)
 				_ = conn.Close()
-				useListener <- true // The listener is still needed
-				continue
-			}
-		}
-	}()
-
-	for _, url := range urls {
-		go func(url string) {
-			c, err := net.Dial("tcp", url)
-			if err != nil {
-				utils.LogError(false, url, "is not reachable, waiting connection...")
-				useListener <- true // Tell to use the listener method
 				return
 			}
-			//DIRECT CONNECTION
+			// Send the serverId to the server
+			_ = conn.SendJSON(p.handshake())
+			p.addConnection(value, conn)
+		}()
+	}
+}
+
+// dial connects to a server with a smaller id, the attempts are spaced with an exponential backoff
+func (p *InterServerProtocol[T]) dial(serverId int) {
+	backoff := MinReconnectDelay
+	for p.isMember(serverId) {
+		if c, err := p.transport.Dial(p.getUrl(serverId)); err == nil {
 			conn := network.CreateConnection(c)
-			conn.SendJSON(p.serverId)
-			if value, e := network.GetJson[int](*conn); e == nil {
-				ready <- serverConnection{value, conn}
+			_ = conn.SendJSON(p.handshake())
+			if value, e := network.GetJson[handshake](*conn); e == nil && value.ServerId == serverId {
+				p.addConnection(value, conn)
+				return
 			}
-		}(url)
+			_ = conn.Close()
+		}
+		utils.LogWarning(false, "inter server protocol", "server", serverId, "is not reachable, retrying in", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > MaxReconnectDelay {
+			backoff = MaxReconnectDelay
+		}
 	}
-	utils.LogInfo(false, "Waiting for all servers to connect...")
-	for range urls {
-		server := <-ready
-		utils.LogSuccess(false, "Server", server.serverId, "connected")
-		p.connections[server.serverId] = server.conn
+}
+
+// handshake gets the handshake sent to a server
+func (p *InterServerProtocol[T]) handshake() handshake {
+	return handshake{ServerId: p.serverId, Started: p.isStarted()}
+}
+
+// isStarted checks if the server is part of the cluster
+func (p *InterServerProtocol[T]) isStarted() bool {
+	select {
+	case <-p.connected:
+		return true
+	default:
+		return false
 	}
-	useListener <- false // stop the listener
-	utils.LogSuccess(false, "All servers connected!")
+}
+
+// addConnection registers the connection of a server, starts listening to its messages and sending it heartbeats.
+// The previous connection of the server is replaced.
+func (p *InterServerProtocol[T]) addConnection(server handshake, conn *network.Connection) {
+	serverId := server.ServerId
+	p.mutex.Lock()
+	if p.closed.Load() {
+		p.mutex.Unlock()
+		_ = conn.Close()
+		return
+	}
+	if old, ok := p.connections[serverId]; ok {
+		_ = old.Close()
+	}
+	p.connections[serverId] = conn
+	allConnected := len(p.connections) == len(p.urls)
+	p.mutex.Unlock()
+
+	seen := &atomic.Int64{} // Time of the last line received on the connection, in nanoseconds
+	seen.Store(time.Now().UnixNano())
+	go p.listenMessages(serverId, conn, seen)
+	go p.sendHeartbeats(serverId, conn, seen)
+
+	if p.isStarted() { // The server joins the cluster again
+		utils.LogSuccess(true, "Server", serverId, "connected again")
+		p.chanPeer <- PeerEvent{ServerId: serverId, Alive: true}
+		return
+	}
+	utils.LogSuccess(false, "Server", serverId, "connected")
+	if server.Started {
+		utils.LogInfo(true, "inter server protocol", "joining the cluster started by server", serverId)
+	}
+	if allConnected || server.Started {
+		p.startup.Do(func() { close(p.connected) })
+	}
+}
+
+// removeConnection closes the connection of a server suspected to have crashed.
+// The connection is dialed again if the server has a smaller id.
+func (p *InterServerProtocol[T]) removeConnection(serverId int, conn *network.Connection, reason string) {
+	p.mutex.Lock()
+	current, ok := p.connections[serverId]
+	if !ok || current != conn { // The connection has already been removed or replaced
+		p.mutex.Unlock()
+		return
+	}
+	delete(p.connections, serverId)
+	p.mutex.Unlock()
+
+	_ = conn.Close()
+	utils.LogWarning(true, "inter server protocol", "server", serverId, "is suspected to have crashed:", reason)
+	p.chanPeer <- PeerEvent{ServerId: serverId, Alive: false}
+	if serverId < p.serverId && p.isMember(serverId) {
+		go p.dial(serverId)
+	}
+}
+
+// isMember checks if a server is part of the cluster, it has not left it
+func (p *InterServerProtocol[T]) isMember(serverId int) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	_, ok := p.urls[serverId]
+	return ok
+}
+
+func (p *InterServerProtocol[T]) getUrl(serverId int) string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.urls[serverId]
+}
+
+// AddServer adds a server joining the cluster, it connects to the servers with a smaller id
+func (p *InterServerProtocol[T]) AddServer(serverId int, url string) {
+	p.mutex.Lock()
+	if serverId == p.serverId || p.removed[serverId] {
+		p.mutex.Unlock()
+		return
+	}
+	_, known := p.urls[serverId]
+	p.urls[serverId] = url
+	if serverId >= p.numberOfServers {
+		p.numberOfServers = serverId + 1
+	}
+	p.mutex.Unlock()
+
+	utils.LogInfo(true, "inter server protocol", "server", serverId, "added to the cluster")
+	if !known && serverId < p.serverId {
+		go p.dial(serverId)
+	}
+}
+
+// RemoveServer removes a server leaving the cluster, its connection is closed and it is never connected again
+func (p *InterServerProtocol[T]) RemoveServer(serverId int) {
+	p.mutex.Lock()
+	delete(p.urls, serverId)
+	p.removed[serverId] = true
+	p.mutex.Unlock()
+
+	utils.LogInfo(true, "inter server protocol", "server", serverId, "removed from the cluster")
+	p.Disconnect(serverId, "left the cluster")
+}
+
+// GetMembers gets the ids of the other servers of the cluster, sorted
+func (p *InterServerProtocol[T]) GetMembers() []int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	members := make([]int, 0, len(p.urls))
+	for serverId := range p.urls {
+		members = append(members, serverId)
+	}
+	sort.Ints(members)
+	return members
+}
+
+// DisableHeartbeatTimeout stops suspecting the silent servers, the crashes are detected by another failure detector
+// which closes their connection with Disconnect
+func (p *InterServerProtocol[T]) DisableHeartbeatTimeout() {
+	p.silenceTimeout.Store(false)
+}
 
-	go p.listenMessages() // Start listening messages
+// Disconnect closes the connection of a server detected as crashed, it is dialed again like a lost connection
+func (p *InterServerProtocol[T]) Disconnect(serverId int, reason string) {
+	p.mutex.RLock()
+	conn, connected := p.connections[serverId]
+	p.mutex.RUnlock()
+	if connected {
+		p.removeConnection(serverId, conn, reason)
+	}
+}
+
+// Close closes the connections of the stopped server, like the crash of its process: the other servers suspect it and
+// the connections are never dialed again. The listener is closed by the caller.
+func (p *InterServerProtocol[T]) Close() {
+	p.closed.Store(true)
+	p.mutex.Lock()
+	connections := p.connections
+	p.connections = make(map[int]*network.Connection)
+	p.urls = make(map[int]string)
+	p.mutex.Unlock()
+	for _, conn := range connections {
+		_ = conn.Close()
+	}
+}
+
+// sendHeartbeats sends heartbeats on the connection of a server until it is closed or replaced, and suspects the server
+// once it has been silent for too long. Each connection has its own goroutine and no lock is held while sending:
+// a slow server delays neither the heartbeats of the others nor the reception of the messages.
+func (p *InterServerProtocol[T]) sendHeartbeats(serverId int, conn *network.Connection, seen *atomic.Int64) {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mutex.RLock()
+		current := p.connections[serverId] == conn
+		p.mutex.RUnlock()
+		if !current {
+			return
+		}
+		if p.silenceTimeout.Load() && time.Since(time.Unix(0, seen.Load())) > HeartbeatTimeout {
+			p.removeConnection(serverId, conn, "no heartbeat")
+			return
+		}
+		_ = conn.SendHeartbeat()
+	}
 }
 
 func (p *InterServerProtocol[T]) SendTo(serverId int, data T) error {
-	if conn, ok := p.connections[serverId]; ok {
+	p.mutex.RLock()
+	conn, ok := p.connections[serverId]
+	p.mutex.RUnlock()
+	if ok {
+		p.sent.Add(1)
 		return conn.SendJSON(data)
 	}
 	return fmt.Errorf("server %d is not connected", serverId)
 }
 
 func (p *InterServerProtocol[T]) SendToAll(data T) error {
+	p.mutex.RLock()
+	var connections []*network.Connection
 	for _, conn := range p.connections {
+		connections = append(connections, conn)
+	}
+	p.mutex.RUnlock()
+
+	for _, conn := range connections {
+		p.sent.Add(1)
 		if err := conn.SendJSON(data); err != nil {
 			return err
 		}
@@ -104,18 +375,25 @@ func (p *InterServerProtocol[T]) SendToAll(data T) error {
 	return nil
 }
 
-func (p *InterServerProtocol[T]) listenMessages() {
-	for serverId := range p.connections {
-		go func(serverId int) {
-			for {
-				data, err := network.GetJson[T](*p.connections[serverId])
-				if err != nil {
-					utils.LogError(false, "Error receiving message from server", serverId, ":", err.Error())
-					continue
-				}
-				p.chanMessage <- data
-			}
-		}(serverId)
+// listenMessages reads the messages of a server until its connection is lost, seen is updated without lock at each line
+func (p *InterServerProtocol[T]) listenMessages(serverId int, conn *network.Connection, seen *atomic.Int64) {
+	for {
+		line, err := conn.GetLine()
+		if err != nil {
+			p.removeConnection(serverId, conn, err.Error())
+			return
+		}
+		seen.Store(time.Now().UnixNano())
+
+		if line == "" { // Heartbeat
+			continue
+		}
+		var data T
+		if err := json.Unmarshal([]byte(line), &data); err != nil {
+			utils.LogError(false, "Error receiving message from server", serverId, ":", err.Error())
+			continue
+		}
+		p.chanMessage <- data
 	}
 }
 
@@ -123,10 +401,31 @@ func (p *InterServerProtocol[T]) GetMessageChan() chan T {
 	return p.chanMessage
 }
 
+// GetPeerChan gets the channel notifying the crashes and the returns of the servers
+func (p *InterServerProtocol[T]) GetPeerChan() chan PeerEvent {
+	return p.chanPeer
+}
+
 func (p *InterServerProtocol[T]) GetServerId() int {
 	return p.serverId
 }
 
+// GetNumberOfServers gets the number of server ids, the servers that left the cluster included
 func (p *InterServerProtocol[T]) GetNumberOfServers() int {
-	return len(p.connections) + 1
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.numberOfServers
+}
+
+// IsConnected checks if a server is connected and not suspected to have crashed
+func (p *InterServerProtocol[T]) IsConnected(serverId int) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	_, ok := p.connections[serverId]
+	return ok
+}
+
+// GetSentMessages gets the number of messages sent to the other servers since the start
+func (p *InterServerProtocol[T]) GetSentMessages() int64 {
+	return p.sent.Load()
 }
@@ -0,0 +1,304 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package snapshot
+// This package takes consistent global snapshots of the servers with the Chandy-Lamport algorithm.
+// The markers are sent on the connections shared by the channels of the Mux, the connections are FIFO: the messages
+// received from a server after the state is recorded and before its marker were in flight when the snapshot was taken.
+// The messages received before the state is recorded but not yet given to their protocol by the Mux are in flight too.
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	Channel         = "snapshot"
+	SnapshotTimeout = 5 * time.Second // Delay to wait for the reports of the servers
+)
+
+type MessageType int
+
+const (
+	MARKER MessageType = 0 // Separates the messages sent before and after the snapshot
+	REPORT MessageType = 1 // Local snapshot of a server, sent to the initiator
+)
+
+// Message is a message of the snapshots
+//   - Number: increases with the snapshots of the initiator, the late markers of a finished snapshot are ignored
+type Message struct {
+	Type      MessageType `json:"type"`
+	Snapshot  string      `json:"snapshot"`
+	Initiator int         `json:"initiator"`
+	Number    int64       `json:"number"`
+	Report    *Report     `json:"report,omitempty"`
+}
+
+// Report is the local snapshot of a server
+//   - Channels: the messages in flight from each server: not yet given to their protocol when the state was recorded,
+//     or received after the state was recorded and before the marker
+//   - Lost: the servers that crashed before sending their marker, their channel may be incomplete
+type Report struct {
+	Server   int                                `json:"server"`
+	State    json.RawMessage                    `json:"state"`
+	Channels map[int][]server_server.MuxMessage `json:"channels"`
+	Lost     []int                              `json:"lost,omitempty"`
+}
+
+// GlobalSnapshot is the snapshot of the cluster
+//   - Missing: the servers that did not send their report, crashed during the snapshot
+type GlobalSnapshot struct {
+	Id        string    `json:"id"`
+	Initiator int       `json:"initiator"`
+	Time      time.Time `json:"time"`
+	Servers   []Report  `json:"servers"`
+	Missing   []int     `json:"missing,omitempty"`
+}
+
+// Write writes the snapshot to a JSON file of the directory, the path of the file is returned
+func (g GlobalSnapshot) Write(directory string) (string, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(directory, fmt.Sprintf("snapshot-%s.json", g.Id))
+	return path, os.WriteFile(path, data, 0644)
+}
+
+// recording is a snapshot being taken by the server
+//   - recorded: the servers whose channel is recorded until their marker is received
+//   - reports, expected, missing, done: used by the initiator to gather the reports of the servers
+type recording struct {
+	id        string
+	initiator int
+	number    int64
+	finished  bool
+	report    Report
+	recorded  map[int]bool
+	reports   map[int]Report
+	expected  map[int]bool
+	missing   []int
+	done      chan bool
+}
+
+// Snapshots
+// records the local snapshots of the server and gathers the reports of the snapshots it initiates.
+type Snapshots struct {
+	mux        *server_server.Mux
+	protocol   server_server.Protocol[server_server.MuxMessage]
+	flush      func()
+	state      func() any
+	recordings map[string]*recording
+	finished   map[int]int64 // Number of the last snapshot recorded by initiator, the late markers are ignored
+	last       int64         // Number of the last snapshot initiated by the server
+	mutex      sync.Mutex
+}
+
+// CreateSnapshots Constructor
+//   - flush: makes the protocols process the messages they already received, called while the Mux delivers no message
+//   - state: gets the local state of the server, recorded when the snapshot reaches the server
+func CreateSnapshots(mux *server_server.Mux, p server_server.Protocol[server_server.MuxMessage], flush func(), state func() any) *Snapshots {
+	s := &Snapshots{
+		mux:        mux,
+		protocol:   p,
+		flush:      flush,
+		state:      state,
+		recordings: make(map[string]*recording),
+		finished:   make(map[int]int64),
+	}
+	mux.Observe(Channel, s)
+	return s
+}
+
+func (s *Snapshots) id() int {
+	return s.protocol.GetServerId()
+}
+
+// record records the local state and sends the markers to the connected servers before any other message.
+// The channels of the connected servers are recorded, except the channel of the server that sent the marker.
+// It must be called by the go routine of the Mux: the messages not yet given to their protocol start the channels.
+func (s *Snapshots) record(id string, initiator int, number int64, sender int) *recording {
+	rec := &recording{
+		id:        id,
+		initiator: initiator,
+		number:    number,
+		report:    Report{Server: s.id(), Channels: make(map[int][]server_server.MuxMessage)},
+		recorded:  make(map[int]bool),
+	}
+	s.mux.Pause(func(undelivered []server_server.MuxMessage) {
+		for _, message := range undelivered {
+			rec.report.Channels[message.Sender] = append(rec.report.Channels[message.Sender], message)
+		}
+		s.flush() // The protocols may send messages while processing, the sending is not stopped yet
+		s.mux.Exclusive(func() {
+			state, err := json.Marshal(s.state())
+			if err != nil {
+				utils.LogError(false, "snapshot", "unable to record the state:", err.Error())
+			}
+			rec.report.State = state
+			for i := 0; i < s.protocol.GetNumberOfServers(); i++ {
+				if i == s.id() || !s.protocol.IsConnected(i) {
+					continue
+				}
+				if _, ok := rec.report.Channels[i]; !ok {
+					rec.report.Channels[i] = []server_server.MuxMessage{}
+				}
+				if i != sender {
+					rec.recorded[i] = true
+				}
+				_ = s.mux.SendRaw(i, Channel, Message{Type: MARKER, Snapshot: id, Initiator: initiator, Number: number})
+			}
+		})
+	})
+	s.recordings[id] = rec
+	utils.LogInfo(false, "snapshot", id, "state recorded")
+	return rec
+}
+
+// checkRecording sends the report to the initiator once the markers of all the recorded channels are received.
+// Only the number of the last snapshot of each initiator is kept once finished.
+func (s *Snapshots) checkRecording(rec *recording) {
+	if len(rec.recorded) > 0 || rec.finished {
+		return
+	}
+	rec.finished = true
+	if rec.number > s.finished[rec.initiator] {
+		s.finished[rec.initiator] = rec.number
+	}
+	if rec.initiator == s.id() {
+		s.addReport(rec, rec.report)
+		return
+	}
+	delete(s.recordings, rec.id)
+	_ = s.mux.SendRaw(rec.initiator, Channel, Message{Type: REPORT, Snapshot: rec.id, Initiator: rec.initiator, Report: &rec.report})
+}
+
+// addReport adds the report of a server to a snapshot initiated by the server
+func (s *Snapshots) addReport(rec *recording, report Report) {
+	rec.reports[report.Server] = report
+	delete(rec.expected, report.Server)
+	s.checkReports(rec)
+}
+
+// checkReports notifies the initiator once every expected report is received
+func (s *Snapshots) checkReports(rec *recording) {
+	if len(rec.expected) == 0 {
+		select {
+		case rec.done <- true:
+		default:
+		}
+	}
+}
+
+func (s *Snapshots) HandleMessage(message server_server.MuxMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if message.Channel != Channel {
+		for _, rec := range s.recordings {
+			if rec.recorded[message.Sender] {
+				rec.report.Channels[message.Sender] = append(rec.report.Channels[message.Sender], message)
+			}
+		}
+		return
+	}
+
+	var m Message
+	if err := json.Unmarshal(message.Payload, &m); err != nil {
+		utils.LogError(false, "snapshot", "invalid message:", err.Error())
+		return
+	}
+	switch m.Type {
+	case MARKER:
+		rec, ok := s.recordings[m.Snapshot]
+		if !ok {
+			if m.Number <= s.finished[m.Initiator] {
+				return // Late marker of a finished snapshot
+			}
+			rec = s.record(m.Snapshot, m.Initiator, m.Number, message.Sender)
+		}
+		delete(rec.recorded, message.Sender)
+		s.checkRecording(rec)
+	case REPORT:
+		if rec, ok := s.recordings[m.Snapshot]; ok && rec.initiator == s.id() && m.Report != nil {
+			s.addReport(rec, *m.Report)
+		}
+	}
+}
+
+// HandlePeerEvent stops waiting for the marker and the report of a crashed server
+func (s *Snapshots) HandlePeerEvent(event server_server.PeerEvent) {
+	if event.Alive {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, rec := range s.recordings {
+		if rec.recorded[event.ServerId] {
+			delete(rec.recorded, event.ServerId)
+			rec.report.Lost = append(rec.report.Lost, event.ServerId)
+			s.checkRecording(rec)
+		}
+		if rec.expected[event.ServerId] {
+			delete(rec.expected, event.ServerId)
+			rec.missing = append(rec.missing, event.ServerId)
+			s.checkReports(rec)
+		}
+	}
+}
+
+// Take takes a global snapshot initiated by the server. The snapshot is returned once every server connected at the
+// start has sent its report, the servers that crashed or did not answer in time are listed as missing.
+func (s *Snapshots) Take() GlobalSnapshot {
+	var rec *recording
+	s.mux.Run(func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		number := time.Now().UnixMilli() // The numbers are not reused after a restart
+		if number <= s.last {
+			number = s.last + 1
+		}
+		s.last = number
+		rec = s.record(fmt.Sprintf("%d-%d", s.id(), number), s.id(), number, -1)
+		rec.reports = make(map[int]Report)
+		rec.expected = map[int]bool{s.id(): true}
+		rec.done = make(chan bool, 1)
+		for serverId := range rec.recorded { // The servers the markers were sent to
+			rec.expected[serverId] = true
+		}
+		s.checkRecording(rec)
+	})
+	id := rec.id
+
+	select {
+	case <-rec.done:
+	case <-time.After(SnapshotTimeout):
+		utils.LogWarning(false, "snapshot", id, "some servers did not send their report")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snapshot := GlobalSnapshot{Id: id, Initiator: s.id(), Time: time.Now()}
+	for _, report := range rec.reports {
+		snapshot.Servers = append(snapshot.Servers, report)
+	}
+	snapshot.Missing = rec.missing
+	for serverId := range rec.expected {
+		snapshot.Missing = append(snapshot.Missing, serverId)
+	}
+	sort.Slice(snapshot.Servers, func(i, j int) bool { return snapshot.Servers[i].Server < snapshot.Servers[j].Server })
+	sort.Ints(snapshot.Missing)
+	delete(s.recordings, id)
+	return snapshot
+}
@@ -0,0 +1,292 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package suzuki_kasami
+
+import (
+	"fmt"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"strings"
+)
+
+type RequestType int
+
+const (
+	REQ RequestType = 0 // Ask for the token
+	TOK RequestType = 1 // Transfer of the token, carries the replicated data
+	UPD RequestType = 2 // Replicated data sent to the servers that do not receive the token
+	REL RequestType = 3 // Local only, the client leaves the critical section
+)
+
+// Token is the privilege that is passed between the servers
+//   - LN: the number of the last request executed by each server
+//   - Queue: the servers waiting for the token
+type Token struct {
+	LN    []int `json:"ln"`
+	Queue []int `json:"queue"`
+}
+
+type Request[T any] struct {
+	ReqType RequestType `json:"req_type"`
+	Number  int         `json:"number"`
+	Token   *Token      `json:"token,omitempty"`
+	Data    T           `json:"data"`
+	HasData bool        `json:"has_data"`
+	Version int         `json:"version"`
+	Sender  int         `json:"sender"`
+}
+
+type SuzukiKasami[T any] struct {
+	rn            []int  // Highest request number received from each server
+	token         *Token // The token, nil if the server does not hold it
+	requesting    bool
+	hasAccess     bool
+	data          T   // Data carried with the token
+	version       int // Number of critical sections whose data has been delivered
+	protocol      server_server.Protocol[Request[T]]
+	peerEvents    chan server_server.PeerEvent
+	waitForAccess chan bool
+	Data          chan T
+}
+
+// InitSuzukiKasami inits the needed structure for Suzuki-Kasami's algorithm, the token is given to the server 0
+func InitSuzukiKasami[T any](p server_server.Protocol[Request[T]]) SuzukiKasami[T] {
+	sk := SuzukiKasami[T]{
+		rn:            make([]int, p.GetNumberOfServers()),
+		protocol:      p,
+		peerEvents:    make(chan server_server.PeerEvent),
+		waitForAccess: make(chan bool, 1),
+		Data:          make(chan T, 1),
+	}
+	if p.GetServerId() == 0 {
+		sk.token = &Token{
+			LN:    make([]int, p.GetNumberOfServers()),
+			Queue: []int{},
+		}
+	}
+	return sk
+}
+
+func (s *SuzukiKasami[T]) id() int {
+	return s.protocol.GetServerId()
+}
+
+func (s *SuzukiKasami[T]) debug() {
+	if !utils.IsLogEnabled() {
+		return
+	}
+
+	headers := []string{"Servers"}
+	data := []string{fmt.Sprintf("V:%d SC:%t TOKEN:%t M:%d", s.version, s.hasAccess, s.token != nil, s.protocol.GetSentMessages())}
+	for i, rn := range s.rn {
+		headers = append(headers, fmt.Sprintf("Server %d", i))
+		if s.token != nil {
+			data = append(data, fmt.Sprintf("RN:%d LN:%d", rn, s.token.LN[i]))
+		} else {
+			data = append(data, fmt.Sprintf("RN:%d", rn))
+		}
+	}
+	utils.PrintTable(headers, []string{strings.Join(data, "\t")})
+}
+
+// SendClientAskCriticalSection indique que le client souhaite l'accès
+func (s *SuzukiKasami[T]) SendClientAskCriticalSection() chan bool {
+	s.protocol.GetMessageChan() <- Request[T]{
+		ReqType: REQ,
+		Sender:  s.id(),
+	}
+	return s.waitForAccess
+}
+
+// SendClientReleaseCriticalSection indique que le client sort de SC
+func (s *SuzukiKasami[T]) SendClientReleaseCriticalSection(data T) {
+	s.protocol.GetMessageChan() <- Request[T]{
+		ReqType: REL,
+		Sender:  s.id(),
+		Data:    data,
+		HasData: true,
+	}
+}
+
+// SendClientLeaveCriticalSection indique que le client sort de SC sans données à répliquer
+func (s *SuzukiKasami[T]) SendClientLeaveCriticalSection() {
+	s.protocol.GetMessageChan() <- Request[T]{
+		ReqType: REL,
+		Sender:  s.id(),
+	}
+}
+
+func (s *SuzukiKasami[T]) GetDataChan() chan T {
+	return s.Data
+}
+
+// deliver forwards the replicated data, the most recent one is kept to be sent with the token
+func (s *SuzukiKasami[T]) deliver(req Request[T]) {
+	if !req.HasData {
+		return
+	}
+	if req.Version > s.version {
+		s.version = req.Version
+		s.data = req.Data
+	}
+	s.Data <- req.Data
+}
+
+// grow extends the request numbers and the token to the servers that joined the cluster
+func (s *SuzukiKasami[T]) grow(serverId int) {
+	size := s.protocol.GetNumberOfServers()
+	if serverId >= size {
+		size = serverId + 1
+	}
+	for len(s.rn) < size {
+		s.rn = append(s.rn, 0)
+	}
+	for s.token != nil && len(s.token.LN) < len(s.rn) {
+		s.token.LN = append(s.token.LN, 0)
+	}
+}
+
+// isWaiting checks if the server has an outstanding request that has not been executed yet
+func (s *SuzukiKasami[T]) isWaiting(serverId int) bool {
+	return s.rn[serverId] == s.token.LN[serverId]+1
+}
+
+// sendToken gives the token to a server, the data of the last critical section is sent with it
+func (s *SuzukiKasami[T]) sendToken(serverId int) {
+	token := s.token
+	s.token = nil
+	_ = s.protocol.SendTo(serverId, Request[T]{
+		ReqType: TOK,
+		Token:   token,
+		Data:    s.data,
+		HasData: s.version > 0,
+		Version: s.version,
+		Sender:  s.id(),
+	})
+}
+
+// enterCriticalSection grants the access if the server holds the token and asked for it
+func (s *SuzukiKasami[T]) enterCriticalSection() {
+	if s.requesting && !s.hasAccess && s.token != nil {
+		s.hasAccess = true
+		s.waitForAccess <- true
+	}
+}
+
+// HandlePeerEvent notifies the crash or the return of a server
+func (s *SuzukiKasami[T]) HandlePeerEvent(event server_server.PeerEvent) {
+	s.peerEvents <- event
+}
+
+// handlePeerEvent removes a crashed server or a server that left the cluster from the queue of the token
+func (s *SuzukiKasami[T]) handlePeerEvent(event server_server.PeerEvent) {
+	if event.Alive || s.token == nil {
+		return
+	}
+	queue := s.token.Queue[:0]
+	for _, serverId := range s.token.Queue {
+		if serverId != event.ServerId {
+			queue = append(queue, serverId)
+		}
+	}
+	s.token.Queue = queue
+	s.grow(event.ServerId)
+	if s.isWaiting(event.ServerId) {
+		s.token.LN[event.ServerId] = s.rn[event.ServerId]
+	}
+}
+
+// handleOutgoingRequest
+func (s *SuzukiKasami[T]) handleOutgoingRequest(req Request[T]) {
+	s.grow(req.Sender)
+	switch req.ReqType {
+	case REQ:
+		s.requesting = true
+		if s.token == nil {
+			s.rn[s.id()] += 1
+			req.Number = s.rn[s.id()]
+			_ = s.protocol.SendToAll(req)
+		}
+		s.enterCriticalSection()
+
+	case REL:
+		s.requesting = false
+		s.hasAccess = false
+		s.token.LN[s.id()] = s.rn[s.id()]
+		if req.HasData {
+			req.Version = s.version + 1
+			s.deliver(req)
+		}
+
+		for i := range s.rn {
+			if i != s.id() && s.isWaiting(i) && !contains(s.token.Queue, i) {
+				s.token.Queue = append(s.token.Queue, i)
+			}
+		}
+		next := -1
+		if len(s.token.Queue) > 0 {
+			next = s.token.Queue[0]
+			s.token.Queue = s.token.Queue[1:]
+		}
+		// The next holder gets the data with the token, the others need an update to keep their data in sync
+		req.ReqType = UPD
+		for i := range s.rn {
+			if req.HasData && i != s.id() && i != next {
+				_ = s.protocol.SendTo(i, req)
+			}
+		}
+		if next != -1 {
+			s.sendToken(next)
+		}
+	}
+	s.debug()
+}
+
+// handleIngoingRequest Traitment des messages entre serveurs
+func (s *SuzukiKasami[T]) handleIngoingRequest(req Request[T]) {
+	s.grow(req.Sender)
+	switch req.ReqType {
+	case REQ:
+		if req.Number > s.rn[req.Sender] {
+			s.rn[req.Sender] = req.Number
+		}
+		if s.token != nil && !s.requesting && s.isWaiting(req.Sender) {
+			s.sendToken(req.Sender)
+		}
+	case TOK:
+		s.deliver(req)
+		s.token = req.Token
+		s.grow(req.Sender)
+		s.enterCriticalSection()
+	case UPD:
+		s.deliver(req)
+	}
+	s.debug()
+}
+
+func (s *SuzukiKasami[T]) Start() {
+	utils.LogInfo(false, "Suzuki-Kasami:", "started")
+	for {
+		select {
+		case event := <-s.peerEvents:
+			s.handlePeerEvent(event)
+		// REQ, TOK, UPD, REL
+		case request := <-s.protocol.GetMessageChan():
+			if request.Sender == s.id() {
+				s.handleOutgoingRequest(request)
+			} else {
+				s.handleIngoingRequest(request)
+			}
+		}
+	}
+}
+
+func contains(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
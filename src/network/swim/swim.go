@@ -0,0 +1,406 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package swim
+// This package detects the failures of the servers with a SWIM-like protocol. Each period, a server pings a random
+// member; without answer in time, it asks other members to ping it on its behalf. A member that answers none of them
+// is suspected, and declared dead if it does not refute the suspicion in time. The changes of the members are
+// piggybacked on the pings and acks, every server converges to the same view without broadcast.
+package swim
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProtocolPeriod = 1 * time.Second        // Delay between two probes of a random member
+	ProbeTimeout   = 300 * time.Millisecond // Delay to wait for the ack of a direct ping before the indirect pings
+	SuspectTimeout = 3 * ProtocolPeriod     // Delay for a suspected member to refute the suspicion before it is declared dead
+	IndirectProbes = 2                      // Number of members asked to ping a member that did not answer
+	MaxPiggyback   = 6                      // Maximum number of updates carried by a message
+	Retransmission = 3                      // An update is piggybacked Retransmission * log2(members + 1) times
+)
+
+type State int
+
+const (
+	Alive   State = 0
+	Suspect State = 1
+	Dead    State = 2
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	}
+	return "dead"
+}
+
+type MessageType int
+
+const (
+	PING     MessageType = 0
+	ACK      MessageType = 1
+	PING_REQ MessageType = 2 // Asks to ping the target on behalf of the sender
+)
+
+// Update is the state of a member known by a server
+//   - Incarnation: only incremented by the member itself, to refute a suspicion. A newer incarnation overrides the
+//     states of the previous ones. A restarted member starts again from zero: the cluster sends it the state it knows
+//     about it, a dead member refutes it and joins again with a newer incarnation
+type Update struct {
+	ServerId    int   `json:"serverId"`
+	State       State `json:"state"`
+	Incarnation int64 `json:"incarnation"`
+}
+
+// Message
+//   - Incarnation: the incarnation of the sender, a message is a proof that the sender is alive
+//   - Target: the member pinged, Origin: the server that asked for an indirect ping, -1 for a direct one
+//   - Updates: the changes of the members piggybacked on the message
+type Message struct {
+	Type        MessageType `json:"type"`
+	Sender      int         `json:"sender"`
+	Incarnation int64       `json:"incarnation"`
+	Seq         int         `json:"seq"`
+	Target      int         `json:"target"`
+	Origin      int         `json:"origin"`
+	Updates     []Update    `json:"updates,omitempty"`
+}
+
+// Member is the state of a server in the view
+type Member struct {
+	Id          int    `json:"id"`
+	State       string `json:"state"`
+	Incarnation int64  `json:"incarnation"`
+}
+
+// probe is the ping of the current period
+type probe struct {
+	target int
+	seq    int
+	acked  bool
+}
+
+// broadcast is an update piggybacked until its transmissions are exhausted
+type broadcast struct {
+	update    Update
+	remaining int
+}
+
+type Swim struct {
+	protocol    server_server.Protocol[Message]
+	members     func() []int // Ids of the other servers of the cluster
+	onChange    func(update Update)
+	incarnation int64
+	view        map[int]Update
+	suspected   map[int]time.Time // Time at which each suspected member was suspected
+	broadcasts  map[int]*broadcast
+	order       []int // Members in the order they are probed, shuffled at each round
+	probe       *probe
+	seq         int
+	indirect    chan int   // Sequence number of a probe whose direct ping timed out
+	random      *rand.Rand // Orders the probes, seeded with the id of the server: the messages do not depend on the run
+	mutex       sync.Mutex
+}
+
+// CreateSwim Constructor
+//   - members: gets the ids of the other servers of the cluster, the servers added at runtime are probed as well
+//   - onChange: called, without the lock held, every time the state of a member changes
+func CreateSwim(p server_server.Protocol[Message], members func() []int, onChange func(update Update)) *Swim {
+	s := &Swim{
+		protocol:   p,
+		members:    members,
+		onChange:   onChange,
+		view:       make(map[int]Update),
+		suspected:  make(map[int]time.Time),
+		broadcasts: make(map[int]*broadcast),
+		indirect:   make(chan int, 1),
+		random:     rand.New(rand.NewSource(int64(p.GetServerId()))),
+	}
+	s.view[s.id()] = Update{ServerId: s.id(), State: Alive, Incarnation: s.incarnation}
+	for _, serverId := range members() {
+		s.view[serverId] = Update{ServerId: serverId, State: Alive}
+	}
+	return s
+}
+
+func (s *Swim) id() int {
+	return s.protocol.GetServerId()
+}
+
+// GetView gets the state of every server of the cluster, sorted by id
+func (s *Swim) GetView() []Member {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	members := append(s.members(), s.id())
+	var view []Member
+	for _, serverId := range members {
+		update := s.view[serverId]
+		view = append(view, Member{Id: serverId, State: update.State.String(), Incarnation: update.Incarnation})
+	}
+	sort.Slice(view, func(i, j int) bool { return view[i].Id < view[j].Id })
+	return view
+}
+
+func (s *Swim) debug() {
+	if !utils.IsLogEnabled() {
+		return
+	}
+	headers := []string{"Servers"}
+	data := []string{fmt.Sprintf("I:%d M:%d", s.incarnation, s.protocol.GetSentMessages())}
+	for _, member := range s.GetView() {
+		headers = append(headers, fmt.Sprintf("Server %d", member.Id))
+		data = append(data, member.State)
+	}
+	utils.PrintTable(headers, []string{strings.Join(data, "\t")})
+}
+
+// overrides checks if an update is newer than the known state of the member
+func overrides(update Update, known Update, ok bool) bool {
+	switch {
+	case !ok || update.Incarnation > known.Incarnation:
+		return true
+	case update.Incarnation < known.Incarnation:
+		return false
+	}
+	return update.State > known.State // Suspect overrides alive and dead overrides both in the same incarnation
+}
+
+// apply updates the view with the state of a member, the mutex must be held.
+// The changes are piggybacked on the next messages, a suspicion about the server itself is refuted.
+func (s *Swim) apply(update Update) (changed bool) {
+	if update.ServerId == s.id() {
+		if update.State == Alive && update.Incarnation > s.incarnation { // Incarnation before a restart
+			s.incarnation = update.Incarnation
+			s.view[s.id()] = update
+		} else if update.State != Alive && update.Incarnation >= s.incarnation {
+			s.incarnation = update.Incarnation + 1
+			s.view[s.id()] = Update{ServerId: s.id(), State: Alive, Incarnation: s.incarnation}
+			s.queue(s.view[s.id()])
+			utils.LogWarning(false, "swim", "suspected by the cluster, refuted with incarnation", s.incarnation)
+		}
+		return false
+	}
+	known, ok := s.view[update.ServerId]
+	if !overrides(update, known, ok) {
+		return false
+	}
+	s.view[update.ServerId] = update
+	if update.State == Suspect {
+		s.suspected[update.ServerId] = time.Now()
+	} else {
+		delete(s.suspected, update.ServerId)
+	}
+	s.queue(update)
+	return !ok || known.State != update.State
+}
+
+// queue piggybacks an update on the next messages, it replaces the previous update of the member
+func (s *Swim) queue(update Update) {
+	transmissions := Retransmission * int(math.Ceil(math.Log2(float64(len(s.view)+1))))
+	s.broadcasts[update.ServerId] = &broadcast{update: update, remaining: transmissions}
+}
+
+// piggyback gets the updates sent with a message, the least transmitted ones first
+func (s *Swim) piggyback() []Update {
+	var pending []*broadcast
+	for _, b := range s.broadcasts {
+		pending = append(pending, b)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].remaining > pending[j].remaining })
+	var updates []Update
+	for _, b := range pending {
+		if len(updates) == MaxPiggyback {
+			break
+		}
+		updates = append(updates, b.update)
+		if b.remaining--; b.remaining <= 0 {
+			delete(s.broadcasts, b.update.ServerId)
+		}
+	}
+	return updates
+}
+
+// send sends a message with the piggybacked updates, the mutex must be held
+func (s *Swim) send(serverId int, message Message) {
+	message.Sender = s.id()
+	message.Incarnation = s.incarnation
+	message.Updates = s.piggyback()
+	_ = s.protocol.SendTo(serverId, message)
+}
+
+// notify calls onChange for the members whose state changed
+func (s *Swim) notify(updates []Update) {
+	for _, update := range updates {
+		switch update.State {
+		case Alive:
+			utils.LogSuccess(false, "swim", "server", update.ServerId, "is alive, incarnation", update.Incarnation)
+		case Suspect:
+			utils.LogWarning(false, "swim", "server", update.ServerId, "is suspected")
+		case Dead:
+			utils.LogWarning(true, "swim", "server", update.ServerId, "is declared dead")
+		}
+		if s.onChange != nil {
+			s.onChange(update)
+		}
+	}
+	if len(updates) > 0 {
+		s.debug()
+	}
+}
+
+// next gets the next member to probe, the members are probed in a random order renewed at each round
+func (s *Swim) next() int {
+	members := s.members()
+	for _, serverId := range members {
+		if _, ok := s.view[serverId]; !ok {
+			s.view[serverId] = Update{ServerId: serverId, State: Alive}
+		}
+	}
+	for len(s.order) > 0 {
+		serverId := s.order[0]
+		s.order = s.order[1:]
+		if update, ok := s.view[serverId]; ok && update.State != Dead && contains(members, serverId) {
+			return serverId
+		}
+	}
+	for _, serverId := range members {
+		if s.view[serverId].State != Dead {
+			s.order = append(s.order, serverId)
+		}
+	}
+	s.random.Shuffle(len(s.order), func(i, j int) { s.order[i], s.order[j] = s.order[j], s.order[i] })
+	if len(s.order) == 0 {
+		return -1
+	}
+	serverId := s.order[0]
+	s.order = s.order[1:]
+	return serverId
+}
+
+// tick ends the probe of the previous period and starts a new one
+func (s *Swim) tick() {
+	s.mutex.Lock()
+	var changes []Update
+	if s.probe != nil && !s.probe.acked {
+		target := s.view[s.probe.target]
+		if target.State == Alive && s.apply(Update{ServerId: target.ServerId, State: Suspect, Incarnation: target.Incarnation}) {
+			changes = append(changes, s.view[target.ServerId])
+		}
+	}
+	for serverId, since := range s.suspected {
+		if time.Since(since) > SuspectTimeout {
+			if s.apply(Update{ServerId: serverId, State: Dead, Incarnation: s.view[serverId].Incarnation}) {
+				changes = append(changes, s.view[serverId])
+			}
+		}
+	}
+
+	s.probe = nil
+	if target := s.next(); target != -1 {
+		s.seq++
+		s.probe = &probe{target: target, seq: s.seq}
+		s.send(target, Message{Type: PING, Seq: s.seq, Target: target, Origin: -1})
+		seq := s.seq
+		time.AfterFunc(ProbeTimeout, func() {
+			select {
+			case s.indirect <- seq:
+			default:
+			}
+		})
+	}
+	s.mutex.Unlock()
+	s.notify(changes)
+}
+
+// pingIndirectly asks random members to ping the target of the probe that did not answer the direct ping
+func (s *Swim) pingIndirectly(seq int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.probe == nil || s.probe.seq != seq || s.probe.acked {
+		return
+	}
+	var helpers []int
+	for _, serverId := range s.members() {
+		if serverId != s.probe.target && s.view[serverId].State == Alive && s.protocol.IsConnected(serverId) {
+			helpers = append(helpers, serverId)
+		}
+	}
+	s.random.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > IndirectProbes {
+		helpers = helpers[:IndirectProbes]
+	}
+	utils.LogInfo(false, "swim", "server", s.probe.target, "did not answer, indirect pings through", helpers)
+	for _, helper := range helpers {
+		s.send(helper, Message{Type: PING_REQ, Seq: seq, Target: s.probe.target, Origin: s.id()})
+	}
+}
+
+func (s *Swim) handleMessage(message Message) {
+	s.mutex.Lock()
+	var changes []Update
+	// The message proves that its sender is alive in its incarnation, a sender declared dead is told to refute it
+	if s.apply(Update{ServerId: message.Sender, State: Alive, Incarnation: message.Incarnation}) {
+		changes = append(changes, s.view[message.Sender])
+	} else if known := s.view[message.Sender]; known.State == Dead {
+		s.queue(known)
+	}
+	for _, update := range message.Updates {
+		if s.apply(update) {
+			changes = append(changes, s.view[update.ServerId])
+		}
+	}
+
+	switch message.Type {
+	case PING:
+		s.send(message.Sender, Message{Type: ACK, Seq: message.Seq, Target: s.id(), Origin: message.Origin})
+	case PING_REQ:
+		s.send(message.Target, Message{Type: PING, Seq: message.Seq, Target: message.Target, Origin: message.Sender})
+	case ACK:
+		if message.Origin != -1 && message.Origin != s.id() { // Ack of an indirect ping, forwarded to the origin
+			s.send(message.Origin, Message{Type: ACK, Seq: message.Seq, Target: message.Target, Origin: message.Origin})
+		} else if s.probe != nil && s.probe.seq == message.Seq && s.probe.target == message.Target {
+			s.probe.acked = true
+		}
+	}
+	s.mutex.Unlock()
+	s.notify(changes)
+}
+
+func (s *Swim) Start() {
+	utils.LogInfo(false, "swim:", "started")
+	ticker := time.NewTicker(ProtocolPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case message := <-s.protocol.GetMessageChan():
+			s.handleMessage(message)
+		case <-s.protocol.GetPeerChan():
+		case seq := <-s.indirect:
+			s.pingIndirectly(seq)
+		case <-ticker.C:
+			s.tick()
+		}
+	}
+}
+
+func contains(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+// Package total_order
+// This package implements a total order broadcast: every server delivers the broadcast messages in the same order.
+// The messages are ordered by their Lamport timestamp, the id of the sender breaks the ties. A message is delivered
+// once every connected server has sent a message with a greater timestamp, its acknowledgement at the latest.
+package total_order
+
+import (
+	"fmt"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/utils"
+	"sort"
+	"strings"
+)
+
+type MessageType int
+
+const (
+	MSG MessageType = 0 // Broadcast message
+	ACK MessageType = 1 // Acknowledgement of a message, sent to all the servers
+	SYN MessageType = 2 // Asks a server for its timestamp, sent to the servers joining the cluster
+)
+
+type Message[T any] struct {
+	Type   MessageType `json:"type"`
+	Stamp  int         `json:"stamp"`
+	Sender int         `json:"sender"`
+	Data   T           `json:"data"`
+}
+
+// before checks if a message is ordered before the message with the given timestamp and sender
+func (m Message[T]) before(stamp int, sender int) bool {
+	return m.Stamp < stamp || m.Stamp == stamp && m.Sender < sender
+}
+
+type TotalOrder[T any] struct {
+	stamp      int
+	protocol   server_server.Protocol[Message[T]]
+	queue      []Message[T]       // Messages not delivered yet, ordered by timestamp and sender
+	latest     map[int]Message[T] // Last message received from each server
+	pending    map[int]bool       // Servers whose timestamp is unknown, the broadcasts are deferred until they answer
+	deferred   []T                // Broadcasts waiting for the timestamps of the servers
+	broadcasts chan T             // Broadcasts of the server
+	delivery   chan T
+}
+
+// InitTotalOrder inits the needed structure for the total order broadcast
+func InitTotalOrder[T any](p server_server.Protocol[Message[T]]) TotalOrder[T] {
+	return TotalOrder[T]{
+		protocol:   p,
+		latest:     make(map[int]Message[T]),
+		pending:    make(map[int]bool),
+		broadcasts: make(chan T),
+		delivery:   make(chan T),
+	}
+}
+
+func (t *TotalOrder[T]) id() int {
+	return t.protocol.GetServerId()
+}
+
+func (t *TotalOrder[T]) debug() {
+	if !utils.IsLogEnabled() {
+		return
+	}
+
+	headers := []string{"Servers"}
+	data := []string{fmt.Sprintf("T:%d Q:%d M:%d", t.stamp, len(t.queue), t.protocol.GetSentMessages())}
+	for i := 0; i < t.protocol.GetNumberOfServers(); i++ {
+		headers = append(headers, fmt.Sprintf("Server %d", i))
+		latest, ok := t.latest[i]
+		switch {
+		case i == t.id():
+			data = append(data, "-")
+		case t.pending[i]:
+			data = append(data, "SYN")
+		case ok:
+			data = append(data, fmt.Sprintf("%d", latest.Stamp))
+		default:
+			data = append(data, "?")
+		}
+	}
+	utils.PrintTable(headers, []string{strings.Join(data, "\t")})
+}
+
+// Broadcast sends a message to all the servers, the message is delivered by the delivery channel of every server
+func (t *TotalOrder[T]) Broadcast(data T) {
+	t.broadcasts <- data
+}
+
+// GetDeliveryChan gets the channel receiving the messages in the total order, the broadcasts of the server included
+func (t *TotalOrder[T]) GetDeliveryChan() chan T {
+	return t.delivery
+}
+
+// synchronize asks a server for its timestamp, the broadcasts are deferred until it answers.
+// The messages broadcast after the answer are ordered after the messages the server has already received.
+func (t *TotalOrder[T]) synchronize(serverId int) {
+	t.pending[serverId] = true
+	_ = t.protocol.SendTo(serverId, Message[T]{Type: SYN, Stamp: t.stamp, Sender: t.id()})
+}
+
+func (t *TotalOrder[T]) enqueue(m Message[T]) {
+	i := sort.Search(len(t.queue), func(i int) bool {
+		return !t.queue[i].before(m.Stamp, m.Sender)
+	})
+	t.queue = append(t.queue, Message[T]{})
+	copy(t.queue[i+1:], t.queue[i:])
+	t.queue[i] = m
+}
+
+func (t *TotalOrder[T]) handleBroadcast(data T) {
+	if len(t.pending) > 0 {
+		t.deferred = append(t.deferred, data)
+		return
+	}
+	t.stamp++
+	m := Message[T]{Type: MSG, Stamp: t.stamp, Sender: t.id(), Data: data}
+	t.enqueue(m)
+	_ = t.protocol.SendToAll(m)
+}
+
+// processDeferredBroadcasts sends the broadcasts deferred while the timestamp of a server was unknown
+func (t *TotalOrder[T]) processDeferredBroadcasts() {
+	if len(t.pending) > 0 {
+		return
+	}
+	deferred := t.deferred
+	t.deferred = nil
+	for _, data := range deferred {
+		t.handleBroadcast(data)
+	}
+}
+
+func (t *TotalOrder[T]) handleMessage(m Message[T]) {
+	if m.Stamp > t.stamp {
+		t.stamp = m.Stamp
+	}
+	t.stamp++
+	t.latest[m.Sender] = m
+
+	switch m.Type {
+	case MSG:
+		t.enqueue(m)
+		_ = t.protocol.SendToAll(Message[T]{Type: ACK, Stamp: t.stamp, Sender: t.id()})
+	case ACK:
+		delete(t.pending, m.Sender)
+		t.processDeferredBroadcasts()
+	case SYN:
+		_ = t.protocol.SendTo(m.Sender, Message[T]{Type: ACK, Stamp: t.stamp, Sender: t.id()})
+	}
+	t.debug()
+}
+
+// handlePeerEvent stops waiting for a crashed server, a server joining the cluster must give its timestamp
+func (t *TotalOrder[T]) handlePeerEvent(event server_server.PeerEvent) {
+	delete(t.latest, event.ServerId)
+	delete(t.pending, event.ServerId)
+	if event.Alive {
+		t.synchronize(event.ServerId)
+	} else {
+		t.processDeferredBroadcasts()
+	}
+	t.debug()
+}
+
+// deliverable checks if every connected server has sent a message ordered after the given one.
+// The messages of a server are received in the order they were sent, no message ordered before can be received anymore.
+// The servers not connected are not waited for: the delivery is not uniform, a message received by some servers only
+// before its sender crashed is delivered by them and never by the others.
+func (t *TotalOrder[T]) deliverable(m Message[T]) bool {
+	for i := 0; i < t.protocol.GetNumberOfServers(); i++ {
+		if i == t.id() || !t.protocol.IsConnected(i) {
+			continue
+		}
+		latest, ok := t.latest[i]
+		if !ok || latest.before(m.Stamp, m.Sender) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *TotalOrder[T]) deliver() {
+	for len(t.queue) > 0 && t.deliverable(t.queue[0]) {
+		m := t.queue[0]
+		t.queue = t.queue[1:]
+		t.delivery <- m.Data
+	}
+}
+
+func (t *TotalOrder[T]) Start() {
+	utils.LogInfo(false, "Total order:", "started")
+	for i := 0; i < t.protocol.GetNumberOfServers(); i++ {
+		if i != t.id() && t.protocol.IsConnected(i) {
+			t.synchronize(i)
+		}
+	}
+	for {
+		select {
+		// MSG, ACK, SYN
+		case message := <-t.protocol.GetMessageChan():
+			t.handleMessage(message)
+		case data := <-t.broadcasts:
+			t.handleBroadcast(data)
+		case event := <-t.protocol.GetPeerChan():
+			t.handlePeerEvent(event)
+		}
+		t.deliver()
+	}
+}
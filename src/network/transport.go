@@ -0,0 +1,26 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package network
+
+import (
+	"net"
+)
+
+// Transport
+// creates the connections between the servers and the clients, over TCP or in memory for the tests.
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	Dial(address string) (net.Conn, error)
+}
+
+// TCPTransport is the transport used by default, the connections are TCP connections
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func (TCPTransport) Dial(address string) (net.Conn, error) {
+	return net.Dial("tcp", address)
+}
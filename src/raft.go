@@ -0,0 +1,67 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"sdr/labo1/src/config"
+	"sdr/labo1/src/dto"
+	"sdr/labo1/src/network"
+	"sdr/labo1/src/network/raft"
+	"sdr/labo1/src/network/server_server"
+)
+
+type raftLog = raft.Raft[dto.Command, []dto.Operation, network.Response[any]]
+
+const raftChannel = "raft"
+
+// raftWriter
+// appends the commands to the replicated log, they are executed by every server once committed.
+type raftWriter struct {
+	raft *raftLog
+}
+
+// startRaft starts replicating the log.
+// The snapshots of the log contain the full state of every event. The term, the vote and the log are saved in the
+// Raft directory of the configuration, a restarted server restores its snapshot and gets the entries from the leader.
+func startRaft(serverConfiguration *config.ServerConfiguration, mux *server_server.Mux, appData *Data) writer {
+	p := openChannel[raft.Message[dto.Command, []dto.Operation]](serverConfiguration, mux, raftChannel) // The messages dropped by the causal order are sent again by the leader
+
+	r := raft.InitRaft[dto.Command, []dto.Operation, network.Response[any]](p, func(command dto.Command) network.Response[any] {
+		if command.Type == dto.ShowCommand {
+			return readEvents(appData, command.EventId)
+		}
+		appData.mutex.Lock()
+		defer appData.mutex.Unlock()
+		response, _ := executeCommand(appData, command)
+		return response
+	}, func() []dto.Operation {
+		appData.mutex.RLock()
+		defer appData.mutex.RUnlock()
+		return stateOperations(appData)
+	}, func(state []dto.Operation) {
+		appData.mutex.Lock()
+		defer appData.mutex.Unlock()
+		appData.events = nil
+		appData.pending = nil
+		applyOperations(appData, state)
+	}, raft.CreateFileStorage[dto.Command, []dto.Operation](filepath.Join(serverConfiguration.GetRaftDirectory(),
+		fmt.Sprintf("raft-%d.json", serverConfiguration.Id))))
+	go r.Start()
+	return &raftWriter{raft: &r}
+}
+
+func (w *raftWriter) write(command dto.Command) network.Response[any] {
+	response, err := w.raft.Submit(command)
+	if err != nil {
+		return network.CreateResponse(false, err.Error())
+	}
+	return response
+}
+
+// read appends the read to the log, the events are read once all the commands before it are executed
+func (w *raftWriter) read(eventId int) network.Response[any] {
+	return w.write(dto.Command{Type: dto.ShowCommand, EventId: eventId})
+}
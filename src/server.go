@@ -4,63 +4,150 @@
 package server
 
 import (
+	"fmt"
 	"net"
 	"os"
 	"sdr/labo1/src/config"
 	"sdr/labo1/src/dto"
 	"sdr/labo1/src/network"
+	"sdr/labo1/src/network/causal"
 	"sdr/labo1/src/network/client_server"
-	"sdr/labo1/src/network/lamport"
+	"sdr/labo1/src/network/consistency"
 	"sdr/labo1/src/network/server_server"
 	"sdr/labo1/src/types"
 	"sdr/labo1/src/utils"
+	"sort"
+	"sync"
 )
 
-// Data Defines the channels used to access concurrency critical data
+// Data Defines the concurrency critical data, the events are protected by the mutex.
+// The events are modified with the write lock held, they are read with the read lock held and copied before being sent:
+// a read never sees an event partially modified and never waits for the critical section of a distributed write.
 type Data struct {
-	users  map[int]*types.User
-	events []*types.Event
+	mutex   sync.RWMutex
+	users   map[int]*types.User
+	events  []*types.Event
+	pending []dto.Operation // Operations received before a previous operation of their event
+	checker *consistency.Checker
+	flush   func() // Applies the replicated data received by the backend and not applied yet, nil if none is kept
 }
 
-var stopServer = make(chan bool)
+// eventsResource is the resource locked to allocate the id of a new event
+const eventsResource = "events"
 
+// eventResource gets the resource locked to modify an event
+func eventResource(eventId int) string {
+	return fmt.Sprintf("event-%d", eventId)
+}
+
+// openChannel opens a channel between the servers, its messages are delivered in causal order if configured
+func openChannel[T any](serverConfiguration *config.ServerConfiguration, mux *server_server.Mux, name string) server_server.Protocol[T] {
+	if serverConfiguration.CausalOrder {
+		return causal.CreateCausalProtocol[T](server_server.OpenChannel[causal.Message[T]](mux, name))
+	}
+	return server_server.OpenChannel[T](mux, name)
+}
+
+// running is a server running in the process, several servers run in the same process in the tests
+//   - stop: asks the server to stop, stopped: closed once its listeners and connections are closed
+type running struct {
+	stop    chan bool
+	stopped chan bool
+}
+
+var (
+	servers      = make(map[int]*running) // Servers running in the process, by id
+	serversMutex sync.Mutex
+)
+
+// Stop stops every server running in the process
 func Stop() {
-	stopServer <- true
+	serversMutex.Lock()
+	ids := make([]int, 0, len(servers))
+	for id := range servers {
+		ids = append(ids, id)
+	}
+	serversMutex.Unlock()
+	for _, id := range ids {
+		StopServer(id)
+	}
+}
+
+// StopServer stops the server running in the process with an id and waits until its connections are closed
+func StopServer(serverId int) {
+	serversMutex.Lock()
+	r, ok := servers[serverId]
+	serversMutex.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case r.stop <- true:
+	default: // Already stopping
+	}
+	<-r.stopped
 }
 
 func Start(serverConfiguration *config.ServerConfiguration) {
 	utils.SetEnabled(serverConfiguration.ShowInfosLogs)
 	utils.SetCriticDebug(serverConfiguration.Debug)
 	utils.LogInfo(true, "debug mode", serverConfiguration.Debug)
+	r := &running{stop: make(chan bool, 1), stopped: make(chan bool)}
+	serversMutex.Lock()
+	servers[serverConfiguration.Id] = r
+	serversMutex.Unlock()
 
-	listenerServer, err := net.Listen("tcp", serverConfiguration.GetCurrentUrls().Server)
+	transport := serverConfiguration.GetTransport()
+	listenerServer, err := transport.Listen(serverConfiguration.GetCurrentUrls().Server)
 	if err != nil {
 		utils.LogError(true, "Error listening:", err.Error())
 		os.Exit(1)
 	}
 
-	interServerProtocol := server_server.CreateInterServerProtocol[lamport.Request[[]dto.Event]](serverConfiguration.Id, listenerServer)
-
-	interServerProtocol.ConnectToServers(serverConfiguration.GetOtherServers())
-
-	// [AT THIS POINT, THE SERVER IS CONNECTED TO ALL OTHER SERVERS]
-
-	// init chan data structure
+	// init data structure
 	appData := Data{
 		users: make(map[int]*types.User),
 	}
 
-	lmpt := lamport.InitLamport[[]dto.Event](interServerProtocol)
-
-	go lmpt.Start() // Start listening to Lamport Messages
-
 	{ // Load configuration
 		users, events := serverConfiguration.GetData()
 		appData.users = users
 		appData.events = events
 	}
 
-	listenerClient, err := net.Listen("tcp", serverConfiguration.GetCurrentUrls().Client)
+	p := server_server.CreateInterServerProtocol[server_server.MuxMessage](serverConfiguration.Id, transport, listenerServer)
+	p.ConnectToServers(serverConfiguration.GetOtherServers())
+	mux := server_server.CreateMux(p)
+	snapshots := createSnapshots(p, mux, &appData)
+	checker := createChecker(mux, &appData)
+	detector := startFailureDetector(serverConfiguration, p, mux)
+	go mux.Start()
+
+	// [AT THIS POINT, THE SERVER IS CONNECTED TO ALL OTHER SERVERS, OR HAS JOINED A RUNNING CLUSTER]
+
+	coordinator := createElection(serverConfiguration, mux)
+	go coordinator.Start()
+	go func() {
+		for leader := range coordinator.GetLeaderChan() {
+			utils.LogSuccess(true, "Coordinator elected:", "server", leader)
+		}
+	}()
+	members := startMembership(serverConfiguration, p, mux, coordinator)
+
+	var w writer
+	switch serverConfiguration.Backend {
+	case "", config.MutualExclusionBackend:
+		w = startMutualExclusion(serverConfiguration, mux, coordinator, &appData)
+	case config.RaftBackend:
+		w = startRaft(serverConfiguration, mux, &appData)
+	case config.TotalOrderBackend:
+		w = startTotalOrder(serverConfiguration, mux, &appData)
+	default:
+		utils.LogError(true, "Unknown backend:", serverConfiguration.Backend)
+		os.Exit(1)
+	}
+
+	listenerClient, err := transport.Listen(serverConfiguration.GetCurrentUrls().Client)
 	if err != nil {
 		utils.LogError(true, "Error listening:", err.Error())
 		os.Exit(1)
@@ -86,44 +173,62 @@ func Start(serverConfiguration *config.ServerConfiguration) {
 	)
 
 	// Register endpoints
-	protocol.AddEndpoint("create", createEndpoint(&protocol, &appData, &lmpt))
-	protocol.AddEndpoint("show", showEndpoint(&protocol, &appData))
-	protocol.AddEndpoint("close", closeEndpoint(&protocol, &appData, &lmpt))
-	protocol.AddEndpoint("register", registerEndpoint(&protocol, &appData, &lmpt))
-
+	protocol.AddEndpoint("create", createEndpoint(w))
+	protocol.AddEndpoint("show", showEndpoint(w, &appData))
+	protocol.AddEndpoint("close", closeEndpoint(w))
+	protocol.AddEndpoint("register", registerEndpoint(w))
+	protocol.AddEndpoint("snapshot", snapshotEndpoint(snapshots))
+	protocol.AddEndpoint("consistency", consistencyEndpoint(checker))
+	protocol.AddEndpoint("join", joinEndpoint(members, &appData))
+	protocol.AddEndpoint("leave", leaveEndpoint(members, &appData))
+	protocol.AddEndpoint("members", membersEndpoint(detector, members))
+	protocol.AddEndpoint("stats", statsEndpoint(serverConfiguration.Id, mux))
+
+	var clients []net.Conn // Connections of the clients, closed when the server stops
+	var clientsMutex sync.Mutex
 	go func() {
 		for {
 			conn, err := listenerClient.Accept()
 			if err != nil {
 				return
 			}
+			clientsMutex.Lock()
+			clients = append(clients, conn)
+			clientsMutex.Unlock()
 			go protocol.HandleConnection(conn)
 		}
 	}()
 
-	go func() {
-		for {
-			select {
-			case data := <-lmpt.Data:
-				protocol.AddPending("UpdateData", true, func() {
-					appData.events = DTOToEvents(data)
-					utils.LogInfo(false, "Lamport callback called")
-				})
-			}
-		}
-	}()
-
 	go protocol.ProcessRequests()
-	<-stopServer
+	<-r.stop
 	utils.LogInfo(true, "Stopping server")
 	_ = listenerClient.Close()
 	_ = listenerServer.Close()
+	p.Close()
+	clientsMutex.Lock()
+	for _, conn := range clients {
+		_ = conn.Close()
+	}
+	clientsMutex.Unlock()
+
+	serversMutex.Lock()
+	delete(servers, serverConfiguration.Id)
+	serversMutex.Unlock()
+	close(r.stopped)
 }
 
 type request = network.Request[client_server.HeaderResponse]
 
+// writer
+// executes the commands modifying the events on every server.
+// A linearizable read is ordered with the writes of the cluster, it sees every write completed before it started.
+type writer interface {
+	write(command dto.Command) network.Response[any]
+	read(eventId int) network.Response[any]
+}
+
 // createEndpoint Registers a custom endpoint accessible on the server
-func createEndpoint(protocol *client_server.ServerProtocol, appData *Data, lmpt *lamport.Lamport[[]dto.Event]) client_server.ServerEndpoint {
+func createEndpoint(w writer) client_server.ServerEndpoint {
 	return client_server.ServerEndpoint{
 		NeedsAuth: true,
 		HandlerFunc: func(request request) network.Response[any] {
@@ -133,126 +238,261 @@ func createEndpoint(protocol *client_server.ServerProtocol, appData *Data, lmpt
 			if data.Name == "" {
 				return network.CreateResponse(false, "name is required")
 			}
-
-			event := &types.Event{
-				Name:         data.Name,
-				Open:         true,
-				OrganizerId:  request.Header.AuthId,
-				Jobs:         make(map[int]*types.Job),
-				Participants: make(map[int]int),
-			}
-			for i, job := range data.Jobs {
-				id := i + 1
-
+			for _, job := range data.Jobs {
 				if job.Capacity < 1 {
 					return network.CreateResponse(false, "capacity must be greater than 0")
 				}
-
 				if job.Name == "" {
 					return network.CreateResponse(false, "name is required")
 				}
-
-				event.Jobs[id] = &types.Job{
-					Id:       id,
-					Name:     job.Name,
-					Capacity: job.Capacity,
-				}
-			}
-			defer func() {
-				lmpt.SendClientReleaseCriticalSection(EventsToDTO(appData.events, appData))
-			}()
-			select {
-			case <-lmpt.SendClientAskCriticalSection():
-				protocol.ProcessPriorityRequests()
-				event.Id = len(appData.events) + 1
-				appData.events = append(appData.events, event)
-				return network.CreateResponse(true, EventToDTO(event, appData))
 			}
+			return w.write(dto.Command{
+				Type:   dto.CreateCommand,
+				UserId: request.Header.AuthId,
+				Create: &data,
+			})
 		},
 	}
 }
 
-// showEndpoint defines an endpoint that displays events
-func showEndpoint(protocol *client_server.ServerProtocol, appData *Data) client_server.ServerEndpoint {
+// showEndpoint defines an endpoint that displays events.
+// The requests are handled concurrently: by default the events known by the server are read without waiting
+// for the writes in progress, a linearizable read is ordered with the writes of the cluster.
+func showEndpoint(w writer, appData *Data) client_server.ServerEndpoint {
 	return client_server.ServerEndpoint{
-		NeedsAuth: false,
+		NeedsAuth:  false,
+		Concurrent: true,
 		HandlerFunc: func(request request) network.Response[any] {
 			data := dto.EventShow{}
 			request.GetJson(&data)
-			protocol.ProcessPriorityRequests()
-			if data.EventId != -1 {
-				for _, ev := range appData.events {
-					if ev.Id == data.EventId {
-						return network.CreateResponse(true, EventToDTO(ev, appData))
-					}
-				}
-				return network.CreateResponse(false, "event not found")
+			if data.Linearizable {
+				return w.read(data.EventId)
 			}
-			return network.CreateResponse(true, EventsToDTO(appData.events, appData))
+			return readEvents(appData, data.EventId)
 		},
 	}
 }
 
+// readEvents gets a copy of an event, or of every event if the id is -1
+func readEvents(appData *Data, eventId int) network.Response[any] {
+	appData.mutex.RLock()
+	defer appData.mutex.RUnlock()
+	if eventId != -1 {
+		if ev := findEvent(appData, eventId); ev != nil {
+			return network.CreateResponse(true, EventToDTO(ev, appData))
+		}
+		return network.CreateResponse(false, "event not found")
+	}
+	return network.CreateResponse(true, EventsToDTO(appData.events, appData))
+}
+
 // closeEndpoint defines an endpoint that closes events
-func closeEndpoint(protocol *client_server.ServerProtocol, appData *Data, lmpt *lamport.Lamport[[]dto.Event]) client_server.ServerEndpoint {
+func closeEndpoint(w writer) client_server.ServerEndpoint {
 	return client_server.ServerEndpoint{
 		NeedsAuth: true,
 		HandlerFunc: func(request request) network.Response[any] {
 			data := dto.EventClose{}
 			request.GetJson(&data)
-
-			defer func() {
-				lmpt.SendClientReleaseCriticalSection(EventsToDTO(appData.events, appData))
-			}()
-			select {
-			case <-lmpt.SendClientAskCriticalSection():
-				protocol.ProcessPriorityRequests() // Check if there are any pending requests
-				for i, ev := range appData.events {
-					if ev.Id == data.EventId {
-						if ev.OrganizerId != request.Header.AuthId {
-							return network.CreateResponse(false, "you are not the organizer")
-						}
-						if !ev.Open {
-							return network.CreateResponse(false, "event already closed")
-						}
-						appData.events[i].Open = false
-						return network.CreateResponse(true, EventToDTO(appData.events[i], appData))
-					}
-				}
-				return network.CreateResponse(false, "event not found")
-			}
+			return w.write(dto.Command{
+				Type:    dto.CloseCommand,
+				UserId:  request.Header.AuthId,
+				EventId: data.EventId,
+			})
 		},
 	}
 }
 
 // registerEndpoint defines an endpoint that register user to events
-func registerEndpoint(protocol *client_server.ServerProtocol, appData *Data, lmpt *lamport.Lamport[[]dto.Event]) client_server.ServerEndpoint {
+func registerEndpoint(w writer) client_server.ServerEndpoint {
 	return client_server.ServerEndpoint{
 		NeedsAuth: true,
 		HandlerFunc: func(request request) network.Response[any] {
 			data := dto.EventRegister{}
 			request.GetJson(&data)
+			return w.write(dto.Command{
+				Type:    dto.RegisterCommand,
+				UserId:  request.Header.AuthId,
+				EventId: data.EventId,
+				JobId:   data.JobId,
+			})
+		},
+	}
+}
 
-			defer func() {
-				lmpt.SendClientReleaseCriticalSection(EventsToDTO(appData.events, appData))
-			}()
-			select {
-			case <-lmpt.SendClientAskCriticalSection():
-				protocol.ProcessPriorityRequests() // Check if there are any pending requests
-				for _, ev := range appData.events {
-					if ev.Id == data.EventId {
-						if err := ev.Register(request.Header.AuthId, data.JobId); err != nil {
-							return network.CreateResponse(false, err.Error())
-						}
-						return network.CreateResponse(true, EventToDTO(ev, appData))
-					}
-				}
-				return network.CreateResponse(false, "event not found")
-			}
+// statsEndpoint defines an endpoint that gets the number of messages sent to the other servers, used to benchmark
+// the algorithms
+func statsEndpoint(serverId int, mux *server_server.Mux) client_server.ServerEndpoint {
+	return client_server.ServerEndpoint{
+		NeedsAuth:  false,
+		Concurrent: true,
+		HandlerFunc: func(request request) network.Response[any] {
+			return network.CreateResponse(true, dto.ServerStats{Id: serverId, Messages: mux.GetSentMessages()})
 		},
 	}
 }
 
+// executeCommand modifies the events, the data mutex must be held.
+// It returns the response sent to the client and the operation to replicate, nil if the command failed.
+func executeCommand(appData *Data, command dto.Command) (network.Response[any], *dto.Operation) {
+	response, operation := applyCommand(appData, command)
+	if operation != nil {
+		appData.changed()
+	}
+	return response, operation
+}
+
+// applyCommand applies the command to the events, the data mutex must be held
+func applyCommand(appData *Data, command dto.Command) (network.Response[any], *dto.Operation) {
+	if command.Type == dto.CreateCommand {
+		event := &types.Event{
+			Id:           1,
+			Name:         command.Create.Name,
+			Open:         true,
+			OrganizerId:  command.UserId,
+			Jobs:         make(map[int]*types.Job),
+			Participants: make(map[int]int),
+			Version:      1,
+		}
+		for i, job := range command.Create.Jobs {
+			id := i + 1
+			event.Jobs[id] = &types.Job{
+				Id:       id,
+				Name:     job.Name,
+				Capacity: job.Capacity,
+			}
+		}
+		if len(appData.events) > 0 {
+			event.Id = appData.events[len(appData.events)-1].Id + 1
+		}
+		appData.events = append(appData.events, event)
+		created := EventToDTO(event, appData)
+		return network.CreateResponse(true, created), &dto.Operation{
+			Type:     dto.EventCreated,
+			EventId:  event.Id,
+			Sequence: event.Version,
+			Event:    &created,
+		}
+	}
+
+	ev := findEvent(appData, command.EventId)
+	if ev == nil {
+		return network.CreateResponse(false, "event not found"), nil
+	}
+	operation := &dto.Operation{EventId: ev.Id}
+	switch command.Type {
+	case dto.CloseCommand:
+		if ev.OrganizerId != command.UserId {
+			return network.CreateResponse(false, "you are not the organizer"), nil
+		}
+		if !ev.Open {
+			return network.CreateResponse(false, "event already closed"), nil
+		}
+		ev.Open = false
+		operation.Type = dto.EventClosed
+	case dto.RegisterCommand:
+		if err := ev.Register(command.UserId, command.JobId); err != nil {
+			return network.CreateResponse(false, err.Error()), nil
+		}
+		operation.Type = dto.RegistrationChanged
+		operation.UserId = command.UserId
+		operation.JobId = command.JobId
+	default:
+		return network.CreateResponse(false, "unknown command"), nil
+	}
+	ev.Version++
+	operation.Sequence = ev.Version
+	return network.CreateResponse(true, EventToDTO(ev, appData)), operation
+}
+
+// findEvent finds an event by its id, the data mutex must be held
+func findEvent(appData *Data, eventId int) *types.Event {
+	for _, ev := range appData.events {
+		if ev.Id == eventId {
+			return ev
+		}
+	}
+	return nil
+}
+
+// eventExists checks if an event is known by the server, events are never deleted
+func eventExists(appData *Data, eventId int) bool {
+	appData.mutex.RLock()
+	defer appData.mutex.RUnlock()
+	return findEvent(appData, eventId) != nil
+}
+
+// applyOperations applies the replicated operations, the data mutex must be held.
+// An operation received before a previous operation of its event is kept until the previous one is applied,
+// it returns true if operations are still waiting.
+func applyOperations(appData *Data, operations []dto.Operation) bool {
+	waiting := append(appData.pending, operations...)
+	for progress := true; progress; {
+		progress = false
+		var next []dto.Operation
+		for _, operation := range waiting {
+			if applyOperation(appData, operation) {
+				progress = true
+			} else {
+				next = append(next, operation)
+			}
+		}
+		waiting = next
+	}
+	appData.pending = waiting
+	sort.Slice(appData.events, func(i, j int) bool {
+		return appData.events[i].Id < appData.events[j].Id
+	})
+	appData.changed()
+	return len(waiting) > 0
+}
+
+// applyOperation applies an operation if it is the next one of its event, it returns false if a previous one is missing
+func applyOperation(appData *Data, operation dto.Operation) bool {
+	ev := findEvent(appData, operation.EventId)
+	switch operation.Type {
+	case dto.EventCreated, dto.EventState:
+		if ev == nil {
+			appData.events = append(appData.events, DTOToEvent(*operation.Event))
+		} else if operation.Sequence > ev.Version {
+			*ev = *DTOToEvent(*operation.Event)
+		}
+		return true
+	}
+
+	if ev == nil || operation.Sequence > ev.Version+1 {
+		return false
+	}
+	if operation.Sequence <= ev.Version { // Already applied
+		return true
+	}
+	switch operation.Type {
+	case dto.EventClosed:
+		ev.Open = false
+	case dto.RegistrationChanged:
+		if err := ev.Register(operation.UserId, operation.JobId); err != nil {
+			utils.LogError(false, "replication", "cannot apply the registration:", err.Error())
+			return false
+		}
+	}
+	ev.Version = operation.Sequence
+	return true
+}
+
+// stateOperations gets the full state of every event, the data mutex must be held
+func stateOperations(appData *Data) []dto.Operation {
+	operations := make([]dto.Operation, 0, len(appData.events))
+	for _, event := range appData.events {
+		state := EventToDTO(event, appData)
+		operations = append(operations, dto.Operation{
+			Type:     dto.EventState,
+			EventId:  event.Id,
+			Sequence: event.Version,
+			Event:    &state,
+		})
+	}
+	return operations
+}
+
 // getUserById find and return and user in the user database
 func getUserById(id int, appData *Data) types.User {
 	users := appData.users
@@ -282,6 +522,7 @@ func EventToDTO(event *types.Event, appData *Data) dto.Event {
 		Jobs:         jobs,
 		Organizer:    getUserById(event.OrganizerId, appData),
 		Participants: participants,
+		Version:      event.Version,
 	}
 }
 
@@ -298,6 +539,7 @@ func DTOToEvent(data dto.Event) *types.Event {
 	jobs := make(map[int]*types.Job)
 
 	for _, job := range data.Jobs {
+		job := job
 		jobs[job.Id] = &job
 	}
 	participants := make(map[int]int)
@@ -311,6 +553,7 @@ func DTOToEvent(data dto.Event) *types.Event {
 		Jobs:         jobs,
 		OrganizerId:  data.Organizer.Id,
 		Participants: participants,
+		Version:      data.Version,
 	}
 }
 
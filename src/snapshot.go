@@ -0,0 +1,54 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package server
+
+import (
+	"sdr/labo1/src/dto"
+	"sdr/labo1/src/network"
+	"sdr/labo1/src/network/client_server"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/network/snapshot"
+)
+
+const snapshotDirectory = "snapshots" // Directory of the JSON files of the global snapshots
+
+// createSnapshots records the events of the server in the global snapshots. The replicated data already received by
+// the backend is applied first, the operations still waiting for a previous one are recorded with the events.
+func createSnapshots(p server_server.Protocol[server_server.MuxMessage], mux *server_server.Mux, appData *Data) *snapshot.Snapshots {
+	return snapshot.CreateSnapshots(mux, p, func() {
+		appData.mutex.RLock()
+		flush := appData.flush
+		appData.mutex.RUnlock()
+		if flush != nil {
+			flush()
+		}
+	}, func() any {
+		appData.mutex.RLock()
+		defer appData.mutex.RUnlock()
+		return dto.SnapshotState{
+			Events:  EventsToDTO(appData.events, appData),
+			Pending: append([]dto.Operation{}, appData.pending...),
+		}
+	})
+}
+
+// snapshotEndpoint defines an endpoint that takes a global snapshot of the servers and writes it to a JSON file
+func snapshotEndpoint(snapshots *snapshot.Snapshots) client_server.ServerEndpoint {
+	return client_server.ServerEndpoint{
+		NeedsAuth: true,
+		HandlerFunc: func(request request) network.Response[any] {
+			global := snapshots.Take()
+			path, err := global.Write(snapshotDirectory)
+			if err != nil {
+				return network.CreateResponse(false, "unable to write the snapshot: "+err.Error())
+			}
+			result := dto.SnapshotResult{Id: global.Id, Path: path, Servers: []int{}, Missing: []int{}}
+			for _, report := range global.Servers {
+				result.Servers = append(result.Servers, report.Server)
+			}
+			result.Missing = append(result.Missing, global.Missing...)
+			return network.CreateResponse(true, result)
+		},
+	}
+}
@@ -0,0 +1,57 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package server
+
+import (
+	"os"
+	"sdr/labo1/src/config"
+	"sdr/labo1/src/dto"
+	"sdr/labo1/src/network"
+	"sdr/labo1/src/network/client_server"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/network/swim"
+	"sdr/labo1/src/utils"
+)
+
+const swimChannel = "swim"
+
+// startFailureDetector starts the SWIM failure detector, its view is given to the clients.
+// With the swim failure detector configured, the connection of a server declared dead is closed instead of the
+// connection of a silent server: the algorithms get its crash like any lost connection.
+func startFailureDetector(serverConfiguration *config.ServerConfiguration, p *server_server.InterServerProtocol[server_server.MuxMessage], mux *server_server.Mux) *swim.Swim {
+	var onChange func(update swim.Update)
+	switch serverConfiguration.FailureDetector {
+	case "", config.HeartbeatDetector:
+	case config.SwimDetector:
+		p.DisableHeartbeatTimeout()
+		onChange = func(update swim.Update) {
+			if update.State == swim.Dead {
+				p.Disconnect(update.ServerId, "declared dead by swim")
+			}
+		}
+	default:
+		utils.LogError(true, "Unknown failure detector:", serverConfiguration.FailureDetector)
+		os.Exit(1)
+	}
+	detector := swim.CreateSwim(server_server.OpenChannel[swim.Message](mux, swimChannel), p.GetMembers, onChange)
+	go detector.Start()
+	return detector
+}
+
+// membersEndpoint defines an endpoint that gets the state of the servers, used by the clients to change of server
+func membersEndpoint(detector *swim.Swim, members *membership) client_server.ServerEndpoint {
+	return client_server.ServerEndpoint{
+		NeedsAuth: false,
+		HandlerFunc: func(request request) network.Response[any] {
+			servers := members.getServers()
+			result := []dto.ServerState{}
+			for _, member := range detector.GetView() {
+				if member.Id < len(servers) {
+					result = append(result, dto.ServerState{Id: member.Id, Client: servers[member.Id].Client, State: member.State})
+				}
+			}
+			return network.CreateResponse(true, result)
+		},
+	}
+}
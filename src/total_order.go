@@ -0,0 +1,206 @@
+// SDR - Labo 2
+// Nicolas Crausaz & Maxime Scharwath
+
+package server
+
+import (
+	"sdr/labo1/src/config"
+	"sdr/labo1/src/dto"
+	"sdr/labo1/src/network"
+	"sdr/labo1/src/network/causal"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/network/total_order"
+	"sdr/labo1/src/utils"
+	"sync"
+	"time"
+)
+
+const (
+	totalOrderChannel = "total-order"
+	totalOrderTimeout = 5 * time.Second // Delay to wait for a command or the state of the cluster to be delivered
+)
+
+type totalOrderType int
+
+const (
+	totalOrderCommand      totalOrderType = 0 // Command of a client, executed by every server
+	totalOrderStateRequest totalOrderType = 1 // A server joining the cluster asks for the state
+	totalOrderState        totalOrderType = 2 // State of the events when the request was delivered
+)
+
+// totalOrderMessage is a message broadcast in total order
+//   - Origin: the server that broadcast the message, it answers to the client
+//   - Target: the server that asked for the state
+type totalOrderMessage struct {
+	Type      totalOrderType  `json:"type"`
+	Origin    int             `json:"origin"`
+	RequestId int             `json:"requestId"`
+	Command   *dto.Command    `json:"command,omitempty"`
+	Target    int             `json:"target"`
+	State     []dto.Operation `json:"state,omitempty"`
+}
+
+// totalOrderWriter
+// broadcasts the commands in total order, every server executes them in the same order without critical section.
+type totalOrderWriter struct {
+	broadcast *total_order.TotalOrder[totalOrderMessage]
+	protocol  server_server.Protocol[total_order.Message[totalOrderMessage]]
+	appData   *Data
+	requests  int
+	results   map[int]chan network.Response[any]
+	mutex     sync.Mutex
+
+	syncing      bool                // The state was asked, the commands delivered until it is received are buffered
+	syncDeadline time.Time           // The buffered commands are executed without the state after the deadline
+	buffered     []totalOrderMessage // Commands delivered after the state request
+	synced       chan bool
+}
+
+// startTotalOrder starts the total order broadcast and gets the events of the cluster
+func startTotalOrder(serverConfiguration *config.ServerConfiguration, mux *server_server.Mux, appData *Data) writer {
+	p := openChannel[total_order.Message[totalOrderMessage]](serverConfiguration, mux, totalOrderChannel)
+	broadcast := total_order.InitTotalOrder[totalOrderMessage](p)
+	w := &totalOrderWriter{
+		broadcast: &broadcast,
+		protocol:  p,
+		appData:   appData,
+		results:   make(map[int]chan network.Response[any]),
+		synced:    make(chan bool, 1),
+	}
+	if repairable, ok := p.(causal.Repairable); ok { // The commands dropped by the causal order are in the state
+		repairable.SetRepair(w.synchronize)
+	}
+	go broadcast.Start()
+	go w.handleDeliveries()
+	w.synchronize()
+	return w
+}
+
+// synchronize gets the state of the cluster, the server may have been restarted after a crash.
+// The state is asked in total order, it contains the commands delivered before the request.
+func (w *totalOrderWriter) synchronize() {
+	alone := true
+	for i := 0; i < w.protocol.GetNumberOfServers(); i++ {
+		if i != w.protocol.GetServerId() && w.protocol.IsConnected(i) {
+			alone = false
+		}
+	}
+	if alone {
+		return
+	}
+	w.broadcast.Broadcast(totalOrderMessage{Type: totalOrderStateRequest, Origin: w.protocol.GetServerId()})
+	select {
+	case <-w.synced:
+		utils.LogSuccess(false, "total order", "state received")
+	case <-time.After(totalOrderTimeout):
+		utils.LogWarning(false, "total order", "no server sent its state")
+	}
+}
+
+// responder checks if the server sends its state to the server asking for it, the connected server with the lowest id
+func (w *totalOrderWriter) responder(target int) bool {
+	for i := 0; i < w.protocol.GetServerId(); i++ {
+		if i != target && w.protocol.IsConnected(i) {
+			return false
+		}
+	}
+	return w.protocol.GetServerId() != target
+}
+
+func (w *totalOrderWriter) execute(m totalOrderMessage) {
+	var response network.Response[any]
+	if m.Command.Type == dto.ShowCommand {
+		if m.Origin != w.protocol.GetServerId() {
+			return // Only the server of the client reads the events
+		}
+		response = readEvents(w.appData, m.Command.EventId)
+	} else {
+		w.appData.mutex.Lock()
+		response, _ = executeCommand(w.appData, *m.Command)
+		w.appData.mutex.Unlock()
+		if m.Origin != w.protocol.GetServerId() {
+			return
+		}
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if result, ok := w.results[m.RequestId]; ok {
+		result <- response
+		delete(w.results, m.RequestId)
+	}
+}
+
+// handleDeliveries executes the commands in the order they are delivered
+func (w *totalOrderWriter) handleDeliveries() {
+	for m := range w.broadcast.GetDeliveryChan() {
+		switch m.Type {
+		case totalOrderCommand:
+			if w.syncing && time.Now().After(w.syncDeadline) {
+				w.flush()
+			}
+			if w.syncing {
+				w.buffered = append(w.buffered, m)
+			} else {
+				w.execute(m)
+			}
+		case totalOrderStateRequest:
+			if m.Origin == w.protocol.GetServerId() {
+				w.syncing = true
+				w.syncDeadline = time.Now().Add(totalOrderTimeout)
+			} else if w.responder(m.Origin) {
+				w.appData.mutex.RLock()
+				state := stateOperations(w.appData)
+				w.appData.mutex.RUnlock()
+				go w.broadcast.Broadcast(totalOrderMessage{Type: totalOrderState, Origin: w.protocol.GetServerId(), Target: m.Origin, State: state})
+			}
+		case totalOrderState:
+			if m.Target != w.protocol.GetServerId() || !w.syncing {
+				continue
+			}
+			w.appData.mutex.Lock()
+			w.appData.events = nil
+			w.appData.pending = nil
+			applyOperations(w.appData, m.State)
+			w.appData.mutex.Unlock()
+			w.flush()
+			select {
+			case w.synced <- true:
+			default: // A state was already received and not waited for
+			}
+		}
+	}
+}
+
+// flush executes the commands buffered while the state was asked
+func (w *totalOrderWriter) flush() {
+	for _, command := range w.buffered {
+		w.execute(command)
+	}
+	w.syncing = false
+	w.buffered = nil
+}
+
+func (w *totalOrderWriter) write(command dto.Command) network.Response[any] {
+	result := make(chan network.Response[any], 1)
+	w.mutex.Lock()
+	w.requests++
+	requestId := w.requests
+	w.results[requestId] = result
+	w.mutex.Unlock()
+
+	w.broadcast.Broadcast(totalOrderMessage{Type: totalOrderCommand, Origin: w.protocol.GetServerId(), RequestId: requestId, Command: &command})
+	select {
+	case response := <-result:
+		return response
+	case <-time.After(totalOrderTimeout):
+		w.mutex.Lock()
+		delete(w.results, requestId)
+		w.mutex.Unlock()
+		return network.CreateResponse(false, "timeout, the command may not have been applied")
+	}
+}
+
+// read broadcasts the read in total order, the events are read once all the commands delivered before it are executed
+func (w *totalOrderWriter) read(eventId int) network.Response[any] {
+	return w.write(dto.Command{Type: dto.ShowCommand, EventId: eventId})
+}
@@ -15,6 +15,7 @@ type Event struct {
 	Open         bool
 	OrganizerId  int
 	Participants map[int]int
+	Version      int // Incremented at each modification, used to keep the most recent replica
 }
 
 // Unregister removes a user from a job that was previously registered
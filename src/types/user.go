@@ -8,4 +8,5 @@ type User struct {
 	Id       int    `json:"id"`
 	Username string `json:"username"`
 	Password string `json:"-"`
+	Admin    bool   `json:"-"`
 }
@@ -8,17 +8,18 @@ import (
 	"fmt"
 	"math/rand"
 	"sdr/labo1/src/utils/colors"
+	"sync/atomic"
 	"time"
 )
 
-var enableCriticDebug = false
+var enableCriticDebug atomic.Bool
 
 func SetCriticDebug(enable bool) {
-	enableCriticDebug = enable
+	enableCriticDebug.Store(enable)
 }
 
 func CreateCriticalSection(name string, callback func()) {
-	if !enableCriticDebug {
+	if !enableCriticDebug.Load() {
 		callback()
 		return
 	}
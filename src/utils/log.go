@@ -8,18 +8,24 @@ package utils
 import (
 	"fmt"
 	"sdr/labo1/src/utils/colors"
+	"sync/atomic"
 	"time"
 )
 
-var enabled = true
+// enabled is read by the go routines of every server running in the process, atomic to set it while they run
+var enabled atomic.Bool
+
+func init() {
+	enabled.Store(true)
+}
 
 // SetEnabled enable trace login globally
 func SetEnabled(enable bool) {
-	enabled = enable
+	enabled.Store(enable)
 }
 
 func IsLogEnabled() bool {
-	return enabled
+	return enabled.Load()
 }
 
 func LogInfo(force bool, prefix string, data ...any) {
@@ -39,7 +45,7 @@ func LogError(force bool, prefix string, data ...any) {
 }
 
 func Log(force bool, prefix string, color string, data ...any) {
-	if !enabled && !force {
+	if !enabled.Load() && !force {
 		return
 	}
 	date := time.Now().Format("2006-01-02 15:04:05")
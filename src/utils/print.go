@@ -40,6 +40,12 @@ func PrintHelp() {
 	fmt.Println("- show")
 	fmt.Println("- show [number]")
 	fmt.Println("- show [number] --resume")
+	fmt.Println("- show [number] --linearizable")
+	fmt.Println("- snapshot")
+	fmt.Println("- consistency")
+	fmt.Println("- members")
+	fmt.Println("- join")
+	fmt.Println("- leave")
 	fmt.Println("- quit")
 	fmt.Println("_________________________")
 }
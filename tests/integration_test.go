@@ -4,13 +4,43 @@
 package tests
 
 import (
+	encoding "encoding/json"
+	"fmt"
 	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
 	server "sdr/labo1/src"
+	"sdr/labo1/src/bench"
+	"sdr/labo1/src/chaos"
+	"sdr/labo1/src/cluster"
 	"sdr/labo1/src/config"
+	"sdr/labo1/src/core"
 	"sdr/labo1/src/dto"
+	"sdr/labo1/src/linearizability"
 	"sdr/labo1/src/network"
+	"sdr/labo1/src/network/causal"
+	"sdr/labo1/src/network/centralized"
 	"sdr/labo1/src/network/client_server"
+	"sdr/labo1/src/network/consistency"
+	"sdr/labo1/src/network/election"
+	"sdr/labo1/src/network/lamport"
+	"sdr/labo1/src/network/maekawa"
+	"sdr/labo1/src/network/memory"
+	"sdr/labo1/src/network/mutual_exclusion"
+	"sdr/labo1/src/network/raft"
+	"sdr/labo1/src/network/raymond"
+	"sdr/labo1/src/network/ricart_agrawala"
+	"sdr/labo1/src/network/server_server"
+	"sdr/labo1/src/network/snapshot"
+	"sdr/labo1/src/network/suzuki_kasami"
+	"sdr/labo1/src/network/swim"
+	"sdr/labo1/src/network/total_order"
 	"sdr/labo1/src/types"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -59,11 +89,13 @@ var validServerConfig = config.ServerConfiguration{
 			1,
 			"user1",
 			"pass1",
+			true,
 		},
 		{
 			2,
 			"test",
 			"test",
+			false,
 		},
 	},
 	Debug:         false,
@@ -697,3 +729,2266 @@ func TestErrors(t *testing.T) {
 	})
 
 }
+
+func TestMutualExclusion(t *testing.T) {
+	algorithms := []string{config.Lamport, config.RicartAgrawala, config.SuzukiKasami, config.Raymond, config.Maekawa, config.Centralized}
+
+	for _, algorithm := range algorithms {
+		algorithm := algorithm
+		t.Run("should create and register with "+algorithm, func(t *testing.T) {
+			serverConfig := validServerConfig
+			serverConfig.MutualExclusion = algorithm
+			go server.Start(&serverConfig)
+			time.Sleep(30 * time.Millisecond)
+
+			conn, _ := connect(validClientConfig.Servers[0])
+			cli := client_server.CreateClientProtocol(conn, func() types.Credentials {
+				return types.Credentials{
+					Username: "user1",
+					Password: "pass1",
+				}
+			})
+
+			_, _ = cli.SendRequest("create", func(auth client_server.AuthId) any {
+				return dto.EventCreate{
+					Name: "Test new event",
+					Jobs: []dto.Job{
+						{
+							Name:     "Test",
+							Capacity: 2,
+						},
+					},
+				}
+			})
+
+			json, _ := cli.SendRequest("register", func(auth client_server.AuthId) any {
+				return dto.EventRegister{
+					EventId: 1,
+					JobId:   1,
+				}
+			})
+
+			event, responseError := network.ParseResponse[*dto.Event](json)
+
+			expect(t, responseError, nil)
+			expect(t, event.Jobs[0].Count, 1)
+
+			t.Cleanup(func() {
+				clean(conn)
+			})
+		})
+	}
+}
+
+// fakeInstance is a mutual exclusion instance giving the messages it receives to the test, or never reading them
+type fakeInstance struct {
+	protocol server_server.Protocol[int]
+	received chan int
+	data     chan int
+}
+
+func (f *fakeInstance) Start() {
+	if f.received == nil {
+		select {} // Blocked
+	}
+	for message := range f.protocol.GetMessageChan() {
+		f.received <- message
+	}
+}
+func (f *fakeInstance) SendClientAskCriticalSection() chan bool { return make(chan bool) }
+func (f *fakeInstance) SendClientReleaseCriticalSection(int)    {}
+func (f *fakeInstance) SendClientLeaveCriticalSection()         {}
+func (f *fakeInstance) GetDataChan() chan int                   { return f.data }
+
+// clockedInstance is a fake instance using a logical clock
+type clockedInstance struct {
+	*fakeInstance
+	clock int
+}
+
+func (c *clockedInstance) GetClock() int      { return c.clock }
+func (c *clockedInstance) SetClock(stamp int) { c.clock = stamp }
+
+func TestResources(t *testing.T) {
+	t.Run("should not block a resource on the instance of another one", func(t *testing.T) {
+		protocol := createFakeProtocol[mutual_exclusion.ResourceMessage[int, int]]()
+		received := make(chan int)
+		created := 0
+		resources := mutual_exclusion.CreateResources[int, int](protocol, func(p server_server.Protocol[int]) mutual_exclusion.MutualExclusion[int] {
+			created++
+			instance := &fakeInstance{protocol: p, data: make(chan int)}
+			if created == 2 { // The instance of event-1 never reads its messages
+				instance.received = received
+			}
+			return instance
+		}, func(int) {}, func() int { return 0 })
+		go resources.Start()
+
+		for i := 0; i < 10; i++ {
+			protocol.messages <- mutual_exclusion.ResourceMessage[int, int]{Resource: "event-1", Message: i}
+		}
+		protocol.peers <- server_server.PeerEvent{ServerId: 1, Alive: false}
+		protocol.messages <- mutual_exclusion.ResourceMessage[int, int]{Resource: "event-2", Message: 42}
+		select {
+		case message := <-received:
+			expect(t, message, 42)
+		case <-time.After(time.Second):
+			t.Fatalf("message of event-2 blocked by event-1")
+		}
+	})
+
+	t.Run("should modify two events at the same time on two servers", func(t *testing.T) {
+		cluster := memory.CreateNetwork(4)
+		startCluster(t, cluster, 2)
+		transport := cluster.Transport("client")
+		clients := []*client_server.ClientProtocol{
+			connectMemory(t, transport, "server-0:client"),
+			connectMemory(t, transport, "server-1:client"),
+		}
+		event := dto.EventCreate{Name: "Concurrent", Jobs: []dto.Job{{Name: "A", Capacity: 2}, {Name: "B", Capacity: 2}}}
+		for _, cli := range clients {
+			_, err := call[dto.Event](cli, "create", event)
+			expect(t, err, nil)
+		}
+
+		// Each server moves the registration of its user between the jobs of its own event
+		var wg sync.WaitGroup
+		errs := make([]error, len(clients))
+		for i, cli := range clients {
+			wg.Add(1)
+			go func(i int, cli *client_server.ClientProtocol) {
+				defer wg.Done()
+				for k := 0; k < 10 && errs[i] == nil; k++ {
+					_, errs[i] = call[dto.Event](cli, "register", dto.EventRegister{EventId: 1 + i, JobId: 1 + k%2})
+				}
+			}(i, cli)
+		}
+		wg.Wait()
+		expect(t, errs[0], nil)
+		expect(t, errs[1], nil)
+
+		var shown []string
+		for _, cli := range clients {
+			events, err := call[[]dto.Event](cli, "show", dto.EventShow{EventId: -1, Linearizable: true})
+			expect(t, err, nil)
+			for _, event := range events { // The jobs are not ordered
+				sort.Slice(event.Jobs, func(i, j int) bool { return event.Jobs[i].Id < event.Jobs[j].Id })
+			}
+			data, _ := encoding.Marshal(events)
+			shown = append(shown, string(data))
+		}
+		expect(t, shown[1], shown[0])
+	})
+
+	t.Run("should give the transferred clocks to the instances created after the transfer", func(t *testing.T) {
+		protocol := createFakeProtocol[mutual_exclusion.ResourceMessage[int, int]]()
+		var created []*clockedInstance
+		resources := mutual_exclusion.CreateResources[int, int](protocol, func(p server_server.Protocol[int]) mutual_exclusion.MutualExclusion[int] {
+			instance := &clockedInstance{fakeInstance: &fakeInstance{protocol: p, data: make(chan int)}}
+			created = append(created, instance)
+			return instance
+		}, func(int) {}, func() int { return 0 })
+		go resources.Start()
+
+		synchronized := make(chan bool)
+		go func() {
+			resources.Synchronize()
+			close(synchronized)
+		}()
+		protocol.messages <- mutual_exclusion.ResourceMessage[int, int]{Transfer: &mutual_exclusion.Transfer[int]{
+			Sender: 1, Clocks: map[string]int{"events": 42, "event-1": 12},
+		}}
+		select {
+		case <-synchronized:
+		case <-time.After(time.Second):
+			t.Fatalf("state not received")
+		}
+
+		// The instances are created when the resources are first used, event-2 is unknown by the sender
+		resources.SendClientLeaveCriticalSection("event-1")
+		resources.SendClientLeaveCriticalSection("event-2")
+		expect(t, len(created), 2)
+		expect(t, created[0].clock, 12)
+		expect(t, created[1].clock, 42)
+	})
+}
+
+// countingProtocol counts the messages of a mutual exclusion algorithm sent to the other servers, by type
+type countingProtocol[M any] struct {
+	server_server.Protocol[M]
+	kind func(req M) int
+	sent *[messageTypes]int64
+}
+
+const messageTypes = 16
+
+func (c countingProtocol[M]) SendTo(serverId int, req M) error {
+	atomic.AddInt64(&c.sent[c.kind(req)], 1)
+	return c.Protocol.SendTo(serverId, req)
+}
+
+func (c countingProtocol[M]) SendToAll(req M) error {
+	for i := 0; i < c.GetNumberOfServers(); i++ {
+		if i != c.GetServerId() && c.IsConnected(i) {
+			atomic.AddInt64(&c.sent[c.kind(req)], 1)
+		}
+	}
+	return c.Protocol.SendToAll(req)
+}
+
+// countMessages counts the messages sent by the servers for a critical section of server 1, the critical section is
+// released with data when replicate is true and left without data otherwise. The data is received by every server,
+// or only by server 1 when lazy is true: the others receive it when they ask for the critical section.
+func countMessages[M any](t *testing.T, size int, kind func(req M) int, create func(id int, p server_server.Protocol[M]) mutual_exclusion.MutualExclusion[int], replicate bool, lazy bool) [messageTypes]int64 {
+	var sent [messageTypes]int64
+	instances := make([]mutual_exclusion.MutualExclusion[int], size)
+	startNodes(t, memory.CreateNetwork(1), size, func(id int, n node) {
+		instances[id] = create(id, countingProtocol[M]{server_server.OpenChannel[M](n.mux, "mutual-exclusion"), kind, &sent})
+		go instances[id].Start()
+	})
+	received := make([]int64, size)
+	stop := make(chan bool)
+	t.Cleanup(func() {
+		close(stop)
+	})
+	for id, m := range instances {
+		go func(id int, m mutual_exclusion.MutualExclusion[int]) {
+			for {
+				select {
+				case <-m.GetDataChan():
+					atomic.AddInt64(&received[id], 1)
+				case <-stop:
+					return
+				}
+			}
+		}(id, m)
+	}
+
+	select {
+	case <-instances[1].SendClientAskCriticalSection():
+	case <-time.After(2 * time.Second):
+		t.Fatal("critical section not given")
+	}
+	if replicate {
+		instances[1].SendClientReleaseCriticalSection(1)
+		for id := range instances {
+			id := id
+			if lazy && id != 1 {
+				continue
+			}
+			eventually(t, 2*time.Second, func() bool {
+				return atomic.LoadInt64(&received[id]) > 0
+			}, fmt.Sprintf("data not received by server %d", id))
+		}
+	} else {
+		instances[1].SendClientLeaveCriticalSection()
+	}
+	time.Sleep(50 * time.Millisecond) // The messages sent after the data is received are counted too
+	for id := range instances {
+		if (!replicate || lazy && id != 1) && atomic.LoadInt64(&received[id]) > 0 {
+			t.Errorf("data received by server %d", id)
+		}
+	}
+	var counts [messageTypes]int64
+	for i := range counts {
+		counts[i] = atomic.LoadInt64(&sent[i])
+	}
+	return counts
+}
+
+func TestMessages(t *testing.T) {
+	const size = 5
+	parents, err := config.ServerConfiguration{Servers: make([]config.ServerUrl, size)}.GetParents()
+	expect(t, err, nil)
+
+	// Messages of a critical section of server 1 with 5 servers, by type, with data to replicate or without.
+	// The servers running Lamport exchange their state when they start (SYN, STA).
+	tests := []struct {
+		algorithm string
+		count     func(t *testing.T, replicate bool) [messageTypes]int64
+		release   map[int]int64
+		leave     map[int]int64
+	}{
+		{config.Lamport, func(t *testing.T, replicate bool) [messageTypes]int64 {
+			return countMessages(t, size, func(req lamport.Request[int]) int { return int(req.ReqType) }, func(id int, p server_server.Protocol[lamport.Request[int]]) mutual_exclusion.MutualExclusion[int] {
+				l := lamport.InitLamport[int](p)
+				return &l
+			}, replicate, false)
+		}, map[int]int64{int(lamport.REQ): 4, int(lamport.ACK): 4, int(lamport.REL): 4, int(lamport.SYN): 20, int(lamport.STA): 20},
+			map[int]int64{int(lamport.REQ): 4, int(lamport.ACK): 4, int(lamport.REL): 4, int(lamport.SYN): 20, int(lamport.STA): 20}},
+		{config.RicartAgrawala, func(t *testing.T, replicate bool) [messageTypes]int64 {
+			return countMessages(t, size, func(req ricart_agrawala.Request[int]) int { return int(req.ReqType) }, func(id int, p server_server.Protocol[ricart_agrawala.Request[int]]) mutual_exclusion.MutualExclusion[int] {
+				r := ricart_agrawala.InitRicartAgrawala[int](p)
+				return &r
+			}, replicate, true)
+		}, map[int]int64{int(ricart_agrawala.REQ): 4, int(ricart_agrawala.OK): 4}, map[int]int64{int(ricart_agrawala.REQ): 4, int(ricart_agrawala.OK): 4}},
+		{config.SuzukiKasami, func(t *testing.T, replicate bool) [messageTypes]int64 {
+			return countMessages(t, size, func(req suzuki_kasami.Request[int]) int { return int(req.ReqType) }, func(id int, p server_server.Protocol[suzuki_kasami.Request[int]]) mutual_exclusion.MutualExclusion[int] {
+				s := suzuki_kasami.InitSuzukiKasami[int](p)
+				return &s
+			}, replicate, false)
+		}, map[int]int64{int(suzuki_kasami.REQ): 4, int(suzuki_kasami.TOK): 1, int(suzuki_kasami.UPD): 4}, map[int]int64{int(suzuki_kasami.REQ): 4, int(suzuki_kasami.TOK): 1}},
+		{config.Raymond, func(t *testing.T, replicate bool) [messageTypes]int64 {
+			return countMessages(t, size, func(req raymond.Request[int]) int { return int(req.ReqType) }, func(id int, p server_server.Protocol[raymond.Request[int]]) mutual_exclusion.MutualExclusion[int] {
+				r := raymond.InitRaymond[int](p, parents)
+				return &r
+			}, replicate, false)
+		}, map[int]int64{int(raymond.REQ): 1, int(raymond.PRV): 1, int(raymond.UPD): 4}, map[int]int64{int(raymond.REQ): 1, int(raymond.PRV): 1}},
+		{config.Centralized, func(t *testing.T, replicate bool) [messageTypes]int64 {
+			return countMessages(t, size, func(req centralized.Request[int]) int { return int(req.ReqType) }, func(id int, p server_server.Protocol[centralized.Request[int]]) mutual_exclusion.MutualExclusion[int] {
+				c := centralized.InitCentralized[int](p, func() int { return 0 })
+				return &c
+			}, replicate, false)
+		}, map[int]int64{int(centralized.REQUEST): 1, int(centralized.GRANT): 1, int(centralized.RELEASE): 1, int(centralized.UPD): 3}, map[int]int64{int(centralized.REQUEST): 1, int(centralized.GRANT): 1, int(centralized.RELEASE): 1}},
+	}
+
+	for _, test := range tests {
+		test := test
+		for _, replicate := range []bool{true, false} {
+			replicate := replicate
+			expected, name := test.release, "should count the messages of "+test.algorithm+" with data"
+			if !replicate {
+				expected, name = test.leave, "should count the messages of "+test.algorithm+" without data"
+			}
+			t.Run(name, func(t *testing.T) {
+				sent := test.count(t, replicate)
+				for reqType := range sent {
+					if sent[reqType] != expected[reqType] {
+						t.Errorf("%d messages of type %d sent, expected %d", sent[reqType], reqType, expected[reqType])
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRicartAgrawala(t *testing.T) {
+	t.Run("should send the released data with the next permission given to each server", func(t *testing.T) {
+		const size = 3
+		instances := make([]*ricart_agrawala.RicartAgrawala[int], size)
+		startNodes(t, memory.CreateNetwork(1), size, func(id int, n node) {
+			r := ricart_agrawala.InitRicartAgrawala[int](server_server.OpenChannel[ricart_agrawala.Request[int]](n.mux, "mutual-exclusion"))
+			instances[id] = &r
+			go r.Start()
+		})
+		var mutex sync.Mutex
+		received := make([][]int, size)
+		for id, r := range instances {
+			go func(id int, data chan int) {
+				for d := range data {
+					mutex.Lock()
+					received[id] = append(received[id], d)
+					mutex.Unlock()
+				}
+			}(id, r.GetDataChan())
+		}
+		receivedBy := func(id int) string {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return fmt.Sprint(received[id])
+		}
+		enter := func(id int) {
+			select {
+			case <-instances[id].SendClientAskCriticalSection():
+			case <-time.After(2 * time.Second):
+				t.Fatalf("critical section not given to server %d", id)
+			}
+		}
+
+		// Server 1 modifies the data twice, the other servers do not ask for the critical section
+		for value := 1; value <= 2; value++ {
+			enter(1)
+			instances[1].SendClientReleaseCriticalSection(value)
+		}
+		time.Sleep(50 * time.Millisecond)
+		expect(t, receivedBy(0), "[]")
+		expect(t, receivedBy(2), "[]")
+
+		enter(2) // The data is sent to the data channel before the access is given
+		eventually(t, time.Second, func() bool { return receivedBy(2) == "[1 2]" }, "data not received by server 2")
+		instances[2].SendClientLeaveCriticalSection()
+		expect(t, receivedBy(0), "[]")
+	})
+}
+
+// maekawaType gets the type of a Maekawa message
+func maekawaType(req maekawa.Request[int]) int {
+	return int(req.ReqType)
+}
+
+func TestMaekawa(t *testing.T) {
+	t.Run("should give the critical section to one server at a time under contention", func(t *testing.T) {
+		const size, rounds = 5, 10
+		quorums, err := config.ServerConfiguration{Servers: make([]config.ServerUrl, size)}.GetQuorums()
+		expect(t, err, nil)
+		var sent [messageTypes]int64
+		instances := make([]*maekawa.Maekawa[int], size)
+		startNodes(t, memory.CreateNetwork(1), size, func(id int, n node) {
+			protocol := server_server.OpenChannel[maekawa.Request[int]](n.mux, "maekawa")
+			m := maekawa.InitMaekawa[int](countingProtocol[maekawa.Request[int]]{protocol, maekawaType, &sent}, quorums[id])
+			instances[id] = &m
+			go m.Start()
+		})
+
+		// Each server increments the replicated counter in the critical section, it must see every previous increment
+		var inside int32
+		values := make([]int64, size)
+		stop := make(chan bool)
+		defer close(stop)
+		var wg sync.WaitGroup
+		for id, m := range instances {
+			wg.Add(1)
+			go func(id int, m *maekawa.Maekawa[int]) {
+				apply := func(data int) {
+					if int64(data) > atomic.LoadInt64(&values[id]) {
+						atomic.StoreInt64(&values[id], int64(data))
+					}
+				}
+				for r := 0; r < rounds; r++ {
+					access := m.SendClientAskCriticalSection()
+					for waiting := true; waiting; {
+						select {
+						case data := <-m.GetDataChan():
+							apply(data)
+						case <-access:
+							waiting = false
+						}
+					}
+					for drained := false; !drained; {
+						select {
+						case data := <-m.GetDataChan():
+							apply(data)
+						default:
+							drained = true
+						}
+					}
+					if atomic.AddInt32(&inside, 1) != 1 {
+						t.Errorf("server %d in the critical section with another server", id)
+					}
+					value := int(atomic.LoadInt64(&values[id])) + 1
+					atomic.StoreInt64(&values[id], int64(value))
+					atomic.AddInt32(&inside, -1)
+					m.SendClientReleaseCriticalSection(value)
+				}
+				wg.Done()
+				for {
+					select {
+					case data := <-m.GetDataChan():
+						apply(data)
+					case <-stop:
+						return
+					}
+				}
+			}(id, m)
+		}
+		wg.Wait()
+
+		for id := range values {
+			id := id
+			eventually(t, 2*time.Second, func() bool {
+				return atomic.LoadInt64(&values[id]) == size*rounds
+			}, fmt.Sprintf("increments missing on server %d", id))
+		}
+		for _, reqType := range []maekawa.RequestType{maekawa.FAILED, maekawa.INQUIRE, maekawa.RELINQUISH} {
+			if atomic.LoadInt64(&sent[reqType]) == 0 {
+				t.Errorf("no message of type %d sent", reqType)
+			}
+		}
+	})
+	t.Run("should not replicate anything when leaving the critical section without data", func(t *testing.T) {
+		const size = 5
+		quorums, err := config.ServerConfiguration{Servers: make([]config.ServerUrl, size)}.GetQuorums()
+		expect(t, err, nil)
+		var sent [messageTypes]int64
+		instances := make([]*maekawa.Maekawa[int], size)
+		startNodes(t, memory.CreateNetwork(1), size, func(id int, n node) {
+			protocol := server_server.OpenChannel[maekawa.Request[int]](n.mux, "maekawa")
+			m := maekawa.InitMaekawa[int](countingProtocol[maekawa.Request[int]]{protocol, maekawaType, &sent}, quorums[id])
+			instances[id] = &m
+			go m.Start()
+		})
+
+		// A read holds the critical section of every server in turn, the votes must be given back without any data
+		for _, m := range instances {
+			select {
+			case <-m.SendClientAskCriticalSection():
+			case <-time.After(2 * time.Second):
+				t.Fatal("critical section not given after a leave")
+			}
+			m.SendClientLeaveCriticalSection()
+		}
+		if atomic.LoadInt64(&sent[maekawa.RELEASE]) == 0 {
+			t.Errorf("no release sent to the quorums")
+		}
+		if updates := atomic.LoadInt64(&sent[maekawa.UPD]); updates != 0 {
+			t.Errorf("%d updates sent without data", updates)
+		}
+		for id, m := range instances {
+			select {
+			case data := <-m.GetDataChan():
+				t.Errorf("server %d received %d without data", id, data)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	})
+}
+
+func TestRaft(t *testing.T) {
+	t.Run("should create and register with raft", func(t *testing.T) {
+		serverConfig := validServerConfig
+		serverConfig.Backend = config.RaftBackend
+		serverConfig.RaftDirectory = t.TempDir()
+		go server.Start(&serverConfig)
+		time.Sleep(30 * time.Millisecond)
+
+		conn, _ := connect(validClientConfig.Servers[0])
+		cli := client_server.CreateClientProtocol(conn, func() types.Credentials {
+			return types.Credentials{
+				Username: "user1",
+				Password: "pass1",
+			}
+		})
+
+		_, _ = cli.SendRequest("create", func(auth client_server.AuthId) any {
+			return dto.EventCreate{
+				Name: "Test new event",
+				Jobs: []dto.Job{
+					{
+						Name:     "Test",
+						Capacity: 2,
+					},
+				},
+			}
+		})
+
+		json, _ := cli.SendRequest("register", func(auth client_server.AuthId) any {
+			return dto.EventRegister{
+				EventId: 1,
+				JobId:   1,
+			}
+		})
+
+		event, responseError := network.ParseResponse[*dto.Event](json)
+
+		expect(t, responseError, nil)
+		expect(t, event.Jobs[0].Count, 1)
+
+		t.Cleanup(func() {
+			clean(conn)
+		})
+	})
+
+	t.Run("should replicate, forward and compact the log on 3 servers", func(t *testing.T) {
+		cluster := memory.CreateNetwork(9)
+		directory := t.TempDir()
+		configs := startClusterWith(t, cluster, 3, func(serverConfig *config.ServerConfiguration) {
+			serverConfig.Backend = config.RaftBackend
+			serverConfig.RaftDirectory = directory
+		})
+		transport := cluster.Transport("client")
+		clients := make([]*client_server.ClientProtocol, len(configs))
+		for i := range clients {
+			clients[i] = connectMemory(t, transport, fmt.Sprintf("server-%d:client", i))
+		}
+
+		// At least two servers are followers, their commands are forwarded to the leader
+		for _, cli := range clients {
+			_, err := call[dto.Event](cli, "create", dto.EventCreate{Name: "Raft", Jobs: []dto.Job{{Name: "Test", Capacity: 100}}})
+			expect(t, err, nil)
+		}
+		for i := 0; i < raft.SnapshotThreshold+6; i++ {
+			_, _ = call[dto.Event](clients[i%len(clients)], "register", dto.EventRegister{EventId: 1 + i%len(clients), JobId: 1})
+		}
+		for _, cli := range clients {
+			events, err := call[[]dto.Event](cli, "show", dto.EventShow{EventId: -1, Linearizable: true})
+			expect(t, err, nil)
+			expect(t, len(events), len(clients))
+		}
+
+		// The log is compacted and saved with the term and the vote
+		storage := raft.CreateFileStorage[dto.Command, []dto.Operation](filepath.Join(directory, "raft-1.json"))
+		state, found, err := storage.Load()
+		expect(t, err, nil)
+		expect(t, found, true)
+		if state.Term == 0 || state.Snapshot.LastIndex < raft.SnapshotThreshold || len(state.Snapshot.State) == 0 {
+			t.Fatalf("Expected a saved term and snapshot, got term %d and snapshot up to %d", state.Term, state.Snapshot.LastIndex)
+		}
+
+		// A restarted server restores its snapshot and keeps its term
+		server.StopServer(1)
+		startClusterServer(configs[1])
+		restarted := connectMemory(t, transport, "server-1:client")
+		events, err := call[[]dto.Event](restarted, "show", dto.EventShow{EventId: -1})
+		expect(t, err, nil)
+		expect(t, len(events), len(clients))
+		events, err = call[[]dto.Event](restarted, "show", dto.EventShow{EventId: -1, Linearizable: true})
+		expect(t, err, nil)
+		expect(t, len(events), len(clients))
+		restored, _, _ := storage.Load()
+		if restored.Term < state.Term {
+			t.Fatalf("Expected the term %d to be kept, got %d", state.Term, restored.Term)
+		}
+	})
+}
+
+func TestTotalOrder(t *testing.T) {
+	t.Run("should create and register with total order broadcast", func(t *testing.T) {
+		serverConfig := validServerConfig
+		serverConfig.Backend = config.TotalOrderBackend
+		go server.Start(&serverConfig)
+		time.Sleep(30 * time.Millisecond)
+
+		conn, _ := connect(validClientConfig.Servers[0])
+		cli := client_server.CreateClientProtocol(conn, func() types.Credentials {
+			return types.Credentials{
+				Username: "user1",
+				Password: "pass1",
+			}
+		})
+
+		_, _ = cli.SendRequest("create", func(auth client_server.AuthId) any {
+			return dto.EventCreate{
+				Name: "Test new event",
+				Jobs: []dto.Job{
+					{
+						Name:     "Test",
+						Capacity: 2,
+					},
+				},
+			}
+		})
+
+		json, _ := cli.SendRequest("register", func(auth client_server.AuthId) any {
+			return dto.EventRegister{
+				EventId: 1,
+				JobId:   1,
+			}
+		})
+
+		event, responseError := network.ParseResponse[*dto.Event](json)
+
+		expect(t, responseError, nil)
+		expect(t, event.Jobs[0].Count, 1)
+
+		t.Cleanup(func() {
+			clean(conn)
+		})
+	})
+
+	t.Run("should deliver the messages in the same order on every server", func(t *testing.T) {
+		const size, broadcasts = 3, 20
+		instances := make([]*total_order.TotalOrder[int], size)
+		startNodes(t, memory.CreateNetwork(1), size, func(id int, n node) {
+			instance := total_order.InitTotalOrder[int](server_server.OpenChannel[total_order.Message[int]](n.mux, "total-order"))
+			instances[id] = &instance
+			go instance.Start()
+		})
+
+		// Every server broadcasts at the same time, the values are unique
+		delivered := make([][]int, size)
+		var wg sync.WaitGroup
+		for id, instance := range instances {
+			wg.Add(2)
+			go func(id int, instance *total_order.TotalOrder[int]) {
+				defer wg.Done()
+				for i := 0; i < broadcasts; i++ {
+					instance.Broadcast(id*broadcasts + i)
+				}
+			}(id, instance)
+			go func(id int, instance *total_order.TotalOrder[int]) {
+				defer wg.Done()
+				for len(delivered[id]) < size*broadcasts {
+					select {
+					case value := <-instance.GetDeliveryChan():
+						delivered[id] = append(delivered[id], value)
+					case <-time.After(5 * time.Second):
+						t.Errorf("server %d delivered %d messages", id, len(delivered[id]))
+						return
+					}
+				}
+			}(id, instance)
+		}
+		wg.Wait()
+
+		for id := 1; id < size; id++ {
+			expect(t, fmt.Sprint(delivered[id]), fmt.Sprint(delivered[0]))
+		}
+		// The broadcasts of a server are delivered in the order they were sent
+		next := make([]int, size)
+		for _, value := range delivered[0] {
+			sender := value / broadcasts
+			expect(t, value, sender*broadcasts+next[sender])
+			next[sender]++
+		}
+	})
+}
+
+func TestLinearizableRead(t *testing.T) {
+	backends := []string{config.MutualExclusionBackend, config.RaftBackend, config.TotalOrderBackend}
+
+	for _, backend := range backends {
+		backend := backend
+		t.Run("should read the events in order with the writes with "+backend, func(t *testing.T) {
+			serverConfig := validServerConfig
+			serverConfig.Backend = backend
+			serverConfig.RaftDirectory = t.TempDir()
+			go server.Start(&serverConfig)
+			time.Sleep(30 * time.Millisecond)
+
+			conn, _ := connect(validClientConfig.Servers[0])
+			cli := client_server.CreateClientProtocol(conn, func() types.Credentials {
+				return types.Credentials{
+					Username: "user1",
+					Password: "pass1",
+				}
+			})
+
+			_, _ = cli.SendRequest("create", func(auth client_server.AuthId) any {
+				return dto.EventCreate{
+					Name: "Test new event",
+					Jobs: []dto.Job{
+						{
+							Name:     "Test",
+							Capacity: 2,
+						},
+					},
+				}
+			})
+			_, _ = cli.SendRequest("register", func(auth client_server.AuthId) any {
+				return dto.EventRegister{
+					EventId: 1,
+					JobId:   1,
+				}
+			})
+
+			json, _ := cli.SendRequest("show", func(auth client_server.AuthId) any {
+				return dto.EventShow{
+					EventId:      1,
+					Linearizable: true,
+				}
+			})
+			event, responseError := network.ParseResponse[*dto.Event](json)
+			expect(t, responseError, nil)
+			expect(t, event.Jobs[0].Count, 1)
+
+			json, _ = cli.SendRequest("show", func(auth client_server.AuthId) any {
+				return dto.EventShow{
+					EventId:      -1,
+					Linearizable: true,
+				}
+			})
+			events, responseError := network.ParseResponse[[]dto.Event](json)
+			expect(t, responseError, nil)
+			expect(t, len(events), 1)
+
+			json, _ = cli.SendRequest("show", func(auth client_server.AuthId) any {
+				return dto.EventShow{
+					EventId:      2,
+					Linearizable: true,
+				}
+			})
+			_, responseError = network.ParseResponse[*dto.Event](json)
+			expectError(t, responseError, "event not found")
+
+			t.Cleanup(func() {
+				clean(conn)
+			})
+		})
+	}
+}
+
+func TestVectorClock(t *testing.T) {
+	t.Run("should compare stamped updates", func(t *testing.T) {
+		expect(t, causal.Compare(causal.VectorClock{1, 0, 0}, causal.VectorClock{1, 1, 0}), causal.Before)
+		expect(t, causal.Compare(causal.VectorClock{2, 1, 0}, causal.VectorClock{1, 1, 0}), causal.After)
+		expect(t, causal.Compare(causal.VectorClock{1, 0, 0}, causal.VectorClock{0, 1, 0}), causal.Concurrent)
+		expect(t, causal.Compare(causal.VectorClock{1, 1, 0}, causal.VectorClock{1, 1, 0}), causal.Equal)
+	})
+}
+
+func TestCausalProtocol(t *testing.T) {
+	broadcast := func(sender int, clock causal.VectorClock, data string) causal.Message[string] {
+		return causal.Message[string]{Data: data, Sender: sender, Clock: clock, Broadcast: true, Incarnation: 1}
+	}
+	receive := func(t *testing.T, c *causal.CausalProtocol[string]) string {
+		select {
+		case data := <-c.GetMessageChan():
+			return data
+		case <-time.After(time.Second):
+			t.Fatalf("message not delivered")
+			return ""
+		}
+	}
+
+	t.Run("should deliver the messages in causal order", func(t *testing.T) {
+		protocol := createFakeProtocol[causal.Message[string]]()
+		c := causal.CreateCausalProtocol[string](protocol)
+
+		protocol.messages <- broadcast(1, causal.VectorClock{0, 1, 0}, "a")
+		expect(t, receive(t, c), "a")
+
+		protocol.messages <- broadcast(1, causal.VectorClock{0, 3, 0}, "c") // Arrived before the message it follows
+		protocol.messages <- broadcast(1, causal.VectorClock{0, 2, 0}, "b")
+		expect(t, receive(t, c), "b")
+		expect(t, receive(t, c), "c")
+
+		protocol.messages <- broadcast(2, causal.VectorClock{0, 4, 1}, "e") // Sent by server 2 after receiving "d"
+		protocol.messages <- broadcast(1, causal.VectorClock{0, 4, 0}, "d")
+		expect(t, receive(t, c), "d")
+		expect(t, receive(t, c), "e")
+		expect(t, c.GetClock().String(), causal.VectorClock{0, 4, 1}.String())
+	})
+
+	t.Run("should drop a message whose dependencies are lost and repair the state", func(t *testing.T) {
+		protocol := createFakeProtocol[causal.Message[string]]()
+		c := causal.CreateCausalProtocol[string](protocol)
+		repaired := make(chan bool, 1)
+		c.SetRepair(func() { repaired <- true })
+
+		protocol.messages <- broadcast(1, causal.VectorClock{0, 1, 0}, "a")
+		expect(t, receive(t, c), "a")
+		protocol.messages <- broadcast(1, causal.VectorClock{0, 3, 0}, "c") // "b" is lost
+
+		select {
+		case data := <-c.GetMessageChan():
+			t.Fatalf("message %s delivered before its dependencies", data)
+		case <-repaired:
+		case <-time.After(causal.DeliveryTimeout + time.Second):
+			t.Fatalf("state not repaired")
+		}
+		protocol.messages <- broadcast(1, causal.VectorClock{0, 4, 0}, "d") // The messages following the dropped one are delivered
+		expect(t, receive(t, c), "d")
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Run("should write the snapshot of the events", func(t *testing.T) {
+		startServer()
+
+		conn, _ := connect(validClientConfig.Servers[0])
+		cli := client_server.CreateClientProtocol(conn, func() types.Credentials {
+			return types.Credentials{
+				Username: "user1",
+				Password: "pass1",
+			}
+		})
+
+		_, _ = cli.SendRequest("create", func(auth client_server.AuthId) any {
+			return dto.EventCreate{
+				Name: "Test new event",
+				Jobs: []dto.Job{
+					{
+						Name:     "Test",
+						Capacity: 2,
+					},
+				},
+			}
+		})
+
+		json, _ := cli.SendRequest("snapshot", func(auth client_server.AuthId) any {
+			return nil
+		})
+		result, responseError := network.ParseResponse[*dto.SnapshotResult](json)
+		expect(t, responseError, nil)
+		expect(t, len(result.Servers), 1)
+		expect(t, len(result.Missing), 0)
+
+		data, err := os.ReadFile(result.Path)
+		expect(t, err, nil)
+		var global snapshot.GlobalSnapshot
+		expect(t, encoding.Unmarshal(data, &global), nil)
+		expect(t, global.Id, result.Id)
+		expect(t, strings.Contains(string(global.Servers[0].State), "Test new event"), true)
+
+		t.Cleanup(func() {
+			_ = os.RemoveAll(filepath.Dir(result.Path))
+			clean(conn)
+		})
+	})
+}
+
+func TestSnapshots(t *testing.T) {
+	t.Run("should record a message received but not yet delivered to its protocol", func(t *testing.T) {
+		snapshots := make([]*snapshot.Snapshots, 2)
+		channels := make([]*server_server.Channel[int], 2)
+		probes := make([]*server_server.Channel[bool], 2)
+		applied := make([]int, 2) // Sum of the values received by each node, its recorded state
+		var mutex sync.Mutex
+		startNodes(t, memory.CreateNetwork(3), 2, func(id int, n node) {
+			snapshots[id] = snapshot.CreateSnapshots(n.mux, n.protocol, func() {}, func() any {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return applied[id]
+			})
+			channels[id] = server_server.OpenChannel[int](n.mux, "data")
+			probes[id] = server_server.OpenChannel[bool](n.mux, "probe")
+		})
+		receive := func(id int) {
+			select {
+			case value := <-channels[id].GetMessageChan():
+				mutex.Lock()
+				applied[id] += value
+				mutex.Unlock()
+			case <-time.After(2 * time.Second):
+				t.Fatalf("value not received by node %d", id)
+			}
+		}
+
+		// The first write is applied by node 1, the second one is in flight: sent before the snapshot, not yet read
+		expect(t, channels[0].SendTo(1, 1), nil)
+		receive(1)
+		expect(t, channels[0].SendTo(1, 2), nil)
+		expect(t, probes[0].SendTo(1, true), nil)
+		select {
+		case <-probes[1].GetMessageChan(): // The connection is FIFO, the write is in the Mux of node 1
+		case <-time.After(2 * time.Second):
+			t.Fatalf("probe not received")
+		}
+
+		global := snapshots[0].Take()
+		expect(t, len(global.Servers), 2)
+		expect(t, len(global.Missing), 0)
+		report := global.Servers[1]
+		expect(t, string(report.State), "1")
+		expect(t, len(report.Channels[0]), 1)
+		var value int
+		expect(t, encoding.Unmarshal(report.Channels[0][0].Payload, &value), nil)
+		expect(t, value, 2)
+		expect(t, report.Channels[0][0].Channel, "data")
+
+		// The message recorded in flight is still delivered after the snapshot
+		receive(1)
+		mutex.Lock()
+		expect(t, applied[1], 3)
+		mutex.Unlock()
+
+		// The markers of a finished snapshot do not start a new one
+		global = snapshots[1].Take()
+		expect(t, len(global.Servers), 2)
+		expect(t, string(global.Servers[1].State), "3")
+		expect(t, len(global.Servers[1].Channels[0]), 0)
+	})
+}
+
+func TestConsistency(t *testing.T) {
+	t.Run("should change the hash of the events after a command", func(t *testing.T) {
+		startServer()
+
+		conn, _ := connect(validClientConfig.Servers[0])
+		cli := client_server.CreateClientProtocol(conn, func() types.Credentials {
+			return types.Credentials{
+				Username: "user1",
+				Password: "pass1",
+			}
+		})
+
+		json, _ := cli.SendRequest("consistency", func(auth client_server.AuthId) any {
+			return nil
+		})
+		before, responseError := network.ParseResponse[*consistency.Status](json)
+		expect(t, responseError, nil)
+		expect(t, before.Consistent, true)
+
+		_, _ = cli.SendRequest("create", func(auth client_server.AuthId) any {
+			return dto.EventCreate{
+				Name: "Test new event",
+				Jobs: []dto.Job{
+					{
+						Name:     "Test",
+						Capacity: 2,
+					},
+				},
+			}
+		})
+
+		json, _ = cli.SendRequest("consistency", func(auth client_server.AuthId) any {
+			return nil
+		})
+		after, responseError := network.ParseResponse[*consistency.Status](json)
+		expect(t, responseError, nil)
+		expect(t, after.Consistent, true)
+		expect(t, after.State.Versions != before.State.Versions, true)
+		expect(t, after.State.Hash != before.State.Hash, true)
+
+		t.Cleanup(func() {
+			clean(conn)
+		})
+	})
+
+	t.Run("should alert when a replica has the same versions as the others but other events", func(t *testing.T) {
+		cluster := memory.CreateNetwork(1)
+		startClusterWith(t, cluster, 3, func(serverConfig *config.ServerConfiguration) {
+			name := "Test event"
+			if serverConfig.Id == 2 { // Same id and version, the state transfer does not replace it
+				name = "Diverged event"
+			}
+			serverConfig.Events = []dto.Event{{Id: 1, Name: name, Open: true, Version: 1,
+				Jobs: []types.Job{{Id: 1, Name: "Test", Capacity: 2}}}}
+		})
+		transport := cluster.Transport("client")
+		clients := make([]*client_server.ClientProtocol, 3)
+		for i := range clients {
+			clients[i] = connectMemory(t, transport, fmt.Sprintf("server-%d:client", i))
+		}
+		statusOf := func(id int) consistency.Status {
+			status, err := call[consistency.Status](clients[id], "consistency", nil)
+			expect(t, err, nil)
+			return status
+		}
+		alerted := func(status consistency.Status) string {
+			var servers []int
+			for _, alert := range status.Alerts {
+				servers = append(servers, alert.Server)
+			}
+			sort.Ints(servers)
+			return fmt.Sprint(servers)
+		}
+
+		// Each server compares its hash with the hashes received from the others
+		eventually(t, 5*time.Second, func() bool {
+			return alerted(statusOf(0)) == "[2]" && alerted(statusOf(1)) == "[2]" && alerted(statusOf(2)) == "[0 1]"
+		}, "diverged replica not detected")
+		for id := range clients {
+			status := statusOf(id)
+			expect(t, status.Consistent, false)
+			expect(t, len(status.Peers), 2)
+		}
+		expect(t, statusOf(0).Peers[1].Hash, statusOf(0).State.Hash)
+		expect(t, statusOf(0).Peers[2].Versions, statusOf(0).State.Versions)
+	})
+}
+
+func TestStateTransfer(t *testing.T) {
+	t.Run("should give the state of the cluster to a restarted server before it serves clients", func(t *testing.T) {
+		cluster := memory.CreateNetwork(1)
+		configs := startClusterWith(t, cluster, 3, nil)
+		transport := cluster.Transport("client")
+		first := connectMemory(t, transport, "server-0:client")
+		_ = connectMemory(t, transport, "server-2:client").Close()
+		_, err := call[dto.Event](first, "create", newEvent)
+		expect(t, err, nil)
+
+		// The events are modified while server 2 is stopped
+		server.StopServer(2)
+		created, err := call[dto.Event](first, "create", newEvent)
+		expect(t, err, nil)
+		_, err = call[dto.Event](first, "register", dto.EventRegister{EventId: created.Id, JobId: 1})
+		expect(t, err, nil)
+
+		startClusterServer(configs[2])
+		restarted := connectMemory(t, transport, "server-2:client")
+		events, err := call[[]dto.Event](restarted, "show", dto.EventShow{EventId: -1})
+		expect(t, err, nil)
+		expect(t, len(events), 2)
+		event, err := call[dto.Event](restarted, "show", dto.EventShow{EventId: created.Id})
+		expect(t, err, nil)
+		expect(t, event.Jobs[0].Count, 1)
+	})
+}
+
+// peerMessage is a message of the mutual exclusion channel of the servers, the messages of the algorithm are not parsed
+type peerMessage = mutual_exclusion.ResourceMessage[encoding.RawMessage, []dto.Operation]
+
+// startWithPeer starts the server 0 of a cluster of 2 servers, the server 1 is played by the test with the returned
+// Mux, started by the test once its channels are opened
+func startWithPeer(t *testing.T, cluster *memory.Network) *server_server.Mux {
+	serverConfig := validServerConfig
+	serverConfig.Servers = []config.ServerUrl{
+		{Client: "server-0:client", Server: "server-0:server"},
+		{Client: "server-1:client", Server: "server-1:server"},
+	}
+	serverConfig.Transport = cluster.Transport("server-0")
+	startClusterServer(serverConfig)
+
+	transport := cluster.Transport("server-1")
+	listener, _ := transport.Listen("server-1:server")
+	peer := server_server.CreateInterServerProtocol[server_server.MuxMessage](1, transport, listener)
+	t.Cleanup(func() {
+		server.Stop()
+		peer.Close()
+		_ = listener.Close()
+		cluster.Close()
+	})
+	peer.ConnectToServers([]string{"server-0:server"})
+	return server_server.CreateMux(peer)
+}
+
+// answerTransfer waits until the server 0 asks for the state and sends it the given events, the messages of the
+// algorithm received meanwhile are ignored
+func answerTransfer(t *testing.T, transfers server_server.Protocol[peerMessage], events []dto.Operation) {
+	for {
+		select {
+		case message := <-transfers.GetMessageChan():
+			if message.Transfer == nil || !message.Transfer.Request {
+				continue
+			}
+			_ = transfers.SendTo(0, peerMessage{Transfer: &mutual_exclusion.Transfer[[]dto.Operation]{Sender: 1, Data: events}})
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatalf("state not asked")
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	t.Run("should ask for the state when an operation of an event is missed", func(t *testing.T) {
+		cluster := memory.CreateNetwork(1)
+		mux := startWithPeer(t, cluster)
+		transfers := server_server.OpenChannel[peerMessage](mux, "mutual-exclusion")
+		go mux.Start()
+		event := dto.Event{Id: 1, Name: "Replicated event", Open: true, Jobs: []types.Job{{Id: 1, Name: "Test", Capacity: 2}}, Version: 1}
+		answerTransfer(t, transfers, []dto.Operation{{Type: dto.EventState, EventId: 1, Sequence: 1, Event: &event}})
+
+		// Server 1 closes the event, the registration before it has been missed by server 0
+		release, _ := encoding.Marshal(lamport.Request[[]dto.Operation]{ReqType: lamport.REL, Sender: 1, HasData: true, Global: true,
+			Data: []dto.Operation{{Type: dto.EventClosed, EventId: 1, Sequence: 3}}})
+		_ = transfers.SendTo(0, peerMessage{Resource: "event-1", Message: release})
+		cli := connectMemory(t, cluster.Transport("client"), "server-0:client")
+		shown, err := call[dto.Event](cli, "show", dto.EventShow{EventId: 1})
+		expect(t, err, nil)
+		expect(t, shown.Open, true) // The operation waits for the missing one
+
+		event.Open, event.Version, event.Jobs[0].Count = false, 3, 1
+		event.Participants = []dto.Participant{{User: types.User{Id: 2}, JobId: 1}}
+		answerTransfer(t, transfers, []dto.Operation{{Type: dto.EventState, EventId: 1, Sequence: 3, Event: &event}})
+		eventually(t, 2*time.Second, func() bool {
+			shown, err = call[dto.Event](cli, "show", dto.EventShow{EventId: 1})
+			return err == nil && !shown.Open
+		}, "state not applied")
+		expect(t, shown.Jobs[0].Count, 1)
+	})
+}
+
+// antiEntropyMessage is a message of the anti-entropy channel of the servers
+type antiEntropyMessage struct {
+	Type     int             `json:"type"`
+	Sender   int             `json:"sender"`
+	Versions map[int]int     `json:"versions,omitempty"`
+	Events   []dto.Operation `json:"events,omitempty"`
+}
+
+func TestAntiEntropy(t *testing.T) {
+	t.Run("should pull the event missed by a server and send it its newer events", func(t *testing.T) {
+		cluster := memory.CreateNetwork(1)
+		// Server 1 created an event while server 0 was disconnected
+		mux := startWithPeer(t, cluster)
+		transfers := server_server.OpenChannel[peerMessage](mux, "mutual-exclusion")
+		entropy := server_server.OpenChannel[antiEntropyMessage](mux, "anti-entropy")
+		go mux.Start()
+		missed := dto.Operation{Type: dto.EventState, EventId: 1, Event: &dto.Event{
+			Id: 1, Name: "Missed event", Open: true, Jobs: []types.Job{{Id: 1, Name: "Test", Capacity: 2}},
+		}}
+
+		// The state transferred when server 0 starts does not contain the event
+		answerTransfer(t, transfers, nil)
+
+		receive := func(expected int) antiEntropyMessage {
+			for {
+				select {
+				case message := <-entropy.GetMessageChan():
+					if message.Type == expected {
+						return message
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("anti-entropy message %d not received", expected)
+				}
+			}
+		}
+		digest := receive(0) // The round of server 0
+		expect(t, len(digest.Versions), 0)
+		_ = entropy.SendTo(0, antiEntropyMessage{Type: 1, Sender: 1, Events: []dto.Operation{missed}})
+
+		cli := connectMemory(t, cluster.Transport("client"), "server-0:client")
+		eventually(t, 2*time.Second, func() bool {
+			event, err := call[*dto.Event](cli, "show", dto.EventShow{EventId: 1})
+			return err == nil && event.Name == "Missed event"
+		}, "event not pulled by server 0")
+
+		// Server 1 lost the event and knows an event server 0 does not have
+		_ = entropy.SendTo(0, antiEntropyMessage{Type: 0, Sender: 1, Versions: map[int]int{2: 0}})
+		events := receive(1)
+		expect(t, len(events.Events), 1)
+		expect(t, events.Events[0].EventId, 1)
+		expect(t, events.Events[0].Event.Name, "Missed event")
+		expect(t, len(receive(0).Versions), 1) // Server 0 asks for the event it does not have
+	})
+}
+
+func TestMembership(t *testing.T) {
+	t.Run("should refuse to change the servers for a user who is not an administrator", func(t *testing.T) {
+		cluster := memory.CreateNetwork(1)
+		startClusterWith(t, cluster, 2, nil)
+		connectMemory(t, cluster.Transport("client"), "server-0:client") // Waits until the server accepts the clients
+		conn, err := cluster.Transport("client").Dial("server-0:client")
+		expect(t, err, nil)
+		cli := client_server.CreateClientProtocol(conn, func() types.Credentials {
+			return types.Credentials{Username: "test", Password: "test"}
+		})
+
+		_, err = call[dto.Membership](cli, "join", dto.ServerJoin{Client: "server-2:client", Server: "server-2:server"})
+		expectError(t, err, "only an administrator can change the servers of the cluster")
+		_, err = call[dto.Membership](cli, "leave", dto.ServerLeave{ServerId: 1})
+		expectError(t, err, "only an administrator can change the servers of the cluster")
+	})
+
+	t.Run("should add and remove a server", func(t *testing.T) {
+		serverConfig := validServerConfig
+		serverConfig.Servers = append([]config.ServerUrl{}, validServerConfig.Servers...)
+		go server.Start(&serverConfig)
+		time.Sleep(30 * time.Millisecond)
+
+		conn, _ := connect(validClientConfig.Servers[0])
+		cli := client_server.CreateClientProtocol(conn, func() types.Credentials {
+			return types.Credentials{
+				Username: "user1",
+				Password: "pass1",
+			}
+		})
+
+		json, _ := cli.SendRequest("join", func(auth client_server.AuthId) any {
+			return dto.ServerJoin{
+				Client: "localhost:10001",
+				Server: "localhost:11001",
+			}
+		})
+		joined, responseError := network.ParseResponse[*dto.Membership](json)
+		expect(t, responseError, nil)
+		expect(t, joined.ServerId, 1)
+		expect(t, joined.Version, 1)
+		expect(t, len(joined.Servers), 2)
+
+		json, _ = cli.SendRequest("join", func(auth client_server.AuthId) any {
+			return dto.ServerJoin{
+				Client: "localhost:10001",
+				Server: "localhost:11001",
+			}
+		})
+		_, responseError = network.ParseResponse[*dto.Membership](json)
+		expectError(t, responseError, "address already used by server 1")
+
+		json, _ = cli.SendRequest("leave", func(auth client_server.AuthId) any {
+			return dto.ServerLeave{ServerId: 1}
+		})
+		left, responseError := network.ParseResponse[*dto.Membership](json)
+		expect(t, responseError, nil)
+		expect(t, left.Version, 2)
+		expect(t, left.Servers[1].Removed, true)
+
+		json, _ = cli.SendRequest("leave", func(auth client_server.AuthId) any {
+			return dto.ServerLeave{ServerId: 0}
+		})
+		_, responseError = network.ParseResponse[*dto.Membership](json)
+		expectError(t, responseError, "the last server cannot leave the cluster")
+
+		t.Cleanup(func() {
+			clean(conn)
+		})
+	})
+
+	t.Run("should connect a joined server and stop a removed one", func(t *testing.T) {
+		cluster := memory.CreateNetwork(1)
+		directory := t.TempDir()
+		configs := startClusterWith(t, cluster, 2, func(serverConfig *config.ServerConfiguration) {
+			serverConfig.Path = filepath.Join(directory, fmt.Sprintf("server-%d.json", serverConfig.Id))
+			content, _ := encoding.Marshal(serverConfig)
+			_ = os.WriteFile(serverConfig.Path, content, 0644)
+		})
+		transport := cluster.Transport("client")
+		first := connectMemory(t, transport, "server-0:client")
+		_ = connectMemory(t, transport, "server-1:client").Close()
+
+		joined, err := call[dto.Membership](first, "join", dto.ServerJoin{Client: "server-2:client", Server: "server-2:server"})
+		expect(t, err, nil)
+		expect(t, joined.ServerId, 2)
+		for _, serverConfig := range configs {
+			written := core.ReadConfig(serverConfig.Path, &config.ServerConfiguration{})
+			eventually(t, 2*time.Second, func() bool {
+				written = core.ReadConfig(serverConfig.Path, &config.ServerConfiguration{})
+				return written.MembershipVersion == 1
+			}, fmt.Sprintf("configuration of server %d not written", serverConfig.Id))
+			expect(t, len(written.Servers), 3)
+			expect(t, written.Servers[2].Server, "server-2:server")
+			expect(t, len(written.Users), len(validServerConfig.Users))
+		}
+
+		// The joined server takes part in the critical sections of the others
+		joinedConfig := configs[0]
+		joinedConfig.Id, joinedConfig.Path = 2, ""
+		joinedConfig.Servers, joinedConfig.MembershipVersion = nil, joined.Version
+		for _, member := range joined.Servers {
+			joinedConfig.Servers = append(joinedConfig.Servers, config.ServerUrl{Client: member.Client, Server: member.Server})
+		}
+		joinedConfig.Transport = cluster.Transport("server-2")
+		startClusterServer(joinedConfig)
+		third := connectMemory(t, transport, "server-2:client")
+		created, err := call[dto.Event](third, "create", newEvent)
+		expect(t, err, nil)
+		event, err := call[dto.Event](first, "show", dto.EventShow{EventId: created.Id, Linearizable: true})
+		expect(t, err, nil)
+		expect(t, event.Name, newEvent.Name)
+		_, err = call[dto.Event](first, "register", dto.EventRegister{EventId: created.Id, JobId: 1})
+		expect(t, err, nil)
+		event, err = call[dto.Event](third, "show", dto.EventShow{EventId: created.Id, Linearizable: true})
+		expect(t, err, nil)
+		expect(t, event.Jobs[0].Count, 1)
+
+		// The removed server stops, the others no longer wait for it
+		left, err := call[dto.Membership](first, "leave", dto.ServerLeave{ServerId: 1})
+		expect(t, err, nil)
+		expect(t, left.Servers[1].Removed, true)
+		eventually(t, 2*time.Second, func() bool {
+			conn, err := transport.Dial("server-1:client")
+			if err == nil {
+				_ = conn.Close()
+			}
+			return err != nil
+		}, "removed server still accepting clients")
+		_, err = call[dto.Event](third, "register", dto.EventRegister{EventId: created.Id, JobId: 1})
+		expect(t, err, nil)
+		written := core.ReadConfig(configs[0].Path, &config.ServerConfiguration{})
+		expect(t, written.Servers[1].Removed, true)
+	})
+}
+
+func TestUpdateConfig(t *testing.T) {
+	t.Run("should replace the keys given and keep the others", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "server.json")
+		content, _ := encoding.Marshal(validServerConfig)
+		_ = os.WriteFile(path, content, 0644)
+
+		servers := []config.ServerUrl{{Client: "localhost:10000", Server: "localhost:11000", Removed: true}}
+		expect(t, core.UpdateConfig(path, map[string]any{"servers": servers, "membershipVersion": 3}), nil)
+		written := core.ReadConfig(path, &config.ServerConfiguration{})
+		expect(t, written.MembershipVersion, 3)
+		expect(t, len(written.Servers), 1)
+		expect(t, written.Servers[0].Removed, true)
+		expect(t, len(written.Users), len(validServerConfig.Users))
+		expect(t, written.Users[1].Username, validServerConfig.Users[1].Username)
+	})
+
+	t.Run("should fail on a missing or invalid file", func(t *testing.T) {
+		directory := t.TempDir()
+		if core.UpdateConfig(filepath.Join(directory, "missing.json"), map[string]any{"membershipVersion": 1}) == nil {
+			t.Errorf("Expected an error for a missing file")
+		}
+		path := filepath.Join(directory, "invalid.json")
+		_ = os.WriteFile(path, []byte("{"), 0644)
+		if core.UpdateConfig(path, map[string]any{"membershipVersion": 1}) == nil {
+			t.Errorf("Expected an error for an invalid file")
+		}
+	})
+}
+
+func TestMembers(t *testing.T) {
+	t.Run("should give the state of the servers", func(t *testing.T) {
+		startServer()
+
+		conn, _ := connect(validClientConfig.Servers[0])
+		cli := client_server.CreateClientProtocol(conn, func() types.Credentials {
+			return types.Credentials{}
+		})
+
+		json, _ := cli.SendRequest("members", func(auth client_server.AuthId) any {
+			return nil
+		})
+		servers, responseError := network.ParseResponse[[]dto.ServerState](json)
+		expect(t, responseError, nil)
+		expect(t, len(servers), 1)
+		expect(t, servers[0].Client, validServerConfig.Servers[0].Client)
+		expect(t, servers[0].State, "alive")
+
+		t.Cleanup(func() {
+			clean(conn)
+		})
+	})
+}
+
+// startCluster starts servers in the same process, connected by the in-memory network
+func startCluster(t *testing.T, cluster *memory.Network, size int) {
+	startClusterWith(t, cluster, size, nil)
+}
+
+// startClusterWith starts servers in the same process with a configuration changed by configure, the configurations
+// are returned to restart the servers
+func startClusterWith(t *testing.T, cluster *memory.Network, size int, configure func(serverConfig *config.ServerConfiguration)) []config.ServerConfiguration {
+	servers := make([]config.ServerUrl, size)
+	for i := range servers {
+		servers[i] = config.ServerUrl{
+			Client: fmt.Sprintf("server-%d:client", i),
+			Server: fmt.Sprintf("server-%d:server", i),
+		}
+	}
+	configs := make([]config.ServerConfiguration, size)
+	for i := range configs {
+		configs[i] = validServerConfig
+		configs[i].Id = i
+		configs[i].Servers = append([]config.ServerUrl{}, servers...)
+		configs[i].Transport = cluster.Transport(fmt.Sprintf("server-%d", i))
+		if configure != nil {
+			configure(&configs[i])
+		}
+		startClusterServer(configs[i])
+	}
+	t.Cleanup(func() {
+		server.Stop()
+		cluster.Close()
+	})
+	return configs
+}
+
+// startClusterServer starts a server of a cluster, or restarts it after a crash, with a copy of its configuration
+func startClusterServer(serverConfig config.ServerConfiguration) {
+	serverConfig.Servers = append([]config.ServerUrl{}, serverConfig.Servers...)
+	go server.Start(&serverConfig)
+}
+
+// connectMemory connects a client to a server of the in-memory network, once the server accepts the clients
+func connectMemory(t *testing.T, transport network.Transport, addr string) *client_server.ClientProtocol {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := transport.Dial(addr)
+		if err == nil {
+			return client_server.CreateClientProtocol(conn, func() types.Credentials {
+				return types.Credentials{
+					Username: "user1",
+					Password: "pass1",
+				}
+			})
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server %s not started: %s", addr, err.Error())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// call sends a request to a server and parses its response
+func call[T any](cli *client_server.ClientProtocol, endpoint string, data any) (T, error) {
+	json, err := cli.SendRequest(endpoint, func(auth client_server.AuthId) any {
+		return data
+	})
+	if err != nil {
+		var none T
+		return none, err
+	}
+	return network.ParseResponse[T](json)
+}
+
+// eventually waits until a condition is true
+func eventually(t *testing.T, timeout time.Duration, condition func() bool, message string) {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s after %v", message, timeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// newEvent is the event created by the tests on the clusters
+var newEvent = dto.EventCreate{Name: "Test new event", Jobs: []dto.Job{{Name: "Test", Capacity: 2}}}
+
+// node is a server of the in-memory network running only the protocols under test on its Mux
+type node struct {
+	protocol *server_server.InterServerProtocol[server_server.MuxMessage]
+	mux      *server_server.Mux
+}
+
+// startNodes connects nodes on the in-memory network and starts their Mux, the protocols under test are opened by
+// open before the Mux is started
+func startNodes(t *testing.T, cluster *memory.Network, size int, open func(id int, n node)) []node {
+	nodes := make([]node, size)
+	var wg sync.WaitGroup
+	for i := range nodes {
+		transport := cluster.Transport(fmt.Sprintf("server-%d", i))
+		listener, err := transport.Listen(fmt.Sprintf("server-%d:server", i))
+		if err != nil {
+			t.Fatalf("listen: %s", err.Error())
+		}
+		var urls []string
+		for j := 0; j < size; j++ {
+			if j != i {
+				urls = append(urls, fmt.Sprintf("server-%d:server", j))
+			}
+		}
+		nodes[i].protocol = server_server.CreateInterServerProtocol[server_server.MuxMessage](i, transport, listener)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			nodes[i].protocol.ConnectToServers(urls)
+		}(i)
+		t.Cleanup(func() {
+			_ = listener.Close()
+		})
+	}
+	wg.Wait()
+	for i := range nodes {
+		nodes[i].mux = server_server.CreateMux(nodes[i].protocol)
+		open(i, nodes[i])
+		go nodes[i].mux.Start()
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.protocol.Close()
+		}
+		cluster.Close()
+	})
+	return nodes
+}
+
+// fakeProtocol is an inter server protocol whose messages are given by the test
+type fakeProtocol[T any] struct {
+	messages chan T
+	peers    chan server_server.PeerEvent
+}
+
+func createFakeProtocol[T any]() fakeProtocol[T] {
+	return fakeProtocol[T]{messages: make(chan T), peers: make(chan server_server.PeerEvent)}
+}
+
+func (f fakeProtocol[T]) SendTo(int, T) error                       { return nil }
+func (f fakeProtocol[T]) SendToAll(T) error                         { return nil }
+func (f fakeProtocol[T]) GetMessageChan() chan T                    { return f.messages }
+func (f fakeProtocol[T]) GetPeerChan() chan server_server.PeerEvent { return f.peers }
+func (f fakeProtocol[T]) GetServerId() int                          { return 0 }
+func (f fakeProtocol[T]) GetNumberOfServers() int                   { return 2 }
+func (f fakeProtocol[T]) IsConnected(int) bool                      { return true }
+func (f fakeProtocol[T]) GetSentMessages() int64                    { return 0 }
+
+// swimNode is a server running SWIM whose instance can crash and restart, the messages of a crashed instance are lost
+//   - drop: the servers to which the messages of the node are lost
+type swimNode struct {
+	protocol server_server.Protocol[swim.Message]
+	current  *swimInstance
+	drop     map[int]bool
+	changes  []swim.Update
+	pingReqs int
+	mutex    sync.Mutex
+}
+
+// swimInstance is the protocol of an instance of SWIM, it sends nothing once the instance crashed
+type swimInstance struct {
+	server_server.Protocol[swim.Message]
+	node     *swimNode
+	messages chan swim.Message
+}
+
+func (i *swimInstance) GetMessageChan() chan swim.Message {
+	return i.messages
+}
+
+func (i *swimInstance) SendTo(serverId int, message swim.Message) error {
+	n := i.node
+	n.mutex.Lock()
+	lost := n.current != i || n.drop[serverId]
+	if !lost && message.Type == swim.PING_REQ {
+		n.pingReqs++
+	}
+	n.mutex.Unlock()
+	if lost {
+		return nil
+	}
+	return i.Protocol.SendTo(serverId, message)
+}
+
+// start starts a new instance of SWIM on the node, the previous one crashes
+func (n *swimNode) start(members []int) *swim.Swim {
+	instance := &swimInstance{Protocol: n.protocol, node: n, messages: make(chan swim.Message)}
+	n.mutex.Lock()
+	n.current = instance
+	n.mutex.Unlock()
+	detector := swim.CreateSwim(instance, func() []int { return members }, func(update swim.Update) {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		n.changes = append(n.changes, update)
+	})
+	go detector.Start()
+	return detector
+}
+
+// crash stops the instance of the node, the messages it receives are lost
+func (n *swimNode) crash() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.current = nil
+}
+
+// forward gives the messages received by the node to its running instance
+func (n *swimNode) forward() {
+	for message := range n.protocol.GetMessageChan() {
+		n.mutex.Lock()
+		current := n.current
+		n.mutex.Unlock()
+		if current != nil {
+			current.messages <- message
+		}
+	}
+}
+
+// states gets the states of a server notified to the node, in order
+func (n *swimNode) states(serverId int) []swim.State {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	var states []swim.State
+	for _, update := range n.changes {
+		if update.ServerId == serverId {
+			states = append(states, update.State)
+		}
+	}
+	return states
+}
+
+// startSwim starts SWIM on 3 servers of the in-memory network
+func startSwim(t *testing.T) ([]*swimNode, []*swim.Swim) {
+	const size = 3
+	nodes := make([]*swimNode, size)
+	detectors := make([]*swim.Swim, size)
+	startNodes(t, memory.CreateNetwork(1), size, func(id int, n node) {
+		nodes[id] = &swimNode{protocol: server_server.OpenChannel[swim.Message](n.mux, "swim"), drop: make(map[int]bool)}
+		go nodes[id].forward()
+	})
+	for id, n := range nodes {
+		var members []int
+		for i := 0; i < size; i++ {
+			if i != id {
+				members = append(members, i)
+			}
+		}
+		detectors[id] = n.start(members)
+	}
+	return nodes, detectors
+}
+
+// memberOf gets a server in the view of a detector
+func memberOf(detector *swim.Swim, serverId int) swim.Member {
+	for _, member := range detector.GetView() {
+		if member.Id == serverId {
+			return member
+		}
+	}
+	return swim.Member{}
+}
+
+func TestSwim(t *testing.T) {
+	t.Run("should ping a server through the others when the direct link is lost", func(t *testing.T) {
+		nodes, detectors := startSwim(t)
+		nodes[0].mutex.Lock()
+		nodes[0].drop[2] = true
+		nodes[0].mutex.Unlock()
+		nodes[2].mutex.Lock()
+		nodes[2].drop[0] = true
+		nodes[2].mutex.Unlock()
+
+		eventually(t, 3*swim.ProtocolPeriod, func() bool {
+			nodes[0].mutex.Lock()
+			defer nodes[0].mutex.Unlock()
+			return nodes[0].pingReqs > 0
+		}, "no indirect ping sent")
+		time.Sleep(swim.ProtocolPeriod + swim.ProbeTimeout) // The probe ends at the next period
+		expect(t, len(nodes[0].states(2)), 0)
+		expect(t, memberOf(detectors[0], 2).State, swim.Alive.String())
+	})
+
+	t.Run("should suspect a crashed server, declare it dead and accept it again once restarted", func(t *testing.T) {
+		nodes, detectors := startSwim(t)
+		nodes[2].crash()
+
+		eventually(t, 6*swim.ProtocolPeriod+swim.SuspectTimeout, func() bool { // The probes and the suspicions are checked at each period
+			return memberOf(detectors[0], 2).State == swim.Dead.String()
+		}, "crashed server not declared dead")
+		expect(t, fmt.Sprint(nodes[0].states(2)), fmt.Sprint([]swim.State{swim.Suspect, swim.Dead}))
+
+		// The restarted server starts again from the incarnation 0, it refutes the state the cluster sends it
+		restarted := nodes[2].start([]int{0, 1})
+		eventually(t, 3*swim.ProtocolPeriod, func() bool {
+			member := memberOf(detectors[0], 2)
+			return member.State == swim.Alive.String() && member.Incarnation > 0
+		}, "restarted server not alive again")
+		expect(t, fmt.Sprint(nodes[0].states(2)), fmt.Sprint([]swim.State{swim.Suspect, swim.Dead, swim.Alive}))
+		if incarnation := memberOf(restarted, 2).Incarnation; incarnation == 0 {
+			t.Errorf("suspicion not refuted by the restarted server")
+		}
+		eventually(t, 3*swim.ProtocolPeriod, func() bool {
+			return memberOf(detectors[1], 2).State == swim.Alive.String()
+		}, "restarted server not alive for every server")
+	})
+}
+
+func TestHeartbeat(t *testing.T) {
+	t.Run("should suspect a silent server and give the critical section without it", func(t *testing.T) {
+		cluster := memory.CreateNetwork(1)
+		transport := cluster.Transport("server-0")
+		listener, _ := transport.Listen("server-0:server")
+		protocol := server_server.CreateInterServerProtocol[lamport.Request[int]](0, transport, listener)
+		t.Cleanup(func() {
+			protocol.Close()
+			_ = listener.Close()
+			cluster.Close()
+		})
+
+		// Server 1 is played by the test, it connects and then stays silent as if it froze
+		go func() {
+			c, err := cluster.Transport("server-1").Dial("server-0:server")
+			if err != nil {
+				t.Errorf("dial: %s", err.Error())
+				return
+			}
+			conn := network.CreateConnection(c)
+			_ = conn.SendJSON(map[string]any{"serverId": 1, "started": false})
+			_, _ = network.GetJson[map[string]any](*conn)
+		}()
+		protocol.ConnectToServers([]string{"server-1:server"})
+
+		l := lamport.InitLamport[int](protocol)
+		go l.Start()
+		suspected := make(chan server_server.PeerEvent, 1)
+		go func() {
+			event := <-protocol.GetPeerChan()
+			l.HandlePeerEvent(event)
+			suspected <- event
+		}()
+
+		// The state of server 1 is unknown, the critical section waits for it until it is suspected
+		access := l.SendClientAskCriticalSection()
+		select {
+		case <-access:
+			t.Fatalf("critical section given without the state of server 1")
+		case <-time.After(server_server.HeartbeatTimeout / 2):
+		}
+		select {
+		case event := <-suspected:
+			expect(t, event, server_server.PeerEvent{ServerId: 1, Alive: false})
+		case <-time.After(server_server.HeartbeatTimeout + 2*server_server.HeartbeatInterval):
+			t.Fatalf("silent server not suspected")
+		}
+		expect(t, protocol.IsConnected(1), false)
+		select {
+		case <-access:
+		case <-time.After(time.Second):
+			t.Fatalf("critical section not given without the suspected server")
+		}
+	})
+}
+
+func TestReconnect(t *testing.T) {
+	t.Run("should dial a dropped connection again and deliver the messages", func(t *testing.T) {
+		channels := make([]server_server.Protocol[int], 2)
+		nodes := startNodes(t, memory.CreateNetwork(1), 2, func(id int, n node) {
+			channels[id] = server_server.OpenChannel[int](n.mux, "test")
+		})
+
+		// The link is cut by server 0, server 1 loses it and dials server 0 again
+		nodes[0].protocol.Disconnect(1, "link cut by the test")
+		for id, channel := range channels {
+			for _, alive := range []bool{false, true} {
+				select {
+				case event := <-channel.GetPeerChan():
+					expect(t, event, server_server.PeerEvent{ServerId: 1 - id, Alive: alive})
+				case <-time.After(2 * time.Second):
+					t.Fatalf("server %d not notified of the connection of server %d (alive %t)", id, 1-id, alive)
+				}
+			}
+		}
+
+		for id, channel := range channels {
+			expect(t, channel.IsConnected(1-id), true)
+			expect(t, channel.SendTo(1-id, id+42), nil)
+			select {
+			case value := <-channels[1-id].GetMessageChan():
+				expect(t, value, id+42)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("message of server %d not delivered after the reconnection", id)
+			}
+		}
+	})
+}
+
+func TestMux(t *testing.T) {
+	t.Run("should not block the channels on a channel not read", func(t *testing.T) {
+		protocol := createFakeProtocol[server_server.MuxMessage]()
+		mux := server_server.CreateMux(protocol)
+		blocked := server_server.OpenChannel[int](mux, "blocked") // Opened but never read
+		live := server_server.OpenChannel[int](mux, "live")
+		go mux.Start()
+
+		for i := 0; i < 3*server_server.MuxQueueSize; i++ {
+			protocol.messages <- server_server.MuxMessage{Channel: "unused", Sender: 1, Payload: []byte("1")}
+			protocol.messages <- server_server.MuxMessage{Channel: "blocked", Sender: 1, Payload: []byte("1")}
+		}
+		protocol.peers <- server_server.PeerEvent{ServerId: 1, Alive: false}
+		protocol.messages <- server_server.MuxMessage{Channel: "live", Sender: 1, Payload: []byte("42")}
+		select {
+		case event := <-live.GetPeerChan():
+			expect(t, event.ServerId, 1)
+		case <-time.After(time.Second):
+			t.Fatalf("peer event not delivered")
+		}
+		select {
+		case value := <-live.GetMessageChan():
+			expect(t, value, 42)
+		case <-time.After(time.Second):
+			t.Fatalf("message not delivered")
+		}
+		select {
+		case value := <-blocked.GetMessageChan(): // The messages of a slow channel are kept
+			expect(t, value, 1)
+		case <-time.After(time.Second):
+			t.Fatalf("message of the blocked channel lost")
+		}
+	})
+}
+
+func TestElection(t *testing.T) {
+	for _, algorithm := range []string{config.Bully, config.ChangRoberts} {
+		algorithm := algorithm
+		t.Run("should elect the greatest server and elect again after its crash with "+algorithm, func(t *testing.T) {
+			elections := make([]election.Election, 4)
+			nodes := startNodes(t, memory.CreateNetwork(1), 4, func(id int, n node) {
+				p := server_server.OpenChannel[election.Message](n.mux, "election")
+				if algorithm == config.Bully {
+					b := election.InitBully(p)
+					elections[id] = &b
+				} else {
+					cr := election.InitChangRoberts(p)
+					elections[id] = &cr
+				}
+			})
+			for _, e := range elections {
+				go e.Start()
+			}
+			leaders := func(alive int) func() bool {
+				return func() bool {
+					for _, e := range elections[:alive] {
+						if e.GetLeader() != alive-1 {
+							return false
+						}
+					}
+					return true
+				}
+			}
+			eventually(t, 5*time.Second, leaders(4), "server 3 not elected")
+
+			nodes[3].protocol.Close() // The coordinator crashes
+			eventually(t, 10*time.Second, leaders(3), "server 2 not elected after the crash of server 3")
+			nodes[2].protocol.Close()
+			eventually(t, 10*time.Second, leaders(2), "server 1 not elected after the crash of server 2")
+		})
+	}
+}
+
+func TestMemoryNetwork(t *testing.T) {
+	// send writes lines on connections to the same listener and gets the order of their delivery
+	send := func(seed int64) []memory.Delivery {
+		cluster := memory.CreateNetwork(seed)
+		defer cluster.Close()
+		listener, _ := cluster.Transport("server").Listen("server:server")
+		var conns []net.Conn
+		for i := 0; i < 3; i++ {
+			conn, _ := cluster.Transport(fmt.Sprintf("client-%d", i)).Dial("server:server")
+			accepted, _ := listener.Accept()
+			conns = append(conns, accepted)
+			for j := 0; j < 5; j++ {
+				_, _ = fmt.Fprintf(conn, "%d-%d\n", i, j)
+			}
+		}
+		for i, conn := range conns {
+			reader := network.CreateConnection(conn)
+			for j := 0; j < 5; j++ {
+				line, _ := reader.GetLine()
+				expect(t, line, fmt.Sprintf("%d-%d", i, j))
+			}
+		}
+		return cluster.Trace()
+	}
+
+	t.Run("should deliver the lines in the same order with the same seed", func(t *testing.T) {
+		first, second, other := send(1), send(1), send(2)
+		expect(t, len(first), 15)
+		expect(t, strings.Join(stringsOf(first), "\n"), strings.Join(stringsOf(second), "\n"))
+		if strings.Join(stringsOf(first), "\n") == strings.Join(stringsOf(other), "\n") {
+			t.Errorf("Expected another order with another seed")
+		}
+	})
+}
+
+func TestReplay(t *testing.T) {
+	// run creates an event and registers to it on a cluster of 3 servers, it gets the trace of the network once every
+	// server has been probed by SWIM
+	run := func(cluster *memory.Network) []memory.Delivery {
+		startCluster(t, cluster, 3)
+		first := connectMemory(t, cluster.Transport("client"), "server-0:client")
+		_, _ = first.SendRequest("create", func(auth client_server.AuthId) any {
+			return dto.EventCreate{
+				Name: "Test new event",
+				Jobs: []dto.Job{
+					{
+						Name:     "Test",
+						Capacity: 2,
+					},
+				},
+			}
+		})
+		last := connectMemory(t, cluster.Transport("client"), "server-2:client")
+		_, _ = last.SendRequest("register", func(auth client_server.AuthId) any {
+			return dto.EventRegister{
+				EventId: 1,
+				JobId:   1,
+			}
+		})
+		eventually(t, 3*swim.ProtocolPeriod, func() bool {
+			acks := 0
+			for _, delivery := range cluster.Trace() {
+				if strings.Contains(delivery.Line, `"channel":"swim"`) && strings.Contains(delivery.Line, `"type":1`) {
+					acks++
+				}
+			}
+			return acks >= 3
+		}, "servers not probed")
+		return cluster.Trace()
+	}
+
+	t.Run("should replay the interleaving of a previous run", func(t *testing.T) {
+		recorded := run(memory.CreateNetwork(1))
+		cluster := memory.ReplayNetwork(1, recorded)
+		replayed := run(cluster)
+		expect(t, cluster.Divergence(), -1)
+		if len(replayed) < len(recorded) {
+			t.Fatalf("Expected %d lines delivered, got %d", len(recorded), len(replayed))
+		}
+		expect(t, strings.Join(stringsOf(replayed[:len(recorded)]), "\n"), strings.Join(stringsOf(recorded), "\n"))
+	})
+}
+
+func stringsOf(trace []memory.Delivery) []string {
+	var lines []string
+	for _, delivery := range trace {
+		lines = append(lines, delivery.String())
+	}
+	return lines
+}
+
+func TestCluster(t *testing.T) {
+	// The mutual exclusion algorithms, then the other backends
+	variants := []string{config.Lamport, config.RicartAgrawala, config.SuzukiKasami, config.Raymond, config.Maekawa,
+		config.Centralized, config.RaftBackend, config.TotalOrderBackend}
+	for _, variant := range variants {
+		for _, size := range []int{3, 5, 7} {
+			variant, size := variant, size
+			t.Run(fmt.Sprintf("should replicate the events on %d servers with %s", size, variant), func(t *testing.T) {
+				cluster := memory.CreateNetwork(int64(size))
+				directory := t.TempDir()
+				startClusterWith(t, cluster, size, func(serverConfig *config.ServerConfiguration) {
+					if variant == config.RaftBackend || variant == config.TotalOrderBackend {
+						serverConfig.Backend = variant
+						serverConfig.RaftDirectory = directory
+					} else {
+						serverConfig.MutualExclusion = variant
+					}
+				})
+				transport := cluster.Transport("client")
+
+				first := connectMemory(t, transport, "server-0:client")
+				_, _ = first.SendRequest("create", func(auth client_server.AuthId) any {
+					return dto.EventCreate{
+						Name: "Test new event",
+						Jobs: []dto.Job{
+							{
+								Name:     "Test",
+								Capacity: 2,
+							},
+						},
+					}
+				})
+				last := connectMemory(t, transport, fmt.Sprintf("server-%d:client", size-1))
+				json, _ := last.SendRequest("register", func(auth client_server.AuthId) any {
+					return dto.EventRegister{
+						EventId: 1,
+						JobId:   1,
+					}
+				})
+				_, responseError := network.ParseResponse[*dto.Event](json)
+				expect(t, responseError, nil)
+
+				for i := 0; i < size; i++ {
+					cli := connectMemory(t, transport, fmt.Sprintf("server-%d:client", i))
+					json, _ := cli.SendRequest("show", func(auth client_server.AuthId) any {
+						return dto.EventShow{
+							EventId:      1,
+							Linearizable: true,
+						}
+					})
+					event, responseError := network.ParseResponse[*dto.Event](json)
+					expect(t, responseError, nil)
+					if event != nil {
+						expect(t, event.Jobs[0].Count, 1)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestChaosProxy(t *testing.T) {
+	cluster := memory.CreateNetwork(1)
+	defer cluster.Close()
+	servers := []config.ServerUrl{
+		{Server: "server-0:server", Proxy: "proxy:0"},
+		{Server: "server-1:server"},
+	}
+	listener, _ := cluster.Transport("server-0").Listen("server-0:server")
+	proxy := chaos.CreateProxy(servers, chaos.Scenario{
+		Seed: 1,
+		Steps: []chaos.Step{
+			{Name: "partition", At: chaos.Duration(300 * time.Millisecond), Partition: [][]int{{0}, {1}}},
+			{Name: "heal", At: chaos.Duration(800 * time.Millisecond)},
+		},
+	}, cluster.Transport("proxy"))
+	expect(t, proxy.Start(), nil)
+	defer proxy.Stop()
+	start := time.Now()
+
+	// dial connects server 1 to server 0 through the proxy
+	dial := func() (*network.Connection, *network.Connection) {
+		conn, err := cluster.Transport("server-1").Dial("proxy:0")
+		expect(t, err, nil)
+		dialed := network.CreateConnection(conn)
+		_ = dialed.SendJSON(map[string]int{"serverId": 1})
+		accepted, _ := listener.Accept()
+		return dialed, network.CreateConnection(accepted)
+	}
+
+	t.Run("should forward the lines before the partition", func(t *testing.T) {
+		dialed, accepted := dial()
+		line, _ := accepted.GetLine()
+		expect(t, line, `{"serverId":1}`)
+		_, _ = fmt.Fprintln(dialed, "before")
+		line, _ = accepted.GetLine()
+		expect(t, line, "before")
+
+		time.Sleep(time.Until(start.Add(500 * time.Millisecond)))
+		_, _ = fmt.Fprintln(dialed, "during")
+		_, err := accepted.GetLine()
+		if err == nil {
+			t.Errorf("Expected the line sent during the partition to be dropped and the connection closed on heal")
+		}
+		if time.Since(start) < 800*time.Millisecond {
+			t.Errorf("Expected the connection to be closed when the partition ends")
+		}
+	})
+
+	t.Run("should forward the lines after the partition", func(t *testing.T) {
+		dialed, accepted := dial()
+		_, _ = accepted.GetLine()
+		_, _ = fmt.Fprintln(dialed, "after")
+		line, _ := accepted.GetLine()
+		expect(t, line, "after")
+	})
+}
+
+func TestLinearizability(t *testing.T) {
+	created := dto.Event{
+		Id:        1,
+		Name:      "Test",
+		Open:      true,
+		Organizer: types.User{Id: 1},
+		Jobs:      []types.Job{{Id: 1, Name: "Test", Capacity: 1}},
+	}
+	registered := func(userId int) dto.Event {
+		event := created
+		event.Jobs = []types.Job{{Id: 1, Name: "Test", Capacity: 1, Count: 1}}
+		event.Participants = []dto.Participant{{User: types.User{Id: userId}, JobId: 1}}
+		return event
+	}
+	create := linearizability.Operation{Client: 0, Type: dto.CreateCommand, UserId: 1, EventId: -1,
+		Create: &dto.EventCreate{Name: "Test", Jobs: []dto.Job{{Name: "Test", Capacity: 1}}},
+		Invoke: 0, Return: 10, Success: true, Events: []dto.Event{created}}
+	register := func(client int, userId int, invoke time.Duration, event dto.Event) linearizability.Operation {
+		return linearizability.Operation{Client: client, Type: dto.RegisterCommand, UserId: userId, EventId: 1, JobId: 1,
+			Invoke: invoke, Return: invoke + 10, Success: true, Events: []dto.Event{event}}
+	}
+	show := func(client int, invoke time.Duration, event dto.Event) linearizability.Operation {
+		return linearizability.Operation{Client: client, Type: dto.ShowCommand, EventId: 1, Invoke: invoke,
+			Return: invoke + 10, Success: true, Events: []dto.Event{event}}
+	}
+
+	t.Run("should accept concurrent requests taking effect in some order", func(t *testing.T) {
+		full := register(2, 2, 20, registered(1))
+		full.Success, full.Error, full.Events = false, "job 1 is full", nil
+		result := linearizability.Check(nil, []linearizability.Operation{
+			create,
+			register(1, 1, 15, registered(1)),
+			full,
+			show(3, 18, created),
+			show(3, 40, registered(1)),
+		})
+		expect(t, result.Linearizable, true)
+	})
+
+	t.Run("should find a minimal counterexample when a job exceeds its capacity", func(t *testing.T) {
+		first, second := register(1, 1, 20, registered(1)), register(2, 2, 40, registered(2))
+		result := linearizability.Check(nil, []linearizability.Operation{
+			create,
+			show(3, 15, created),
+			first,
+			second,
+			show(3, 60, registered(2)),
+		})
+		expect(t, result.Linearizable, false)
+		expect(t, len(result.Counterexample), 2)
+		if len(result.Counterexample) == 2 {
+			expect(t, result.Counterexample[0].Client, first.Client)
+			expect(t, result.Counterexample[1].Client, second.Client)
+		}
+	})
+
+	t.Run("should find a stale read", func(t *testing.T) {
+		stale := show(1, 20, created)
+		stale.Success, stale.Error, stale.Events = false, "event not found", nil
+		result := linearizability.Check(nil, []linearizability.Operation{create, stale})
+		expect(t, result.Linearizable, false)
+		expect(t, len(result.Counterexample), 2)
+	})
+
+	t.Run("should accept a request without response taking effect or not", func(t *testing.T) {
+		lost := register(1, 1, 20, dto.Event{})
+		lost.Pending, lost.Success, lost.Events = true, false, nil
+		result := linearizability.Check(nil, []linearizability.Operation{
+			create,
+			lost,
+			show(2, 40, registered(1)),
+		})
+		expect(t, result.Linearizable, true)
+		result = linearizability.Check(nil, []linearizability.Operation{create, lost, show(2, 40, created)})
+		expect(t, result.Linearizable, true)
+	})
+
+	t.Run("should record a linearizable history on a cluster", func(t *testing.T) {
+		cluster := memory.CreateNetwork(1)
+		startCluster(t, cluster, 3)
+		recorder := linearizability.CreateRecorder()
+		first := connectMemory(t, cluster.Transport("client"), "server-0:client")
+		recorder.Create(0, first, dto.EventCreate{Name: "Test", Jobs: []dto.Job{{Name: "Test", Capacity: 2}}})
+
+		done := make(chan bool)
+		for i := 0; i < 3; i++ {
+			go func(clientId int) {
+				defer func() { done <- true }()
+				cli := connectMemory(t, cluster.Transport("client"), fmt.Sprintf("server-%d:client", clientId))
+				for n := 0; n < 3; n++ {
+					recorder.Register(clientId+1, cli, 1, 1)
+					recorder.Show(clientId+1, cli, 1, true)
+				}
+			}(i)
+		}
+		for i := 0; i < 3; i++ {
+			<-done
+		}
+		result := linearizability.Check(nil, recorder.Operations())
+		expect(t, result.Linearizable, true)
+		expect(t, result.Operations, 19)
+	})
+}
+
+func TestBench(t *testing.T) {
+	t.Run("should measure the requests and the messages of a cluster", func(t *testing.T) {
+		cluster := memory.CreateNetwork(1)
+		startCluster(t, cluster, 3)
+		transport := cluster.Transport("client")
+		var servers []string
+		for i := 0; i < 3; i++ {
+			servers = append(servers, fmt.Sprintf("server-%d:client", i))
+			_ = connectMemory(t, transport, servers[i]).Close()
+		}
+
+		b := bench.CreateBench(bench.Config{Volunteers: 3, Organizers: 1, Duration: 500 * time.Millisecond, Seed: 1},
+			servers, validServerConfig.Users, transport.Dial)
+		report, err := b.Run()
+		expect(t, err, nil)
+		expect(t, report.Lost, 0)
+		if report.Writes() == 0 || report.Requests() <= report.Writes() {
+			t.Errorf("expected writes and reads, got %d requests and %d writes", report.Requests(), report.Writes())
+		}
+		if report.Messages["mutual-exclusion"] == 0 {
+			t.Errorf("expected messages of the mutual exclusion, got %v", report.Messages)
+		}
+		for _, endpoint := range report.Endpoints {
+			if endpoint.Percentile(0.5) > endpoint.Percentile(0.99) {
+				t.Errorf("p50 of %s greater than its p99", endpoint.Name)
+			}
+		}
+	})
+}
+
+// TestLauncherServer is a server started by the launcher in TestLauncher: the test binary runs it as a child process
+func TestLauncherServer(t *testing.T) {
+	id := os.Getenv("LAUNCHER_SERVER")
+	if id == "" {
+		return
+	}
+	fmt.Println("server", id, "ready")
+	var input string
+	for input != "quit" {
+		if _, err := fmt.Scanln(&input); err != nil {
+			os.Exit(1)
+		}
+	}
+	fmt.Println("server", id, "quit")
+	os.Exit(0)
+}
+
+// lockedBuffer is the output of the launcher, read by the test while the servers write to it
+type lockedBuffer struct {
+	buffer strings.Builder
+	mutex  sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+// waitFor waits until the output has a line
+func (b *lockedBuffer) waitFor(t *testing.T, line string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mutex.Lock()
+		found := strings.Contains(b.buffer.String(), line)
+		b.mutex.Unlock()
+		if found {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("line %q not written", line)
+}
+
+func TestLauncher(t *testing.T) {
+	t.Run("should start, kill, restart and stop the servers", func(t *testing.T) {
+		output := &lockedBuffer{}
+		c := cluster.CreateCluster([]int{0, 1}, func(id int) *exec.Cmd {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestLauncherServer$")
+			cmd.Env = append(os.Environ(), fmt.Sprintf("LAUNCHER_SERVER=%d", id))
+			return cmd
+		}, output)
+		t.Cleanup(c.StopAll)
+
+		expect(t, c.StartAll(), nil)
+		output.waitFor(t, "[server 0]\033[0m server 0 ready")
+		output.waitFor(t, "[server 1]\033[0m server 1 ready")
+		expectError(t, c.Start(0), "server 0 is already running")
+		expectError(t, c.Kill(2), "unknown server 2")
+
+		expect(t, c.Kill(1), nil)
+		output.waitFor(t, "[server 1]\033[0m exited: signal: killed")
+		expect(t, c.IsRunning(1), false)
+		expectError(t, c.Stop(1), "server 1 is not running")
+
+		expect(t, c.Restart(1), nil)
+		output.waitFor(t, "[server 1]\033[0m server 1 ready")
+		c.StopAll()
+		output.waitFor(t, "[server 0]\033[0m server 0 quit")
+		output.waitFor(t, "[server 1]\033[0m server 1 quit")
+		expect(t, len(c.Running()), 0)
+	})
+}